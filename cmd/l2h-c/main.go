@@ -23,6 +23,9 @@ func main() {
 		add           = flag.String("a", "", "添加新的路径绑定，格式: path:password")
 		delete        = flag.Int("d", -1, "删除某个路径绑定（使用编号）")
 		server        = flag.String("s", "", "设置服务器A的地址和API key，格式: server.com:apikey")
+		repin         = flag.Bool("repin", false, "重新记录服务器A的身份指纹（服务器A更换身份密钥后使用）")
+		fingerprint   = flag.String("fingerprint", "", "与 -s 或 -repin 一起使用，要求服务器A的身份指纹与之一致")
+		insecureNoPin = flag.Bool("insecure-no-pin", false, "不验证服务器A的身份，用于连接没有身份密钥的旧版本服务器A（不安全）")
 		port          = flag.Int("port", 55055, "管理页面端口")
 		dataDir       = flag.String("data-dir", "./data", "数据目录")
 		daemon        = flag.Bool("daemon", false, "后台运行模式（仅Linux）")
@@ -135,6 +138,10 @@ func main() {
 				fmt.Printf("%d\t%s\t\t%d\t\t%s\n", i+1, binding.Path, binding.Port, passwordProtected)
 			}
 		}
+		if fp, err := manager.NodeKeyFingerprint(); err == nil {
+			fmt.Printf("\n节点公钥指纹: %s\n", fp)
+			fmt.Println("访客可以在链接后加上 #l2h-key=<指纹> 确保连接的是本节点")
+		}
 		os.Exit(0)
 	}
 
@@ -193,20 +200,55 @@ func main() {
 	}
 
 	if *server != "" {
-		parts := strings.SplitN(*server, ":", 2)
-		if len(parts) != 2 {
+		// API Key 中不含冒号，以最后一个冒号分隔，地址部分可以包含协议和端口
+		idx := strings.LastIndex(*server, ":")
+		if idx <= 0 || idx == len(*server)-1 {
 			appLogger.Fatal("格式错误，应为 server.com:apikey")
 		}
-		if err := manager.SetServerInfo(parts[0], parts[1]); err != nil {
+		serverURL, apiKey := (*server)[:idx], (*server)[idx+1:]
+		if err := manager.SetServerInfo(serverURL, apiKey); err != nil {
 			appLogger.Fatal("设置服务器信息失败: %v", err)
 		}
-		fmt.Printf("成功设置服务器信息: %s\n", parts[0])
+		fmt.Printf("成功设置服务器信息: %s\n", serverURL)
+
+		old, fp, err := manager.PinServer(*fingerprint)
+		switch {
+		case err != nil && *fingerprint != "":
+			appLogger.Fatal("记录服务器A的身份指纹失败: %v", err)
+		case err != nil:
+			fmt.Printf("警告: %v，将在首次连接时记录服务器A的身份指纹\n", err)
+		case old != "" && old != fp:
+			fmt.Printf("服务器A的身份指纹已从 %s 更新为: %s\n", old, fp)
+		default:
+			fmt.Printf("已记录服务器A的身份指纹: %s\n", fp)
+		}
+		if err == nil && *fingerprint == "" {
+			fmt.Println("请核对与服务器A显示的指纹（l2h-s --fingerprint）一致")
+		}
+		os.Exit(0)
+	}
+
+	if *repin {
+		old, fp, err := manager.PinServer(*fingerprint)
+		if err != nil {
+			appLogger.Fatal("重新记录服务器A的身份指纹失败: %v", err)
+		}
+		if old != "" && old != fp {
+			fmt.Printf("原来记录的指纹: %s\n", old)
+		}
+		fmt.Printf("已记录服务器A的身份指纹: %s\n", fp)
+		if *fingerprint == "" {
+			fmt.Println("请核对与服务器A显示的指纹（l2h-s --fingerprint）一致")
+		}
 		os.Exit(0)
 	}
 
 	// 如果没有指定任何命令，启动服务
 	appLogger.Info("启动服务器B，端口: %d, 数据库: %s", *port, dbPath)
 	srv := serverb.NewServer(*port, dbPath)
+	if *insecureNoPin {
+		srv.SkipIdentity()
+	}
 	if err := srv.Start(); err != nil {
 		appLogger.Fatal("启动服务器失败: %v", err)
 	}
@@ -221,10 +263,16 @@ func printHelp() {
 	fmt.Println("选项:")
 	fmt.Println("  --help              显示此帮助信息")
 	fmt.Println("  --show-admin-info    显示管理页面账号密码信息")
-	fmt.Println("  -l                  显示当前绑定的路径和端口信息")
+	fmt.Println("  -l                  显示当前绑定的路径和端口信息，以及节点公钥指纹")
 	fmt.Println("  -a path:password    添加新的路径绑定，password可以为空")
 	fmt.Println("  -d <编号>           删除某个路径绑定")
 	fmt.Println("  -s server.com:apikey 设置服务器A的地址和API key")
+	fmt.Println("                      地址可带协议和端口，如 https://server.com:55080:apikey")
+	fmt.Println("                      同时记录服务器A的身份指纹，之后只连接身份一致的服务器")
+	fmt.Println("  -repin              重新记录服务器A的身份指纹（服务器A更换身份密钥后使用）")
+	fmt.Println("  -fingerprint <指纹> 与 -s 或 -repin 一起使用，要求服务器A的身份指纹与之一致")
+	fmt.Println("  -insecure-no-pin    不验证服务器A的身份，用于连接没有身份密钥的旧版本服务器A")
+	fmt.Println("                      伪造的服务器可以借此获得 API Key，请尽快升级服务器A")
 	fmt.Println("  --port              管理页面端口 (默认: 55055)")
 	fmt.Println("  --data-dir          数据目录 (默认: ./data)")
 	fmt.Println("  --daemon            后台运行模式（仅Linux）")
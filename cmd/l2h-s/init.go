@@ -122,6 +122,7 @@ func runInitWizard(dataDir, configPath string, defaultPort int) (*config.Config,
 			DBPath:   filepath.Join(dataDir, "l2h-s.db"),
 			LogFile:  "l2h-s.log",
 			LogLevel: "INFO",
+			STUNPort: config.DefaultSTUNPort,
 		},
 		Logging: config.LoggingConfig{
 			Level:  "INFO",
@@ -189,9 +190,15 @@ func printHelp() {
 	fmt.Println("  --daemon        后台运行模式（仅Linux）")
 	fmt.Println("  --foreground    强制前台运行")
 	fmt.Println("  --pid-file      PID文件路径（后台运行时使用）")
+	fmt.Println("  --reset-2fa <用户名>  关闭管理员的两步验证（验证设备丢失时使用）")
+	fmt.Println("  --fingerprint   显示服务器身份指纹，与服务器B记录的指纹核对")
 	fmt.Println()
 	fmt.Println("首次运行:")
 	fmt.Println("  首次运行时会启动初始化向导，引导您完成基本配置。")
 	fmt.Println("  配置将保存在数据目录中的 config.json 文件里。")
 	fmt.Println()
+	fmt.Println("HTTPS:")
+	fmt.Println("  在 config.json 的 server_a.tls 中配置证书文件（cert_file、key_file）")
+	fmt.Println("  或 ACME 自动申请证书（acme.domains），http_port 把 HTTP 请求重定向到 HTTPS。")
+	fmt.Println()
 }
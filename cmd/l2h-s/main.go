@@ -1,12 +1,15 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
 
+	"l2h/internal/certs"
 	"l2h/internal/config"
+	"l2h/internal/link"
 	"l2h/internal/logger"
 	"l2h/internal/servera"
 	"l2h/internal/utils"
@@ -21,6 +24,8 @@ func main() {
 		daemon     = flag.Bool("daemon", false, "后台运行模式（仅Linux）")
 		foreground = flag.Bool("foreground", false, "强制前台运行")
 		pidFile    = flag.String("pid-file", "", "PID文件路径（后台运行时使用）")
+		reset2FA   = flag.String("reset-2fa", "", "关闭指定管理员的两步验证（验证设备丢失时使用）")
+		showID     = flag.Bool("fingerprint", false, "显示服务器身份指纹（服务器B用它确认服务器A的身份）")
 	)
 
 	flag.Parse()
@@ -121,6 +126,37 @@ func main() {
 		cfg.ServerA.DBPath = dbPath
 	}
 
+	if *reset2FA != "" {
+		db, err := servera.NewDatabase(cfg.ServerA.DBPath)
+		if err != nil {
+			appLogger.Fatal("打开数据库失败: %v", err)
+		}
+		if err := db.ResetTOTP(*reset2FA); err != nil {
+			appLogger.Fatal("关闭两步验证失败: %v", err)
+		}
+		db.Close()
+		fmt.Printf("已关闭管理员 %s 的两步验证，请登录后重新启用\n", *reset2FA)
+		os.Exit(0)
+	}
+
+	if *showID {
+		db, err := servera.NewDatabase(cfg.ServerA.DBPath)
+		if err != nil {
+			appLogger.Fatal("打开数据库失败: %v", err)
+		}
+		key, err := db.IdentityKey()
+		if err != nil {
+			appLogger.Fatal("读取身份密钥失败: %v", err)
+		}
+		db.Close()
+		fmt.Println(link.Fingerprint(key.Public().(ed25519.PublicKey)))
+		os.Exit(0)
+	}
+
+	if err := utils.SetTrustedProxies(cfg.ServerA.TrustedProxies); err != nil {
+		appLogger.Fatal("可信代理配置错误: %v", err)
+	}
+
 	appLogger.Info("启动服务器A，端口: %d, 数据库: %s", serverPort, cfg.ServerA.DBPath)
 
 	if isFirstRun {
@@ -128,6 +164,15 @@ func main() {
 	}
 
 	server := servera.NewServer(serverPort, cfg.ServerA.DBPath, configPath)
+	server.SetSTUNPort(cfg.ServerA.GetSTUNPort())
+	if cfg.ServerA.TLS != nil {
+		m, err := certs.New(cfg.ServerA.TLS, *dataDir)
+		if err != nil {
+			appLogger.Fatal("HTTPS 配置错误: %v", err)
+		}
+		server.SetTLS(m, cfg.ServerA.TLS.HTTPPort)
+	}
+	appLogger.Info("服务器身份指纹: %s，服务器B设置地址时请核对", server.Fingerprint())
 	if err := server.Start(); err != nil {
 		appLogger.Fatal("启动服务器失败: %v", err)
 	}
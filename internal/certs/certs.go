@@ -0,0 +1,163 @@
+// Package certs 为服务器A的 HTTPS 监听提供证书
+//
+// 证书可以来自用户提供的证书和私钥文件，文件更新后自动重新加载，无需重启；
+// 也可以通过 ACME 协议（如 Let's Encrypt）自动申请和续期，支持 http-01 和 tls-alpn-01 验证。
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"l2h/internal/config"
+)
+
+// reloadInterval 检查证书文件是否更新的最短间隔
+var reloadInterval = 10 * time.Second
+
+// Manager 提供 HTTPS 证书
+type Manager struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	certMod   time.Time
+	keyMod    time.Time
+	checkedAt time.Time
+
+	// acme 不为 nil 时通过 ACME 获取证书
+	acme *autocert.Manager
+}
+
+// New 按配置创建证书管理器，相对路径相对于 dataDir
+func New(cfg *config.TLSConfig, dataDir string) (*Manager, error) {
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dataDir, p)
+	}
+
+	if cfg.ACME != nil {
+		if cfg.CertFile != "" || cfg.KeyFile != "" {
+			return nil, errors.New("证书文件和 ACME 只能配置一种")
+		}
+		return newACME(cfg.ACME, resolve)
+	}
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("需要同时配置 cert_file 和 key_file，或者配置 acme")
+	}
+
+	m := &Manager{certFile: resolve(cfg.CertFile), keyFile: resolve(cfg.KeyFile)}
+	if _, err := m.reload(); err != nil {
+		return nil, err
+	}
+	m.checkedAt = time.Now()
+	return m, nil
+}
+
+func newACME(cfg *config.ACMEConfig, resolve func(string) string) (*Manager, error) {
+	if len(cfg.Domains) == 0 {
+		return nil, errors.New("ACME 需要配置 domains")
+	}
+	client := &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	if cfg.CAFile != "" {
+		data, err := os.ReadFile(resolve(cfg.CAFile))
+		if err != nil {
+			return nil, fmt.Errorf("读取 ACME 根证书失败: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s 中没有有效的证书", cfg.CAFile)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	cacheDir := cfg.CacheDir
+	if cacheDir == "" {
+		cacheDir = "certs"
+	}
+	return &Manager{acme: &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(resolve(cacheDir)),
+		HostPolicy: autocert.HostWhitelist(cfg.Domains...),
+		Email:      cfg.Email,
+		Client:     client,
+	}}, nil
+}
+
+// TLSConfig 返回 HTTPS 监听使用的 TLS 配置
+func (m *Manager) TLSConfig() *tls.Config {
+	if m.acme != nil {
+		return m.acme.TLSConfig()
+	}
+	return &tls.Config{
+		GetCertificate: m.getCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
+
+// HTTPHandler 返回 HTTP 端口的处理器：使用 ACME 时先应答 http-01 验证，其余请求交给 fallback
+func (m *Manager) HTTPHandler(fallback http.Handler) http.Handler {
+	if m.acme != nil {
+		return m.acme.HTTPHandler(fallback)
+	}
+	return fallback
+}
+
+func (m *Manager) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if time.Since(m.checkedAt) >= reloadInterval {
+		m.checkedAt = time.Now()
+		changed, err := m.reload()
+		if err != nil {
+			// 证书和私钥可能还没有全部写完，继续使用原证书，下次检查时重试
+			log.Printf("重新加载证书失败，继续使用原证书: %v", err)
+		} else if changed {
+			log.Printf("证书文件已更新，已重新加载 %s", m.certFile)
+		}
+	}
+	return m.cert, nil
+}
+
+// reload 在证书或私钥文件的修改时间变化时重新加载，返回证书是否发生了变化
+func (m *Manager) reload() (bool, error) {
+	certInfo, err := os.Stat(m.certFile)
+	if err != nil {
+		return false, fmt.Errorf("读取证书失败: %w", err)
+	}
+	keyInfo, err := os.Stat(m.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("读取私钥失败: %w", err)
+	}
+	if m.cert != nil && certInfo.ModTime().Equal(m.certMod) && keyInfo.ModTime().Equal(m.keyMod) {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(m.certFile, m.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("加载证书失败: %w", err)
+	}
+	m.cert = &cert
+	m.certMod = certInfo.ModTime()
+	m.keyMod = keyInfo.ModTime()
+	return true, nil
+}
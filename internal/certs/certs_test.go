@@ -0,0 +1,398 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"l2h/internal/config"
+)
+
+// writeCert 在 dir 中写入 CommonName 为 localhost、序列号为 serial 的自签名证书，
+// writeKey 为 false 时只更新证书，模拟证书和私钥没有同时写完
+func writeCert(t *testing.T, dir string, serial int64, writeKey bool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 修改时间逐次增加，避免文件系统时间精度不足导致检测不到更新
+	mod := time.Now().Add(time.Duration(serial) * time.Second)
+	certFile := filepath.Join(dir, "cert.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(certFile, mod, mod)
+	if !writeKey {
+		return
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(keyFile, mod, mod)
+}
+
+// servedSerial 返回 m 当前提供的证书的序列号
+func servedSerial(t *testing.T, m *Manager) int64 {
+	t.Helper()
+	cert, err := m.TLSConfig().GetCertificate(&tls.ClientHelloInfo{ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.SerialNumber.Int64()
+}
+
+func TestFileReload(t *testing.T) {
+	old := reloadInterval
+	reloadInterval = 0
+	t.Cleanup(func() { reloadInterval = old })
+
+	dir := t.TempDir()
+	writeCert(t, dir, 1, true)
+	m, err := New(&config.TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem"}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := servedSerial(t, m); got != 1 {
+		t.Fatalf("证书序列号 = %d，期望 1", got)
+	}
+
+	writeCert(t, dir, 2, true)
+	if got := servedSerial(t, m); got != 2 {
+		t.Errorf("更新文件后证书序列号 = %d，期望 2", got)
+	}
+
+	// 证书与私钥不匹配时继续使用原证书
+	writeCert(t, dir, 3, false)
+	if got := servedSerial(t, m); got != 2 {
+		t.Errorf("私钥未更新时证书序列号 = %d，期望继续使用 2", got)
+	}
+	writeCert(t, dir, 4, true)
+	if got := servedSerial(t, m); got != 4 {
+		t.Errorf("私钥更新后证书序列号 = %d，期望 4", got)
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	dir := t.TempDir()
+	writeCert(t, dir, 1, true)
+	tests := []struct {
+		name string
+		cfg  config.TLSConfig
+	}{
+		{"缺少私钥", config.TLSConfig{CertFile: "cert.pem"}},
+		{"证书文件不存在", config.TLSConfig{CertFile: "missing.pem", KeyFile: "key.pem"}},
+		{"证书与私钥颠倒", config.TLSConfig{CertFile: "key.pem", KeyFile: "cert.pem"}},
+		{"同时配置两种方式", config.TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem", ACME: &config.ACMEConfig{Domains: []string{"example.test"}}}},
+		{"ACME 缺少域名", config.TLSConfig{ACME: &config.ACMEConfig{}}},
+		{"ACME 根证书无效", config.TLSConfig{ACME: &config.ACMEConfig{Domains: []string{"example.test"}, CAFile: "key.pem"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(&tt.cfg, dir); err == nil {
+				t.Error("New() 没有返回错误")
+			}
+		})
+	}
+}
+
+// acmeCA 模拟 ACME 服务（类似 Pebble），只支持 http-01 验证。
+// 验证时向 resolve 中记录的地址请求 key authorization，通过后用自己的根证书签发证书
+type acmeCA struct {
+	srv     *httptest.Server
+	root    *x509.Certificate
+	rootKey *ecdsa.PrivateKey
+
+	mu        sync.Mutex
+	resolve   map[string]string
+	thumb     string
+	domains   map[string]string // 订单 ID -> 域名
+	validated map[string]bool
+	certs     map[string][]byte
+	nextID    int
+}
+
+func newACMECA(t *testing.T) *acmeCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "l2h test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _ := x509.ParseCertificate(der)
+
+	ca := &acmeCA{
+		root:      root,
+		rootKey:   key,
+		resolve:   make(map[string]string),
+		domains:   make(map[string]string),
+		validated: make(map[string]bool),
+		certs:     make(map[string][]byte),
+	}
+	ca.srv = httptest.NewTLSServer(http.HandlerFunc(ca.serve))
+	t.Cleanup(ca.srv.Close)
+	return ca
+}
+
+// caFile 把 ACME 服务自身的 HTTPS 证书写入文件，供 ACMEConfig.CAFile 使用
+func (ca *acmeCA) caFile(t *testing.T, dir string) string {
+	t.Helper()
+	name := filepath.Join(dir, "acme-ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.srv.Certificate().Raw})
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func (ca *acmeCA) serve(w http.ResponseWriter, r *http.Request) {
+	base := ca.srv.URL
+	w.Header().Set("Replay-Nonce", base64.RawURLEncoding.EncodeToString(big.NewInt(time.Now().UnixNano()).Bytes()))
+	if r.URL.Path == "/dir" {
+		writeACME(w, http.StatusOK, map[string]string{
+			"newNonce":   base + "/nonce",
+			"newAccount": base + "/account",
+			"newOrder":   base + "/order",
+			"revokeCert": base + "/revoke",
+			"keyChange":  base + "/key-change",
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		return
+	}
+
+	var jws struct{ Protected, Payload string }
+	json.NewDecoder(r.Body).Decode(&jws)
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	kind, id, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch kind {
+	case "account":
+		protected, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+		var header struct {
+			JWK struct{ X, Y string } `json:"jwk"`
+		}
+		json.Unmarshal(protected, &header)
+		x, _ := base64.RawURLEncoding.DecodeString(header.JWK.X)
+		y, _ := base64.RawURLEncoding.DecodeString(header.JWK.Y)
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		ca.thumb, _ = acme.JWKThumbprint(pub)
+		w.Header().Set("Location", base+"/account/1")
+		writeACME(w, http.StatusCreated, map[string]string{"status": "valid"})
+	case "order":
+		if id == "" {
+			var req struct {
+				Identifiers []struct{ Value string } `json:"identifiers"`
+			}
+			json.Unmarshal(payload, &req)
+			ca.nextID++
+			id = fmt.Sprint(ca.nextID)
+			ca.domains[id] = req.Identifiers[0].Value
+			w.Header().Set("Location", base+"/order/"+id)
+			writeACME(w, http.StatusCreated, ca.order(id))
+			return
+		}
+		writeACME(w, http.StatusOK, ca.order(id))
+	case "authz":
+		writeACME(w, http.StatusOK, ca.authz(id))
+	case "challenge":
+		if !ca.validated[id] {
+			ca.validated[id] = ca.validate(id)
+		}
+		writeACME(w, http.StatusOK, ca.challenge(id))
+	case "finalize":
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		if err := ca.issue(id, der); err != nil {
+			writeACME(w, http.StatusBadRequest, map[string]string{"type": "urn:ietf:params:acme:error:badCSR", "detail": err.Error()})
+			return
+		}
+		writeACME(w, http.StatusOK, ca.order(id))
+	case "cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(ca.certs[id])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeACME(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (ca *acmeCA) token(id string) string {
+	return "token-" + id
+}
+
+func (ca *acmeCA) challenge(id string) map[string]string {
+	status := "pending"
+	if ca.validated[id] {
+		status = "valid"
+	}
+	return map[string]string{"type": "http-01", "url": ca.srv.URL + "/challenge/" + id, "token": ca.token(id), "status": status}
+}
+
+func (ca *acmeCA) authz(id string) map[string]interface{} {
+	return map[string]interface{}{
+		"status":     ca.challenge(id)["status"],
+		"identifier": map[string]string{"type": "dns", "value": ca.domains[id]},
+		"challenges": []interface{}{ca.challenge(id)},
+	}
+}
+
+func (ca *acmeCA) order(id string) map[string]interface{} {
+	o := map[string]interface{}{
+		"status":         "pending",
+		"identifiers":    []interface{}{map[string]string{"type": "dns", "value": ca.domains[id]}},
+		"authorizations": []string{ca.srv.URL + "/authz/" + id},
+		"finalize":       ca.srv.URL + "/finalize/" + id,
+	}
+	switch {
+	case ca.certs[id] != nil:
+		o["status"] = "valid"
+		o["certificate"] = ca.srv.URL + "/cert/" + id
+	case ca.validated[id]:
+		o["status"] = "ready"
+	}
+	return o
+}
+
+// validate 向域名对应的 HTTP 地址请求 http-01 的 key authorization
+func (ca *acmeCA) validate(id string) bool {
+	domain := ca.domains[id]
+	req, _ := http.NewRequest(http.MethodGet, "http://"+ca.resolve[domain]+"/.well-known/acme-challenge/"+ca.token(id), nil)
+	req.Host = domain
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode == http.StatusOK && string(body) == ca.token(id)+"."+ca.thumb
+}
+
+func (ca *acmeCA) issue(id string, der []byte) error {
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return err
+	}
+	if !ca.validated[id] || len(csr.DNSNames) != 1 || csr.DNSNames[0] != ca.domains[id] {
+		return fmt.Errorf("CSR 与订单不符")
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(100 + len(ca.certs))),
+		Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, tmpl, ca.root, csr.PublicKey, ca.rootKey)
+	if err != nil {
+		return err
+	}
+	ca.certs[id] = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.root.Raw})...)
+	return nil
+}
+
+func TestACME(t *testing.T) {
+	ca := newACMECA(t)
+	dir := t.TempDir()
+	m, err := New(&config.TLSConfig{ACME: &config.ACMEConfig{
+		Domains:      []string{"example.test"},
+		DirectoryURL: ca.srv.URL + "/dir",
+		CAFile:       ca.caFile(t, dir),
+	}}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// HTTP 端口应答 http-01 验证，其余请求交给 fallback
+	httpSrv := httptest.NewServer(m.HTTPHandler(http.NotFoundHandler()))
+	t.Cleanup(httpSrv.Close)
+	ca.resolve["example.test"] = strings.TrimPrefix(httpSrv.URL, "http://")
+
+	httpsSrv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	httpsSrv.TLS = m.TLSConfig()
+	httpsSrv.StartTLS()
+	t.Cleanup(httpsSrv.Close)
+	addr := httpsSrv.Listener.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.root)
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "example.test", RootCAs: roots})
+	if err != nil {
+		t.Fatalf("使用 ACME 签发的证书握手失败: %v", err)
+	}
+	conn.Close()
+	if _, err := os.Stat(filepath.Join(dir, "certs", "example.test")); err != nil {
+		t.Errorf("证书没有保存到缓存目录: %v", err)
+	}
+
+	// 未配置的域名不申请证书
+	if conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "other.test", InsecureSkipVerify: true}); err == nil {
+		conn.Close()
+		t.Error("为未配置的域名提供了证书")
+	}
+}
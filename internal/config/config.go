@@ -15,12 +15,42 @@ type Config struct {
 	Logging LoggingConfig `json:"logging,omitempty"`
 }
 
+// DefaultSTUNPort 内置 STUN 服务的默认 UDP 端口
+const DefaultSTUNPort = 3478
+
 // ServerAConfig 服务器A配置结构体
 type ServerAConfig struct {
 	Port     int    `json:"port"`
 	DBPath   string `json:"db_path"`
 	LogFile  string `json:"log_file,omitempty"`
 	LogLevel string `json:"log_level,omitempty"`
+	// STUNPort 内置 STUN 服务的 UDP 端口，0 使用默认端口，负数关闭
+	STUNPort int `json:"stun_port,omitempty"`
+	// TrustedProxies 可信反向代理的地址或网段，来自这些地址的请求按 X-Forwarded-For 识别访客 IP
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+	// TLS 启用 HTTPS，为空时以 HTTP 监听 Port
+	TLS *TLSConfig `json:"tls,omitempty"`
+}
+
+// TLSConfig 服务器A的 HTTPS 配置，证书文件和 ACME 二选一，相对路径相对于数据目录
+type TLSConfig struct {
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	// HTTPPort 把 HTTP 请求重定向到 HTTPS 的端口，ACME 的 http-01 验证也使用该端口，0 不监听
+	HTTPPort int         `json:"http_port,omitempty"`
+	ACME     *ACMEConfig `json:"acme,omitempty"`
+}
+
+// ACMEConfig 通过 ACME 协议（如 Let's Encrypt）自动申请和续期证书
+type ACMEConfig struct {
+	Domains []string `json:"domains"`
+	Email   string   `json:"email,omitempty"`
+	// DirectoryURL ACME 服务的目录地址，为空时使用 Let's Encrypt
+	DirectoryURL string `json:"directory_url,omitempty"`
+	// CAFile 访问 ACME 服务时额外信任的根证书，用于私有 CA 或测试环境
+	CAFile string `json:"ca_file,omitempty"`
+	// CacheDir 保存账户密钥和证书的目录，默认为数据目录下的 certs
+	CacheDir string `json:"cache_dir,omitempty"`
 }
 
 // ServerBConfig 服务器B配置结构体
@@ -91,6 +121,7 @@ func Default() *Config {
 			DBPath:   "l2h-s.db",
 			LogFile:  "logs/l2h-s.log",
 			LogLevel: "INFO",
+			STUNPort: DefaultSTUNPort,
 		},
 		ServerB: ServerBConfig{
 			Port:     55055,
@@ -105,6 +136,18 @@ func Default() *Config {
 	}
 }
 
+// GetSTUNPort 返回内置 STUN 服务实际使用的端口，返回 0 表示关闭
+func (c *ServerAConfig) GetSTUNPort() int {
+	switch {
+	case c.STUNPort < 0:
+		return 0
+	case c.STUNPort == 0:
+		return DefaultSTUNPort
+	default:
+		return c.STUNPort
+	}
+}
+
 // GetLogLevel 将字符串转换为日志级别数值
 func GetLogLevel(level string) int {
 	switch level {
@@ -0,0 +1,130 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// 节点密钥是 l2h-c 的 ECDSA P-256 密钥，用来向访客浏览器证明数据通道的另一端是服务器B，
+// 服务器A只转发信令和中继数据，无法冒充服务器B。使用 P-256 而不是 Ed25519，
+// 因为所有浏览器的 WebCrypto 都支持 P-256 ECDSA 验证
+
+// ErrInvalidNodeKey 节点公钥格式无效
+var ErrInvalidNodeKey = errors.New("无效的节点公钥")
+
+// GenerateNodeKey 生成新的节点密钥，返回 DER 编码的私钥
+func GenerateNodeKey() ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return x509.MarshalECPrivateKey(key)
+}
+
+// ParseNodePrivateKey 解析 GenerateNodeKey 生成的私钥
+func ParseNodePrivateKey(der []byte) (*ecdsa.PrivateKey, error) {
+	return x509.ParseECPrivateKey(der)
+}
+
+// MarshalNodeKey 返回节点公钥的未压缩点编码（65 字节），与 WebCrypto 的 raw 格式相同
+func MarshalNodeKey(pub *ecdsa.PublicKey) []byte {
+	key, err := pub.ECDH()
+	if err != nil {
+		return nil
+	}
+	return key.Bytes()
+}
+
+// ParseNodeKey 解析 MarshalNodeKey 编码的节点公钥
+func ParseNodeKey(raw []byte) (*ecdsa.PublicKey, error) {
+	if len(raw) != 65 || raw[0] != 4 {
+		return nil, ErrInvalidNodeKey
+	}
+	pub := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(raw[1:33]),
+		Y:     new(big.Int).SetBytes(raw[33:]),
+	}
+	if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+		return nil, ErrInvalidNodeKey
+	}
+	return pub, nil
+}
+
+// KeyFingerprint 返回公钥的指纹，格式与 OpenSSH 相同，如 SHA256:+Yk9...
+func KeyFingerprint(raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// SignNode 用节点密钥对 message 签名，返回 r||s 形式（64 字节）的签名，与 WebCrypto 的格式相同
+func SignNode(key *ecdsa.PrivateKey, message []byte) ([]byte, error) {
+	hash := sha256.Sum256(message)
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return sig, nil
+}
+
+// VerifyNode 验证 SignNode 生成的签名
+func VerifyNode(pub *ecdsa.PublicKey, message, sig []byte) bool {
+	if len(sig) != 64 {
+		return false
+	}
+	hash := sha256.Sum256(message)
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	return ecdsa.Verify(pub, hash[:], r, s)
+}
+
+// DTLSMessage 返回服务器B为 WebRTC 连接签名的内容：路径以及 offer 和 answer 中的 DTLS 证书指纹。
+// 访客浏览器验证签名后才使用 answer，服务器A替换任一方的证书都会被发现
+func DTLSMessage(path, offerSDP, answerSDP string) ([]byte, error) {
+	offer, err := SDPFingerprint(offerSDP)
+	if err != nil {
+		return nil, fmt.Errorf("offer %w", err)
+	}
+	answer, err := SDPFingerprint(answerSDP)
+	if err != nil {
+		return nil, fmt.Errorf("answer %w", err)
+	}
+	return []byte("l2h-dtls-v1\n" + path + "\n" + offer + "\n" + answer), nil
+}
+
+// SDPFingerprint 返回 SDP 中的 DTLS 证书指纹，算法名为小写、指纹为大写。
+// 同一个指纹可以出现多次；有多个不同的指纹时返回错误，否则签名只覆盖其中一个，
+// 服务器A可以再加入自己的证书指纹
+func SDPFingerprint(sdp string) (string, error) {
+	var found string
+	for _, line := range strings.Split(sdp, "\n") {
+		value, ok := strings.CutPrefix(strings.TrimSpace(line), "a=fingerprint:")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) != 2 {
+			return "", errors.New("SDP 中的 DTLS 证书指纹格式错误")
+		}
+		fp := strings.ToLower(fields[0]) + " " + strings.ToUpper(fields[1])
+		if found != "" && fp != found {
+			return "", errors.New("SDP 中有多个不同的 DTLS 证书指纹")
+		}
+		found = fp
+	}
+	if found == "" {
+		return "", errors.New("SDP 中没有 DTLS 证书指纹")
+	}
+	return found, nil
+}
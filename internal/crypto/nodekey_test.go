@@ -0,0 +1,86 @@
+package crypto
+
+import (
+	"testing"
+)
+
+func TestNodeKeySignature(t *testing.T) {
+	der, err := GenerateNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParseNodePrivateKey(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := MarshalNodeKey(&key.PublicKey)
+	pub, err := ParseNodeKey(raw)
+	if err != nil {
+		t.Fatalf("ParseNodeKey() 失败: %v", err)
+	}
+
+	msg := []byte("l2h-dtls-v1\n/app\nsha-256 AA\nsha-256 BB")
+	sig, err := SignNode(key, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sig) != 64 {
+		t.Fatalf("签名长度 = %d，期望 64", len(sig))
+	}
+	if !VerifyNode(pub, msg, sig) {
+		t.Error("VerifyNode() 拒绝了有效的签名")
+	}
+	if VerifyNode(pub, append(msg, 'x'), sig) {
+		t.Error("VerifyNode() 接受了被修改内容的签名")
+	}
+	if VerifyNode(pub, msg, sig[:63]) {
+		t.Error("VerifyNode() 接受了长度错误的签名")
+	}
+}
+
+func TestParseNodeKeyInvalid(t *testing.T) {
+	offCurve := make([]byte, 65)
+	offCurve[0] = 4
+	offCurve[64] = 1
+	for name, raw := range map[string][]byte{
+		"空":     nil,
+		"压缩格式":  make([]byte, 33),
+		"不在曲线上": offCurve,
+	} {
+		if _, err := ParseNodeKey(raw); err != ErrInvalidNodeKey {
+			t.Errorf("%s: ParseNodeKey() 错误 = %v，期望 ErrInvalidNodeKey", name, err)
+		}
+	}
+}
+
+func TestSDPFingerprint(t *testing.T) {
+	tests := []struct {
+		name    string
+		sdp     string
+		want    string
+		wantErr bool
+	}{
+		{name: "标准格式", sdp: "v=0\r\na=fingerprint:sha-256 ab:cd:EF\r\na=setup:actpass\r\n", want: "sha-256 AB:CD:EF"},
+		{name: "重复的相同指纹", sdp: "a=fingerprint:SHA-256 AA:BB\r\nm=application\r\na=fingerprint:sha-256 aa:bb\r\n", want: "sha-256 AA:BB"},
+		{name: "多个不同的指纹", sdp: "a=fingerprint:sha-256 AA:BB\r\nm=application\r\na=fingerprint:sha-256 CC:DD\r\n", wantErr: true},
+		{name: "不同算法的指纹", sdp: "a=fingerprint:sha-256 AA:BB\r\na=fingerprint:sha-1 AA:BB\r\n", wantErr: true},
+		{name: "没有指纹", sdp: "v=0\r\na=setup:active\r\n", wantErr: true},
+		{name: "格式错误", sdp: "a=fingerprint:sha-256\r\n", wantErr: true},
+		{name: "格式错误的第二个指纹", sdp: "a=fingerprint:sha-256 AA:BB\r\na=fingerprint:sha-256 CC DD\r\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SDPFingerprint(tt.sdp)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("SDPFingerprint() = %q, %v，期望 %q", got, err, tt.want)
+			}
+		})
+	}
+
+	if _, err := DTLSMessage("/app", "v=0\r\n", "a=fingerprint:sha-256 AA\r\n"); err == nil {
+		t.Error("DTLSMessage() 没有拒绝缺少指纹的 offer")
+	}
+	if _, err := DTLSMessage("/app", "a=fingerprint:sha-256 AA\r\n", "a=fingerprint:sha-256 BB\r\na=fingerprint:sha-256 CC\r\n"); err == nil {
+		t.Error("DTLSMessage() 没有拒绝有多个指纹的 answer")
+	}
+}
@@ -20,6 +20,10 @@ const (
 	keyLength   = 32
 )
 
+// verifySlots 限制同时进行的密码验证数量，每次验证需要约 64 MiB 内存，
+// 避免大量并发的登录请求耗尽内存
+var verifySlots = make(chan struct{}, 4)
+
 // HashPassword 使用 Argon2id 算法对密码进行哈希
 func HashPassword(password string) (string, error) {
 	salt := make([]byte, saltLength)
@@ -65,7 +69,9 @@ func VerifyPassword(password, hashedPassword string) (bool, error) {
 		return false, fmt.Errorf("解码哈希失败: %w", err)
 	}
 
+	verifySlots <- struct{}{}
 	otherHash := argon2.IDKey([]byte(password), salt, t, m, uint8(p), uint32(len(hash)))
+	<-verifySlots
 
 	return subtle.ConstantTimeCompare(hash, otherHash) == 1, nil
 }
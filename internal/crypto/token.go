@@ -0,0 +1,40 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// SignToken 使用 HMAC-SHA256 为 payload 签名，返回 "payload.签名" 形式的令牌，
+// 两部分均为 URL 安全的 base64 编码，可直接用作 cookie 值
+func SignToken(key []byte, payload string) string {
+	data := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	return data + "." + base64.RawURLEncoding.EncodeToString(sign(key, data))
+}
+
+// VerifyToken 验证令牌的签名，成功时返回签名时的 payload
+func VerifyToken(key []byte, token string) (string, bool) {
+	data, mac, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", false
+	}
+
+	expected, err := base64.RawURLEncoding.DecodeString(mac)
+	if err != nil || !hmac.Equal(expected, sign(key, data)) {
+		return "", false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(data)
+	if err != nil {
+		return "", false
+	}
+	return string(payload), true
+}
+
+func sign(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
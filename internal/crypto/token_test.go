@@ -0,0 +1,44 @@
+package crypto
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerifyToken(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	token := SignToken(key, "12.v3.4.1700000000")
+	data, mac, _ := strings.Cut(token, ".")
+
+	tests := []struct {
+		name  string
+		key   []byte
+		token string
+		want  string
+		ok    bool
+	}{
+		{name: "有效", key: key, token: token, want: "12.v3.4.1700000000", ok: true},
+		{name: "其他密钥", key: []byte("another key"), token: token},
+		{name: "篡改 payload", key: key, token: SignToken(key, "13.v3.4.1700000000")[:len(data)] + "." + mac},
+		{name: "篡改签名", key: key, token: data + "." + mac[:len(mac)-2] + "AA"},
+		{name: "缺少签名", key: key, token: data},
+		{name: "空签名", key: key, token: data + "."},
+		{name: "无效的 base64", key: key, token: data + ".!!!"},
+		{name: "空令牌", key: key, token: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := VerifyToken(tt.key, tt.token)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("VerifyToken() = (%q, %v)，期望 (%q, %v)", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestSignTokenCookieSafe(t *testing.T) {
+	token := SignToken([]byte("key"), "含有 ; 和 = 的 payload")
+	if strings.ContainsAny(token, " ;=,\"") {
+		t.Errorf("令牌 %q 含有 cookie 中不允许的字符", token)
+	}
+}
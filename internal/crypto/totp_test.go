@@ -0,0 +1,103 @@
+package crypto
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret RFC 6238 附录 B 中 SHA-1 测试密钥 "12345678901234567890" 的 base32 编码
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 附录 B 的测试向量，取 8 位验证码的后 6 位
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := TOTPCode(rfc6238Secret, TOTPStep(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatalf("TOTPCode() 失败: %v", err)
+		}
+		if got != tt.want {
+			t.Errorf("时间 %d 的验证码 = %s，期望 %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := TOTPStep(now)
+	code := func(s int64) string {
+		c, err := TOTPCode(rfc6238Secret, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		wantStep int64
+		ok       bool
+	}{
+		{name: "当前时间步", secret: rfc6238Secret, code: code(step), wantStep: step, ok: true},
+		{name: "上一个时间步", secret: rfc6238Secret, code: code(step - 1), wantStep: step - 1, ok: true},
+		{name: "下一个时间步", secret: rfc6238Secret, code: code(step + 1), wantStep: step + 1, ok: true},
+		{name: "超出允许的偏差", secret: rfc6238Secret, code: code(step - 2)},
+		{name: "前后有空白", secret: rfc6238Secret, code: " " + code(step) + "\n", wantStep: step, ok: true},
+		{name: "小写密钥", secret: strings.ToLower(rfc6238Secret), code: code(step), wantStep: step, ok: true},
+		{name: "位数不对", secret: rfc6238Secret, code: code(step)[:5]},
+		{name: "错误的验证码", secret: rfc6238Secret, code: "000000"},
+		{name: "无效的密钥", secret: "!!!", code: code(step)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := VerifyTOTP(tt.secret, tt.code, now)
+			if ok != tt.ok || (ok && got != tt.wantStep) {
+				t.Errorf("VerifyTOTP() = (%d, %v)，期望 (%d, %v)", got, ok, tt.wantStep, tt.ok)
+			}
+		})
+	}
+}
+
+func TestGenerateTOTPSecret(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret) != 32 {
+		t.Errorf("密钥长度 = %d，期望 32", len(secret))
+	}
+	if _, err := TOTPCode(secret, 1); err != nil {
+		t.Errorf("生成的密钥无法使用: %v", err)
+	}
+	if other, _ := GenerateTOTPSecret(); other == secret {
+		t.Error("两次生成的密钥相同")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	u, err := url.Parse(TOTPURI("L2H", "admin user", rfc6238Secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/L2H:admin user" {
+		t.Errorf("TOTPURI() = %s", u)
+	}
+	q := u.Query()
+	if q.Get("secret") != rfc6238Secret || q.Get("issuer") != "L2H" || q.Get("digits") != "6" || q.Get("period") != "30" {
+		t.Errorf("TOTPURI() 参数 = %v", q)
+	}
+}
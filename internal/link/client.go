@@ -0,0 +1,306 @@
+package link
+
+import (
+	"crypto/ecdh"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// ErrNotConnected 控制连接尚未建立
+var ErrNotConnected = errors.New("未连接到服务器A")
+
+// Handler 处理 l2h-s 下发的消息，每条消息在独立的 goroutine 中调用
+type Handler func(c *Client, msg *Message)
+
+// Client 由 l2h-c 主动建立并保持的控制连接
+type Client struct {
+	serverURL string
+	apiKey    string
+	handler   Handler
+	onConnect func(c *Client)
+	onPin     func(fingerprint string) error
+	// skipIdentity 为 true 时不验证 l2h-s 的身份，在请求头中直接发送 API Key
+	skipIdentity bool
+
+	mu     sync.Mutex
+	conn   *conn
+	relays map[string]*Relay
+	// fingerprint 记录的 l2h-s 身份指纹，为空时在首次连接时记录
+	fingerprint string
+}
+
+func NewClient(serverURL, apiKey string, handler Handler) *Client {
+	return &Client{
+		serverURL: serverURL,
+		apiKey:    apiKey,
+		handler:   handler,
+		relays:    make(map[string]*Relay),
+	}
+}
+
+// OnConnect 设置每次连接（包括重连）建立后的回调，需在 Run 之前调用
+func (c *Client) OnConnect(f func(c *Client)) {
+	c.onConnect = f
+}
+
+// PinIdentity 设置记录的 l2h-s 身份指纹，之后只连接身份与之一致的服务器。
+// fingerprint 为空时信任首次连接的服务器（TOFU），并调用 onPin 保存它的指纹。需在 Run 之前调用
+func (c *Client) PinIdentity(fingerprint string, onPin func(fingerprint string) error) {
+	c.mu.Lock()
+	c.fingerprint = fingerprint
+	c.mu.Unlock()
+	c.onPin = onPin
+}
+
+// SkipIdentity 不验证 l2h-s 的身份，在连接请求头中直接发送 API Key。
+// 仅用于连接没有身份密钥的旧版本 l2h-s，伪造的服务器可以借此拿到 API Key。需在 Run 之前调用
+func (c *Client) SkipIdentity() {
+	c.skipIdentity = true
+}
+
+// SetAPIKey 替换连接 l2h-s 使用的 API Key，从下一次重连开始生效
+func (c *Client) SetAPIKey(apiKey string) {
+	c.mu.Lock()
+	c.apiKey = apiKey
+	c.mu.Unlock()
+}
+
+// Run 持续保持与 l2h-s 的连接，断开后按指数退避重连，永不返回
+func (c *Client) Run() {
+	backoff := minBackoff
+	for {
+		start := time.Now()
+		err := c.serve()
+		if time.Since(start) > maxBackoff {
+			backoff = minBackoff
+		}
+		log.Printf("与服务器A的连接中断: %v，%v 后重连", err, backoff)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// serve 建立一次连接并处理消息直到连接断开
+func (c *Client) serve() error {
+	wsURL, err := WebSocketURL(c.serverURL)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	apiKey, pinned := c.apiKey, c.fingerprint
+	c.mu.Unlock()
+
+	header := http.Header{}
+	var challenge string
+	var eph *ecdh.PrivateKey
+	if c.skipIdentity {
+		header.Set(APIKeyHeader, apiKey)
+	} else {
+		if challenge, err = newChallenge(); err != nil {
+			return err
+		}
+		if eph, err = newKeyShare(); err != nil {
+			return err
+		}
+		header.Set(ChallengeHeader, challenge)
+		header.Set(KeyShareHeader, base64.StdEncoding.EncodeToString(eph.PublicKey().Bytes()))
+	}
+
+	ws, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		switch {
+		case resp == nil || resp.StatusCode != http.StatusUnauthorized:
+			return err
+		case c.skipIdentity:
+			return fmt.Errorf("API Key 无效或已过期")
+		default:
+			// 旧版本的服务器A要求在请求头中发送 API Key
+			return c.noIdentity()
+		}
+	}
+	if !c.skipIdentity {
+		if err := c.authenticate(ws, resp.Header, challenge, eph, pinned, apiKey); err != nil {
+			ws.Close()
+			return err
+		}
+	}
+
+	conn := newConn(ws)
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+	log.Printf("已连接到服务器A: %s", wsURL)
+	if c.onConnect != nil {
+		go c.onConnect(c)
+	}
+
+	defer func() {
+		c.mu.Lock()
+		c.conn = nil
+		relays := c.relays
+		c.relays = make(map[string]*Relay)
+		c.mu.Unlock()
+		conn.close()
+		for _, relay := range relays {
+			relay.shutdown()
+		}
+	}()
+
+	for {
+		msg, id, data, err := conn.read()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case msg == nil:
+			c.mu.Lock()
+			relay, ok := c.relays[id]
+			c.mu.Unlock()
+			if ok {
+				relay.deliver(data)
+			}
+			continue
+		case msg.Type == TypeRelayOpen:
+			// 在读循环中同步登记，保证随后到达的数据不会丢失
+			relay := newRelay(msg.ID, conn.sendData, c.closeRelay)
+			if msg.Window > 0 {
+				// l2h-s 支持流量控制：按窗口限制发送，读取后确认，并先告知 l2h-s 本端也支持
+				relay.acknowledge(func(id string, n int) error {
+					return conn.send(&Message{Type: TypeRelayAck, ID: id, Window: n})
+				})
+				relay.grant(0)
+				conn.send(&Message{Type: TypeRelayAck, ID: msg.ID})
+			}
+			c.mu.Lock()
+			c.relays[msg.ID] = relay
+			c.mu.Unlock()
+		case msg.Type == TypeRelayAck:
+			c.mu.Lock()
+			relay, ok := c.relays[msg.ID]
+			c.mu.Unlock()
+			if ok {
+				relay.grant(msg.Window)
+			}
+			continue
+		case msg.Type == TypeRelayClose:
+			c.mu.Lock()
+			relay, ok := c.relays[msg.ID]
+			delete(c.relays, msg.ID)
+			c.mu.Unlock()
+			if ok {
+				relay.shutdown()
+			}
+			continue
+		}
+		go c.handler(c, msg)
+	}
+}
+
+// authenticate 验证 l2h-s 的身份，通过后发送用认证密钥加密的 API Key 并等待认证结果
+func (c *Client) authenticate(ws *websocket.Conn, h http.Header, challenge string, eph *ecdh.PrivateKey, pinned, apiKey string) error {
+	key, err := c.checkIdentity(h, challenge, eph, pinned)
+	if err != nil {
+		return err
+	}
+	sealed, err := sealAPIKey(key, apiKey)
+	if err != nil {
+		return err
+	}
+	ws.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := ws.WriteJSON(&Message{Type: TypeAuth, APIKey: sealed}); err != nil {
+		return err
+	}
+
+	ws.SetReadDeadline(time.Now().Add(authTimeout))
+	var msg Message
+	if err := ws.ReadJSON(&msg); err != nil {
+		return err
+	}
+	switch msg.Type {
+	case TypeAuth:
+		return nil
+	case TypeError:
+		return errors.New(msg.Error)
+	}
+	return fmt.Errorf("认证时收到意外的消息 %s", msg.Type)
+}
+
+// checkIdentity 验证 l2h-s 在连接响应中的签名，并与记录的指纹比较，返回协商出的认证密钥。
+// 尚未记录指纹时记录本次连接的服务器
+func (c *Client) checkIdentity(h http.Header, challenge string, eph *ecdh.PrivateKey, pinned string) ([]byte, error) {
+	fp, key, err := verifyIdentity(h, challenge, eph)
+	switch {
+	case err == ErrNoIdentity:
+		return nil, c.noIdentity()
+	case err != nil:
+		return nil, err
+	case pinned == "":
+		if c.onPin != nil {
+			if err := c.onPin(fp); err != nil {
+				return nil, fmt.Errorf("保存服务器A的身份指纹失败: %w", err)
+			}
+		}
+		c.mu.Lock()
+		c.fingerprint = fp
+		c.mu.Unlock()
+		log.Printf("首次连接，已记录服务器A的身份指纹 %s，请核对与服务器A显示的一致", fp)
+	case fp != pinned:
+		return nil, &IdentityMismatchError{Pinned: pinned, Got: fp}
+	}
+	return key, nil
+}
+
+// noIdentity 服务器A没有证明自己的身份时拒绝连接，不发送 API Key
+func (c *Client) noIdentity() error {
+	return fmt.Errorf("%w，无法确认服务器的身份。请升级服务器A；"+
+		"确实要连接旧版本的服务器A时，使用 l2h-c -insecure-no-pin 启动", ErrNoIdentity)
+}
+
+// Relay 返回 l2h-s 请求建立的中继，收到 TypeRelayOpen 消息后可用
+func (c *Client) Relay(id string) (*Relay, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	relay, ok := c.relays[id]
+	return relay, ok
+}
+
+// closeRelay 在本地关闭中继时通知 l2h-s
+func (c *Client) closeRelay(id string) {
+	c.mu.Lock()
+	_, ok := c.relays[id]
+	delete(c.relays, id)
+	c.mu.Unlock()
+	if ok {
+		c.Send(&Message{Type: TypeRelayClose, ID: id})
+	}
+}
+
+// Send 向 l2h-s 发送一条消息
+func (c *Client) Send(msg *Message) error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	if conn == nil {
+		return ErrNotConnected
+	}
+	return conn.send(msg)
+}
@@ -0,0 +1,120 @@
+package link
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	writeWait  = 10 * time.Second
+	pongWait   = 60 * time.Second
+	pingPeriod = 25 * time.Second
+)
+
+// conn 对 WebSocket 连接的封装，负责串行写入和心跳
+type conn struct {
+	ws        *websocket.Conn
+	mu        sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newConn(ws *websocket.Conn) *conn {
+	c := &conn{
+		ws:   ws,
+		done: make(chan struct{}),
+	}
+
+	ws.SetReadDeadline(time.Now().Add(pongWait))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	go c.pingLoop()
+	return c
+}
+
+func (c *conn) pingLoop() {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.mu.Lock()
+			err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+			c.mu.Unlock()
+			if err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// send 发送一条 JSON 消息
+func (c *conn) send(msg *Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.ws.WriteJSON(msg)
+}
+
+// sendData 发送一条中继数据（二进制消息）
+func (c *conn) sendData(id string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.ws.WriteMessage(websocket.BinaryMessage, encodeData(id, data))
+}
+
+// read 读取下一条消息，文本消息解析为 Message，二进制消息为中继数据
+func (c *conn) read() (*Message, string, []byte, error) {
+	typ, raw, err := c.ws.ReadMessage()
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	if typ == websocket.BinaryMessage {
+		id, data, err := decodeData(raw)
+		return nil, id, data, err
+	}
+
+	var msg Message
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return nil, "", nil, err
+	}
+	return &msg, "", nil, nil
+}
+
+// encodeData 中继数据格式：连接ID长度（1字节）+ 连接ID + 负载
+func encodeData(id string, data []byte) []byte {
+	buf := make([]byte, 1+len(id)+len(data))
+	buf[0] = byte(len(id))
+	copy(buf[1:], id)
+	copy(buf[1+len(id):], data)
+	return buf
+}
+
+func decodeData(raw []byte) (string, []byte, error) {
+	if len(raw) < 1 || len(raw) < 1+int(raw[0]) {
+		return "", nil, errors.New("无效的中继数据")
+	}
+	n := int(raw[0])
+	return string(raw[1 : 1+n]), raw[1+n:], nil
+}
+
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.ws.Close()
+	})
+}
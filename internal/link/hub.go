@@ -0,0 +1,443 @@
+package link
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// offerTimeout 等待 l2h-c 返回 answer 的最长时间
+	offerTimeout = 30 * time.Second
+	// authTimeout 升级连接后等待 l2h-c 发送认证消息的最长时间
+	authTimeout = 10 * time.Second
+)
+
+var (
+	ErrNoPeer        = errors.New("服务器B节点不在线")
+	ErrPeerGone      = errors.New("服务器B已断开连接")
+	ErrOfferTimeout  = errors.New("等待服务器B应答超时")
+	ErrUnknownConnID = errors.New("未知的连接ID")
+)
+
+// Peer 一个已连接的 l2h-c
+type Peer struct {
+	NodeID      int
+	NodeName    string
+	RemoteAddr  string
+	ConnectedAt time.Time
+
+	conn *conn
+	// allow 检查该节点能否为未指定节点的路径提供服务，nil 表示不限制
+	allow func(path string) bool
+}
+
+// Send 向该 l2h-c 发送一条消息，仅对 OnMessage 回调收到的 Peer 有效
+func (p *Peer) Send(msg *Message) error {
+	if p.conn == nil {
+		return ErrPeerGone
+	}
+	return p.conn.send(msg)
+}
+
+// Hub 管理 l2h-c 主动建立的控制连接，运行在 l2h-s 上
+type Hub struct {
+	mu       sync.Mutex
+	peers    map[*Peer]struct{}
+	routes   map[string]*Peer
+	pending  map[string]chan *Message
+	relays   map[string]*hubRelay
+	onMsg    func(*Peer, *Message)
+	upgrader websocket.Upgrader
+	identity ed25519.PrivateKey
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		peers:   make(map[*Peer]struct{}),
+		routes:  make(map[string]*Peer),
+		pending: make(map[string]chan *Message),
+		relays:  make(map[string]*hubRelay),
+	}
+}
+
+// hubRelay 记录中继所属的 l2h-c
+type hubRelay struct {
+	*Relay
+	peer *Peer
+}
+
+// OnMessage 设置 l2h-c 主动上报消息（如连接关闭、路径同步）的回调，
+// 带连接ID的消息只在该连接属于发送消息的节点时交给回调
+func (h *Hub) OnMessage(f func(peer *Peer, msg *Message)) {
+	h.mu.Lock()
+	h.onMsg = f
+	h.mu.Unlock()
+}
+
+// SetIdentity 设置 l2h-s 的身份密钥，建立连接时用它向 l2h-c 证明身份，需在 Serve 之前调用
+func (h *Hub) SetIdentity(key ed25519.PrivateKey) {
+	h.identity = key
+}
+
+// Node 通过 API Key 认证的节点
+type Node struct {
+	ID   int
+	Name string
+	// Allow 不为 nil 时未指定节点的路径只转发给 Allow 允许的节点
+	Allow func(path string) bool
+}
+
+// Authenticate 校验节点 l2h-c 的 API Key，返回对应的节点
+type Authenticate func(apiKey string) (*Node, error)
+
+// Serve 接受节点 l2h-c 的 WebSocket 连接并处理消息直到连接断开。
+// l2h-c 验证 l2h-s 的身份之后，才发送用本次连接的认证密钥加密的 API Key，交给 auth 校验；
+// 不验证身份的 l2h-c 在请求头中直接发送 API Key，在升级连接之前校验
+func (h *Hub) Serve(w http.ResponseWriter, r *http.Request, auth Authenticate) {
+	if apiKey := r.Header.Get(APIKeyHeader); apiKey != "" {
+		node, err := auth(apiKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		ws, err := h.upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		h.servePeer(ws, r, node)
+		return
+	}
+
+	header := http.Header{}
+	key, err := SignIdentity(header, h.identity, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ws, err := h.upgrader.Upgrade(w, r, header)
+	if err != nil {
+		return
+	}
+	node, err := acceptAuth(ws, key, auth)
+	if err != nil {
+		ws.SetWriteDeadline(time.Now().Add(writeWait))
+		ws.WriteJSON(&Message{Type: TypeError, Error: err.Error()})
+		ws.Close()
+		return
+	}
+	h.servePeer(ws, r, node)
+}
+
+// acceptAuth 读取 l2h-c 发送的 TypeAuth 消息，解密 API Key 并认证，成功后回复 TypeAuth
+func acceptAuth(ws *websocket.Conn, key []byte, auth Authenticate) (*Node, error) {
+	ws.SetReadDeadline(time.Now().Add(authTimeout))
+	var msg Message
+	if err := ws.ReadJSON(&msg); err != nil {
+		return nil, err
+	}
+	if msg.Type != TypeAuth {
+		return nil, ErrInvalidAuth
+	}
+	apiKey, err := openAPIKey(key, msg.APIKey)
+	if err != nil {
+		return nil, err
+	}
+	node, err := auth(apiKey)
+	if err != nil {
+		return nil, err
+	}
+	ws.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := ws.WriteJSON(&Message{Type: TypeAuth}); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// servePeer 登记认证通过的节点并处理消息直到连接断开
+func (h *Hub) servePeer(ws *websocket.Conn, r *http.Request, node *Node) {
+	peer := &Peer{
+		NodeID:      node.ID,
+		NodeName:    node.Name,
+		RemoteAddr:  r.RemoteAddr,
+		ConnectedAt: time.Now(),
+		conn:        newConn(ws),
+		allow:       node.Allow,
+	}
+
+	// 同一节点重复连接时以新连接为准
+	h.mu.Lock()
+	var stale []*Peer
+	for p := range h.peers {
+		if p.NodeID == node.ID {
+			stale = append(stale, p)
+		}
+	}
+	h.peers[peer] = struct{}{}
+	h.mu.Unlock()
+	for _, p := range stale {
+		log.Printf("节点 %s 从 %s 重新连接，关闭旧连接 %s", node.Name, peer.RemoteAddr, p.RemoteAddr)
+		p.conn.close()
+	}
+	log.Printf("服务器B节点 %s 已连接: %s", peer.NodeName, peer.RemoteAddr)
+
+	defer h.removePeer(peer)
+
+	for {
+		msg, id, data, err := peer.conn.read()
+		if err != nil {
+			return
+		}
+		if msg == nil {
+			h.deliver(peer, id, data)
+			continue
+		}
+		h.dispatch(peer, msg)
+	}
+}
+
+// deliver 将 l2h-c 发来的中继数据交给对应的访客连接，只接受中继所属节点的数据
+func (h *Hub) deliver(peer *Peer, id string, data []byte) {
+	h.mu.Lock()
+	relay, ok := h.relays[id]
+	h.mu.Unlock()
+	if ok && relay.peer == peer {
+		relay.deliver(data)
+	}
+}
+
+func (h *Hub) removePeer(peer *Peer) {
+	peer.conn.close()
+
+	h.mu.Lock()
+	delete(h.peers, peer)
+	for id, p := range h.routes {
+		if p != peer {
+			continue
+		}
+		delete(h.routes, id)
+		if ch, ok := h.pending[id]; ok {
+			delete(h.pending, id)
+			ch <- &Message{Type: TypeError, ID: id, Error: ErrPeerGone.Error()}
+		}
+	}
+	for id, relay := range h.relays {
+		if relay.peer == peer {
+			delete(h.relays, id)
+			relay.shutdown()
+		}
+	}
+	h.mu.Unlock()
+	log.Printf("服务器B节点 %s 已断开: %s", peer.NodeName, peer.RemoteAddr)
+}
+
+// dispatch 将 l2h-c 的应答交给等待中的请求，其余消息交给回调处理。
+// 带连接ID的消息只在该连接属于发送消息的节点时处理，节点不能影响其他节点的连接
+func (h *Hub) dispatch(peer *Peer, msg *Message) {
+	h.mu.Lock()
+	if msg.ID != "" && !h.owns(peer, msg.ID) {
+		h.mu.Unlock()
+		log.Printf("忽略节点 %s 发来的不属于它的连接 %s 的消息 %s", peer.NodeName, msg.ID, msg.Type)
+		return
+	}
+	switch msg.Type {
+	case TypeAnswer, TypeError:
+		ch, ok := h.pending[msg.ID]
+		delete(h.pending, msg.ID)
+		h.mu.Unlock()
+		if ok {
+			ch <- msg
+		}
+	case TypeRelayClose:
+		relay, ok := h.relays[msg.ID]
+		delete(h.relays, msg.ID)
+		h.mu.Unlock()
+		if ok {
+			relay.shutdown()
+		}
+	case TypeRelayAck:
+		relay, ok := h.relays[msg.ID]
+		h.mu.Unlock()
+		if ok {
+			relay.grant(msg.Window)
+		}
+	default:
+		if msg.Type == TypeClose {
+			delete(h.routes, msg.ID)
+		}
+		handler := h.onMsg
+		h.mu.Unlock()
+		if handler != nil {
+			handler(peer, msg)
+		}
+	}
+}
+
+// owns 返回连接 id 是否由 peer 负责，调用方需持有锁
+func (h *Hub) owns(peer *Peer, id string) bool {
+	if p, ok := h.routes[id]; ok && p == peer {
+		return true
+	}
+	relay, ok := h.relays[id]
+	return ok && relay.peer == peer
+}
+
+// Connected 返回是否有 l2h-c 在线
+func (h *Hub) Connected() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.peers) > 0
+}
+
+// Peers 返回当前在线的节点
+func (h *Hub) Peers() []Peer {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	peers := make([]Peer, 0, len(h.peers))
+	for p := range h.peers {
+		peers = append(peers, Peer{
+			NodeID:      p.NodeID,
+			NodeName:    p.NodeName,
+			RemoteAddr:  p.RemoteAddr,
+			ConnectedAt: p.ConnectedAt,
+		})
+	}
+	return peers
+}
+
+// peerFor 返回负责指定节点的连接，nodeID 为 0 时返回任意允许该路径的在线节点，调用方需持有锁
+func (h *Hub) peerFor(nodeID int, path string) *Peer {
+	var found *Peer
+	for p := range h.peers {
+		if nodeID != 0 && p.NodeID != nodeID {
+			continue
+		}
+		if nodeID == 0 && p.allow != nil && !p.allow(path) {
+			continue
+		}
+		// 同一节点短暂存在新旧两个连接时选择较新的
+		if found == nil || p.ConnectedAt.After(found.ConnectedAt) {
+			found = p
+		}
+	}
+	return found
+}
+
+// Send 向指定节点发送一条消息，节点不在线时返回 ErrNoPeer
+func (h *Hub) Send(nodeID int, msg *Message) error {
+	if nodeID == 0 {
+		return ErrNoPeer
+	}
+	h.mu.Lock()
+	peer := h.peerFor(nodeID, "")
+	h.mu.Unlock()
+	if peer == nil {
+		return ErrNoPeer
+	}
+	return peer.Send(msg)
+}
+
+// Offer 将访客的 offer 转发给指定节点并等待 answer，iceServers 为访客使用的 ICE 服务器。
+// signature 为 l2h-c 对 DTLS 证书指纹的签名，由访客浏览器验证
+func (h *Hub) Offer(nodeID int, id, path, sdp string, iceServers []string) (answer, signature string, err error) {
+	h.mu.Lock()
+	peer := h.peerFor(nodeID, path)
+	if peer == nil {
+		h.mu.Unlock()
+		return "", "", ErrNoPeer
+	}
+	ch := make(chan *Message, 1)
+	h.pending[id] = ch
+	h.routes[id] = peer
+	h.mu.Unlock()
+
+	if err := peer.conn.send(&Message{Type: TypeOffer, ID: id, Path: path, SDP: sdp, ICEServers: iceServers}); err != nil {
+		h.forget(id)
+		return "", "", err
+	}
+
+	select {
+	case msg := <-ch:
+		if msg.Type == TypeError {
+			h.forget(id)
+			return "", "", errors.New(msg.Error)
+		}
+		return msg.SDP, msg.Signature, nil
+	case <-time.After(offerTimeout):
+		h.forget(id)
+		return "", "", ErrOfferTimeout
+	}
+}
+
+// OpenRelay 请求指定节点为访客建立一条经由控制连接的中继，
+// secure 表示访客会在中继上先进行加密握手
+func (h *Hub) OpenRelay(nodeID int, id, path string, secure bool) (*Relay, error) {
+	h.mu.Lock()
+	peer := h.peerFor(nodeID, path)
+	if peer == nil {
+		h.mu.Unlock()
+		return nil, ErrNoPeer
+	}
+	relay := newRelay(id, peer.conn.sendData, h.closeRelay)
+	relay.acknowledge(func(id string, n int) error {
+		return peer.conn.send(&Message{Type: TypeRelayAck, ID: id, Window: n})
+	})
+	h.relays[id] = &hubRelay{Relay: relay, peer: peer}
+	h.mu.Unlock()
+
+	// 旧版本的 l2h-c 不确认读取的消息，收到它的第一条确认后才限制发送
+	if err := peer.conn.send(&Message{Type: TypeRelayOpen, ID: id, Path: path, Secure: secure, Window: relayWindow}); err != nil {
+		h.mu.Lock()
+		delete(h.relays, id)
+		h.mu.Unlock()
+		relay.shutdown()
+		return nil, err
+	}
+	return relay, nil
+}
+
+// closeRelay 在访客一侧关闭中继时通知 l2h-c
+func (h *Hub) closeRelay(id string) {
+	h.mu.Lock()
+	relay, ok := h.relays[id]
+	delete(h.relays, id)
+	h.mu.Unlock()
+	if ok {
+		relay.peer.conn.send(&Message{Type: TypeRelayClose, ID: id})
+	}
+}
+
+// Candidate 将访客的 ICE 候选转发给负责该连接的 l2h-c
+func (h *Hub) Candidate(id, candidate string) error {
+	h.mu.Lock()
+	peer, ok := h.routes[id]
+	h.mu.Unlock()
+	if !ok {
+		return ErrUnknownConnID
+	}
+	return peer.conn.send(&Message{Type: TypeCandidate, ID: id, Candidate: candidate})
+}
+
+// Close 通知 l2h-c 关闭指定连接
+func (h *Hub) Close(id string) error {
+	h.mu.Lock()
+	peer, ok := h.routes[id]
+	delete(h.routes, id)
+	h.mu.Unlock()
+	if !ok {
+		return ErrUnknownConnID
+	}
+	return peer.conn.send(&Message{Type: TypeClose, ID: id})
+}
+
+func (h *Hub) forget(id string) {
+	h.mu.Lock()
+	delete(h.pending, id)
+	delete(h.routes, id)
+	h.mu.Unlock()
+}
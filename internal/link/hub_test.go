@@ -0,0 +1,386 @@
+package link
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebSocketURL(t *testing.T) {
+	tests := []struct {
+		server  string
+		want    string
+		wantErr bool
+	}{
+		{server: "example.com", want: "ws://example.com/api/link"},
+		{server: "example.com:55080", want: "ws://example.com:55080/api/link"},
+		{server: "https://example.com", want: "wss://example.com/api/link"},
+		{server: "http://example.com/l2h/", want: "ws://example.com/l2h/api/link"},
+		{server: "wss://example.com", want: "wss://example.com/api/link"},
+		{server: "ftp://example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.server, func(t *testing.T) {
+			got, err := WebSocketURL(tt.server)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("WebSocketURL() 错误 = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("WebSocketURL() = %q，期望 %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// startLink 启动运行 Hub 的 l2h-s，并让节点 1 的 l2h-c 用 handler 连接上来
+func startLink(t *testing.T, handler Handler) (*Hub, *Client) {
+	t.Helper()
+	hub := newTestHub(t)
+	return hub, connectNode(t, hub, 1, handler)
+}
+
+// newTestHub 创建带有身份密钥的 Hub
+func newTestHub(t *testing.T) *Hub {
+	t.Helper()
+	hub := NewHub()
+	hub.SetIdentity(newIdentityKey(t))
+	return hub
+}
+
+// authNode 返回只接受 API Key l2h_key 的认证函数，认证为节点 nodeID
+func authNode(nodeID int, allow func(string) bool) Authenticate {
+	return func(apiKey string) (*Node, error) {
+		if apiKey != "l2h_key" {
+			return nil, errors.New("API Key 无效或已过期")
+		}
+		return &Node{ID: nodeID, Name: fmt.Sprintf("node-%d", nodeID), Allow: allow}, nil
+	}
+}
+
+// connectNode 让节点 nodeID 的 l2h-c 连接到 hub
+func connectNode(t *testing.T, hub *Hub, nodeID int, handler Handler) *Client {
+	t.Helper()
+	return connectNodeAllow(t, hub, nodeID, nil, handler)
+}
+
+// connectNodeAllow 让节点 nodeID 的 l2h-c 连接到 hub，只为 allow 允许的路径提供服务
+func connectNodeAllow(t *testing.T, hub *Hub, nodeID int, allow func(string) bool, handler Handler) *Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hub.Serve(w, r, authNode(nodeID, allow))
+	}))
+	t.Cleanup(srv.Close)
+
+	client := NewClient(srv.URL, "l2h_key", handler)
+	go client.serve()
+	waitFor(t, func() bool { return nodeOnline(hub, nodeID) })
+	return client
+}
+
+func nodeOnline(hub *Hub, nodeID int) bool {
+	return nodeAddr(hub, nodeID) != ""
+}
+
+// nodeAddr 返回节点 nodeID 的连接地址，不在线时返回空
+func nodeAddr(hub *Hub, nodeID int) string {
+	for _, p := range hub.Peers() {
+		if p.NodeID == nodeID {
+			return p.RemoteAddr
+		}
+	}
+	return ""
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("等待超时")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHub(t *testing.T) {
+	candidates := make(chan *Message, 1)
+	hub, client := startLink(t, func(c *Client, msg *Message) {
+		switch msg.Type {
+		case TypeOffer:
+			if msg.Path == "missing" {
+				c.Send(&Message{Type: TypeError, ID: msg.ID, Error: "路径不存在"})
+				return
+			}
+			c.Send(&Message{Type: TypeAnswer, ID: msg.ID, SDP: "answer:" + msg.SDP, Signature: "signed"})
+		case TypeCandidate, TypeClose:
+			candidates <- msg
+		}
+	})
+	closed := make(chan *Message, 1)
+	hub.OnMessage(func(_ *Peer, msg *Message) { closed <- msg })
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr string
+	}{
+		{name: "answer", path: "app", want: "answer:offer"},
+		{name: "l2h-c 返回错误", path: "missing", wantErr: "路径不存在"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, sig, err := hub.Offer(1, "c-"+tt.name, tt.path, "offer", nil)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("Offer() 错误 = %v，期望 %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want || sig != "signed" {
+				t.Errorf("Offer() = %q, %q，期望 %q 和 l2h-c 的签名", got, sig, tt.want)
+			}
+		})
+	}
+
+	// 候选和关闭转发给负责该连接的 l2h-c
+	if err := hub.Candidate("c-answer", "candidate:1"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-candidates; msg.Type != TypeCandidate || msg.ID != "c-answer" || msg.Candidate != "candidate:1" {
+		t.Errorf("l2h-c 收到 %+v", msg)
+	}
+	if err := hub.Candidate("c-unknown", "candidate:1"); !errors.Is(err, ErrUnknownConnID) {
+		t.Errorf("未知连接的候选: %v", err)
+	}
+	if err := hub.Close("c-answer"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-candidates; msg.Type != TypeClose || msg.ID != "c-answer" {
+		t.Errorf("l2h-c 收到 %+v", msg)
+	}
+	if err := hub.Candidate("c-answer", "candidate:2"); !errors.Is(err, ErrUnknownConnID) {
+		t.Errorf("关闭后的候选: %v", err)
+	}
+
+	// l2h-c 主动上报的消息交给 OnMessage
+	if _, _, err := hub.Offer(1, "c-other", "app", "offer", nil); err != nil {
+		t.Fatal(err)
+	}
+	client.Send(&Message{Type: TypeClose, ID: "c-other"})
+	if msg := <-closed; msg.Type != TypeClose || msg.ID != "c-other" {
+		t.Errorf("OnMessage 收到 %+v", msg)
+	}
+}
+
+func TestHubPeerGone(t *testing.T) {
+	offers := make(chan *Message, 1)
+	hub, client := startLink(t, func(c *Client, msg *Message) { offers <- msg })
+
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := hub.Offer(1, "c1", "app", "offer", nil)
+		errc <- err
+	}()
+	<-offers
+	// 等待应答时 l2h-c 断开
+	client.mu.Lock()
+	client.conn.close()
+	client.mu.Unlock()
+	if err := <-errc; err == nil || err.Error() != ErrPeerGone.Error() {
+		t.Errorf("Offer() 错误 = %v，期望 %v", err, ErrPeerGone)
+	}
+	waitFor(t, func() bool { return !hub.Connected() })
+	if _, _, err := hub.Offer(0, "c2", "app", "offer", nil); !errors.Is(err, ErrNoPeer) {
+		t.Errorf("没有 l2h-c 时 Offer() 错误 = %v，期望 %v", err, ErrNoPeer)
+	}
+}
+
+// TestHubRouting 访客的 offer 只转发给路径所属的节点
+func TestHubRouting(t *testing.T) {
+	hub := newTestHub(t)
+	answer := func(name string) Handler {
+		return func(c *Client, msg *Message) {
+			if msg.Type == TypeOffer {
+				c.Send(&Message{Type: TypeAnswer, ID: msg.ID, SDP: name})
+			}
+		}
+	}
+	connectNode(t, hub, 1, answer("node-1"))
+	connectNode(t, hub, 2, answer("node-2"))
+
+	tests := []struct {
+		name    string
+		nodeID  int
+		want    string
+		wantErr error
+	}{
+		{name: "节点 1", nodeID: 1, want: "node-1"},
+		{name: "节点 2", nodeID: 2, want: "node-2"},
+		{name: "离线的节点", nodeID: 3, wantErr: ErrNoPeer},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := hub.Offer(tt.nodeID, fmt.Sprintf("c%d", i), "app", "offer", nil)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Offer() 错误 = %v，期望 %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Offer() 由 %q 应答，期望 %q", got, tt.want)
+			}
+		})
+	}
+
+	// 同一节点重新连接后旧连接被关闭，offer 转发给新连接
+	old := nodeAddr(hub, 2)
+	connectNode(t, hub, 2, answer("node-2-new"))
+	waitFor(t, func() bool { return len(hub.Peers()) == 2 && nodeAddr(hub, 2) != old })
+	if got, _, err := hub.Offer(2, "c-new", "app", "offer", nil); err != nil || got != "node-2-new" {
+		t.Errorf("重新连接后 Offer() = %q, %v，期望由新连接应答", got, err)
+	}
+}
+
+// TestHubOwnership 节点发来的消息不能影响其他节点负责的连接和中继
+func TestHubOwnership(t *testing.T) {
+	hub := newTestHub(t)
+	offers := make(chan *Message, 1)
+	owner := connectNode(t, hub, 1, func(c *Client, msg *Message) {
+		if msg.Type == TypeOffer {
+			offers <- msg
+		}
+	})
+	other := connectNode(t, hub, 2, func(*Client, *Message) {})
+
+	reported := make(chan *Message, 10)
+	synced := make(chan struct{}, 1)
+	hub.OnMessage(func(peer *Peer, msg *Message) {
+		if msg.Type == TypeSync {
+			synced <- struct{}{}
+			return
+		}
+		reported <- msg
+	})
+	// flush 等待节点 2 之前发送的消息都已处理
+	flush := func() {
+		t.Helper()
+		other.Send(&Message{Type: TypeSync})
+		select {
+		case <-synced:
+		case <-time.After(5 * time.Second):
+			t.Fatal("等待节点 2 的消息超时")
+		}
+	}
+
+	type result struct {
+		sdp string
+		err error
+	}
+	answered := make(chan result, 1)
+	go func() {
+		sdp, _, err := hub.Offer(1, "c1", "app", "offer", nil)
+		answered <- result{sdp, err}
+	}()
+	<-offers
+
+	other.Send(&Message{Type: TypeAnswer, ID: "c1", SDP: "node-2"})
+	other.Send(&Message{Type: TypeError, ID: "c1", Error: "node-2"})
+	other.Send(&Message{Type: TypeState, ID: "c1", State: "connected"})
+	other.Send(&Message{Type: TypeClose, ID: "c1"})
+	flush()
+	select {
+	case res := <-answered:
+		t.Fatalf("Offer() 被节点 2 应答: %+v", res)
+	case msg := <-reported:
+		t.Fatalf("节点 2 关于节点 1 连接的消息交给了 OnMessage: %+v", msg)
+	default:
+	}
+
+	owner.Send(&Message{Type: TypeAnswer, ID: "c1", SDP: "node-1"})
+	if res := <-answered; res.err != nil || res.sdp != "node-1" {
+		t.Errorf("Offer() = %+v，期望由节点 1 应答", res)
+	}
+	owner.Send(&Message{Type: TypeClose, ID: "c1"})
+	if msg := <-reported; msg.Type != TypeClose || msg.ID != "c1" {
+		t.Errorf("OnMessage 收到 %+v，期望节点 1 关闭 c1", msg)
+	}
+
+	relay, err := hub.OpenRelay(1, "r1", "app", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { _, ok := owner.Relay("r1"); return ok })
+	other.mu.Lock()
+	other.conn.sendData("r1", []byte("node-2"))
+	other.mu.Unlock()
+	other.Send(&Message{Type: TypeRelayClose, ID: "r1"})
+	flush()
+
+	ownerRelay, _ := owner.Relay("r1")
+	if err := ownerRelay.WriteMessage([]byte("node-1")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := relay.ReadMessage()
+	if err != nil || string(data) != "node-1" {
+		t.Errorf("中继读取 %q, %v，期望只收到节点 1 的数据", data, err)
+	}
+}
+
+// TestHubRoutingAllow 未指定节点的路径只转发给允许该路径的节点
+func TestHubRoutingAllow(t *testing.T) {
+	hub := newTestHub(t)
+	answer := func(c *Client, msg *Message) {
+		if msg.Type == TypeOffer {
+			c.Send(&Message{Type: TypeAnswer, ID: msg.ID, SDP: "node-1"})
+		}
+	}
+	connectNodeAllow(t, hub, 1, func(path string) bool { return path == "app" }, answer)
+
+	if got, _, err := hub.Offer(0, "c1", "app", "offer", nil); err != nil || got != "node-1" {
+		t.Errorf("允许的路径 Offer() = %q, %v", got, err)
+	}
+	if _, _, err := hub.Offer(0, "c2", "other", "offer", nil); !errors.Is(err, ErrNoPeer) {
+		t.Errorf("不允许的路径 Offer() 错误 = %v，期望 %v", err, ErrNoPeer)
+	}
+	// 路径明确属于该节点时不受限制
+	if got, _, err := hub.Offer(1, "c3", "other", "offer", nil); err != nil || got != "node-1" {
+		t.Errorf("属于该节点的路径 Offer() = %q, %v", got, err)
+	}
+	if _, err := hub.OpenRelay(0, "r1", "other", false); !errors.Is(err, ErrNoPeer) {
+		t.Errorf("不允许的路径 OpenRelay() 错误 = %v，期望 %v", err, ErrNoPeer)
+	}
+}
+
+// TestHubSync l2h-c 上报的同步消息带着来源节点交给 OnMessage，结果经 Peer.Send 返回
+func TestHubSync(t *testing.T) {
+	results := make(chan *Message, 1)
+	hub, client := startLink(t, func(c *Client, msg *Message) {
+		if msg.Type == TypeSyncResult {
+			results <- msg
+		}
+	})
+	hub.OnMessage(func(peer *Peer, msg *Message) {
+		if msg.Type != TypeSync {
+			return
+		}
+		peer.Send(&Message{Type: TypeSyncResult, Conflicts: []string{fmt.Sprintf("%d:%s", peer.NodeID, msg.Bindings[0].Path)}})
+	})
+
+	client.Send(&Message{Type: TypeSync, Bindings: []Binding{{Path: "app", Port: 8080}}})
+	select {
+	case msg := <-results:
+		if len(msg.Conflicts) != 1 || msg.Conflicts[0] != "1:app" {
+			t.Errorf("同步结果 = %+v，期望来自节点 1 的 app", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("没有收到同步结果")
+	}
+	if err := (&Peer{}).Send(&Message{Type: TypeSyncResult}); !errors.Is(err, ErrPeerGone) {
+		t.Errorf("没有连接的 Peer.Send() 错误 = %v，期望 %v", err, ErrPeerGone)
+	}
+}
@@ -0,0 +1,235 @@
+package link
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"l2h/internal/crypto"
+)
+
+// IdentityPath l2h-s 证明自己身份的 HTTP 路径，无需认证
+const IdentityPath = "/api/identity"
+
+// 身份证明使用的 HTTP 头：l2h-c 发送随机的 challenge 和本次连接的临时 X25519 公钥，
+// l2h-s 返回身份公钥、自己的临时公钥和用身份私钥对 challenge 及双方临时公钥的签名
+const (
+	ChallengeHeader = "X-L2H-Challenge"
+	KeyShareHeader  = "X-L2H-Key-Share"
+	IdentityHeader  = "X-L2H-Identity"
+	SignatureHeader = "X-L2H-Signature"
+)
+
+// APIKeyHeader 旧版本的 l2h-c 在连接请求头中直接发送 API Key
+const APIKeyHeader = "X-API-Key"
+
+// maxChallengeLen challenge 的最大长度，l2h-c 生成的 challenge 为 43 个字符
+const maxChallengeLen = 128
+
+// authInfo HKDF 的 info，用双方临时密钥的共享密钥派生加密 API Key 的认证密钥
+const authInfo = "l2h-link-auth-v1"
+
+var (
+	ErrNoIdentity      = errors.New("服务器A没有提供身份证明")
+	ErrInvalidIdentity = errors.New("服务器A的身份证明无效")
+	ErrInvalidAuth     = errors.New("无效的认证消息")
+)
+
+// IdentityMismatchError 服务器A的身份与 l2h-c 记录的指纹不一致
+type IdentityMismatchError struct {
+	Pinned string
+	Got    string
+}
+
+func (e *IdentityMismatchError) Error() string {
+	return fmt.Sprintf("服务器A的身份指纹 %s 与记录的 %s 不一致，可能连接到了伪造的服务器。"+
+		"确认服务器A更换了身份密钥后，使用 l2h-c -repin 重新记录", e.Got, e.Pinned)
+}
+
+// Fingerprint 返回身份公钥的指纹，格式与 OpenSSH 相同，如 SHA256:+Yk9...
+func Fingerprint(pub ed25519.PublicKey) string {
+	return crypto.KeyFingerprint(pub)
+}
+
+// NormalizeFingerprint 去掉用户输入的指纹两端的空白，补上省略的 SHA256: 前缀
+func NormalizeFingerprint(fp string) string {
+	fp = strings.TrimSpace(fp)
+	if fp != "" && !strings.HasPrefix(fp, "SHA256:") {
+		fp = "SHA256:" + fp
+	}
+	return fp
+}
+
+// identityMessage 返回被签名的内容，加上前缀避免身份私钥被用来签署其他用途的数据。
+// 签名覆盖双方的临时公钥，中间人转发 challenge 得到的签名只对 l2h-s 的临时密钥有效，
+// 它无法算出共享密钥，也就无法解开 l2h-c 随后发送的 API Key
+func identityMessage(challenge string, clientShare, serverShare []byte) []byte {
+	msg := []byte("l2h-identity-v2\n" + challenge + "\n")
+	msg = append(msg, clientShare...)
+	return append(msg, serverShare...)
+}
+
+func newChallenge() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// newKeyShare 生成本次连接的临时 X25519 密钥
+func newKeyShare() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// authKey 由共享密钥派生认证密钥，salt 为双方的临时公钥
+func authKey(shared, clientShare, serverShare []byte) ([]byte, error) {
+	salt := append(append([]byte{}, clientShare...), serverShare...)
+	return hkdf.Key(sha256.New, shared, salt, authInfo, 32)
+}
+
+// SignIdentity 若请求携带了 challenge 和临时公钥，生成 l2h-s 一方的临时密钥，
+// 把身份公钥、临时公钥和签名写入响应头，返回与 l2h-c 协商出的认证密钥
+func SignIdentity(h http.Header, key ed25519.PrivateKey, r *http.Request) ([]byte, error) {
+	challenge := r.Header.Get(ChallengeHeader)
+	if key == nil {
+		return nil, ErrNoIdentity
+	}
+	if challenge == "" || len(challenge) > maxChallengeLen {
+		return nil, errors.New("缺少有效的 challenge")
+	}
+	clientShare, err := base64.StdEncoding.DecodeString(r.Header.Get(KeyShareHeader))
+	if err != nil {
+		return nil, errors.New("无效的临时公钥")
+	}
+	clientKey, err := ecdh.X25519().NewPublicKey(clientShare)
+	if err != nil {
+		return nil, errors.New("无效的临时公钥")
+	}
+
+	eph, err := newKeyShare()
+	if err != nil {
+		return nil, err
+	}
+	shared, err := eph.ECDH(clientKey)
+	if err != nil {
+		return nil, errors.New("无效的临时公钥")
+	}
+	serverShare := eph.PublicKey().Bytes()
+	sig := ed25519.Sign(key, identityMessage(challenge, clientShare, serverShare))
+	h.Set(IdentityHeader, base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+	h.Set(KeyShareHeader, base64.StdEncoding.EncodeToString(serverShare))
+	h.Set(SignatureHeader, base64.StdEncoding.EncodeToString(sig))
+	return authKey(shared, clientShare, serverShare)
+}
+
+// verifyIdentity 检查响应头中对 challenge 和双方临时公钥的签名，
+// 返回 l2h-s 身份公钥的指纹和协商出的认证密钥
+func verifyIdentity(h http.Header, challenge string, eph *ecdh.PrivateKey) (string, []byte, error) {
+	if h.Get(IdentityHeader) == "" {
+		return "", nil, ErrNoIdentity
+	}
+	pub, err := base64.StdEncoding.DecodeString(h.Get(IdentityHeader))
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return "", nil, ErrInvalidIdentity
+	}
+	serverShare, err := base64.StdEncoding.DecodeString(h.Get(KeyShareHeader))
+	if err != nil {
+		return "", nil, ErrInvalidIdentity
+	}
+	serverKey, err := ecdh.X25519().NewPublicKey(serverShare)
+	if err != nil {
+		return "", nil, ErrInvalidIdentity
+	}
+	clientShare := eph.PublicKey().Bytes()
+	sig, err := base64.StdEncoding.DecodeString(h.Get(SignatureHeader))
+	if err != nil || !ed25519.Verify(pub, identityMessage(challenge, clientShare, serverShare), sig) {
+		return "", nil, ErrInvalidIdentity
+	}
+	shared, err := eph.ECDH(serverKey)
+	if err != nil {
+		return "", nil, ErrInvalidIdentity
+	}
+	key, err := authKey(shared, clientShare, serverShare)
+	if err != nil {
+		return "", nil, err
+	}
+	return Fingerprint(pub), key, nil
+}
+
+// sealAPIKey 用认证密钥加密 API Key。认证密钥每个连接不同且只加密这一条消息，nonce 固定为 0
+func sealAPIKey(key []byte, apiKey string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nil, make([]byte, gcm.NonceSize()), []byte(apiKey), []byte(authInfo))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openAPIKey 解密 l2h-c 发送的 API Key
+func openAPIKey(key []byte, sealed string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", ErrInvalidAuth
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	apiKey, err := gcm.Open(nil, make([]byte, gcm.NonceSize()), raw, []byte(authInfo))
+	if err != nil {
+		return "", ErrInvalidAuth
+	}
+	return string(apiKey), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// FetchIdentity 请求 l2h-s 用身份私钥签名随机的 challenge，验证后返回其身份公钥的指纹。
+// 只用于查看和记录指纹，不发送 API Key
+func FetchIdentity(serverURL string) (string, error) {
+	identityURL, err := HTTPURL(serverURL, IdentityPath)
+	if err != nil {
+		return "", err
+	}
+	challenge, err := newChallenge()
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, identityURL, nil)
+	if err != nil {
+		return "", err
+	}
+	eph, err := newKeyShare()
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(ChallengeHeader, challenge)
+	req.Header.Set(KeyShareHeader, base64.StdEncoding.EncodeToString(eph.PublicKey().Bytes()))
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	fp, _, err := verifyIdentity(resp.Header, challenge, eph)
+	return fp, err
+}
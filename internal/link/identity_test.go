@@ -0,0 +1,219 @@
+package link
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// startIdentityServer 启动使用身份密钥 key 的 l2h-s，key 为 nil 时模拟没有身份密钥、
+// 只接受请求头中 API Key 的旧版本
+func startIdentityServer(t *testing.T, key ed25519.PrivateKey) (*Hub, string) {
+	t.Helper()
+	hub := NewHub()
+	hub.SetIdentity(key)
+	mux := http.NewServeMux()
+	mux.HandleFunc(Path, func(w http.ResponseWriter, r *http.Request) {
+		if key == nil && r.Header.Get(APIKeyHeader) == "" {
+			http.Error(w, "缺少 API Key", http.StatusUnauthorized)
+			return
+		}
+		hub.Serve(w, r, authNode(1, nil))
+	})
+	if key != nil {
+		mux.HandleFunc(IdentityPath, func(w http.ResponseWriter, r *http.Request) {
+			SignIdentity(w.Header(), key, r)
+		})
+	}
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return hub, srv.URL
+}
+
+func newIdentityKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestIdentityPinning(t *testing.T) {
+	key := newIdentityKey(t)
+	fp := Fingerprint(key.Public().(ed25519.PublicKey))
+	other := Fingerprint(newIdentityKey(t).Public().(ed25519.PublicKey))
+
+	tests := []struct {
+		name      string
+		key       ed25519.PrivateKey
+		pinned    string
+		apiKey    string
+		skip      bool
+		wantPin   string
+		wantErr   error
+		wantMsg   string
+		mismatch  bool
+		connected bool
+	}{
+		{name: "首次连接记录指纹", key: key, wantPin: fp, connected: true},
+		{name: "指纹一致", key: key, pinned: fp, connected: true},
+		{name: "指纹不一致", key: key, pinned: other, mismatch: true},
+		{name: "API Key 无效", key: key, pinned: fp, apiKey: "wrong", wantMsg: "API Key 无效"},
+		{name: "旧版本服务器未记录指纹", wantErr: ErrNoIdentity},
+		{name: "记录了指纹的服务器没有身份密钥", pinned: fp, wantErr: ErrNoIdentity},
+		{name: "明确跳过身份验证", skip: true, connected: true},
+		{name: "跳过身份验证时 API Key 无效", skip: true, apiKey: "wrong", wantMsg: "API Key 无效"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub, serverURL := startIdentityServer(t, tt.key)
+			pins := make(chan string, 1)
+			apiKey := "l2h_key"
+			if tt.apiKey != "" {
+				apiKey = tt.apiKey
+			}
+			client := NewClient(serverURL, apiKey, func(*Client, *Message) {})
+			client.PinIdentity(tt.pinned, func(fp string) error {
+				pins <- fp
+				return nil
+			})
+			if tt.skip {
+				client.SkipIdentity()
+			}
+
+			errc := make(chan error, 1)
+			go func() { errc <- client.serve() }()
+			if tt.connected {
+				// l2h-c 在身份验证通过后才保存连接，Send 成功说明控制连接已建立
+				waitFor(t, func() bool { return client.Send(&Message{Type: TypeState}) == nil })
+				var pinned string
+				select {
+				case pinned = <-pins:
+				default:
+				}
+				if pinned != tt.wantPin {
+					t.Errorf("记录的指纹 = %q，期望 %q", pinned, tt.wantPin)
+				}
+				return
+			}
+
+			err := <-errc
+			var mismatch *IdentityMismatchError
+			if tt.mismatch {
+				if !errors.As(err, &mismatch) || mismatch.Pinned != other || mismatch.Got != fp {
+					t.Errorf("serve() 错误 = %v，期望指纹不一致", err)
+				}
+			} else if tt.wantMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantMsg) {
+					t.Errorf("serve() 错误 = %v，期望包含 %q", err, tt.wantMsg)
+				}
+			} else if err == nil || !errors.Is(err, tt.wantErr) {
+				t.Errorf("serve() 错误 = %v，期望 %v", err, tt.wantErr)
+			}
+			if nodeOnline(hub, 1) {
+				t.Error("身份验证失败后仍然建立了控制连接")
+			}
+		})
+	}
+}
+
+func TestFetchIdentity(t *testing.T) {
+	key := newIdentityKey(t)
+	_, serverURL := startIdentityServer(t, key)
+	fp, err := FetchIdentity(serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := Fingerprint(key.Public().(ed25519.PublicKey)); fp != want {
+		t.Errorf("FetchIdentity() = %q，期望 %q", fp, want)
+	}
+
+}
+
+// TestIdentityBinding 签名绑定双方的临时公钥：重放其他 challenge 的签名、
+// 替换 l2h-s 的临时公钥都无法通过验证，只有 l2h-s 能解开 l2h-c 加密的 API Key
+func TestIdentityBinding(t *testing.T) {
+	key := newIdentityKey(t)
+	eph, err := newKeyShare()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, Path, nil)
+	r.Header.Set(ChallengeHeader, "challenge")
+	r.Header.Set(KeyShareHeader, base64.StdEncoding.EncodeToString(eph.PublicKey().Bytes()))
+	h := http.Header{}
+	serverKey, err := SignIdentity(h, key, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, clientKey, err := verifyIdentity(h, "challenge", eph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := sealAPIKey(clientKey, "l2h_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := openAPIKey(serverKey, sealed); err != nil || got != "l2h_key" {
+		t.Errorf("openAPIKey() = %q, %v，期望 l2h_key", got, err)
+	}
+
+	// 中间人用自己的临时密钥替换 l2h-s 的临时公钥
+	mitm, err := newKeyShare()
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaced := h.Clone()
+	replaced.Set(KeyShareHeader, base64.StdEncoding.EncodeToString(mitm.PublicKey().Bytes()))
+	if _, _, err := verifyIdentity(replaced, "challenge", eph); err != ErrInvalidIdentity {
+		t.Errorf("替换临时公钥后 verifyIdentity() 错误 = %v，期望 %v", err, ErrInvalidIdentity)
+	}
+	if _, _, err := verifyIdentity(h, "other", eph); err != ErrInvalidIdentity {
+		t.Errorf("重放其他 challenge 的签名时 verifyIdentity() 错误 = %v，期望 %v", err, ErrInvalidIdentity)
+	}
+	other, err := newKeyShare()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := verifyIdentity(h, "challenge", other); err != ErrInvalidIdentity {
+		t.Errorf("转发其他 l2h-c 的签名时 verifyIdentity() 错误 = %v，期望 %v", err, ErrInvalidIdentity)
+	}
+	if _, err := openAPIKey(make([]byte, 32), sealed); err != ErrInvalidAuth {
+		t.Errorf("用其他密钥 openAPIKey() 错误 = %v，期望 %v", err, ErrInvalidAuth)
+	}
+}
+
+func TestHTTPURL(t *testing.T) {
+	tests := []struct {
+		server string
+		want   string
+	}{
+		{server: "example.com:55080", want: "http://example.com:55080/api/identity"},
+		{server: "https://example.com/l2h/", want: "https://example.com/l2h/api/identity"},
+		{server: "wss://example.com", want: "https://example.com/api/identity"},
+	}
+	for _, tt := range tests {
+		got, err := HTTPURL(tt.server, IdentityPath)
+		if err != nil || got != tt.want {
+			t.Errorf("HTTPURL(%q) = %q, %v，期望 %q", tt.server, got, err, tt.want)
+		}
+	}
+}
+
+func TestNormalizeFingerprint(t *testing.T) {
+	for in, want := range map[string]string{
+		" SHA256:abc ": "SHA256:abc",
+		"abc":          "SHA256:abc",
+		"":             "",
+	} {
+		if got := NormalizeFingerprint(in); got != want {
+			t.Errorf("NormalizeFingerprint(%q) = %q，期望 %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Package link 实现 l2h-c 与 l2h-s 之间的控制连接
+//
+// l2h-c 位于 NAT 之后，因此总是由 l2h-c 主动通过 WebSocket 连接 l2h-s，
+// 并使用 API Key 认证。l2h-s 通过该连接转发访客的 offer、ICE 候选等信令。
+//
+// l2h-s 持有长期的 Ed25519 身份密钥。连接时 l2h-c 发送随机的 challenge 和临时 X25519 公钥，
+// l2h-s 回复自己的临时公钥，并用身份密钥对 challenge 和双方的临时公钥签名。
+// l2h-c 首次连接时记录身份公钥的指纹，之后拒绝连接指纹不一致的服务器；
+// 验证通过后才用双方协商出的认证密钥加密 API Key，作为第一条消息（TypeAuth）发送。
+package link
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// 消息类型
+const (
+	TypeOffer     = "offer"
+	TypeAnswer    = "answer"
+	TypeCandidate = "candidate"
+	TypeClose     = "close"
+	TypeError     = "error"
+	// TypeState l2h-c 上报连接状态和累计流量
+	TypeState = "state"
+	// TypeSync l2h-c 上报本机的全部路径绑定，TypeSyncResult 为 l2h-s 的同步结果
+	TypeSync       = "sync"
+	TypeSyncResult = "sync_result"
+
+	// 中继：ICE 无法直连时，访客流量经 l2h-s 和控制连接转发
+	TypeRelayOpen  = "relay_open"
+	TypeRelayClose = "relay_close"
+	// TypeRelayAck 中继的接收方确认已读取的消息数，发送方据此继续发送
+	TypeRelayAck = "relay_ack"
+
+	// TypeKeyRotate l2h-s 下发轮换后的 API Key，l2h-c 保存后回复 TypeKeyRotated
+	TypeKeyRotate  = "key_rotate"
+	TypeKeyRotated = "key_rotated"
+
+	// TypeNodeKey l2h-c 连接后上报节点公钥，l2h-s 将其公布给访问该节点路径的访客
+	TypeNodeKey = "node_key"
+
+	// TypeAuth l2h-c 验证 l2h-s 的身份后发送加密的 API Key，认证通过后 l2h-s 回复 TypeAuth
+	TypeAuth = "auth"
+)
+
+// Path 控制连接在 l2h-s 上的 HTTP 路径
+const Path = "/api/link"
+
+// Message 控制连接上传输的消息
+type Message struct {
+	Type      string `json:"type"`
+	ID        string `json:"id,omitempty"`
+	Path      string `json:"path,omitempty"`
+	SDP       string `json:"sdp,omitempty"`
+	Candidate string `json:"candidate,omitempty"`
+	Error     string `json:"error,omitempty"`
+	// ICEServers 随 offer 下发，l2h-c 与访客使用相同的 STUN 服务器
+	ICEServers []string  `json:"ice_servers,omitempty"`
+	State      string    `json:"state,omitempty"`
+	BytesIn    int64     `json:"bytes_in,omitempty"`
+	BytesOut   int64     `json:"bytes_out,omitempty"`
+	Bindings   []Binding `json:"bindings,omitempty"`
+	Conflicts  []string  `json:"conflicts,omitempty"`
+	// APIKey 随 TypeKeyRotate 下发的新 API Key，或随 TypeAuth 发送的加密后的 API Key（base64）
+	APIKey string `json:"api_key,omitempty"`
+	// Signature 随 answer 返回，是 l2h-c 用节点密钥对双方 DTLS 证书指纹的签名（base64）
+	Signature string `json:"signature,omitempty"`
+	// NodeKey 随 TypeNodeKey 上报的节点公钥（base64）
+	NodeKey string `json:"node_key,omitempty"`
+	// Secure 随 TypeRelayOpen 下发，表示访客要求在中继上进行加密握手
+	Secure bool `json:"secure,omitempty"`
+	// Window 随 TypeRelayOpen 下发时表示 l2h-s 支持中继的流量控制，
+	// 随 TypeRelayAck 为接收方确认读取的消息数
+	Window int `json:"window,omitempty"`
+}
+
+// Binding 同步给 l2h-s 的路径绑定，Password 为哈希后的访问密码
+type Binding struct {
+	Path     string `json:"path"`
+	Port     int    `json:"port"`
+	Password string `json:"password,omitempty"`
+}
+
+// WebSocketURL 根据用户配置的服务器地址生成控制连接的 WebSocket 地址
+// 地址可以是 example.com、example.com:55080 或 https://example.com
+func WebSocketURL(serverURL string) (string, error) {
+	return serverURLFor(serverURL, Path, true)
+}
+
+// HTTPURL 根据用户配置的服务器地址生成 l2h-s 上 path 的 HTTP 地址
+func HTTPURL(serverURL, path string) (string, error) {
+	return serverURLFor(serverURL, path, false)
+}
+
+func serverURLFor(serverURL, path string, websocket bool) (string, error) {
+	if !strings.Contains(serverURL, "://") {
+		serverURL = "http://" + serverURL
+	}
+
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return "", fmt.Errorf("无效的服务器地址: %w", err)
+	}
+
+	secure := false
+	switch u.Scheme {
+	case "http", "ws":
+	case "https", "wss":
+		secure = true
+	default:
+		return "", fmt.Errorf("不支持的协议: %s", u.Scheme)
+	}
+	switch {
+	case websocket && secure:
+		u.Scheme = "wss"
+	case websocket:
+		u.Scheme = "ws"
+	case secure:
+		u.Scheme = "https"
+	default:
+		u.Scheme = "http"
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	return u.String(), nil
+}
@@ -0,0 +1,218 @@
+package link
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// relayWindow 每个中继连接缓存的待读消息数，也是对端未确认时最多发送的消息数
+const relayWindow = 256
+
+// Relay 经由控制连接中转的访客连接，在 ICE 无法直连时替代数据通道
+// 它实现了与数据通道相同的消息式读写接口，可直接交给 tunnel.Serve
+//
+// 同一控制连接上的所有中继共用一个读循环，读循环不能因为某个中继的读取方过慢而阻塞。
+// 因此中继使用按消息计数的流量控制：接收方每读取一批消息就用 TypeRelayAck 告知对端，
+// 发送方已发送但对端未确认的消息不超过 relayWindow，超过时 WriteMessage 等待确认
+type Relay struct {
+	id       string
+	send     func(id string, data []byte) error
+	onClose  func(id string)
+	incoming chan []byte
+
+	// ack 不为 nil 时读取消息后向对端确认
+	ack func(id string, n int) error
+	// unacked 已读取但尚未确认的消息数，只在 ReadMessage 中访问
+	unacked int
+
+	mu sync.Mutex
+	// limited 对端支持流量控制后为 true，此后发送的消息数受 credit 限制
+	limited bool
+	// credit 还可以发送的消息数，对端支持流量控制之前发送的消息也计入
+	credit int
+	wake   chan struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newRelay(id string, send func(string, []byte) error, onClose func(string)) *Relay {
+	return &Relay{
+		id:       id,
+		send:     send,
+		onClose:  onClose,
+		incoming: make(chan []byte, relayWindow),
+		credit:   relayWindow,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// ID 返回中继对应的连接ID
+func (r *Relay) ID() string {
+	return r.id
+}
+
+// ReadMessage 读取对端发来的下一条消息，中继关闭后返回 io.EOF
+func (r *Relay) ReadMessage() ([]byte, error) {
+	select {
+	case msg := <-r.incoming:
+		if r.ack != nil {
+			r.unacked++
+			if r.unacked >= relayWindow/2 {
+				r.ack(r.id, r.unacked)
+				r.unacked = 0
+			}
+		}
+		return msg, nil
+	case <-r.done:
+		return nil, io.EOF
+	}
+}
+
+// WriteMessage 向对端发送一条消息，对端确认的窗口用完时等待
+func (r *Relay) WriteMessage(data []byte) error {
+	for {
+		r.mu.Lock()
+		ok := !r.limited || r.credit > 0
+		if ok {
+			r.credit--
+		}
+		more := r.limited && r.credit > 0
+		r.mu.Unlock()
+		if ok {
+			if more {
+				// 窗口还有剩余，唤醒其他等待的写入方
+				r.signal()
+			}
+			break
+		}
+		select {
+		case <-r.wake:
+		case <-r.done:
+			return io.ErrClosedPipe
+		}
+	}
+
+	select {
+	case <-r.done:
+		return io.ErrClosedPipe
+	default:
+	}
+	return r.send(r.id, data)
+}
+
+// acknowledge 读取消息后用 ack 向对端确认，对端据此继续发送
+func (r *Relay) acknowledge(ack func(id string, n int) error) {
+	r.ack = ack
+}
+
+// grant 对端确认读取了 n 条消息。收到对端的确认说明它支持流量控制，此后按窗口限制发送
+func (r *Relay) grant(n int) {
+	r.mu.Lock()
+	r.limited = true
+	r.credit += n
+	r.mu.Unlock()
+	r.signal()
+}
+
+func (r *Relay) signal() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Close 关闭中继并通知对端
+func (r *Relay) Close() error {
+	if r.shutdown() && r.onClose != nil {
+		r.onClose(r.id)
+	}
+	return nil
+}
+
+// deliver 投递对端发来的消息。deliver 在控制连接的读循环中调用，不能阻塞：
+// 对端不遵守窗口或不支持流量控制导致缓冲区满时，关闭该中继并通知对端
+func (r *Relay) deliver(data []byte) {
+	select {
+	case r.incoming <- data:
+	case <-r.done:
+	default:
+		log.Printf("中继 %s 的缓冲区已满，关闭中继", r.id)
+		r.Close()
+	}
+}
+
+// shutdown 关闭中继但不通知对端，返回是否是首次关闭
+func (r *Relay) shutdown() bool {
+	first := false
+	r.closeOnce.Do(func() {
+		first = true
+		close(r.done)
+	})
+	return first
+}
+
+var relayUpgrader = websocket.Upgrader{
+	ReadBufferSize:  32 << 10,
+	WriteBufferSize: 32 << 10,
+}
+
+// Counter 统计中继流量，方向以访客为准
+type Counter interface {
+	AddBytesIn(n int)
+	AddBytesOut(n int)
+}
+
+// ServeRelay 将访客浏览器的 WebSocket 连接与中继双向对接，直到任一端关闭
+// 调用方负责在此之前完成访客认证，counter 可以为 nil
+func ServeRelay(w http.ResponseWriter, r *http.Request, relay *Relay, counter Counter) {
+	defer relay.Close()
+
+	ws, err := relayUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	go func() {
+		defer ws.Close()
+		for {
+			msg, err := relay.ReadMessage()
+			if err != nil {
+				ws.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+				return
+			}
+			ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := ws.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+				relay.Close()
+				return
+			}
+			if counter != nil {
+				counter.AddBytesOut(len(msg))
+			}
+		}
+	}()
+
+	for {
+		typ, msg, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if typ != websocket.BinaryMessage {
+			continue
+		}
+		if err := relay.WriteMessage(msg); err != nil {
+			return
+		}
+		if counter != nil {
+			counter.AddBytesIn(len(msg))
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package link
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRelayData(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     []byte
+		id      string
+		data    []byte
+		wantErr bool
+	}{
+		{name: "编解码", raw: encodeData("c1", []byte("hello")), id: "c1", data: []byte("hello")},
+		{name: "空负载", raw: encodeData("c1", nil), id: "c1", data: []byte{}},
+		{name: "空", raw: nil, wantErr: true},
+		{name: "连接ID被截断", raw: []byte{5, 'c', '1'}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, data, err := decodeData(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeData() 错误 = %v", err)
+			}
+			if id != tt.id || !bytes.Equal(data, tt.data) {
+				t.Errorf("decodeData() = %q, %q，期望 %q, %q", id, data, tt.id, tt.data)
+			}
+		})
+	}
+}
+
+// byteCounter 记录中继流量
+type byteCounter struct{ in, out atomic.Int64 }
+
+func (c *byteCounter) AddBytesIn(n int)  { c.in.Add(int64(n)) }
+func (c *byteCounter) AddBytesOut(n int) { c.out.Add(int64(n)) }
+
+// TestRelay 访客的 WebSocket 经 l2h-s 和控制连接中转到 l2h-c，l2h-c 一侧回显
+func TestRelay(t *testing.T) {
+	hub, _ := startLink(t, func(c *Client, msg *Message) {
+		if msg.Type != TypeRelayOpen {
+			return
+		}
+		relay, ok := c.Relay(msg.ID)
+		if !ok {
+			t.Errorf("没有找到中继 %s", msg.ID)
+			return
+		}
+		defer relay.Close()
+		for {
+			data, err := relay.ReadMessage()
+			if err != nil {
+				return
+			}
+			relay.WriteMessage(append([]byte(msg.Path+":"), data...))
+		}
+	})
+
+	var counter byteCounter
+	visitor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		relay, err := hub.OpenRelay(1, r.URL.Query().Get("id"), "app", false)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		ServeRelay(w, r, relay, &counter)
+	}))
+	defer visitor.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(visitor.URL, "http")+"/?id=r1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	msgs := []string{"ping", strings.Repeat("x", 32<<10)}
+	var sent int64
+	for _, msg := range msgs {
+		sent += int64(len(msg))
+		if err := ws.WriteMessage(websocket.BinaryMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		typ, got, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ != websocket.BinaryMessage || string(got) != "app:"+msg {
+			t.Errorf("收到 %d 字节，期望回显 %d 字节", len(got), len(msg)+4)
+		}
+	}
+
+	// 访客收到回显后流量才计入，等待计数更新
+	waitFor(t, func() bool {
+		return counter.in.Load() == sent && counter.out.Load() == sent+int64(4*len(msgs))
+	})
+
+	// 访客断开后 l2h-s 和 l2h-c 两侧的中继都被移除
+	ws.Close()
+	waitFor(t, func() bool {
+		hub.mu.Lock()
+		defer hub.mu.Unlock()
+		return len(hub.relays) == 0
+	})
+}
+
+// TestRelayPeerClose l2h-c 关闭中继后访客的 WebSocket 被关闭
+func TestRelayPeerClose(t *testing.T) {
+	hub, _ := startLink(t, func(c *Client, msg *Message) {
+		if relay, ok := c.Relay(msg.ID); ok {
+			relay.Close()
+		}
+	})
+	relay, err := hub.OpenRelay(1, "r1", "app", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := relay.ReadMessage()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != io.EOF {
+			t.Errorf("ReadMessage() 错误 = %v，期望 io.EOF", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("中继没有关闭")
+	}
+	if err := relay.WriteMessage([]byte("x")); err != io.ErrClosedPipe {
+		t.Errorf("关闭后 WriteMessage() 错误 = %v", err)
+	}
+}
+
+// TestRelayWindow 对端确认前最多发送 relayWindow 条消息；对端超出窗口时关闭中继而不是阻塞读循环
+func TestRelayWindow(t *testing.T) {
+	closed := make(chan string, 1)
+	var sent atomic.Int64
+	relay := newRelay("r1", func(string, []byte) error {
+		sent.Add(1)
+		return nil
+	}, func(id string) { closed <- id })
+
+	relay.grant(0)
+	for i := 0; i < relayWindow; i++ {
+		if err := relay.WriteMessage([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done := make(chan error, 1)
+	go func() { done <- relay.WriteMessage([]byte("x")) }()
+	select {
+	case <-done:
+		t.Fatal("窗口用完后 WriteMessage() 没有等待确认")
+	case <-time.After(50 * time.Millisecond):
+	}
+	relay.grant(1)
+	select {
+	case err := <-done:
+		if err != nil || sent.Load() != relayWindow+1 {
+			t.Errorf("确认后 WriteMessage() 错误 = %v，已发送 %d 条", err, sent.Load())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("确认后 WriteMessage() 仍在等待")
+	}
+
+	for i := 0; i < relayWindow; i++ {
+		relay.deliver([]byte("x"))
+	}
+	select {
+	case <-closed:
+		t.Fatal("窗口内的消息关闭了中继")
+	default:
+	}
+	relay.deliver([]byte("x"))
+	select {
+	case id := <-closed:
+		if id != "r1" {
+			t.Errorf("关闭的中继 = %q，期望 r1", id)
+		}
+	default:
+		t.Fatal("超出窗口后中继没有关闭")
+	}
+}
+
+// TestRelayFlowControl 访客读取过慢时 l2h-c 等待确认，同一控制连接上的其他中继不受影响
+func TestRelayFlowControl(t *testing.T) {
+	const total = 4 * relayWindow
+	hub, _ := startLink(t, func(c *Client, msg *Message) {
+		relay, ok := c.Relay(msg.ID)
+		if msg.Type != TypeRelayOpen || !ok {
+			return
+		}
+		if msg.Path == "bulk" {
+			for i := 0; i < total; i++ {
+				if err := relay.WriteMessage([]byte(strconv.Itoa(i))); err != nil {
+					return
+				}
+			}
+			return
+		}
+		for {
+			data, err := relay.ReadMessage()
+			if err != nil {
+				return
+			}
+			relay.WriteMessage(data)
+		}
+	})
+
+	bulk, err := hub.OpenRelay(1, "bulk", "bulk", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 访客暂不读取，l2h-c 用完窗口后停止发送
+	waitFor(t, func() bool { return len(bulk.incoming) == relayWindow })
+
+	echo, err := hub.OpenRelay(1, "echo", "echo", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := echo.WriteMessage([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readRelay(t, echo); string(got) != "ping" {
+		t.Errorf("其他中继收到 %q，期望 ping", got)
+	}
+
+	for i := 0; i < total; i++ {
+		if got := readRelay(t, bulk); string(got) != strconv.Itoa(i) {
+			t.Fatalf("第 %d 条消息 = %q", i, got)
+		}
+	}
+}
+
+// readRelay 读取中继的下一条消息，超时则失败
+func readRelay(t *testing.T, relay *Relay) []byte {
+	t.Helper()
+	type result struct {
+		data []byte
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		data, err := relay.ReadMessage()
+		ch <- result{data, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r.data
+	case <-time.After(5 * time.Second):
+		t.Fatal("读取中继超时")
+		return nil
+	}
+}
@@ -0,0 +1,328 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// clockSkew 验证过期时间时允许的时钟误差
+	clockSkew = 2 * time.Minute
+	// keysRefreshInterval 遇到未知密钥 ID 时重新获取 JWKS 的最小间隔，防止被用来放大请求
+	keysRefreshInterval = time.Minute
+)
+
+// IDToken 验证通过的 ID Token
+type IDToken struct {
+	Subject string
+	Email   string
+	// EmailVerified 只有提供方声明 email_verified 为 true 时才为 true
+	EmailVerified bool
+	claims        map[string]json.RawMessage
+}
+
+// Strings 返回字符串或字符串数组类型的声明，如 groups
+func (t *IDToken) Strings(name string) []string {
+	raw, ok := t.claims[name]
+	if !ok {
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err == nil {
+		return list
+	}
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil && single != "" {
+		return []string{single}
+	}
+	return nil
+}
+
+// Name 返回便于在日志中识别用户的名称
+func (t *IDToken) Name() string {
+	if t.Email != "" {
+		return t.Email
+	}
+	return t.Subject
+}
+
+// Verify 验证 ID Token 的签名、签发方、受众、有效期和 nonce
+func (p *Provider) Verify(ctx context.Context, raw, clientID, nonce string) (*IDToken, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("ID Token 格式错误")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("解析 ID Token 头部失败: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("解析 ID Token 签名失败: %w", err)
+	}
+
+	key, err := p.key(ctx, header.Kid, header.Alg)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]json.RawMessage
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("解析 ID Token 声明失败: %w", err)
+	}
+	token := &IDToken{claims: claims}
+
+	var std struct {
+		Issuer        string          `json:"iss"`
+		Subject       string          `json:"sub"`
+		Audience      json.RawMessage `json:"aud"`
+		AuthorizedBy  string          `json:"azp"`
+		Expiry        float64         `json:"exp"`
+		IssuedAt      float64         `json:"iat"`
+		Nonce         string          `json:"nonce"`
+		Email         string          `json:"email"`
+		EmailVerified json.RawMessage `json:"email_verified"`
+	}
+	if err := decodeSegment(parts[1], &std); err != nil {
+		return nil, fmt.Errorf("解析 ID Token 声明失败: %w", err)
+	}
+
+	if strings.TrimSuffix(std.Issuer, "/") != strings.TrimSuffix(p.Issuer, "/") {
+		return nil, fmt.Errorf("ID Token 签发方不匹配: %q", std.Issuer)
+	}
+	audience := token.Strings("aud")
+	if !slices.Contains(audience, clientID) {
+		return nil, errors.New("ID Token 的受众不包含本客户端")
+	}
+	if len(audience) > 1 && std.AuthorizedBy != "" && std.AuthorizedBy != clientID {
+		return nil, errors.New("ID Token 的 azp 不是本客户端")
+	}
+	now := time.Now()
+	if std.Expiry == 0 || now.After(time.Unix(int64(std.Expiry), 0).Add(clockSkew)) {
+		return nil, errors.New("ID Token 已过期")
+	}
+	if std.IssuedAt != 0 && time.Unix(int64(std.IssuedAt), 0).After(now.Add(clockSkew)) {
+		return nil, errors.New("ID Token 的签发时间在未来")
+	}
+	if std.Nonce != nonce {
+		return nil, errors.New("ID Token 的 nonce 不匹配")
+	}
+	if std.Subject == "" {
+		return nil, errors.New("ID Token 缺少 sub")
+	}
+
+	token.Subject = std.Subject
+	token.Email = std.Email
+	// 有的提供方以字符串 "true" 表示，不视为已验证，但也不因此拒绝整个 ID Token
+	token.EmailVerified = string(std.EmailVerified) == "true"
+	return token, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// jwk JWKS 中的一个公钥
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+
+	key crypto.PublicKey
+}
+
+// key 返回签名使用的公钥，密钥 ID 未知时重新获取 JWKS 以支持提供方轮换密钥
+func (p *Provider) key(ctx context.Context, kid, alg string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if k := findKey(p.keys, kid, alg); k != nil {
+		return k, nil
+	}
+	if time.Since(p.keysFetched) < keysRefreshInterval {
+		return nil, fmt.Errorf("找不到 ID Token 的签名密钥 %q", kid)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	p.keysFetched = time.Now()
+	if err := getJSON(ctx, p.client, p.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("读取提供方公钥失败: %w", err)
+	}
+	keys := set.Keys[:0]
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		k.key = pub
+		keys = append(keys, k)
+	}
+	p.keys = keys
+
+	if k := findKey(p.keys, kid, alg); k != nil {
+		return k, nil
+	}
+	return nil, fmt.Errorf("找不到 ID Token 的签名密钥 %q", kid)
+}
+
+func findKey(keys []jwk, kid, alg string) crypto.PublicKey {
+	for _, k := range keys {
+		if kid != "" && k.Kid != kid {
+			continue
+		}
+		if k.Alg != "" && k.Alg != alg {
+			continue
+		}
+		return k.key
+	}
+	return nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() {
+			return nil, errors.New("RSA 公钥指数过大")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("不支持的曲线 %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC 公钥不在曲线上")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("不支持的曲线 %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("无效的 Ed25519 公钥")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("不支持的密钥类型 %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("无效的公钥参数")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// verifySignature 按 alg 验证签名。只接受非对称算法，拒绝 none 和 HS256 等
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+	default:
+		return fmt.Errorf("不支持的签名算法 %q", alg)
+	}
+
+	invalid := errors.New("ID Token 签名无效")
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		h := hash.New()
+		h.Write(signed)
+		var err error
+		switch alg[:2] {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(k, hash, h.Sum(nil), signature)
+		case "PS":
+			err = rsa.VerifyPSS(k, hash, h.Sum(nil), signature, nil)
+		default:
+			return invalid
+		}
+		if err != nil {
+			return invalid
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(signature) != 2*size {
+			return invalid
+		}
+		h := hash.New()
+		h.Write(signed)
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, h.Sum(nil), r, s) {
+			return invalid
+		}
+	case ed25519.PublicKey:
+		if alg != "EdDSA" || !ed25519.Verify(k, signed, signature) {
+			return invalid
+		}
+	default:
+		return invalid
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+// Package oidc 实现 OpenID Connect 授权码流程的依赖方，供 l2h-s 通过单点登录保护路径
+//
+// 通过 /.well-known/openid-configuration 发现提供方的端点，使用带 PKCE 的授权码流程
+// 换取 ID Token，再用提供方公布的 JWKS 验证其签名和声明。只依赖标准库。
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scopes 授权请求的 scope
+var Scopes = []string{"openid", "email", "profile"}
+
+// httpTimeout 访问提供方端点的超时时间
+const httpTimeout = 10 * time.Second
+
+// maxResponseSize 提供方响应的最大长度
+const maxResponseSize = 1 << 20
+
+// Provider 一个 OpenID Connect 提供方
+type Provider struct {
+	Issuer                string
+	AuthorizationEndpoint string
+	TokenEndpoint         string
+	JWKSURI               string
+
+	// postAuth 提供方只支持 client_secret_post 时在表单中提交客户端凭据
+	postAuth bool
+	client   *http.Client
+
+	mu          sync.Mutex
+	keys        []jwk
+	keysFetched time.Time
+}
+
+type discoveryDocument struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	TokenAuthMethods      []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// ValidateURL 检查提供方地址：必须使用 HTTPS，本机地址（如测试用的模拟提供方）允许使用 HTTP
+func ValidateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("无效的地址 %q: %w", raw, err)
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		host := u.Hostname()
+		if host == "localhost" {
+			return nil
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+			return nil
+		}
+		return fmt.Errorf("地址 %q 必须使用 HTTPS", raw)
+	default:
+		return fmt.Errorf("无效的地址 %q", raw)
+	}
+}
+
+// Discover 读取提供方的配置文档
+func Discover(ctx context.Context, issuer string) (*Provider, error) {
+	if err := ValidateURL(issuer); err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: httpTimeout}
+	var doc discoveryDocument
+	if err := getJSON(ctx, client, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &doc); err != nil {
+		return nil, fmt.Errorf("读取提供方配置失败: %w", err)
+	}
+
+	// 配置文档中的 issuer 必须与配置的地址一致，防止被其他提供方冒充
+	if strings.TrimSuffix(doc.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return nil, fmt.Errorf("提供方 issuer 不匹配: %q", doc.Issuer)
+	}
+	for _, endpoint := range []string{doc.AuthorizationEndpoint, doc.TokenEndpoint, doc.JWKSURI} {
+		if endpoint == "" {
+			return nil, errors.New("提供方配置缺少必要的端点")
+		}
+		if err := ValidateURL(endpoint); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Provider{
+		Issuer:                doc.Issuer,
+		AuthorizationEndpoint: doc.AuthorizationEndpoint,
+		TokenEndpoint:         doc.TokenEndpoint,
+		JWKSURI:               doc.JWKSURI,
+		postAuth: len(doc.TokenAuthMethods) > 0 &&
+			!slices.Contains(doc.TokenAuthMethods, "client_secret_basic") &&
+			slices.Contains(doc.TokenAuthMethods, "client_secret_post"),
+		client: client,
+	}, nil
+}
+
+// AuthCodeURL 返回将浏览器重定向到提供方登录页面的地址
+func (p *Provider) AuthCodeURL(clientID, redirectURI, state, nonce, challenge string) string {
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", clientID)
+	v.Set("redirect_uri", redirectURI)
+	v.Set("scope", strings.Join(Scopes, " "))
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", challenge)
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return p.AuthorizationEndpoint + sep + v.Encode()
+}
+
+// Exchange 用授权码换取 ID Token
+func (p *Provider) Exchange(ctx context.Context, clientID, clientSecret, redirectURI, code, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("code_verifier", verifier)
+	if p.postAuth {
+		form.Set("client_id", clientID)
+		form.Set("client_secret", clientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if !p.postAuth {
+		// RFC 6749 2.3.1：客户端凭据先进行表单编码
+		req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("请求令牌失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&body); err != nil {
+		return "", fmt.Errorf("解析令牌响应失败 (HTTP %d): %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || body.Error != "" {
+		return "", fmt.Errorf("提供方拒绝了授权码 (HTTP %d): %s %s", resp.StatusCode, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("令牌响应中没有 id_token")
+	}
+	return body.IDToken, nil
+}
+
+// NewPKCE 生成 PKCE 的 code_verifier 和对应的 S256 code_challenge
+func NewPKCE() (verifier, challenge string, err error) {
+	verifier, err = RandomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// RandomString 返回 n 个随机字节的 URL 安全 base64 编码，用于 state 和 nonce
+func RandomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("生成随机数失败: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s 返回 HTTP %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(v)
+}
@@ -0,0 +1,387 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID     = "l2h-client"
+	testClientSecret = "s3cret/+"
+)
+
+// mockProvider 模拟的 OpenID Connect 提供方，使用 ES256 签发 ID Token
+type mockProvider struct {
+	*httptest.Server
+	key *ecdsa.PrivateKey
+	kid string
+
+	// discovery 修改返回的配置文档，为 nil 时返回正常的文档
+	discovery func(doc map[string]any)
+	// authMethods 公布的令牌端点认证方式
+	authMethods []string
+
+	mu         sync.Mutex
+	jwksHits   int
+	tokenForms []tokenRequest
+}
+
+type tokenRequest struct {
+	form             map[string]string
+	basicID, basicPW string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockProvider{key: key, kid: "k1"}
+	m.Server = httptest.NewServer(http.HandlerFunc(m.serve))
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockProvider) serve(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		doc := map[string]any{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		}
+		if m.authMethods != nil {
+			doc["token_endpoint_auth_methods_supported"] = m.authMethods
+		}
+		if m.discovery != nil {
+			m.discovery(doc)
+		}
+		json.NewEncoder(w).Encode(doc)
+	case "/jwks":
+		m.mu.Lock()
+		m.jwksHits++
+		m.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+			{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"},
+			{"kty": "EC", "kid": "enc", "use": "enc", "crv": "P-256", "x": b64(m.key.X.Bytes()), "y": b64(m.key.Y.Bytes())},
+			{"kty": "EC", "kid": m.kid, "use": "sig", "alg": "ES256", "crv": "P-256", "x": b64(m.key.X.FillBytes(make([]byte, 32))), "y": b64(m.key.Y.FillBytes(make([]byte, 32)))},
+		}})
+	case "/token":
+		r.ParseForm()
+		req := tokenRequest{form: make(map[string]string)}
+		for k := range r.PostForm {
+			req.form[k] = r.PostForm.Get(k)
+		}
+		req.basicID, req.basicPW, _ = r.BasicAuth()
+		m.mu.Lock()
+		m.tokenForms = append(m.tokenForms, req)
+		m.mu.Unlock()
+		if req.form["code"] != "good-code" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "bad code"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": m.sign(m.claims("n1"))})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// claims 返回一组有效的声明
+func (m *mockProvider) claims(nonce string) map[string]any {
+	now := time.Now().Unix()
+	return map[string]any{
+		"iss":            m.URL,
+		"sub":            "user-1",
+		"aud":            testClientID,
+		"exp":            now + 300,
+		"iat":            now,
+		"nonce":          nonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+	}
+}
+
+// sign 使用提供方的密钥签发 ID Token
+func (m *mockProvider) sign(claims map[string]any) string {
+	return m.signWith(map[string]any{"alg": "ES256", "kid": m.kid}, claims, m.key)
+}
+
+func (m *mockProvider) signWith(header, claims map[string]any, key *ecdsa.PrivateKey) string {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := b64(h) + "." + b64(c)
+	sum := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+	if err != nil {
+		panic(err)
+	}
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return signed + "." + b64(sig)
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestDiscover(t *testing.T) {
+	tests := []struct {
+		name      string
+		discovery func(doc map[string]any)
+		methods   []string
+		wantErr   string
+		postAuth  bool
+	}{
+		{name: "有效"},
+		{name: "只支持 client_secret_post", methods: []string{"client_secret_post"}, postAuth: true},
+		{name: "同时支持两种认证方式", methods: []string{"client_secret_post", "client_secret_basic"}},
+		{name: "issuer 不匹配", discovery: func(doc map[string]any) { doc["issuer"] = "https://evil.example" }, wantErr: "issuer 不匹配"},
+		{name: "缺少端点", discovery: func(doc map[string]any) { delete(doc, "jwks_uri") }, wantErr: "缺少必要的端点"},
+		{name: "端点未使用 HTTPS", discovery: func(doc map[string]any) { doc["token_endpoint"] = "http://idp.example/token" }, wantErr: "必须使用 HTTPS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockProvider(t)
+			m.discovery = tt.discovery
+			m.authMethods = tt.methods
+			p, err := Discover(context.Background(), m.URL+"/")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Discover() 错误 = %v，期望包含 %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.TokenEndpoint != m.URL+"/token" || p.JWKSURI != m.URL+"/jwks" || p.postAuth != tt.postAuth {
+				t.Errorf("Discover() = %+v", p)
+			}
+		})
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://idp.example", true},
+		{"http://127.0.0.1:8080", true},
+		{"http://[::1]:8080", true},
+		{"http://localhost", true},
+		{"http://idp.example", false},
+		{"ftp://idp.example", false},
+		{"idp.example", false},
+	}
+	for _, tt := range tests {
+		if err := ValidateURL(tt.url); (err == nil) != tt.ok {
+			t.Errorf("ValidateURL(%q) = %v", tt.url, err)
+		}
+	}
+}
+
+func TestAuthCodeURLAndPKCE(t *testing.T) {
+	verifier, challenge, err := NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	if challenge != b64(sum[:]) {
+		t.Errorf("code_challenge 不是 code_verifier 的 S256")
+	}
+	if len(verifier) < 43 {
+		t.Errorf("code_verifier 过短: %d", len(verifier))
+	}
+
+	p := &Provider{AuthorizationEndpoint: "https://idp.example/authorize?tenant=a"}
+	u := p.AuthCodeURL(testClientID, "https://l2h.example/api/sso/callback", "st", "no", challenge)
+	want := map[string]string{
+		"tenant":                "a",
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"redirect_uri":          "https://l2h.example/api/sso/callback",
+		"scope":                 "openid email profile",
+		"state":                 "st",
+		"nonce":                 "no",
+		"code_challenge":        challenge,
+		"code_challenge_method": "S256",
+	}
+	req := httptest.NewRequest(http.MethodGet, u, nil)
+	for k, v := range want {
+		if got := req.URL.Query().Get(k); got != v {
+			t.Errorf("%s = %q，期望 %q", k, got, v)
+		}
+	}
+}
+
+func TestExchange(t *testing.T) {
+	tests := []struct {
+		name     string
+		methods  []string
+		code     string
+		wantErr  string
+		wantPost bool
+	}{
+		{name: "client_secret_basic", code: "good-code"},
+		{name: "client_secret_post", methods: []string{"client_secret_post"}, code: "good-code", wantPost: true},
+		{name: "授权码无效", code: "bad-code", wantErr: "invalid_grant"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockProvider(t)
+			m.authMethods = tt.methods
+			p, err := Discover(context.Background(), m.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, err := p.Exchange(context.Background(), testClientID, testClientSecret, "https://l2h.example/cb", tt.code, "verifier")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Exchange() 错误 = %v，期望包含 %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || token == "" {
+				t.Fatalf("Exchange() = %q, %v", token, err)
+			}
+
+			req := m.tokenForms[0]
+			if req.form["code_verifier"] != "verifier" || req.form["redirect_uri"] != "https://l2h.example/cb" || req.form["grant_type"] != "authorization_code" {
+				t.Errorf("令牌请求 = %v", req.form)
+			}
+			if tt.wantPost {
+				if req.form["client_id"] != testClientID || req.form["client_secret"] != testClientSecret || req.basicID != "" {
+					t.Errorf("client_secret_post 凭据 = %v / %q", req.form, req.basicID)
+				}
+			} else if req.basicID != testClientID || req.basicPW != "s3cret%2F%2B" || req.form["client_secret"] != "" {
+				t.Errorf("client_secret_basic 凭据 = %q:%q", req.basicID, req.basicPW)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	m := newMockProvider(t)
+	p, err := Discover(context.Background(), m.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	with := func(change func(c map[string]any)) string {
+		c := m.claims("n1")
+		change(c)
+		return m.sign(c)
+	}
+	valid := m.sign(m.claims("n1"))
+	parts := strings.Split(valid, ".")
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name     string
+		token    string
+		nonce    string
+		wantErr  string
+		verified bool
+	}{
+		{name: "有效", token: valid, nonce: "n1", verified: true},
+		{name: "未声明 email_verified", token: with(func(c map[string]any) { delete(c, "email_verified") }), nonce: "n1"},
+		{name: "email_verified 为字符串", token: with(func(c map[string]any) { c["email_verified"] = "true" }), nonce: "n1"},
+		{name: "email_verified 为 false", token: with(func(c map[string]any) { c["email_verified"] = false }), nonce: "n1"},
+		{name: "受众为数组", token: with(func(c map[string]any) { c["aud"] = []string{"other", testClientID}; c["azp"] = testClientID }), nonce: "n1", verified: true},
+		{name: "nonce 不匹配", token: valid, nonce: "n2", wantErr: "nonce 不匹配"},
+		{name: "签发方不匹配", token: with(func(c map[string]any) { c["iss"] = "https://evil.example" }), nonce: "n1", wantErr: "签发方不匹配"},
+		{name: "受众不匹配", token: with(func(c map[string]any) { c["aud"] = "other" }), nonce: "n1", wantErr: "受众不包含本客户端"},
+		{name: "azp 不是本客户端", token: with(func(c map[string]any) { c["aud"] = []string{"other", testClientID}; c["azp"] = "other" }), nonce: "n1", wantErr: "azp"},
+		{name: "已过期", token: with(func(c map[string]any) { c["exp"] = now - int64(clockSkew.Seconds()) - 60 }), nonce: "n1", wantErr: "已过期"},
+		{name: "在允许的时钟误差内", token: with(func(c map[string]any) { c["exp"] = now - 30 }), nonce: "n1", verified: true},
+		{name: "缺少 exp", token: with(func(c map[string]any) { delete(c, "exp") }), nonce: "n1", wantErr: "已过期"},
+		{name: "签发时间在未来", token: with(func(c map[string]any) { c["iat"] = now + 3600 }), nonce: "n1", wantErr: "签发时间在未来"},
+		{name: "缺少 sub", token: with(func(c map[string]any) { delete(c, "sub") }), nonce: "n1", wantErr: "缺少 sub"},
+		{name: "篡改声明", token: parts[0] + "." + b64([]byte(`{"iss":"`+m.URL+`","sub":"admin","aud":"`+testClientID+`","exp":9999999999,"nonce":"n1"}`)) + "." + parts[2], nonce: "n1", wantErr: "签名无效"},
+		{name: "其他密钥签名", token: m.signWith(map[string]any{"alg": "ES256", "kid": m.kid}, m.claims("n1"), other), nonce: "n1", wantErr: "签名无效"},
+		{name: "alg 为 none", token: b64([]byte(`{"alg":"none","kid":"k1"}`)) + "." + parts[1] + ".", nonce: "n1", wantErr: "签名密钥"},
+		{name: "HS256", token: b64([]byte(`{"alg":"HS256","kid":"hmac"}`)) + "." + parts[1] + "." + parts[2], nonce: "n1", wantErr: "签名密钥"},
+		{name: "用途为加密的密钥", token: m.signWith(map[string]any{"alg": "ES256", "kid": "enc"}, m.claims("n1"), m.key), nonce: "n1", wantErr: "签名密钥"},
+		{name: "格式错误", token: "a.b", nonce: "n1", wantErr: "格式错误"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tok, err := p.Verify(context.Background(), tt.token, testClientID, tt.nonce)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Verify() 错误 = %v，期望包含 %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tok.Subject != "user-1" || tok.Email != "alice@example.com" || tok.EmailVerified != tt.verified {
+				t.Errorf("Verify() = %+v", tok)
+			}
+		})
+	}
+
+	// 未知的密钥 ID 在 keysRefreshInterval 内不会重复请求 JWKS
+	m.mu.Lock()
+	hits := m.jwksHits
+	m.mu.Unlock()
+	if hits != 1 {
+		t.Errorf("JWKS 请求了 %d 次，期望 1 次", hits)
+	}
+}
+
+func TestVerifyRSA(t *testing.T) {
+	// RSA 密钥生成较慢，只在这里使用一次
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "r1", "n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	defer srv.Close()
+
+	p := &Provider{Issuer: "https://idp.example", JWKSURI: srv.URL, client: srv.Client()}
+	claims, _ := json.Marshal(map[string]any{"iss": "https://idp.example", "sub": "u", "aud": testClientID, "exp": time.Now().Unix() + 60, "nonce": "n"})
+	for _, alg := range []string{"RS256", "PS256"} {
+		header, _ := json.Marshal(map[string]string{"alg": alg, "kid": "r1"})
+		signed := b64(header) + "." + b64(claims)
+		sum := sha256.Sum256([]byte(signed))
+		var sig []byte
+		if alg == "RS256" {
+			sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		} else {
+			sig, err = rsa.SignPSS(rand.Reader, key, crypto.SHA256, sum[:], nil)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.Verify(context.Background(), signed+"."+b64(sig), testClientID, "n"); err != nil {
+			t.Errorf("%s: %v", alg, err)
+		}
+	}
+}
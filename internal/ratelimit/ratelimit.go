@@ -0,0 +1,249 @@
+// Package ratelimit 防止对路径密码和管理员登录的暴力破解
+//
+// 失败次数同时按来源 IP 和按目标（某个路径或管理员登录）统计。超过免费次数后，
+// 每次失败都要等待指数增长的时间才能再次尝试；达到锁定次数后锁定一段时间。
+// 检查在验证密码之前进行，被限制的请求不会触发开销很大的 Argon2id 计算。
+package ratelimit
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"l2h/internal/utils"
+)
+
+// Policy 限制策略
+type Policy struct {
+	// Free 不受限制的失败次数
+	Free int
+	// Lockout 达到该失败次数后锁定
+	Lockout int
+	// Base 超过免费次数后第一次退避的时长，之后每次失败翻倍
+	Base time.Duration
+	// LockoutDuration 锁定时长
+	LockoutDuration time.Duration
+}
+
+var (
+	// IPPolicy 单个来源 IP 的限制
+	IPPolicy = Policy{Free: 5, Lockout: 10, Base: time.Second, LockoutDuration: 15 * time.Minute}
+	// TargetPolicy 单个目标的限制，宽于 IP 限制，避免单个攻击者轻易锁住所有访客
+	TargetPolicy = Policy{Free: 20, Lockout: 50, Base: time.Second, LockoutDuration: 15 * time.Minute}
+)
+
+const (
+	// forgetAfter 超过该时间没有失败的记录被清除
+	forgetAfter = time.Hour
+	// maxEvents 保留的锁定事件数量
+	maxEvents = 100
+)
+
+// Event 一次锁定事件
+type Event struct {
+	// Scope 被锁定的维度：ip 或 target
+	Scope    string    `json:"scope"`
+	IP       string    `json:"ip"`
+	Target   string    `json:"target"`
+	Failures int       `json:"failures"`
+	LockedAt time.Time `json:"locked_at"`
+	Until    time.Time `json:"until"`
+	Active   bool      `json:"active"`
+}
+
+type entry struct {
+	failures int
+	// pending 已通过 Check 但还没有结果的尝试
+	pending int
+	until   time.Time
+	last    time.Time
+}
+
+// Guard 按来源 IP 和目标统计失败次数
+type Guard struct {
+	mu        sync.Mutex
+	entries   map[string]*entry
+	events    []Event
+	lastSweep time.Time
+}
+
+// NewGuard 创建 Guard
+func NewGuard() *Guard {
+	return &Guard{entries: make(map[string]*entry)}
+}
+
+// Check 返回来自 ip 对 target 的尝试还需等待的时间，0 表示允许尝试。
+// 允许时预留一次尝试，调用方必须以 Fail、Succeed 或 Release 结束该尝试。
+// 进行中的尝试按失败计入限制，并发的请求不能在失败记录之前绕过退避和锁定
+func (g *Guard) Check(ip, target string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	for _, k := range g.keys(ip, target) {
+		if d := g.wait(k.key, k.policy, now); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+	for _, k := range g.keys(ip, target) {
+		e := g.entry(k.key)
+		e.pending++
+		e.last = now
+	}
+	return 0
+}
+
+// Fail 记录一次失败，结束 Check 预留的尝试
+func (g *Guard) Fail(ip, target string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	g.sweep(now)
+	g.release(ip, target)
+	g.fail("ip", "ip:"+ip, ip, target, IPPolicy, now)
+	g.fail("target", "target:"+target, ip, target, TargetPolicy, now)
+}
+
+// Release 结束 Check 预留但没有得出结果的尝试（如内部错误），不记录失败
+func (g *Guard) Release(ip, target string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.release(ip, target)
+}
+
+type guardKey struct {
+	key    string
+	policy Policy
+}
+
+func (g *Guard) keys(ip, target string) []guardKey {
+	return []guardKey{{"ip:" + ip, IPPolicy}, {"target:" + target, TargetPolicy}}
+}
+
+func (g *Guard) entry(key string) *entry {
+	e, ok := g.entries[key]
+	if !ok {
+		e = &entry{}
+		g.entries[key] = e
+	}
+	return e
+}
+
+// wait 返回 key 还需等待的时间。进行中的尝试若全部失败会触发退避时，
+// 新的尝试要等待它们结束
+func (g *Guard) wait(key string, p Policy, now time.Time) time.Duration {
+	e, ok := g.entries[key]
+	if !ok {
+		return 0
+	}
+	if e.until.After(now) {
+		return e.until.Sub(now)
+	}
+	if n := e.failures + e.pending; e.pending > 0 && n > p.Free {
+		return backoff(p, n)
+	}
+	return 0
+}
+
+func (g *Guard) release(ip, target string) {
+	for _, k := range g.keys(ip, target) {
+		if e, ok := g.entries[k.key]; ok && e.pending > 0 {
+			e.pending--
+		}
+	}
+}
+
+// backoff 返回失败 failures 次后的等待时间，failures 须大于免费次数
+func backoff(p Policy, failures int) time.Duration {
+	if failures >= p.Lockout {
+		return p.LockoutDuration
+	}
+	wait := p.Base << (failures - p.Free - 1)
+	if wait <= 0 || wait > p.LockoutDuration {
+		wait = p.LockoutDuration
+	}
+	return wait
+}
+
+func (g *Guard) fail(scope, key, ip, target string, p Policy, now time.Time) {
+	e := g.entry(key)
+	e.failures++
+	e.last = now
+
+	switch {
+	case e.failures >= p.Lockout:
+		e.until = now.Add(p.LockoutDuration)
+		g.record(Event{Scope: scope, IP: ip, Target: target, Failures: e.failures, LockedAt: now, Until: e.until})
+		if scope == "ip" {
+			log.Printf("来源 %s 登录失败 %d 次，锁定 %v（最近目标 %s）", ip, e.failures, p.LockoutDuration, target)
+		} else {
+			log.Printf("%s 登录失败 %d 次，锁定 %v（最近来源 %s）", target, e.failures, p.LockoutDuration, ip)
+		}
+		// 锁定结束后从退避阶段继续计数
+		e.failures = p.Free
+	case e.failures > p.Free:
+		e.until = now.Add(backoff(p, e.failures))
+	}
+}
+
+// Succeed 记录一次成功，结束 Check 预留的尝试并清除来源 IP 的失败次数。
+// 目标的失败次数不清除，否则攻击者可以借助正常访客的登录重新获得尝试机会
+func (g *Guard) Succeed(ip, target string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.release(ip, target)
+	if e, ok := g.entries["ip:"+ip]; ok {
+		e.failures = 0
+		e.until = time.Time{}
+	}
+}
+
+// Events 返回最近的锁定事件，最新的在前
+func (g *Guard) Events() []Event {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	events := make([]Event, 0, len(g.events))
+	for i := len(g.events) - 1; i >= 0; i-- {
+		ev := g.events[i]
+		ev.Active = ev.Until.After(now)
+		events = append(events, ev)
+	}
+	return events
+}
+
+func (g *Guard) record(ev Event) {
+	g.events = append(g.events, ev)
+	if len(g.events) > maxEvents {
+		g.events = g.events[len(g.events)-maxEvents:]
+	}
+}
+
+// sweep 清除长时间没有失败且未被锁定的记录
+func (g *Guard) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < time.Minute {
+		return
+	}
+	g.lastSweep = now
+	for key, e := range g.entries {
+		if e.pending == 0 && now.Sub(e.last) > forgetAfter && now.After(e.until) {
+			delete(g.entries, key)
+		}
+	}
+}
+
+// WriteTooMany 返回 429 响应，告知客户端需要等待的时间
+func WriteTooMany(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(wait.Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	utils.WriteError(w, http.StatusTooManyRequests, fmt.Sprintf("尝试次数过多，请 %d 秒后再试", seconds))
+}
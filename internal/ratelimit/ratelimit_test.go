@@ -0,0 +1,184 @@
+package ratelimit
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// attempt 一次失败或成功的登录，n 为重复次数
+type attempt struct {
+	ip, target string
+	n          int
+	succeed    bool
+}
+
+// sources n 个不同来源对 target 各失败一次
+func sources(target string, n int) []attempt {
+	var out []attempt
+	for i := 0; i < n; i++ {
+		out = append(out, attempt{ip: fmt.Sprintf("10.0.0.%d", i), target: target, n: 1})
+	}
+	return out
+}
+
+func TestGuard(t *testing.T) {
+	const admin = "admin"
+	tests := []struct {
+		name     string
+		attempts []attempt
+		ip       string
+		target   string
+		min, max time.Duration
+	}{
+		{
+			name:     "免费次数内不受限",
+			attempts: []attempt{{ip: "1.1.1.1", target: admin, n: IPPolicy.Free}},
+			ip:       "1.1.1.1", target: admin,
+		},
+		{
+			name:     "超过免费次数后退避",
+			attempts: []attempt{{ip: "1.1.1.1", target: admin, n: IPPolicy.Free + 1}},
+			ip:       "1.1.1.1", target: admin,
+			min: 0, max: IPPolicy.Base,
+		},
+		{
+			name:     "退避时间翻倍",
+			attempts: []attempt{{ip: "1.1.1.1", target: admin, n: IPPolicy.Free + 3}},
+			ip:       "1.1.1.1", target: admin,
+			min: 3 * IPPolicy.Base, max: 4 * IPPolicy.Base,
+		},
+		{
+			name:     "达到锁定次数",
+			attempts: []attempt{{ip: "1.1.1.1", target: admin, n: IPPolicy.Lockout}},
+			ip:       "1.1.1.1", target: admin,
+			min: IPPolicy.LockoutDuration - time.Minute, max: IPPolicy.LockoutDuration,
+		},
+		{
+			name:     "其他来源不受影响",
+			attempts: []attempt{{ip: "1.1.1.1", target: admin, n: IPPolicy.Lockout}},
+			ip:       "2.2.2.2", target: admin,
+		},
+		{
+			name:     "多个来源尝试同一目标",
+			attempts: sources(admin, TargetPolicy.Free+1),
+			ip:       "2.2.2.2", target: admin,
+			min: 0, max: TargetPolicy.Base,
+		},
+		{
+			name: "成功清除该来源的退避",
+			attempts: []attempt{
+				{ip: "1.1.1.1", target: "path:a", n: IPPolicy.Free + 1},
+				{ip: "1.1.1.1", target: "path:a", succeed: true},
+			},
+			ip: "1.1.1.1", target: "path:a",
+		},
+		{
+			name: "成功不清除目标的失败次数",
+			attempts: append(sources(admin, TargetPolicy.Free+1),
+				attempt{ip: "10.0.0.1", target: admin, succeed: true}),
+			ip: "2.2.2.2", target: admin,
+			min: 0, max: TargetPolicy.Base,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGuard()
+			for _, a := range tt.attempts {
+				if a.succeed {
+					g.Succeed(a.ip, a.target)
+					continue
+				}
+				for i := 0; i < a.n; i++ {
+					g.Fail(a.ip, a.target)
+				}
+			}
+			wait := g.Check(tt.ip, tt.target)
+			if tt.max == 0 {
+				if wait != 0 {
+					t.Errorf("Check() = %v，期望允许尝试", wait)
+				}
+				return
+			}
+			if wait <= tt.min || wait > tt.max {
+				t.Errorf("Check() = %v，期望在 (%v, %v] 之间", wait, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestGuardEvents(t *testing.T) {
+	g := NewGuard()
+	for i := 0; i < IPPolicy.Lockout; i++ {
+		g.Fail("1.1.1.1", "admin")
+	}
+	events := g.Events()
+	if len(events) != 1 {
+		t.Fatalf("锁定事件 %d 个，期望 1 个", len(events))
+	}
+	ev := events[0]
+	if ev.Scope != "ip" || ev.IP != "1.1.1.1" || ev.Target != "admin" || ev.Failures != IPPolicy.Lockout || !ev.Active {
+		t.Errorf("锁定事件 = %+v", ev)
+	}
+
+	// 锁定后从退避阶段继续计数，再次达到锁定次数时重新锁定
+	for i := 0; i < IPPolicy.Lockout-IPPolicy.Free; i++ {
+		g.Fail("1.1.1.1", "admin")
+	}
+	if n := len(g.Events()); n != 2 {
+		t.Errorf("锁定事件 %d 个，期望 2 个", n)
+	}
+}
+
+func TestGuardConcurrent(t *testing.T) {
+	tests := []struct {
+		name    string
+		ip      func(i int) string
+		allowed int
+	}{
+		{name: "同一来源", ip: func(int) string { return "1.1.1.1" }, allowed: IPPolicy.Free + 1},
+		{name: "多个来源", ip: func(i int) string { return fmt.Sprintf("10.0.%d.%d", i/256, i%256) }, allowed: TargetPolicy.Free + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGuard()
+			const n = 200
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			var allowed []string
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(ip string) {
+					defer wg.Done()
+					if g.Check(ip, "admin") == 0 {
+						mu.Lock()
+						allowed = append(allowed, ip)
+						mu.Unlock()
+					}
+				}(tt.ip(i))
+			}
+			wg.Wait()
+			// 所有尝试在 Check 之后才失败，进行中的尝试也要计入限制
+			if len(allowed) != tt.allowed {
+				t.Errorf("并发允许 %d 次尝试，期望 %d 次", len(allowed), tt.allowed)
+			}
+			for _, ip := range allowed {
+				g.Fail(ip, "admin")
+			}
+			if wait := g.Check(tt.ip(n), "admin"); wait == 0 {
+				t.Error("失败记录之后仍允许尝试")
+			}
+		})
+	}
+}
+
+func TestGuardRelease(t *testing.T) {
+	g := NewGuard()
+	for i := 0; i < IPPolicy.Lockout; i++ {
+		if wait := g.Check("1.1.1.1", "admin"); wait != 0 {
+			t.Fatalf("第 %d 次 Check() = %v，释放的尝试不应计入失败", i+1, wait)
+		}
+		g.Release("1.1.1.1", "admin")
+	}
+}
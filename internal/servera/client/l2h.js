@@ -0,0 +1,565 @@
+// l2h 引导页脚本
+// 建立到服务器B的 WebRTC 数据通道（无法直连时改用服务器A的 WebSocket 中继），
+// 注册 Service Worker，并把 Service Worker 拦截到的请求按 tunnel 帧协议
+// （见 internal/tunnel）在通道上转发。
+//
+// 服务器A公布了路径所在节点的公钥时，引导页验证服务器B对 DTLS 证书指纹的签名，
+// 中继则先与服务器B完成加密握手，服务器A只转发信令和密文，无法解密或篡改访客的流量。
+(function () {
+    'use strict';
+
+    const FRAME_REQUEST = 1;
+    const FRAME_RESPONSE = 2;
+    const FRAME_DATA = 3;
+    const FRAME_END = 4;
+    const FRAME_ABORT = 5;
+
+    const HEADER_SIZE = 5;
+    const MAX_CHUNK = 16 * 1024 - HEADER_SIZE;
+    const MAX_BUFFERED = 1 << 20;
+    const GATHER_TIMEOUT = 2000;
+    const RECONNECT_DELAY = 3000;
+    const BUFFER_POLL = 20;
+    // KEY_PARAM 链接中携带节点公钥指纹的参数，如 /app/#l2h-key=SHA256:...
+    const KEY_PARAM = 'l2h-key=';
+    const KEY_STORAGE = 'l2h-key:';
+
+    const config = window.L2H;
+    const encoder = new TextEncoder();
+    const decoder = new TextDecoder();
+    const statusEl = document.getElementById('l2h-status');
+
+    let channel = null;
+    // nodeKey 用于验证服务器B签名的节点公钥，服务器A没有公布公钥时为 null
+    let nodeKey = null;
+    let appOpened = false;
+    let waiters = [];
+    let nextStream = 1;
+    const streams = new Map();
+
+    function setStatus(text, isError) {
+        statusEl.textContent = text;
+        statusEl.className = isError ? 'error' : '';
+        statusEl.hidden = !text;
+    }
+
+    function encodeFrame(type, id, payload) {
+        const body = payload ? new Uint8Array(payload) : new Uint8Array(0);
+        const buf = new Uint8Array(HEADER_SIZE + body.length);
+        buf[0] = type;
+        new DataView(buf.buffer).setUint32(1, id);
+        buf.set(body, HEADER_SIZE);
+        return buf.buffer;
+    }
+
+    function send(type, id, payload) {
+        if (channel) {
+            channel.send(encodeFrame(type, id, payload));
+        }
+    }
+
+    // waitChannel 等待数据通道可用
+    function waitChannel() {
+        if (channel) {
+            return Promise.resolve(channel);
+        }
+        return new Promise((resolve) => waiters.push(resolve));
+    }
+
+    // waitBuffered 发送缓冲过大时等待对端消费
+    // WebSocket 没有 bufferedamountlow 事件，因此统一轮询缓冲量
+    function waitBuffered() {
+        if (!channel || channel.bufferedAmount <= MAX_BUFFERED) {
+            return Promise.resolve();
+        }
+        return new Promise((resolve) => {
+            const timer = setInterval(() => {
+                if (!channel || channel.bufferedAmount <= MAX_BUFFERED / 4) {
+                    clearInterval(timer);
+                    resolve();
+                }
+            }, BUFFER_POLL);
+        });
+    }
+
+    function postJSON(url, data) {
+        return fetch(url, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(data)
+        }).then(async (res) => {
+            const body = await res.json().catch(() => ({}));
+            if (!res.ok) {
+                throw new Error(body.error || res.statusText);
+            }
+            return body;
+        });
+    }
+
+    function gatheringComplete(pc) {
+        if (pc.iceGatheringState === 'complete') {
+            return Promise.resolve();
+        }
+        return new Promise((resolve) => {
+            const timer = setTimeout(resolve, GATHER_TIMEOUT);
+            pc.addEventListener('icegatheringstatechange', () => {
+                if (pc.iceGatheringState === 'complete') {
+                    clearTimeout(timer);
+                    resolve();
+                }
+            });
+        });
+    }
+
+    function concatBytes(...parts) {
+        const out = new Uint8Array(parts.reduce((n, p) => n + p.length, 0));
+        let off = 0;
+        for (const p of parts) {
+            out.set(p, off);
+            off += p.length;
+        }
+        return out;
+    }
+
+    function base64Bytes(text) {
+        return Uint8Array.from(atob(text), (c) => c.charCodeAt(0));
+    }
+
+    // keyFingerprint 计算公钥指纹，格式与服务器B显示的相同
+    async function keyFingerprint(raw) {
+        const sum = new Uint8Array(await crypto.subtle.digest('SHA-256', raw));
+        return 'SHA256:' + btoa(String.fromCharCode(...sum)).replace(/=+$/, '');
+    }
+
+    // takeHashKey 读取并移除链接中的节点公钥指纹，避免传给应用
+    function takeHashKey() {
+        if (!location.hash.startsWith('#' + KEY_PARAM)) {
+            return '';
+        }
+        const fp = decodeURIComponent(location.hash.slice(1 + KEY_PARAM.length)).trim();
+        history.replaceState(null, '', location.pathname + location.search);
+        return fp.startsWith('SHA256:') ? fp : 'SHA256:' + fp;
+    }
+
+    // loadNodeKey 确认服务器A公布的节点公钥可信：与链接中的指纹一致，
+    // 或与此前在本浏览器中记录的一致（首次访问时记录）
+    async function loadNodeKey() {
+        const expected = takeHashKey();
+        const pinned = localStorage.getItem(KEY_STORAGE + config.path);
+        if (!config.nodeKey) {
+            if (expected || pinned) {
+                throw new Error('服务器A没有公布节点公钥，无法确认连接的是服务器B');
+            }
+            return null;
+        }
+
+        const raw = base64Bytes(config.nodeKey);
+        const fp = await keyFingerprint(raw);
+        if (fp !== config.nodeFingerprint) {
+            throw new Error('节点公钥与指纹不符');
+        }
+        if (expected && fp !== expected) {
+            throw new Error('节点公钥指纹 ' + fp + ' 与链接中的 ' + expected + ' 不一致，连接可能被篡改');
+        }
+        if (!expected && pinned && fp !== pinned &&
+            !confirm('此路径的节点公钥已变更：\n' + pinned + '\n→ ' + fp +
+                '\n\n如果不确定服务器B重新生成了密钥，请取消并联系网站管理员。是否信任新的公钥？')) {
+            throw new Error('节点公钥已变更，已取消连接');
+        }
+        localStorage.setItem(KEY_STORAGE + config.path, fp);
+        return crypto.subtle.importKey('raw', raw, { name: 'ECDSA', namedCurve: 'P-256' }, false, ['verify']);
+    }
+
+    function verifyNode(signature, data) {
+        return crypto.subtle.verify({ name: 'ECDSA', hash: 'SHA-256' }, nodeKey, signature, data);
+    }
+
+    // sdpFingerprint 返回 SDP 中的 DTLS 证书指纹，与 internal/crypto.SDPFingerprint 相同：
+    // 没有指纹、格式错误或有多个不同的指纹时返回空，签名只覆盖一个指纹时不能有其他证书
+    function sdpFingerprint(sdp) {
+        let found = '';
+        for (const line of sdp.split('\n')) {
+            const value = line.trim();
+            if (!value.startsWith('a=fingerprint:')) {
+                continue;
+            }
+            const fields = value.slice('a=fingerprint:'.length).trim().split(/\s+/);
+            if (fields.length !== 2) {
+                return '';
+            }
+            const fp = fields[0].toLowerCase() + ' ' + fields[1].toUpperCase();
+            if (found && fp !== found) {
+                return '';
+            }
+            found = fp;
+        }
+        return found;
+    }
+
+    // verifyAnswer 验证服务器B对双方 DTLS 证书指纹的签名，服务器A替换任一方的证书都无法通过
+    async function verifyAnswer(offer, answer, signature) {
+        const offerFP = sdpFingerprint(offer);
+        const answerFP = sdpFingerprint(answer);
+        const ok = signature && offerFP && answerFP && await verifyNode(base64Bytes(signature),
+            encoder.encode('l2h-dtls-v1\n' + config.path + '\n' + offerFP + '\n' + answerFP));
+        if (!ok) {
+            throw new Error('无法验证服务器B的身份，连接可能被篡改');
+        }
+    }
+
+    // connect 建立到服务器B的通道：优先使用 WebRTC 点对点连接，
+    // 超时或失败时改用经由服务器A转发的 WebSocket 中继，两者承载相同的帧协议
+    async function connect() {
+        setStatus('正在建立连接...');
+
+        let connID = null;
+        let transport;
+        try {
+            transport = await connectPeer((id) => { connID = id; });
+        } catch (err) {
+            // 信令本身失败（如服务器B不在线）时中继同样不可用
+            if (!connID) {
+                throw err;
+            }
+            setStatus('点对点连接失败，正在切换到中继...');
+            transport = await connectRelay(connID);
+        }
+
+        const ch = transport.channel;
+        ch.onmessage = (e) => handleFrame(e.data);
+        ch.onclose = () => {
+            channel = null;
+            for (const st of streams.values()) {
+                st.port.postMessage({ type: 'error', message: '连接已断开' });
+            }
+            streams.clear();
+            transport.close();
+            setStatus('连接已断开，正在重连...', true);
+            setTimeout(reconnect, RECONNECT_DELAY);
+        };
+
+        channel = ch;
+        waiters.forEach((resolve) => resolve(ch));
+        waiters = [];
+        setStatus('');
+
+        if (!appOpened) {
+            openApp();
+        }
+    }
+
+    // connectPeer 建立 WebRTC 数据通道，onID 在信令完成、获得连接ID后调用
+    async function connectPeer(onID) {
+        const pc = new RTCPeerConnection({
+            iceServers: config.iceServers.length ? [{ urls: config.iceServers }] : []
+        });
+        const dc = pc.createDataChannel('l2h');
+        dc.binaryType = 'arraybuffer';
+
+        // offer 发出之后才收集到的候选通过信令接口补发
+        let offerSent = false;
+        let connID = null;
+        const lateCandidates = [];
+        pc.onicecandidate = (e) => {
+            if (!e.candidate || !offerSent) {
+                return;
+            }
+            if (connID) {
+                postJSON('/api/webrtc/candidate', { id: connID, candidate: JSON.stringify(e.candidate) }).catch(() => {});
+            } else {
+                lateCandidates.push(e.candidate);
+            }
+        };
+
+        try {
+            await pc.setLocalDescription(await pc.createOffer());
+            await gatheringComplete(pc);
+
+            const offer = pc.localDescription.sdp;
+            offerSent = true;
+            const res = await postJSON('/api/webrtc/offer', { path: config.path, offer: offer });
+            if (nodeKey) {
+                await verifyAnswer(offer, res.answer, res.signature);
+            }
+            connID = res.id;
+            onID(connID);
+            await pc.setRemoteDescription({ type: 'answer', sdp: res.answer });
+            for (const candidate of lateCandidates) {
+                postJSON('/api/webrtc/candidate', { id: connID, candidate: JSON.stringify(candidate) }).catch(() => {});
+            }
+
+            await new Promise((resolve, reject) => {
+                const timer = setTimeout(() => reject(new Error('点对点连接超时')), config.relayTimeout);
+                dc.onopen = () => {
+                    clearTimeout(timer);
+                    resolve();
+                };
+                pc.onconnectionstatechange = () => {
+                    if (pc.connectionState === 'failed') {
+                        clearTimeout(timer);
+                        reject(new Error('无法建立点对点连接'));
+                    }
+                };
+            });
+        } catch (err) {
+            pc.close();
+            throw err;
+        }
+
+        return { channel: dc, close: () => pc.close() };
+    }
+
+    // connectRelay 通过服务器A的 WebSocket 中继连接服务器B，prevID 为放弃的点对点连接
+    async function connectRelay(prevID) {
+        const scheme = location.protocol === 'https:' ? 'wss:' : 'ws:';
+        const url = scheme + '//' + location.host + '/api/relay?path=' +
+            encodeURIComponent(config.path) + '&id=' + encodeURIComponent(prevID) + (nodeKey ? '&secure=1' : '');
+        const ws = new WebSocket(url);
+        ws.binaryType = 'arraybuffer';
+
+        await new Promise((resolve, reject) => {
+            ws.onopen = () => {
+                ws.onerror = null;
+                resolve();
+            };
+            ws.onerror = () => reject(new Error('无法建立中继连接'));
+        });
+        if (!nodeKey) {
+            return { channel: ws, close: () => ws.close() };
+        }
+        try {
+            return { channel: await secureRelay(ws), close: () => ws.close() };
+        } catch (err) {
+            ws.close();
+            throw err;
+        }
+    }
+
+    function seqNonce(seq) {
+        const iv = new Uint8Array(12);
+        new DataView(iv.buffer).setBigUint64(4, BigInt(seq));
+        return iv;
+    }
+
+    // secureRelay 在中继上与服务器B完成加密握手（见 internal/tunnel/secure.go），
+    // 返回与数据通道接口相同的加密通道，服务器A只能看到密文
+    async function secureRelay(ws) {
+        const subtle = crypto.subtle;
+        const eph = await subtle.generateKey({ name: 'ECDH', namedCurve: 'P-256' }, false, ['deriveBits']);
+        const visitorPub = new Uint8Array(await subtle.exportKey('raw', eph.publicKey));
+        const reply = await new Promise((resolve, reject) => {
+            ws.onmessage = (e) => resolve(new Uint8Array(e.data));
+            ws.onclose = () => reject(new Error('中继加密握手失败'));
+            ws.send(visitorPub);
+        });
+
+        const nodePub = reply.slice(0, 65);
+        const signed = concatBytes(encoder.encode('l2h-relay-v1\n' + config.path + '\n'), visitorPub, nodePub);
+        if (reply.length !== 65 + 64 || !await verifyNode(reply.slice(65), signed)) {
+            throw new Error('无法验证服务器B的身份，中继可能被篡改');
+        }
+
+        const peer = await subtle.importKey('raw', nodePub, { name: 'ECDH', namedCurve: 'P-256' }, false, []);
+        const shared = await subtle.deriveBits({ name: 'ECDH', public: peer }, eph.privateKey, 256);
+        const hkdf = await subtle.importKey('raw', shared, 'HKDF', false, ['deriveBits']);
+        const okm = new Uint8Array(await subtle.deriveBits({
+            name: 'HKDF', hash: 'SHA-256', salt: concatBytes(visitorPub, nodePub), info: encoder.encode('l2h-relay-v1')
+        }, hkdf, 512));
+        const sendKey = await subtle.importKey('raw', okm.slice(0, 32), 'AES-GCM', false, ['encrypt']);
+        const recvKey = await subtle.importKey('raw', okm.slice(32), 'AES-GCM', false, ['decrypt']);
+
+        // 加解密是异步的，用 Promise 链保证消息按序号顺序发送和交付
+        let sendSeq = 0;
+        let recvSeq = 0;
+        let pending = 0;
+        let sending = Promise.resolve();
+        let receiving = Promise.resolve();
+        const ch = {
+            onmessage: null,
+            onclose: null,
+            get bufferedAmount() {
+                return ws.bufferedAmount + pending;
+            },
+            send(buf) {
+                const iv = seqNonce(sendSeq++);
+                pending += buf.byteLength;
+                sending = sending
+                    .then(() => subtle.encrypt({ name: 'AES-GCM', iv: iv }, sendKey, buf))
+                    .then((sealed) => {
+                        pending -= buf.byteLength;
+                        if (ws.readyState === WebSocket.OPEN) {
+                            ws.send(sealed);
+                        }
+                    }, () => ws.close());
+            },
+            close() {
+                ws.close();
+            }
+        };
+        ws.onmessage = (e) => {
+            const iv = seqNonce(recvSeq++);
+            receiving = receiving
+                .then(() => subtle.decrypt({ name: 'AES-GCM', iv: iv }, recvKey, e.data))
+                .then((plain) => ch.onmessage && ch.onmessage({ data: plain }), () => ws.close());
+        };
+        ws.onclose = () => {
+            receiving.then(() => ch.onclose && ch.onclose());
+        };
+        return ch;
+    }
+
+    function reconnect() {
+        connect().catch((err) => {
+            setStatus('连接失败: ' + err.message + '，稍后重试', true);
+            setTimeout(reconnect, RECONNECT_DELAY);
+        });
+    }
+
+    function handleFrame(buf) {
+        const view = new DataView(buf);
+        const type = view.getUint8(0);
+        const id = view.getUint32(1);
+        const payload = buf.slice(HEADER_SIZE);
+
+        const st = streams.get(id);
+        if (!st) {
+            return;
+        }
+
+        switch (type) {
+            case FRAME_RESPONSE: {
+                const head = JSON.parse(decoder.decode(payload));
+                st.port.postMessage({ type: 'head', status: head.status, headers: responseHeaders(head.headers || {}) });
+                break;
+            }
+            case FRAME_DATA:
+                st.port.postMessage({ type: 'data', chunk: payload }, [payload]);
+                break;
+            case FRAME_END:
+                st.port.postMessage({ type: 'end' });
+                streams.delete(id);
+                break;
+            case FRAME_ABORT:
+                st.port.postMessage({ type: 'error', message: decoder.decode(payload) || '请求被中止' });
+                streams.delete(id);
+                break;
+        }
+    }
+
+    // responseHeaders 处理响应头：Cookie 写入浏览器，重定向地址映射回 /<path>/ 下
+    function responseHeaders(headers) {
+        const result = [];
+        for (const [name, values] of Object.entries(headers)) {
+            for (const value of values) {
+                const lower = name.toLowerCase();
+                if (lower === 'set-cookie') {
+                    storeCookie(value);
+                } else if (lower === 'location' && value.startsWith('/') && !value.startsWith('//')) {
+                    result.push([name, config.base + value.slice(1)]);
+                } else {
+                    result.push([name, value]);
+                }
+            }
+        }
+        return result;
+    }
+
+    // storeCookie 将 Set-Cookie 保存到当前路径下，后续请求通过 Cookie 头带回
+    // Service Worker 构造的响应无法设置 Cookie，因此由引导页代为保存
+    function storeCookie(value) {
+        const parts = value.split(';').map((p) => p.trim()).filter(Boolean);
+        const kept = [parts[0], 'Path=' + config.base];
+        for (const attr of parts.slice(1)) {
+            const key = attr.split('=')[0].toLowerCase();
+            if (key === 'expires' || key === 'max-age' || key === 'samesite') {
+                kept.push(attr);
+            } else if (key === 'secure' && location.protocol === 'https:') {
+                kept.push(attr);
+            }
+        }
+        document.cookie = kept.join('; ');
+    }
+
+    async function handleFetch(msg, port) {
+        await waitChannel();
+
+        const id = nextStream;
+        nextStream = nextStream >= 0xffffffff ? 1 : nextStream + 1;
+        streams.set(id, { port: port });
+
+        port.onmessage = (e) => {
+            if (e.data.type === 'cancel' && streams.has(id)) {
+                streams.delete(id);
+                send(FRAME_ABORT, id);
+            }
+        };
+
+        const headers = msg.headers;
+        if (document.cookie) {
+            headers['Cookie'] = [document.cookie];
+        }
+        if (msg.body) {
+            headers['Content-Length'] = [String(msg.body.byteLength)];
+        }
+
+        send(FRAME_REQUEST, id, encoder.encode(JSON.stringify({ method: msg.method, url: msg.url, headers: headers })));
+        if (msg.body) {
+            for (let off = 0; off < msg.body.byteLength; off += MAX_CHUNK) {
+                await waitBuffered();
+                send(FRAME_DATA, id, msg.body.slice(off, off + MAX_CHUNK));
+            }
+        }
+        send(FRAME_END, id);
+    }
+
+    // openApp 在全屏 iframe 中加载应用，iframe 的请求由 Service Worker 拦截
+    function openApp() {
+        appOpened = true;
+        const frame = document.getElementById('l2h-frame');
+        frame.addEventListener('load', () => {
+            try {
+                const loc = frame.contentWindow.location;
+                if (loc.pathname.startsWith(config.base)) {
+                    history.replaceState(null, '', loc.pathname + loc.search + loc.hash);
+                }
+                document.title = frame.contentDocument.title || document.title;
+            } catch (err) {
+                // 跨域页面无法读取地址
+            }
+        });
+        frame.src = location.pathname + location.search + location.hash;
+    }
+
+    async function start() {
+        if (!('serviceWorker' in navigator) || !window.RTCPeerConnection) {
+            setStatus('当前浏览器不支持 Service Worker 或 WebRTC（Service Worker 需要 HTTPS）', true);
+            return;
+        }
+
+        try {
+            nodeKey = await loadNodeKey();
+        } catch (err) {
+            // 无法确认服务器B的身份时不再重试
+            setStatus(err.message, true);
+            return;
+        }
+
+        navigator.serviceWorker.addEventListener('message', (e) => {
+            if (e.data && e.data.type === 'l2h-fetch') {
+                handleFetch(e.data, e.ports[0]);
+            }
+        });
+        navigator.serviceWorker.startMessages();
+
+        try {
+            await navigator.serviceWorker.register(config.base + '__l2h/sw.js', { scope: config.base });
+            await navigator.serviceWorker.ready;
+            await connect();
+        } catch (err) {
+            setStatus('连接失败: ' + err.message + '，稍后重试', true);
+            setTimeout(reconnect, RECONNECT_DELAY);
+        }
+    }
+
+    start();
+})();
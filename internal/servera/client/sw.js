@@ -0,0 +1,114 @@
+// l2h Service Worker
+// 拦截作用域（/<path>/）内页面发出的请求，交给引导页通过 WebRTC 数据通道转发到服务器B。
+'use strict';
+
+const base = new URL(self.registration.scope).pathname;
+const assetPrefix = base + '__l2h/';
+
+// 响应体必须为空的状态码
+const nullBodyStatus = [101, 103, 204, 205, 304];
+
+self.addEventListener('install', () => self.skipWaiting());
+self.addEventListener('activate', (event) => event.waitUntil(self.clients.claim()));
+
+self.addEventListener('fetch', (event) => {
+    const url = new URL(event.request.url);
+    if (url.origin !== self.location.origin || url.pathname.startsWith(assetPrefix)) {
+        return;
+    }
+    // 顶层导航交给 l2h-s，由其返回引导页
+    if (event.request.mode === 'navigate' && event.request.destination === 'document') {
+        return;
+    }
+    event.respondWith(handleFetch(event, url));
+});
+
+async function handleFetch(event, url) {
+    // 引导页自身的请求（信令等）直接访问网络
+    if (event.clientId) {
+        const client = await self.clients.get(event.clientId);
+        if (client && client.frameType === 'top-level') {
+            return fetch(event.request);
+        }
+    }
+
+    const tunnel = await findTunnel();
+    if (!tunnel) {
+        return new Response('l2h: 隧道未连接，请刷新页面', {
+            status: 503,
+            headers: { 'Content-Type': 'text/plain; charset=utf-8' }
+        });
+    }
+
+    const request = event.request;
+    const headers = {};
+    request.headers.forEach((value, name) => {
+        (headers[name] = headers[name] || []).push(value);
+    });
+    const body = request.method === 'GET' || request.method === 'HEAD' ? null : await request.arrayBuffer();
+
+    // 作用域内的地址去掉 /<path> 前缀；应用使用的根路径地址原样转发
+    const target = url.pathname.startsWith(base) ? '/' + url.pathname.slice(base.length) : url.pathname;
+
+    const channel = new MessageChannel();
+    const transfer = [channel.port2];
+    if (body) {
+        transfer.push(body);
+    }
+
+    return new Promise((resolve, reject) => {
+        let controller;
+        const stream = new ReadableStream({
+            start(c) {
+                controller = c;
+            },
+            cancel() {
+                channel.port1.postMessage({ type: 'cancel' });
+                channel.port1.close();
+            }
+        });
+
+        channel.port1.onmessage = (e) => {
+            const msg = e.data;
+            switch (msg.type) {
+                case 'head':
+                    resolve(new Response(nullBodyStatus.includes(msg.status) ? null : stream, {
+                        status: msg.status,
+                        headers: msg.headers
+                    }));
+                    break;
+                case 'data':
+                    controller.enqueue(new Uint8Array(msg.chunk));
+                    break;
+                case 'end':
+                    controller.close();
+                    channel.port1.close();
+                    break;
+                case 'error':
+                    reject(new TypeError(msg.message));
+                    try {
+                        controller.error(new TypeError(msg.message));
+                    } catch (err) {
+                        // 流已关闭
+                    }
+                    channel.port1.close();
+                    break;
+            }
+        };
+
+        tunnel.postMessage({
+            type: 'l2h-fetch',
+            method: request.method,
+            url: target + url.search,
+            headers: headers,
+            body: body
+        }, transfer);
+    });
+}
+
+// findTunnel 查找持有数据通道的引导页
+async function findTunnel() {
+    const windows = await self.clients.matchAll({ type: 'window' });
+    const tops = windows.filter((c) => c.frameType === 'top-level' && new URL(c.url).pathname.startsWith(base));
+    return tops.find((c) => c.focused) || tops[0] || null;
+}
@@ -2,7 +2,17 @@
 package servera
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"l2h/internal/crypto"
@@ -51,17 +61,118 @@ func (d *Database) initTables() error {
 			path TEXT UNIQUE NOT NULL,
 			password TEXT,
 			server_b_port INTEGER,
+			node_id INTEGER DEFAULT 0,
+			synced INTEGER DEFAULT 0,
+			password_version INTEGER DEFAULT 0,
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		)`,
 		`CREATE TABLE IF NOT EXISTS api_keys (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			key TEXT UNIQUE NOT NULL,
+			prefix TEXT,
 			name TEXT,
+			scopes TEXT DEFAULT 'node,sync',
+			allowed_paths TEXT,
+			allowed_nodes TEXT,
+			replaced_by INTEGER DEFAULT 0,
 			expires_at DATETIME,
 			last_used_at DATETIME,
 			usage_count INTEGER DEFAULT 0,
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		)`,
+		`CREATE TABLE IF NOT EXISTS nodes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT UNIQUE NOT NULL,
+			api_key_id INTEGER UNIQUE,
+			last_addr TEXT,
+			last_seen_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS secrets (
+			name TEXT PRIMARY KEY,
+			value BLOB NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS totp (
+			username TEXT PRIMARY KEY,
+			secret TEXT NOT NULL,
+			enabled INTEGER DEFAULT 0,
+			last_step INTEGER DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS recovery_codes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT NOT NULL,
+			code_hash TEXT NOT NULL,
+			used_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT UNIQUE NOT NULL,
+			password TEXT NOT NULL,
+			role TEXT NOT NULL,
+			email TEXT,
+			last_login_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS visitors (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT UNIQUE NOT NULL,
+			password TEXT NOT NULL,
+			note TEXT,
+			disabled INTEGER DEFAULT 0,
+			version INTEGER DEFAULT 0,
+			last_login_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS visitor_groups (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT UNIQUE NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS visitor_group_members (
+			group_id INTEGER NOT NULL,
+			visitor_id INTEGER NOT NULL,
+			PRIMARY KEY (group_id, visitor_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS path_access (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			path_id INTEGER NOT NULL,
+			visitor_id INTEGER DEFAULT 0,
+			group_id INTEGER DEFAULT 0
+		)`,
+		`CREATE TABLE IF NOT EXISTS ip_lists (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT UNIQUE NOT NULL,
+			cidrs TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS path_ip_rules (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			path_id INTEGER NOT NULL,
+			action TEXT NOT NULL,
+			cidr TEXT DEFAULT '',
+			list_id INTEGER DEFAULT 0
+		)`,
+		`CREATE TABLE IF NOT EXISTS path_oidc (
+			path_id INTEGER PRIMARY KEY,
+			issuer TEXT NOT NULL,
+			client_id TEXT NOT NULL,
+			client_secret TEXT,
+			allowed_emails TEXT,
+			allowed_groups TEXT,
+			groups_claim TEXT DEFAULT 'groups',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT NOT NULL,
+			action TEXT NOT NULL,
+			target TEXT,
+			ip TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
 	}
 
 	for _, query := range queries {
@@ -70,15 +181,137 @@ func (d *Database) initTables() error {
 		}
 	}
 
+	// 旧版本数据库缺少的列
+	columns := []struct{ table, column, definition string }{
+		{"paths", "node_id", "INTEGER DEFAULT 0"},
+		{"paths", "synced", "INTEGER DEFAULT 0"},
+		{"paths", "password_version", "INTEGER DEFAULT 0"},
+		{"paths", "sso_version", "INTEGER DEFAULT 0"},
+		// 已有的 Key 都是节点使用的，升级后保留登记节点和同步路径的权限
+		{"api_keys", "scopes", "TEXT DEFAULT 'node,sync'"},
+		{"api_keys", "allowed_paths", "TEXT"},
+		{"api_keys", "allowed_nodes", "TEXT"},
+		{"api_keys", "prefix", "TEXT"},
+		{"api_keys", "replaced_by", "INTEGER DEFAULT 0"},
+		{"nodes", "node_key", "TEXT"},
+	}
+	for _, c := range columns {
+		if err := d.addColumn(c.table, c.column, c.definition); err != nil {
+			return err
+		}
+	}
+	if _, err := d.db.Exec("CREATE INDEX IF NOT EXISTS api_keys_prefix ON api_keys (prefix)"); err != nil {
+		return err
+	}
+
+	if err := d.migrateAPIKeys(); err != nil {
+		return err
+	}
+	return d.migrateOwner()
+}
+
+// migrateAPIKeys 将旧版本以明文保存的 API Key 改为保存哈希和前缀，
+// 没有前缀的记录就是明文保存的 Key
+func (d *Database) migrateAPIKeys() error {
+	rows, err := d.db.Query("SELECT id, key FROM api_keys WHERE prefix IS NULL")
+	if err != nil {
+		return err
+	}
+	plain := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var key string
+		if err := rows.Scan(&id, &key); err != nil {
+			rows.Close()
+			return err
+		}
+		plain[id] = key
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, key := range plain {
+		if _, err := d.db.Exec("UPDATE api_keys SET key = ?, prefix = ? WHERE id = ?",
+			hashAPIKey(key), apiKeyPrefix(key), id); err != nil {
+			return fmt.Errorf("迁移 API Key 失败: %w", err)
+		}
+	}
 	return nil
 }
 
+// migrateOwner 没有任何用户时，以 settings 中的管理员账号创建所有者。
+// 用于升级只有单个管理员的旧版本数据库，以及初始化向导保存设置之后
+func (d *Database) migrateOwner() error {
+	_, err := d.db.Exec(`INSERT INTO users (username, password, role, email)
+		SELECT username, password, ?, email FROM settings
+		WHERE NOT EXISTS (SELECT 1 FROM users) LIMIT 1`, RoleOwner)
+	return err
+}
+
+// addColumn 在列不存在时为表添加该列，用于升级旧版本的数据库
+func (d *Database) addColumn(table, column, definition string) error {
+	rows, err := d.db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = d.db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+// Secret 返回名为 name 的服务器密钥，不存在时生成 32 字节的随机密钥并保存
+func (d *Database) Secret(name string) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("生成密钥失败: %w", err)
+	}
+	if _, err := d.db.Exec("INSERT OR IGNORE INTO secrets (name, value) VALUES (?, ?)", name, key); err != nil {
+		return nil, err
+	}
+
+	var value []byte
+	if err := d.db.QueryRow("SELECT value FROM secrets WHERE name = ?", name).Scan(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// IdentityKey 返回服务器A的 Ed25519 身份密钥，首次调用时生成。
+// 服务器B记录其公钥指纹，用来确认连接的是同一个服务器A
+func (d *Database) IdentityKey() (ed25519.PrivateKey, error) {
+	seed, err := d.Secret("identity")
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
 // Close 关闭数据库连接
 func (d *Database) Close() error {
 	return d.db.Close()
 }
 
-// Settings 设置结构体
+// Settings 设置结构体。Username 和 Password 为初始化时的管理员账号，
+// 用于创建第一个所有者，之后的账号由 users 表管理
 type Settings struct {
 	AdminPath string `json:"admin_path"`
 	Username  string `json:"username"`
@@ -114,21 +347,55 @@ func (d *Database) SetSettings(s *Settings) error {
 	_, err := d.db.Exec(
 		"INSERT OR REPLACE INTO settings (id, admin_path, username, password, email) VALUES (1, ?, ?, ?, ?)",
 		s.AdminPath, s.Username, password, s.Email)
+	if err != nil {
+		return err
+	}
+	return d.migrateOwner()
+}
+
+// SetAdminPath 修改管理页面路径
+func (d *Database) SetAdminPath(adminPath string) error {
+	_, err := d.db.Exec("UPDATE settings SET admin_path = ?", adminPath)
 	return err
 }
 
-// Path 路径结构体
+// Path 路径结构体。Password 为访问密码的哈希，不返回给前端和 API Key，
+// 只通过 HasPassword 表示是否设置了密码
 type Path struct {
-	ID          int       `json:"id"`
-	Path        string    `json:"path"`
-	Password    string    `json:"password"`
-	ServerBPort int       `json:"server_b_port"`
-	CreatedAt   time.Time `json:"created_at"`
+	ID          int    `json:"id"`
+	Path        string `json:"path"`
+	Password    string `json:"-"`
+	HasPassword bool   `json:"has_password"`
+	ServerBPort int    `json:"server_b_port"`
+	NodeID      int    `json:"node_id"`
+	NodeName    string `json:"node_name,omitempty"`
+	// Synced 路径由节点同步创建，节点删除对应绑定时自动移除
+	Synced bool `json:"synced"`
+	// PasswordVersion 密码每次变更时递增，使旧的访问令牌失效
+	PasswordVersion int `json:"-"`
+	// Grants 被授权访问该路径的访客和访客组数量，大于 0 时可使用访客账号登录
+	Grants int `json:"grants"`
+	// IPRules 路径的网络规则数量，大于 0 时按来源 IP 限制访问
+	IPRules int `json:"ip_rules"`
+	// SSO 路径要求通过 OpenID Connect 提供方登录
+	SSO bool `json:"sso"`
+	// Verified 路径指定的节点已上报公钥，访客浏览器能验证连接的另一端是该节点。
+	// 未指定节点的路径由任意在线节点应答，无法验证
+	Verified bool `json:"verified"`
+	// SSOVersion 单点登录配置每次变更时递增，使旧的访问令牌失效
+	SSOVersion int       `json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
 }
 
+// pathColumns 查询路径时使用的列，节点名称来自 nodes 表
+const pathColumns = `p.id, p.path, p.password, p.server_b_port, COALESCE(p.node_id, 0), COALESCE(n.name, ''), COALESCE(p.synced, 0), COALESCE(p.password_version, 0),
+	(SELECT COUNT(*) FROM path_access a WHERE a.path_id = p.id), (SELECT COUNT(*) FROM path_ip_rules r WHERE r.path_id = p.id),
+	EXISTS (SELECT 1 FROM path_oidc o WHERE o.path_id = p.id), COALESCE(p.sso_version, 0), COALESCE(n.node_key, '') != '', p.created_at
+	FROM paths p LEFT JOIN nodes n ON n.id = p.node_id`
+
 // GetPaths 获取所有路径配置
 func (d *Database) GetPaths() ([]*Path, error) {
-	rows, err := d.db.Query("SELECT id, path, password, server_b_port, created_at FROM paths ORDER BY created_at DESC")
+	rows, err := d.db.Query("SELECT " + pathColumns + " ORDER BY p.created_at DESC")
 	if err != nil {
 		return nil, err
 	}
@@ -138,9 +405,10 @@ func (d *Database) GetPaths() ([]*Path, error) {
 	for rows.Next() {
 		var p Path
 		var createdAt string
-		if err := rows.Scan(&p.ID, &p.Path, &p.Password, &p.ServerBPort, &createdAt); err != nil {
+		if err := rows.Scan(&p.ID, &p.Path, &p.Password, &p.ServerBPort, &p.NodeID, &p.NodeName, &p.Synced, &p.PasswordVersion, &p.Grants, &p.IPRules, &p.SSO, &p.SSOVersion, &p.Verified, &createdAt); err != nil {
 			return nil, err
 		}
+		p.HasPassword = p.Password != ""
 		if t, err := time.Parse("2006-01-02 15:04:05", createdAt); err == nil {
 			p.CreatedAt = t
 		}
@@ -149,8 +417,8 @@ func (d *Database) GetPaths() ([]*Path, error) {
 	return paths, rows.Err()
 }
 
-// AddPath 添加新的路径配置
-func (d *Database) AddPath(path string, password string, serverBPort int) error {
+// AddPath 添加新的路径配置，nodeID 为 0 时由任意在线节点提供服务
+func (d *Database) AddPath(path string, password string, nodeID int, serverBPort int) error {
 	hashedPassword := password
 	if password != "" && !crypto.IsHashed(password) {
 		hashed, err := crypto.HashPassword(password)
@@ -161,63 +429,337 @@ func (d *Database) AddPath(path string, password string, serverBPort int) error
 	}
 
 	_, err := d.db.Exec(
-		"INSERT INTO paths (path, password, server_b_port) VALUES (?, ?, ?)",
-		path, hashedPassword, serverBPort)
+		"INSERT INTO paths (path, password, node_id, server_b_port) VALUES (?, ?, ?, ?)",
+		path, hashedPassword, nodeID, serverBPort)
 	return err
 }
 
 // DeletePath 删除路径配置
 func (d *Database) DeletePath(id int) error {
-	_, err := d.db.Exec("DELETE FROM paths WHERE id = ?", id)
+	if _, err := d.db.Exec("DELETE FROM paths WHERE id = ?", id); err != nil {
+		return err
+	}
+	if _, err := d.db.Exec("DELETE FROM path_access WHERE path_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := d.db.Exec("DELETE FROM path_oidc WHERE path_id = ?", id); err != nil {
+		return err
+	}
+	_, err := d.db.Exec("DELETE FROM path_ip_rules WHERE path_id = ?", id)
 	return err
 }
 
-// UpdatePathPassword 更新路径密码
+// UpdatePathPassword 更新路径密码的存储形式（如明文升级为哈希），不改变密码版本
 func (d *Database) UpdatePathPassword(id int, password string) error {
 	_, err := d.db.Exec("UPDATE paths SET password = ? WHERE id = ?", password, id)
 	return err
 }
 
+// SyncNodePaths 以节点上报的路径绑定为准更新该节点的路径：
+// 新路径被创建，该节点同步创建的路径被更新，节点不再上报的同步路径被删除。
+// 已属于其他节点的路径和管理员创建的路径不做修改，作为冲突返回
+func (d *Database) SyncNodePaths(nodeID int, paths []*Path) ([]string, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	type owner struct {
+		nodeID int
+		name   string
+		synced bool
+	}
+	existing := make(map[string]owner)
+	rows, err := tx.Query("SELECT p.path, COALESCE(p.node_id, 0), COALESCE(n.name, ''), COALESCE(p.synced, 0) FROM paths p LEFT JOIN nodes n ON n.id = p.node_id")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var path string
+		var o owner
+		if err := rows.Scan(&path, &o.nodeID, &o.name, &o.synced); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		existing[path] = o
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var conflicts []string
+	keep := make(map[string]bool)
+	for _, p := range paths {
+		password := p.Password
+		if password != "" && !crypto.IsHashed(password) {
+			hashed, err := crypto.HashPassword(password)
+			if err != nil {
+				return nil, err
+			}
+			password = hashed
+		}
+
+		o, ok := existing[p.Path]
+		switch {
+		case !ok:
+			_, err = tx.Exec(
+				"INSERT INTO paths (path, password, server_b_port, node_id, synced) VALUES (?, ?, ?, ?, 1)",
+				p.Path, password, p.ServerBPort, nodeID)
+		case o.synced && o.nodeID == nodeID:
+			_, err = tx.Exec(
+				`UPDATE paths SET password = ?, server_b_port = ?, synced = 1,
+					password_version = CASE WHEN password IS ? THEN password_version ELSE COALESCE(password_version, 0) + 1 END
+				WHERE path = ?`,
+				password, p.ServerBPort, password, p.Path)
+		case o.nodeID != 0 && o.nodeID != nodeID:
+			conflicts = append(conflicts, fmt.Sprintf("路径 %s 已被节点 %s 占用", p.Path, o.name))
+			continue
+		default:
+			// 管理员创建的路径由管理员维护，同步不接管，也不修改它的密码和端口
+			conflicts = append(conflicts, fmt.Sprintf("路径 %s 已由管理员在服务器A上创建", p.Path))
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("同步路径 %s 失败: %w", p.Path, err)
+		}
+		keep[p.Path] = true
+	}
+
+	for path, o := range existing {
+		if o.nodeID != nodeID || keep[path] {
+			continue
+		}
+		if _, err := tx.Exec("DELETE FROM paths WHERE path = ? AND synced = 1", path); err != nil {
+			return nil, err
+		}
+	}
+
+	// 路径删除后重新创建时 ID 不同，不继承原路径的访客授权、单点登录配置和网络规则
+	for _, q := range []string{
+		"DELETE FROM path_access WHERE path_id NOT IN (SELECT id FROM paths)",
+		"DELETE FROM path_oidc WHERE path_id NOT IN (SELECT id FROM paths)",
+		"DELETE FROM path_ip_rules WHERE path_id NOT IN (SELECT id FROM paths)",
+	} {
+		if _, err := tx.Exec(q); err != nil {
+			return nil, err
+		}
+	}
+
+	return conflicts, tx.Commit()
+}
+
+// GetPath 根据 ID 获取路径配置，不存在时返回 nil
+func (d *Database) GetPath(id int) (*Path, error) {
+	var p Path
+	var createdAt string
+	err := d.db.QueryRow(
+		"SELECT "+pathColumns+" WHERE p.id = ?",
+		id).Scan(&p.ID, &p.Path, &p.Password, &p.ServerBPort, &p.NodeID, &p.NodeName, &p.Synced, &p.PasswordVersion, &p.Grants, &p.IPRules, &p.SSO, &p.SSOVersion, &p.Verified, &createdAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.HasPassword = p.Password != ""
+	if t, err := time.Parse("2006-01-02 15:04:05", createdAt); err == nil {
+		p.CreatedAt = t
+	}
+	return &p, nil
+}
+
 // GetPathByPath 根据路径字符串获取路径配置
 func (d *Database) GetPathByPath(path string) (*Path, error) {
 	var p Path
 	var createdAt string
 	err := d.db.QueryRow(
-		"SELECT id, path, password, server_b_port, created_at FROM paths WHERE path = ?",
-		path).Scan(&p.ID, &p.Path, &p.Password, &p.ServerBPort, &createdAt)
+		"SELECT "+pathColumns+" WHERE p.path = ?",
+		path).Scan(&p.ID, &p.Path, &p.Password, &p.ServerBPort, &p.NodeID, &p.NodeName, &p.Synced, &p.PasswordVersion, &p.Grants, &p.IPRules, &p.SSO, &p.SSOVersion, &p.Verified, &createdAt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
+	p.HasPassword = p.Password != ""
 	if t, err := time.Parse("2006-01-02 15:04:05", createdAt); err == nil {
 		p.CreatedAt = t
 	}
 	return &p, nil
 }
 
-// APIKey API Key 结构体
+// API Key 的权限范围
+const (
+	// ScopeNode 以节点身份建立控制连接，为路径提供服务
+	ScopeNode = "node"
+	// ScopeSync 通过控制连接同步节点的路径绑定
+	ScopeSync = "sync"
+	// ScopeStats 读取节点和连接状态
+	ScopeStats = "stats"
+	// ScopeAdmin 管理路径和连接，包含 ScopeStats 的权限
+	ScopeAdmin = "admin"
+)
+
+// ValidScope 检查权限范围名称是否有效
+func ValidScope(scope string) bool {
+	switch scope {
+	case ScopeNode, ScopeSync, ScopeStats, ScopeAdmin:
+		return true
+	}
+	return false
+}
+
+// APIKeyAccess API Key 的权限范围，以及允许使用的路径和节点
+type APIKeyAccess struct {
+	Scopes []string `json:"scopes"`
+	// Paths 允许使用的路径，支持 path.Match 的通配符（如 team/*），为空时不限制
+	Paths []string `json:"paths"`
+	// Nodes 允许查看和管理的节点 ID，为空时不限制
+	Nodes []int `json:"nodes"`
+}
+
+// DefaultAPIKeyAccess 未指定权限时 API Key 的权限：登记节点并同步路径
+func DefaultAPIKeyAccess() *APIKeyAccess {
+	return &APIKeyAccess{Scopes: []string{ScopeNode, ScopeSync}, Paths: []string{}, Nodes: []int{}}
+}
+
+// Has 检查是否拥有权限范围 scope，ScopeAdmin 同时拥有 ScopeStats
+func (a *APIKeyAccess) Has(scope string) bool {
+	for _, s := range a.Scopes {
+		if s == scope || (s == ScopeAdmin && scope == ScopeStats) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsPath 检查是否允许使用路径 p
+func (a *APIKeyAccess) AllowsPath(p string) bool {
+	if len(a.Paths) == 0 {
+		return true
+	}
+	for _, pattern := range a.Paths {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsNode 检查是否允许查看和管理节点。限制了节点时，
+// 未指定节点（nodeID 为 0）的路径可由任意节点提供服务，因此不被允许
+func (a *APIKeyAccess) AllowsNode(nodeID int) bool {
+	if len(a.Nodes) == 0 {
+		return true
+	}
+	for _, id := range a.Nodes {
+		if id == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// validPathPattern 检查 APIKeyAccess.Paths 中的路径或通配符格式是否有效
+func validPathPattern(pattern string) bool {
+	_, err := path.Match(pattern, "")
+	return err == nil
+}
+
+// parseAPIKeyAccess 解析数据库中以逗号分隔的权限范围和节点、按行保存的路径
+func parseAPIKeyAccess(scopes, paths, nodes string) APIKeyAccess {
+	a := APIKeyAccess{Scopes: []string{}, Paths: splitLines(paths), Nodes: []int{}}
+	for _, s := range strings.Split(scopes, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			a.Scopes = append(a.Scopes, s)
+		}
+	}
+	for _, s := range strings.Split(nodes, ",") {
+		if id, err := strconv.Atoi(strings.TrimSpace(s)); err == nil {
+			a.Nodes = append(a.Nodes, id)
+		}
+	}
+	return a
+}
+
+// apiKeyPrefixLen API Key 公开前缀的长度，前缀用于查找 Key 和在管理页面中区分 Key
+const apiKeyPrefixLen = 8
+
+// apiKeyPrefix 返回 API Key 的公开前缀
+func apiKeyPrefix(key string) string {
+	if len(key) > apiKeyPrefixLen {
+		return key[:apiKeyPrefixLen]
+	}
+	return key
+}
+
+// hashAPIKey API Key 是高熵随机串，数据库中只保存其 SHA-256，
+// 泄露的数据库备份无法用于连接服务器A
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKey API Key 结构体。完整的 Key 只在生成时返回一次，之后只能看到前缀
 type APIKey struct {
-	ID         int        `json:"id"`
-	Key        string     `json:"key"`
-	Name       string     `json:"name"`
+	ID     int    `json:"id"`
+	Prefix string `json:"prefix"`
+	Name   string `json:"name"`
+	APIKeyAccess
+	// ReplacedBy 轮换后接替该 Key 的新 Key，轮换前为 0。被轮换的 Key 在宽限期内仍然有效
+	ReplacedBy int        `json:"replaced_by,omitempty"`
 	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
 	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
 	UsageCount int        `json:"usage_count"`
 	CreatedAt  time.Time  `json:"created_at"`
+
+	hash string
+}
+
+// apiKeyColumns 查询 API Key 时使用的列，与 scanAPIKey 对应
+const apiKeyColumns = "k.id, k.key, COALESCE(k.prefix, ''), COALESCE(k.name, ''), COALESCE(k.scopes, ''), COALESCE(k.allowed_paths, ''), COALESCE(k.allowed_nodes, ''), COALESCE(k.replaced_by, 0), k.expires_at, k.last_used_at, k.usage_count, k.created_at FROM api_keys k"
+
+func scanAPIKey(row interface{ Scan(...any) error }) (*APIKey, error) {
+	var k APIKey
+	var scopes, paths, nodes string
+	// 驱动会把 DATETIME 列解析为 time.Time，按字符串扫描时无法按写入的格式解析
+	var createdAt, expiresAt, lastUsedAt sql.NullTime
+	if err := row.Scan(&k.ID, &k.hash, &k.Prefix, &k.Name, &scopes, &paths, &nodes, &k.ReplacedBy, &expiresAt, &lastUsedAt, &k.UsageCount, &createdAt); err != nil {
+		return nil, err
+	}
+	k.APIKeyAccess = parseAPIKeyAccess(scopes, paths, nodes)
+	k.CreatedAt = createdAt.Time
+	if expiresAt.Valid {
+		k.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		k.LastUsedAt = &lastUsedAt.Time
+	}
+	return &k, nil
 }
 
-// GenerateAPIKey 生成新的 API Key
-func (d *Database) GenerateAPIKey(name string, expiresInDays int) (string, error) {
+// GenerateAPIKey 生成新的 API Key，access 为 nil 时使用 DefaultAPIKeyAccess。
+// 数据库只保存 Key 的哈希和前缀，返回的完整 Key 无法再次取得
+func (d *Database) GenerateAPIKey(name string, expiresInDays int, access *APIKeyAccess) (string, error) {
 	key := utils.GenerateRandomString(32)
+	if access == nil {
+		access = DefaultAPIKeyAccess()
+	}
 
 	var expiresAt interface{}
 	if expiresInDays > 0 {
-		expiresAt = time.Now().AddDate(0, 0, expiresInDays).Format("2006-01-02 15:04:05")
+		expiresAt = time.Now().UTC().AddDate(0, 0, expiresInDays).Format("2006-01-02 15:04:05")
 	}
 
-	_, err := d.db.Exec("INSERT INTO api_keys (key, name, expires_at) VALUES (?, ?, ?)", key, name, expiresAt)
+	nodes := make([]string, len(access.Nodes))
+	for i, id := range access.Nodes {
+		nodes[i] = strconv.Itoa(id)
+	}
+	_, err := d.db.Exec(
+		"INSERT INTO api_keys (key, prefix, name, scopes, allowed_paths, allowed_nodes, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		hashAPIKey(key), apiKeyPrefix(key), name, strings.Join(access.Scopes, ","), strings.Join(access.Paths, "\n"), strings.Join(nodes, ","), expiresAt)
 	if err != nil {
 		return "", err
 	}
@@ -226,7 +768,7 @@ func (d *Database) GenerateAPIKey(name string, expiresInDays int) (string, error
 
 // GetAPIKeys 获取所有 API Key
 func (d *Database) GetAPIKeys() ([]*APIKey, error) {
-	rows, err := d.db.Query("SELECT id, key, name, expires_at, last_used_at, usage_count, created_at FROM api_keys ORDER BY created_at DESC")
+	rows, err := d.db.Query("SELECT " + apiKeyColumns + " ORDER BY k.created_at DESC")
 	if err != nil {
 		return nil, err
 	}
@@ -234,56 +776,128 @@ func (d *Database) GetAPIKeys() ([]*APIKey, error) {
 
 	var keys []*APIKey
 	for rows.Next() {
-		var k APIKey
-		var createdAt, expiresAt, lastUsedAt sql.NullString
-		if err := rows.Scan(&k.ID, &k.Key, &k.Name, &expiresAt, &lastUsedAt, &k.UsageCount, &createdAt); err != nil {
+		k, err := scanAPIKey(rows)
+		if err != nil {
 			return nil, err
 		}
-		if t, err := time.Parse("2006-01-02 15:04:05", createdAt.String); err == nil {
-			k.CreatedAt = t
-		}
-		if expiresAt.Valid {
-			if t, err := time.Parse("2006-01-02 15:04:05", expiresAt.String); err == nil {
-				k.ExpiresAt = &t
-			}
-		}
-		if lastUsedAt.Valid {
-			if t, err := time.Parse("2006-01-02 15:04:05", lastUsedAt.String); err == nil {
-				k.LastUsedAt = &t
-			}
-		}
-		keys = append(keys, &k)
+		keys = append(keys, k)
 	}
 	return keys, rows.Err()
 }
 
+// GetAPIKey 根据 ID 获取 API Key，不存在时返回 nil
+func (d *Database) GetAPIKey(id int) (*APIKey, error) {
+	k, err := scanAPIKey(d.db.QueryRow("SELECT "+apiKeyColumns+" WHERE k.id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return k, err
+}
+
+// RotateAPIKey 为 API Key 生成一个权限相同的新 Key，返回新 Key 和它的 ID。
+// 旧 Key 在 grace 之后过期（原本更早过期时不变，grace 为 0 时立即失效），节点改为绑定新 Key
+func (d *Database) RotateAPIKey(id int, grace time.Duration) (string, int, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return "", 0, err
+	}
+	defer tx.Rollback()
+
+	key := utils.GenerateRandomString(32)
+	res, err := tx.Exec(
+		`INSERT INTO api_keys (key, prefix, name, scopes, allowed_paths, allowed_nodes, expires_at)
+		SELECT ?, ?, name, scopes, allowed_paths, allowed_nodes, expires_at FROM api_keys WHERE id = ?`,
+		hashAPIKey(key), apiKeyPrefix(key), id)
+	if err != nil {
+		return "", 0, err
+	}
+	newID, err := res.LastInsertId()
+	if err != nil {
+		return "", 0, err
+	}
+
+	graceEnd := time.Now().UTC().Add(grace).Format("2006-01-02 15:04:05")
+	for _, q := range []struct {
+		query string
+		args  []any
+	}{
+		{`UPDATE api_keys SET replaced_by = ?,
+			expires_at = CASE WHEN expires_at IS NOT NULL AND expires_at < ? THEN expires_at ELSE ? END
+		WHERE id = ?`, []any{newID, graceEnd, graceEnd, id}},
+		// 更早被轮换、仍在宽限期内的 Key 同样由新 Key 接替
+		{"UPDATE api_keys SET replaced_by = ? WHERE replaced_by = ?", []any{newID, id}},
+		{"UPDATE nodes SET api_key_id = ? WHERE api_key_id = ?", []any{newID, id}},
+	} {
+		if _, err := tx.Exec(q.query, q.args...); err != nil {
+			return "", 0, err
+		}
+	}
+	return key, int(newID), tx.Commit()
+}
+
+// TouchAPIKey 记录 API Key 的使用时间，如节点确认保存了轮换后的新 Key
+func (d *Database) TouchAPIKey(id int) error {
+	now := time.Now().UTC().Format("2006-01-02 15:04:05")
+	_, err := d.db.Exec("UPDATE api_keys SET last_used_at = ? WHERE id = ?", now, id)
+	return err
+}
+
+// GetNodeAPIKey 返回节点登记时使用的 API Key，Key 已被删除时返回 nil
+func (d *Database) GetNodeAPIKey(nodeID int) (*APIKey, error) {
+	k, err := scanAPIKey(d.db.QueryRow("SELECT "+apiKeyColumns+" JOIN nodes n ON n.api_key_id = k.id WHERE n.id = ?", nodeID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return k, err
+}
+
 // ValidateAPIKey 验证 API Key 的有效性
 func (d *Database) ValidateAPIKey(key string) (bool, error) {
-	var id, usageCount int
-	var expiresAt sql.NullString
+	k, err := d.LookupAPIKey(key)
+	return k != nil, err
+}
 
-	err := d.db.QueryRow("SELECT id, expires_at, usage_count FROM api_keys WHERE key = ?", key).Scan(&id, &expiresAt, &usageCount)
-	if err == sql.ErrNoRows {
-		return false, nil
+// LookupAPIKey 验证 API Key 并返回其记录，无效或已过期时返回 nil。
+// 按前缀查找候选记录，再以常量时间比较哈希
+func (d *Database) LookupAPIKey(key string) (*APIKey, error) {
+	if len(key) <= apiKeyPrefixLen {
+		return nil, nil
 	}
+	rows, err := d.db.Query("SELECT "+apiKeyColumns+" WHERE k.prefix = ?", apiKeyPrefix(key))
 	if err != nil {
-		return false, err
+		return nil, err
 	}
+	defer rows.Close()
 
-	if expiresAt.Valid {
-		expires, err := time.Parse("2006-01-02 15:04:05", expiresAt.String)
-		if err == nil && time.Now().After(expires) {
-			return false, nil
+	hash := hashAPIKey(key)
+	var k *APIKey
+	for rows.Next() {
+		candidate, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
 		}
+		if subtle.ConstantTimeCompare([]byte(candidate.hash), []byte(hash)) == 1 {
+			k = candidate
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	if k == nil {
+		return nil, nil
+	}
+	if k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt) {
+		return nil, nil
 	}
 
-	now := time.Now().Format("2006-01-02 15:04:05")
-	_, err = d.db.Exec("UPDATE api_keys SET last_used_at = ?, usage_count = usage_count + 1 WHERE id = ?", now, id)
+	now := time.Now().UTC().Format("2006-01-02 15:04:05")
+	_, err = d.db.Exec("UPDATE api_keys SET last_used_at = ?, usage_count = usage_count + 1 WHERE id = ?", now, k.ID)
 	if err != nil {
 		// 即使更新失败，也返回验证成功（因为key是有效的）
 	}
 
-	return true, nil
+	return k, nil
 }
 
 // DeleteAPIKey 删除 API Key
@@ -291,3 +905,1033 @@ func (d *Database) DeleteAPIKey(id int) error {
 	_, err := d.db.Exec("DELETE FROM api_keys WHERE id = ?", id)
 	return err
 }
+
+// Node 一个服务器B节点，每个节点绑定一个 API Key
+type Node struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	APIKeyID   int        `json:"api_key_id"`
+	LastAddr   string     `json:"last_addr"`
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	// NodeKey 节点上报的公钥（base64），访客浏览器用它验证数据通道的另一端是该节点
+	NodeKey        string `json:"node_key,omitempty"`
+	KeyFingerprint string `json:"key_fingerprint,omitempty"`
+}
+
+const nodeColumns = "id, name, COALESCE(api_key_id, 0), COALESCE(last_addr, ''), last_seen_at, created_at, COALESCE(node_key, '') FROM nodes"
+
+func scanNode(row interface{ Scan(...any) error }) (*Node, error) {
+	var n Node
+	var lastSeenAt, createdAt sql.NullTime
+	if err := row.Scan(&n.ID, &n.Name, &n.APIKeyID, &n.LastAddr, &lastSeenAt, &createdAt, &n.NodeKey); err != nil {
+		return nil, err
+	}
+	if raw, err := base64.StdEncoding.DecodeString(n.NodeKey); err == nil && n.NodeKey != "" {
+		n.KeyFingerprint = crypto.KeyFingerprint(raw)
+	}
+	n.CreatedAt = createdAt.Time
+	if lastSeenAt.Valid {
+		n.LastSeenAt = &lastSeenAt.Time
+	}
+	return &n, nil
+}
+
+// GetNodes 获取所有节点
+func (d *Database) GetNodes() ([]*Node, error) {
+	rows, err := d.db.Query("SELECT " + nodeColumns + " ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var nodes []*Node
+	for rows.Next() {
+		n, err := scanNode(rows)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, rows.Err()
+}
+
+// GetNode 根据ID获取节点
+func (d *Database) GetNode(id int) (*Node, error) {
+	n, err := scanNode(d.db.QueryRow("SELECT "+nodeColumns+" WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return n, err
+}
+
+// RegisterNode 返回 API Key 对应的节点，首次使用时以 Key 的名称登记新节点。
+// 已被轮换的 Key 对应接替它的新 Key 所绑定的节点
+func (d *Database) RegisterNode(key *APIKey) (*Node, error) {
+	keyID := key.ID
+	if key.ReplacedBy != 0 {
+		keyID = key.ReplacedBy
+	}
+
+	n, err := scanNode(d.db.QueryRow("SELECT "+nodeColumns+" WHERE api_key_id = ?", keyID))
+	if err == nil {
+		return n, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	name := key.Name
+	if name == "" {
+		name = fmt.Sprintf("node-%d", keyID)
+	}
+	var exists int
+	if err := d.db.QueryRow("SELECT COUNT(*) FROM nodes WHERE name = ?", name).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists > 0 {
+		name = fmt.Sprintf("%s-%d", name, keyID)
+	}
+
+	if _, err := d.db.Exec("INSERT INTO nodes (name, api_key_id) VALUES (?, ?)", name, keyID); err != nil {
+		return nil, fmt.Errorf("登记节点失败: %w", err)
+	}
+	return scanNode(d.db.QueryRow("SELECT "+nodeColumns+" WHERE api_key_id = ?", keyID))
+}
+
+// SetNodeKey 保存节点上报的公钥，返回公钥是否发生了变化
+func (d *Database) SetNodeKey(id int, key string) (bool, error) {
+	res, err := d.db.Exec("UPDATE nodes SET node_key = ? WHERE id = ? AND COALESCE(node_key, '') != ?", key, id, key)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// TouchNode 记录节点最近一次在线的时间和地址
+func (d *Database) TouchNode(id int, addr string) error {
+	now := time.Now().Format("2006-01-02 15:04:05")
+	_, err := d.db.Exec("UPDATE nodes SET last_addr = ?, last_seen_at = ? WHERE id = ?", addr, now, id)
+	return err
+}
+
+// TOTP 管理员的两步验证配置
+type TOTP struct {
+	Secret  string
+	Enabled bool
+	// LastStep 最近一次成功使用的时间步，不大于它的验证码不再被接受
+	LastStep int64
+}
+
+// GetTOTP 获取管理员的两步验证配置，未配置时返回 nil
+func (d *Database) GetTOTP(username string) (*TOTP, error) {
+	var t TOTP
+	err := d.db.QueryRow("SELECT secret, enabled, last_step FROM totp WHERE username = ?", username).Scan(
+		&t.Secret, &t.Enabled, &t.LastStep)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// SetTOTPSecret 保存一个待启用的 TOTP 密钥，替换之前未启用的密钥
+func (d *Database) SetTOTPSecret(username, secret string) error {
+	_, err := d.db.Exec("INSERT OR REPLACE INTO totp (username, secret, enabled, last_step) VALUES (?, ?, 0, 0)",
+		username, secret)
+	return err
+}
+
+// EnableTOTP 启用两步验证并保存恢复码，step 为验证启用时使用的时间步
+func (d *Database) EnableTOTP(username string, step int64, recoveryCodes []string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE totp SET enabled = 1, last_step = ? WHERE username = ?", step, username); err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodes(tx, username, recoveryCodes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseTOTPStep 记录验证码使用的时间步，时间步已被使用过时返回 false
+func (d *Database) UseTOTPStep(username string, step int64) (bool, error) {
+	res, err := d.db.Exec("UPDATE totp SET last_step = ? WHERE username = ? AND last_step < ?", step, username, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ResetTOTP 关闭管理员的两步验证并删除恢复码
+func (d *Database) ResetTOTP(username string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM totp WHERE username = ?", username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE username = ?", username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetRecoveryCodes 用新的恢复码替换管理员的全部恢复码
+func (d *Database) SetRecoveryCodes(username string, codes []string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(tx, username, codes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, username string, codes []string) error {
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE username = ?", username); err != nil {
+		return err
+	}
+	for _, code := range codes {
+		if _, err := tx.Exec("INSERT INTO recovery_codes (username, code_hash) VALUES (?, ?)",
+			username, hashRecoveryCode(code)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseRecoveryCode 使用一个恢复码，每个恢复码只能使用一次
+func (d *Database) UseRecoveryCode(username, code string) (bool, error) {
+	now := time.Now().Format("2006-01-02 15:04:05")
+	res, err := d.db.Exec("UPDATE recovery_codes SET used_at = ? WHERE username = ? AND code_hash = ? AND used_at IS NULL",
+		now, username, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// CountRecoveryCodes 返回管理员剩余可用的恢复码数量
+func (d *Database) CountRecoveryCodes(username string) (int, error) {
+	var n int
+	err := d.db.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE username = ? AND used_at IS NULL", username).Scan(&n)
+	return n, err
+}
+
+// hashRecoveryCode 恢复码本身是高熵随机串，保存忽略大小写和分隔符后的 SHA-256 即可
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// 管理员角色，权限依次递减
+const (
+	// RoleOwner 所有者，可以管理用户和系统设置
+	RoleOwner = "owner"
+	// RoleAdmin 管理员，可以管理路径、API Key 和连接
+	RoleAdmin = "admin"
+	// RoleViewer 只读用户，只能查看
+	RoleViewer = "viewer"
+)
+
+var roleLevels = map[string]int{RoleViewer: 1, RoleAdmin: 2, RoleOwner: 3}
+
+// ValidRole 检查角色名称是否有效
+func ValidRole(role string) bool {
+	return roleLevels[role] > 0
+}
+
+// User 管理后台用户
+type User struct {
+	ID          int        `json:"id"`
+	Username    string     `json:"username"`
+	Password    string     `json:"-"`
+	Role        string     `json:"role"`
+	Email       string     `json:"email"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// Can 检查用户是否拥有 role 或更高的权限
+func (u *User) Can(role string) bool {
+	return roleLevels[u.Role] >= roleLevels[role]
+}
+
+const userColumns = "id, username, password, role, COALESCE(email, ''), last_login_at, created_at FROM users"
+
+func scanUser(row interface{ Scan(...any) error }) (*User, error) {
+	var u User
+	var lastLogin, createdAt sql.NullTime
+	if err := row.Scan(&u.ID, &u.Username, &u.Password, &u.Role, &u.Email, &lastLogin, &createdAt); err != nil {
+		return nil, err
+	}
+	if lastLogin.Valid {
+		u.LastLoginAt = &lastLogin.Time
+	}
+	u.CreatedAt = createdAt.Time
+	return &u, nil
+}
+
+// GetUsers 获取所有用户
+func (d *Database) GetUsers() ([]*User, error) {
+	rows, err := d.db.Query("SELECT " + userColumns + " ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// GetUser 根据 ID 获取用户，不存在时返回 nil
+func (d *Database) GetUser(id int) (*User, error) {
+	u, err := scanUser(d.db.QueryRow("SELECT "+userColumns+" WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return u, err
+}
+
+// GetUserByName 根据用户名获取用户，不存在时返回 nil
+func (d *Database) GetUserByName(username string) (*User, error) {
+	u, err := scanUser(d.db.QueryRow("SELECT "+userColumns+" WHERE username = ?", username))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return u, err
+}
+
+// CreateUser 创建用户，密码以 Argon2id 哈希保存
+func (d *Database) CreateUser(username, password, role, email string) error {
+	hashed, err := crypto.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec("INSERT INTO users (username, password, role, email) VALUES (?, ?, ?, ?)",
+		username, hashed, role, email)
+	return err
+}
+
+// UpdateUser 修改用户的角色和邮箱
+func (d *Database) UpdateUser(id int, role, email string) error {
+	_, err := d.db.Exec("UPDATE users SET role = ?, email = ? WHERE id = ?", role, email, id)
+	return err
+}
+
+// SetUserPassword 修改用户密码
+func (d *Database) SetUserPassword(id int, password string) error {
+	hashed, err := crypto.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec("UPDATE users SET password = ? WHERE id = ?", hashed, id)
+	return err
+}
+
+// TouchUserLogin 记录用户的登录时间
+func (d *Database) TouchUserLogin(id int) error {
+	now := time.Now().Format("2006-01-02 15:04:05")
+	_, err := d.db.Exec("UPDATE users SET last_login_at = ? WHERE id = ?", now, id)
+	return err
+}
+
+// DeleteUser 删除用户及其两步验证配置
+func (d *Database) DeleteUser(id int) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var username string
+	if err := tx.QueryRow("SELECT username FROM users WHERE id = ?", id).Scan(&username); err != nil {
+		return err
+	}
+	for _, q := range []string{
+		"DELETE FROM totp WHERE username = ?",
+		"DELETE FROM recovery_codes WHERE username = ?",
+		"DELETE FROM users WHERE username = ?",
+	} {
+		if _, err := tx.Exec(q, username); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// AuditEntry 一条操作记录
+type AuditEntry struct {
+	ID        int       `json:"id"`
+	Username  string    `json:"username"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AddAudit 记录用户的一次操作
+func (d *Database) AddAudit(username, action, target, ip string) error {
+	_, err := d.db.Exec("INSERT INTO audit_log (username, action, target, ip) VALUES (?, ?, ?, ?)",
+		username, action, target, ip)
+	return err
+}
+
+// GetAuditLog 获取最近的 limit 条操作记录，最新的在前
+func (d *Database) GetAuditLog(limit int) ([]*AuditEntry, error) {
+	rows, err := d.db.Query(
+		"SELECT id, username, action, COALESCE(target, ''), COALESCE(ip, ''), created_at FROM audit_log ORDER BY id DESC LIMIT ?",
+		limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		var createdAt sql.NullTime
+		if err := rows.Scan(&e.ID, &e.Username, &e.Action, &e.Target, &e.IP, &createdAt); err != nil {
+			return nil, err
+		}
+		e.CreatedAt = createdAt.Time
+		entries = append(entries, &e)
+	}
+	return entries, rows.Err()
+}
+
+// Visitor 访客账号，被授权后可以登录受保护的路径
+type Visitor struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Password string `json:"-"`
+	Note     string `json:"note"`
+	Disabled bool   `json:"disabled"`
+	// Version 修改密码或停用时递增，使已签发的访问令牌失效
+	Version     int        `json:"-"`
+	Groups      []int      `json:"groups"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+const visitorColumns = "id, username, password, COALESCE(note, ''), disabled, version, last_login_at, created_at FROM visitors"
+
+func scanVisitor(row interface{ Scan(...any) error }) (*Visitor, error) {
+	var v Visitor
+	var lastLogin, createdAt sql.NullTime
+	if err := row.Scan(&v.ID, &v.Username, &v.Password, &v.Note, &v.Disabled, &v.Version, &lastLogin, &createdAt); err != nil {
+		return nil, err
+	}
+	if lastLogin.Valid {
+		v.LastLoginAt = &lastLogin.Time
+	}
+	v.CreatedAt = createdAt.Time
+	return &v, nil
+}
+
+// GetVisitors 获取所有访客账号及其所属的组
+func (d *Database) GetVisitors() ([]*Visitor, error) {
+	rows, err := d.db.Query("SELECT " + visitorColumns + " ORDER BY username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var visitors []*Visitor
+	byID := make(map[int]*Visitor)
+	for rows.Next() {
+		v, err := scanVisitor(rows)
+		if err != nil {
+			return nil, err
+		}
+		v.Groups = []int{}
+		visitors = append(visitors, v)
+		byID[v.ID] = v
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	members, err := d.db.Query("SELECT group_id, visitor_id FROM visitor_group_members ORDER BY group_id")
+	if err != nil {
+		return nil, err
+	}
+	defer members.Close()
+	for members.Next() {
+		var groupID, visitorID int
+		if err := members.Scan(&groupID, &visitorID); err != nil {
+			return nil, err
+		}
+		if v, ok := byID[visitorID]; ok {
+			v.Groups = append(v.Groups, groupID)
+		}
+	}
+	return visitors, members.Err()
+}
+
+// GetVisitor 根据 ID 获取访客账号，不存在时返回 nil
+func (d *Database) GetVisitor(id int) (*Visitor, error) {
+	v, err := scanVisitor(d.db.QueryRow("SELECT "+visitorColumns+" WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return v, err
+}
+
+// GetVisitorByName 根据用户名获取访客账号，不存在时返回 nil
+func (d *Database) GetVisitorByName(username string) (*Visitor, error) {
+	v, err := scanVisitor(d.db.QueryRow("SELECT "+visitorColumns+" WHERE username = ?", username))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return v, err
+}
+
+// CreateVisitor 创建访客账号，密码以 Argon2id 哈希保存
+func (d *Database) CreateVisitor(username, password, note string) error {
+	hashed, err := crypto.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec("INSERT INTO visitors (username, password, note) VALUES (?, ?, ?)", username, hashed, note)
+	return err
+}
+
+// UpdateVisitor 修改访客的备注和停用状态，停用时已签发的访问令牌失效
+func (d *Database) UpdateVisitor(id int, note string, disabled bool) error {
+	_, err := d.db.Exec(
+		`UPDATE visitors SET note = ?, disabled = ?,
+			version = CASE WHEN disabled = ? THEN version ELSE version + 1 END
+		WHERE id = ?`,
+		note, disabled, disabled, id)
+	return err
+}
+
+// SetVisitorPassword 修改访客密码，已签发的访问令牌失效
+func (d *Database) SetVisitorPassword(id int, password string) error {
+	hashed, err := crypto.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec("UPDATE visitors SET password = ?, version = version + 1 WHERE id = ?", hashed, id)
+	return err
+}
+
+// TouchVisitorLogin 记录访客的登录时间
+func (d *Database) TouchVisitorLogin(id int) error {
+	now := time.Now().Format("2006-01-02 15:04:05")
+	_, err := d.db.Exec("UPDATE visitors SET last_login_at = ? WHERE id = ?", now, id)
+	return err
+}
+
+// DeleteVisitor 删除访客账号及其组成员关系和路径授权
+func (d *Database) DeleteVisitor(id int) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, q := range []string{
+		"DELETE FROM visitor_group_members WHERE visitor_id = ?",
+		"DELETE FROM path_access WHERE visitor_id = ?",
+		"DELETE FROM visitors WHERE id = ?",
+	} {
+		if _, err := tx.Exec(q, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// VisitorGroup 访客组，授权给组等同于授权给组内所有访客
+type VisitorGroup struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Members   []int     `json:"members"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// GetVisitorGroups 获取所有访客组及其成员
+func (d *Database) GetVisitorGroups() ([]*VisitorGroup, error) {
+	rows, err := d.db.Query("SELECT id, name, created_at FROM visitor_groups ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []*VisitorGroup
+	byID := make(map[int]*VisitorGroup)
+	for rows.Next() {
+		g := &VisitorGroup{Members: []int{}}
+		var createdAt sql.NullTime
+		if err := rows.Scan(&g.ID, &g.Name, &createdAt); err != nil {
+			return nil, err
+		}
+		g.CreatedAt = createdAt.Time
+		groups = append(groups, g)
+		byID[g.ID] = g
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	members, err := d.db.Query("SELECT group_id, visitor_id FROM visitor_group_members ORDER BY visitor_id")
+	if err != nil {
+		return nil, err
+	}
+	defer members.Close()
+	for members.Next() {
+		var groupID, visitorID int
+		if err := members.Scan(&groupID, &visitorID); err != nil {
+			return nil, err
+		}
+		if g, ok := byID[groupID]; ok {
+			g.Members = append(g.Members, visitorID)
+		}
+	}
+	return groups, members.Err()
+}
+
+// GetVisitorGroupName 返回访客组名称，不存在时返回空字符串
+func (d *Database) GetVisitorGroupName(id int) (string, error) {
+	var name string
+	err := d.db.QueryRow("SELECT name FROM visitor_groups WHERE id = ?", id).Scan(&name)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return name, err
+}
+
+// CreateVisitorGroup 创建访客组
+func (d *Database) CreateVisitorGroup(name string, members []int) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO visitor_groups (name) VALUES (?)", name)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if err := setGroupMembers(tx, int(id), members); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateVisitorGroup 修改访客组名称并替换其成员
+func (d *Database) UpdateVisitorGroup(id int, name string, members []int) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE visitor_groups SET name = ? WHERE id = ?", name, id); err != nil {
+		return err
+	}
+	if err := setGroupMembers(tx, id, members); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func setGroupMembers(tx *sql.Tx, groupID int, members []int) error {
+	if _, err := tx.Exec("DELETE FROM visitor_group_members WHERE group_id = ?", groupID); err != nil {
+		return err
+	}
+	for _, visitorID := range members {
+		if _, err := tx.Exec(
+			"INSERT OR IGNORE INTO visitor_group_members (group_id, visitor_id) SELECT ?, id FROM visitors WHERE id = ?",
+			groupID, visitorID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteVisitorGroup 删除访客组及其成员关系和路径授权
+func (d *Database) DeleteVisitorGroup(id int) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, q := range []string{
+		"DELETE FROM visitor_group_members WHERE group_id = ?",
+		"DELETE FROM path_access WHERE group_id = ?",
+		"DELETE FROM visitor_groups WHERE id = ?",
+	} {
+		if _, err := tx.Exec(q, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// PathAccess 路径授权的访客和访客组
+type PathAccess struct {
+	Visitors []int `json:"visitors"`
+	Groups   []int `json:"groups"`
+}
+
+// GetPathAccess 获取路径授权的访客和访客组
+func (d *Database) GetPathAccess(pathID int) (*PathAccess, error) {
+	rows, err := d.db.Query("SELECT COALESCE(visitor_id, 0), COALESCE(group_id, 0) FROM path_access WHERE path_id = ? ORDER BY id", pathID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	access := &PathAccess{Visitors: []int{}, Groups: []int{}}
+	for rows.Next() {
+		var visitorID, groupID int
+		if err := rows.Scan(&visitorID, &groupID); err != nil {
+			return nil, err
+		}
+		if visitorID != 0 {
+			access.Visitors = append(access.Visitors, visitorID)
+		}
+		if groupID != 0 {
+			access.Groups = append(access.Groups, groupID)
+		}
+	}
+	return access, rows.Err()
+}
+
+// SetPathAccess 替换路径授权的访客和访客组，不存在的访客和组被忽略
+func (d *Database) SetPathAccess(pathID int, access *PathAccess) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM path_access WHERE path_id = ?", pathID); err != nil {
+		return err
+	}
+	for _, id := range access.Visitors {
+		if _, err := tx.Exec(
+			"INSERT INTO path_access (path_id, visitor_id) SELECT ?, id FROM visitors WHERE id = ?",
+			pathID, id); err != nil {
+			return err
+		}
+	}
+	for _, id := range access.Groups {
+		if _, err := tx.Exec(
+			"INSERT INTO path_access (path_id, group_id) SELECT ?, id FROM visitor_groups WHERE id = ?",
+			pathID, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// VisitorCanAccess 检查访客是否可以访问路径：账号未停用、令牌签发后未修改密码，
+// 并且直接或通过所属的组被授权访问该路径
+func (d *Database) VisitorCanAccess(visitorID, version, pathID int) (bool, error) {
+	var ok bool
+	err := d.db.QueryRow(`SELECT EXISTS (
+		SELECT 1 FROM visitors v
+		JOIN path_access a ON a.path_id = ?
+		WHERE v.id = ? AND v.version = ? AND v.disabled = 0
+			AND (a.visitor_id = v.id OR a.group_id IN (SELECT group_id FROM visitor_group_members WHERE visitor_id = v.id))
+	)`, pathID, visitorID, version).Scan(&ok)
+	return ok, err
+}
+
+// PathSSO 路径的 OpenID Connect 单点登录配置
+type PathSSO struct {
+	PathID       int    `json:"path_id"`
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"-"`
+	// AllowedEmails 允许登录的邮箱，"@example.com" 表示该域名下的所有邮箱
+	AllowedEmails []string `json:"allowed_emails"`
+	// AllowedGroups 允许登录的组，与 AllowedEmails 都为空时允许提供方的所有用户登录
+	AllowedGroups []string `json:"allowed_groups"`
+	// GroupsClaim ID Token 中包含用户所属组的声明名称
+	GroupsClaim string `json:"groups_claim"`
+}
+
+// GetPathSSO 获取路径的单点登录配置，未配置时返回 nil
+func (d *Database) GetPathSSO(pathID int) (*PathSSO, error) {
+	var c PathSSO
+	var secret, emails, groups, claim sql.NullString
+	err := d.db.QueryRow(
+		"SELECT path_id, issuer, client_id, client_secret, allowed_emails, allowed_groups, groups_claim FROM path_oidc WHERE path_id = ?",
+		pathID).Scan(&c.PathID, &c.Issuer, &c.ClientID, &secret, &emails, &groups, &claim)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.ClientSecret = secret.String
+	c.AllowedEmails = splitLines(emails.String)
+	c.AllowedGroups = splitLines(groups.String)
+	c.GroupsClaim = claim.String
+	return &c, nil
+}
+
+// SetPathSSO 保存路径的单点登录配置，已登录访客的令牌随之失效
+func (d *Database) SetPathSSO(c *PathSSO) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		`INSERT INTO path_oidc (path_id, issuer, client_id, client_secret, allowed_emails, allowed_groups, groups_claim)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(path_id) DO UPDATE SET issuer = excluded.issuer, client_id = excluded.client_id,
+			client_secret = excluded.client_secret, allowed_emails = excluded.allowed_emails,
+			allowed_groups = excluded.allowed_groups, groups_claim = excluded.groups_claim`,
+		c.PathID, c.Issuer, c.ClientID, c.ClientSecret,
+		strings.Join(c.AllowedEmails, "\n"), strings.Join(c.AllowedGroups, "\n"), c.GroupsClaim); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE paths SET sso_version = COALESCE(sso_version, 0) + 1 WHERE id = ?", c.PathID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeletePathSSO 关闭路径的单点登录
+func (d *Database) DeletePathSSO(pathID int) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM path_oidc WHERE path_id = ?", pathID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE paths SET sso_version = COALESCE(sso_version, 0) + 1 WHERE id = ?", pathID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// splitLines 拆分按行保存的列表，忽略空行
+func splitLines(s string) []string {
+	list := []string{}
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			list = append(list, line)
+		}
+	}
+	return list
+}
+
+// IPList 可在多个路径的网络规则中引用的地址列表，如办公网络
+type IPList struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CIDRs     []string  `json:"cidrs"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// GetIPLists 获取所有地址列表
+func (d *Database) GetIPLists() ([]*IPList, error) {
+	rows, err := d.db.Query("SELECT id, name, COALESCE(cidrs, ''), created_at FROM ip_lists ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lists := []*IPList{}
+	for rows.Next() {
+		var l IPList
+		var cidrs string
+		var createdAt sql.NullTime
+		if err := rows.Scan(&l.ID, &l.Name, &cidrs, &createdAt); err != nil {
+			return nil, err
+		}
+		l.CIDRs = splitLines(cidrs)
+		l.CreatedAt = createdAt.Time
+		lists = append(lists, &l)
+	}
+	return lists, rows.Err()
+}
+
+// GetIPListName 获取地址列表的名称，不存在时返回空字符串
+func (d *Database) GetIPListName(id int) (string, error) {
+	var name string
+	err := d.db.QueryRow("SELECT name FROM ip_lists WHERE id = ?", id).Scan(&name)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return name, err
+}
+
+// CreateIPList 创建地址列表
+func (d *Database) CreateIPList(name string, cidrs []string) error {
+	_, err := d.db.Exec("INSERT INTO ip_lists (name, cidrs) VALUES (?, ?)", name, strings.Join(cidrs, "\n"))
+	return err
+}
+
+// UpdateIPList 修改地址列表，引用该列表的路径立即按新的地址生效
+func (d *Database) UpdateIPList(id int, name string, cidrs []string) error {
+	_, err := d.db.Exec("UPDATE ip_lists SET name = ?, cidrs = ? WHERE id = ?", name, strings.Join(cidrs, "\n"), id)
+	return err
+}
+
+// DeleteIPList 删除地址列表及路径规则中对它的引用
+func (d *Database) DeleteIPList(id int) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, q := range []string{
+		"DELETE FROM path_ip_rules WHERE list_id = ?",
+		"DELETE FROM ip_lists WHERE id = ?",
+	} {
+		if _, err := tx.Exec(q, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// IPRuleSet 一组网络规则：单独的地址或网段，以及引用的地址列表
+type IPRuleSet struct {
+	CIDRs []string `json:"cidrs"`
+	Lists []int    `json:"lists"`
+}
+
+// PathNetwork 路径的网络规则。拒绝规则优先；设置了允许规则时只有匹配的地址可以访问
+type PathNetwork struct {
+	Allow IPRuleSet `json:"allow"`
+	Deny  IPRuleSet `json:"deny"`
+}
+
+// GetPathNetwork 获取路径的网络规则
+func (d *Database) GetPathNetwork(pathID int) (*PathNetwork, error) {
+	rows, err := d.db.Query("SELECT action, COALESCE(cidr, ''), COALESCE(list_id, 0) FROM path_ip_rules WHERE path_id = ? ORDER BY id", pathID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	network := &PathNetwork{
+		Allow: IPRuleSet{CIDRs: []string{}, Lists: []int{}},
+		Deny:  IPRuleSet{CIDRs: []string{}, Lists: []int{}},
+	}
+	for rows.Next() {
+		var action, cidr string
+		var listID int
+		if err := rows.Scan(&action, &cidr, &listID); err != nil {
+			return nil, err
+		}
+		set := &network.Allow
+		if action == "deny" {
+			set = &network.Deny
+		}
+		if cidr != "" {
+			set.CIDRs = append(set.CIDRs, cidr)
+		}
+		if listID != 0 {
+			set.Lists = append(set.Lists, listID)
+		}
+	}
+	return network, rows.Err()
+}
+
+// SetPathNetwork 替换路径的网络规则，不存在的地址列表被忽略
+func (d *Database) SetPathNetwork(pathID int, network *PathNetwork) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM path_ip_rules WHERE path_id = ?", pathID); err != nil {
+		return err
+	}
+	for action, set := range map[string]IPRuleSet{"allow": network.Allow, "deny": network.Deny} {
+		for _, cidr := range set.CIDRs {
+			if _, err := tx.Exec(
+				"INSERT INTO path_ip_rules (path_id, action, cidr) VALUES (?, ?, ?)",
+				pathID, action, cidr); err != nil {
+				return err
+			}
+		}
+		for _, id := range set.Lists {
+			if _, err := tx.Exec(
+				"INSERT INTO path_ip_rules (path_id, action, list_id) SELECT ?, ?, id FROM ip_lists WHERE id = ?",
+				pathID, action, id); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// GetPathCIDRs 返回路径允许和拒绝的全部网段，引用的地址列表被展开。
+// 路径有允许规则时 allow 不为 nil，即使引用的列表为空，此时拒绝所有地址
+func (d *Database) GetPathCIDRs(pathID int) (allow, deny []string, err error) {
+	rows, err := d.db.Query(`SELECT r.action, COALESCE(r.cidr, ''), COALESCE(l.cidrs, '')
+		FROM path_ip_rules r LEFT JOIN ip_lists l ON l.id = r.list_id
+		WHERE r.path_id = ?`, pathID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var action, cidr, listCIDRs string
+		if err := rows.Scan(&action, &cidr, &listCIDRs); err != nil {
+			return nil, nil, err
+		}
+		cidrs := splitLines(listCIDRs)
+		if cidr != "" {
+			cidrs = append(cidrs, cidr)
+		}
+		if action == "deny" {
+			deny = append(deny, cidrs...)
+		} else {
+			if allow == nil {
+				allow = []string{}
+			}
+			allow = append(allow, cidrs...)
+		}
+	}
+	return allow, deny, rows.Err()
+}
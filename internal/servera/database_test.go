@@ -0,0 +1,423 @@
+package servera
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"l2h/internal/crypto"
+)
+
+func TestRegisterNode(t *testing.T) {
+	s := newTestServer(t)
+	tests := []struct {
+		name    string
+		keyName string
+		want    string
+	}{
+		{name: "使用 API Key 名称", keyName: "office", want: "office"},
+		{name: "名称重复时加上编号", keyName: "office", want: "office-2"},
+		{name: "没有名称", keyName: "", want: "node-3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := s.db.GenerateAPIKey(tt.keyName, 0, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, err := s.db.LookupAPIKey(raw)
+			if err != nil || key == nil {
+				t.Fatalf("LookupAPIKey() = %v, %v", key, err)
+			}
+			node, err := s.db.RegisterNode(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if node.Name != tt.want || node.APIKeyID != key.ID {
+				t.Errorf("RegisterNode() = %q (key %d)，期望 %q (key %d)", node.Name, node.APIKeyID, tt.want, key.ID)
+			}
+
+			// 同一个 API Key 再次连接时沿用已有的节点
+			again, err := s.db.RegisterNode(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again.ID != node.ID {
+				t.Errorf("再次登记得到节点 %d，期望 %d", again.ID, node.ID)
+			}
+		})
+	}
+
+	if err := s.db.TouchNode(1, "203.0.113.1:1234"); err != nil {
+		t.Fatal(err)
+	}
+	node, err := s.db.GetNode(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.LastAddr != "203.0.113.1:1234" || node.LastSeenAt == nil {
+		t.Errorf("TouchNode() 后节点 = %+v", node)
+	}
+}
+
+func TestLookupAPIKey(t *testing.T) {
+	s := newTestServer(t)
+	valid, err := s.db.GenerateAPIKey("valid", 30, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  string
+		want string
+	}{
+		{name: "有效", key: valid, want: "valid"},
+		{name: "不存在", key: "l2h_unknown"},
+		{name: "空", key: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := s.db.LookupAPIKey(tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ""; key != nil {
+				got = key.Name
+				if got != tt.want {
+					t.Errorf("LookupAPIKey() = %q，期望 %q", got, tt.want)
+				}
+			} else if tt.want != "" {
+				t.Errorf("LookupAPIKey() = nil，期望 %q", tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncNodePaths(t *testing.T) {
+	s := newTestServer(t)
+	for _, name := range []string{"a", "b"} {
+		raw, err := s.db.GenerateAPIKey(name, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, _ := s.db.LookupAPIKey(raw)
+		if _, err := s.db.RegisterNode(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.db.AddPath("manual", "pw", 0, 80); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.AddPath("assigned", "", 1, 80); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.AddPath("other", "", 2, 80); err != nil {
+		t.Fatal(err)
+	}
+
+	// 每一步以节点 1 上报的绑定同步，want 为同步后全部路径的 路径:端口:节点
+	tests := []struct {
+		name      string
+		paths     []*Path
+		conflicts int
+		want      []string
+	}{
+		{
+			name: "创建路径，不接管管理员创建的路径",
+			paths: []*Path{
+				{Path: "app", Password: "secret", ServerBPort: 8080},
+				{Path: "manual", ServerBPort: 81},
+				{Path: "assigned", ServerBPort: 81},
+				{Path: "other", ServerBPort: 82},
+			},
+			conflicts: 3,
+			want:      []string{"app:8080:1", "assigned:80:1", "manual:80:0", "other:80:2"},
+		},
+		{
+			name:      "更新端口",
+			paths:     []*Path{{Path: "app", ServerBPort: 9090}, {Path: "manual", ServerBPort: 81}},
+			conflicts: 1,
+			want:      []string{"app:9090:1", "assigned:80:1", "manual:80:0", "other:80:2"},
+		},
+		{
+			name: "删除不再上报的同步路径",
+			want: []string{"assigned:80:1", "manual:80:0", "other:80:2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conflicts, err := s.db.SyncNodePaths(1, tt.paths)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(conflicts) != tt.conflicts {
+				t.Errorf("冲突 = %q，期望 %d 个", conflicts, tt.conflicts)
+			}
+			paths, err := s.db.GetPaths()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, p := range paths {
+				got = append(got, fmt.Sprintf("%s:%d:%d", p.Path, p.ServerBPort, p.NodeID))
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("同步后路径 = %v，期望 %v", got, tt.want)
+			}
+		})
+	}
+
+	// 管理员创建的路径的密码不被同步修改
+	p, err := s.db.GetPathByPath("manual")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := crypto.VerifyPassword("pw", p.Password); !ok || p.Synced {
+		t.Errorf("管理员创建的路径 = %+v，期望密码不变且未标记为同步", p)
+	}
+}
+
+func TestSyncNodePathsPassword(t *testing.T) {
+	s := newTestServer(t)
+	if _, err := s.db.SyncNodePaths(1, []*Path{{Path: "app", Password: "secret", ServerBPort: 8080}}); err != nil {
+		t.Fatal(err)
+	}
+	p, err := s.db.GetPathByPath("app")
+	if err != nil || p == nil {
+		t.Fatalf("GetPathByPath() = %v, %v", p, err)
+	}
+	if ok, err := crypto.VerifyPassword("secret", p.Password); !p.Synced || !ok || err != nil {
+		t.Errorf("同步的路径 = %+v，期望已同步且密码已哈希", p)
+	}
+}
+
+func TestSyncNodePathsPasswordVersion(t *testing.T) {
+	s := newTestServer(t)
+	steps := []struct {
+		name     string
+		password string
+		want     int
+	}{
+		{name: "创建", password: "a", want: 0},
+		{name: "密码未变", password: "a", want: 0},
+		{name: "修改密码", password: "b", want: 1},
+		{name: "取消密码", password: "", want: 2},
+	}
+	hashed := ""
+	for _, tt := range steps {
+		t.Run(tt.name, func(t *testing.T) {
+			// 节点上报的是哈希后的密码，相同密码的哈希不变
+			password := tt.password
+			if password != "" {
+				if ok, _ := crypto.VerifyPassword(password, hashed); ok {
+					password = hashed
+				} else {
+					hashed, _ = crypto.HashPassword(password)
+					password = hashed
+				}
+			}
+			if _, err := s.db.SyncNodePaths(1, []*Path{{Path: "app", Password: password, ServerBPort: 8080}}); err != nil {
+				t.Fatal(err)
+			}
+			p, err := s.db.GetPathByPath("app")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.PasswordVersion != tt.want {
+				t.Errorf("密码版本 = %d，期望 %d", p.PasswordVersion, tt.want)
+			}
+		})
+	}
+}
+
+// TestAPIKeyHashedAtRest 数据库只保存 API Key 的哈希，旧版本的明文 Key 升级后仍然有效
+func TestAPIKeyHashedAtRest(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "l2h-s.db")
+	old, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Exec(`CREATE TABLE api_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		key TEXT UNIQUE NOT NULL,
+		name TEXT,
+		expires_at DATETIME,
+		last_used_at DATETIME,
+		usage_count INTEGER DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`); err != nil {
+		t.Fatal(err)
+	}
+	const legacy = "legacyKeyLegacyKeyLegacyKey12345"
+	if _, err := old.Exec("INSERT INTO api_keys (key, name) VALUES (?, 'old')", legacy); err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+
+	db, err := NewDatabase(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	raw, err := db.GenerateAPIKey("new", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  string
+		want string
+	}{
+		{name: "升级前的 Key", key: legacy, want: "old"},
+		{name: "新生成的 Key", key: raw, want: "new"},
+		{name: "前缀相同的错误 Key", key: raw[:apiKeyPrefixLen] + "wrong", want: ""},
+		{name: "只有前缀", key: raw[:apiKeyPrefixLen], want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := db.LookupAPIKey(tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if k != nil {
+				got = k.Name
+				// 升级前的 Key 保留登记节点和同步路径的权限
+				if !k.Has(ScopeNode) || !k.Has(ScopeSync) {
+					t.Errorf("权限范围 = %v", k.Scopes)
+				}
+			}
+			if got != tt.want {
+				t.Errorf("LookupAPIKey() = %q，期望 %q", got, tt.want)
+			}
+		})
+	}
+
+	var stored []string
+	rows, err := db.db.Query("SELECT key || ' ' || COALESCE(prefix, '') FROM api_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s string
+		rows.Scan(&s)
+		stored = append(stored, s)
+	}
+	for _, s := range stored {
+		if strings.Contains(s, legacy) || strings.Contains(s, raw) {
+			t.Errorf("数据库中保存了完整的 Key: %s", s)
+		}
+	}
+
+	keys, err := db.GetAPIKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(keys)
+	if strings.Contains(string(body), legacy) || strings.Contains(string(body), raw) || !strings.Contains(string(body), `"prefix":"`+raw[:apiKeyPrefixLen]+`"`) {
+		t.Errorf("GetAPIKeys() = %s，期望只包含前缀", body)
+	}
+}
+
+func TestRotateAPIKey(t *testing.T) {
+	s := newTestServer(t)
+	old, err := s.db.GenerateAPIKey("office", 0, &APIKeyAccess{Scopes: []string{ScopeNode}, Paths: []string{"team/*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey, _ := s.db.LookupAPIKey(old)
+	node, err := s.db.RegisterNode(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	successor, newID, err := s.db.RotateAPIKey(oldKey.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, _ := s.db.GetAPIKey(oldKey.ID)
+	if rotated.ReplacedBy != newID || rotated.ExpiresAt == nil || time.Until(*rotated.ExpiresAt) > time.Hour+time.Minute {
+		t.Errorf("旧 Key = %+v，期望由 %d 接替并在一小时后过期", rotated, newID)
+	}
+	if k, _ := s.db.GetNodeAPIKey(node.ID); k == nil || k.ID != newID {
+		t.Errorf("GetNodeAPIKey() = %+v，期望新 Key %d", k, newID)
+	}
+
+	// 宽限期内新旧 Key 都有效，权限相同并且对应同一个节点
+	for _, raw := range []string{old, successor} {
+		k, err := s.db.LookupAPIKey(raw)
+		if err != nil || k == nil {
+			t.Fatalf("LookupAPIKey(%.8s) = %v, %v", raw, k, err)
+		}
+		if !k.Has(ScopeNode) || k.Has(ScopeSync) || !k.AllowsPath("team/app") || k.AllowsPath("other") {
+			t.Errorf("Key %.8s 的权限 = %+v，期望与旧 Key 相同", raw, k.APIKeyAccess)
+		}
+		n, err := s.db.RegisterNode(k)
+		if err != nil || n.ID != node.ID {
+			t.Errorf("RegisterNode(%.8s) = %+v, %v，期望节点 %d", raw, n, err, node.ID)
+		}
+	}
+	// 宽限期为 0 时旧 Key 立即失效，更早被轮换的 Key 改由最新的 Key 接替
+	third, thirdID, err := s.db.RotateAPIKey(newID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, _ := s.db.LookupAPIKey(successor); k != nil {
+		t.Error("宽限期为 0 时旧 Key 仍然有效")
+	}
+	if k, _ := s.db.LookupAPIKey(third); k == nil {
+		t.Error("第二次轮换的新 Key 无效")
+	}
+	if first, _ := s.db.GetAPIKey(oldKey.ID); first.ReplacedBy != thirdID {
+		t.Errorf("最早的 Key 由 %d 接替，期望 %d", first.ReplacedBy, thirdID)
+	}
+}
+
+// TestAPIKeyTimezone API Key 的时间以 UTC 写入，过期和宽限期不受服务器时区影响
+func TestAPIKeyTimezone(t *testing.T) {
+	local := time.Local
+	t.Cleanup(func() { time.Local = local })
+
+	for _, zone := range []*time.Location{time.FixedZone("UTC+8", 8*3600), time.FixedZone("UTC-5", -5*3600)} {
+		t.Run(zone.String(), func(t *testing.T) {
+			time.Local = zone
+			s := newTestServer(t)
+
+			raw, err := s.db.GenerateAPIKey("office", 1, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, _ := s.db.LookupAPIKey(raw)
+			if key == nil || key.ExpiresAt == nil || time.Until(*key.ExpiresAt) < 23*time.Hour || time.Until(*key.ExpiresAt) > 25*time.Hour {
+				t.Fatalf("一天后过期的 Key = %+v", key)
+			}
+			if key, _ = s.db.GetAPIKey(key.ID); key.LastUsedAt == nil || time.Since(*key.LastUsedAt) > time.Minute {
+				t.Errorf("最后使用时间 = %v，期望为现在", key.LastUsedAt)
+			}
+
+			successor, _, err := s.db.RotateAPIKey(key.ID, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if k, _ := s.db.LookupAPIKey(raw); k == nil || time.Until(*k.ExpiresAt) > time.Hour+time.Minute {
+				t.Errorf("宽限期为一小时的旧 Key = %+v，期望一小时内有效", k)
+			}
+			succ, _ := s.db.LookupAPIKey(successor)
+			if _, _, err := s.db.RotateAPIKey(succ.ID, 0); err != nil {
+				t.Fatal(err)
+			}
+			if k, _ := s.db.LookupAPIKey(successor); k != nil {
+				t.Error("宽限期为 0 时旧 Key 仍然有效")
+			}
+		})
+	}
+}
@@ -1,67 +1,110 @@
 package servera
 
 import (
+	"context"
 	"net/http"
 	"strings"
 
+	"l2h/internal/session"
 	"l2h/internal/utils"
 )
 
-// requireAPIKey 中间件：验证 API Key
-func (s *Server) requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+// requireAPIKey 中间件：验证 API Key，并要求 Key 拥有权限范围 scope
+func (s *Server) requireAPIKey(scope string, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// 从 Header 或 Query 参数获取 API Key
-		apiKey := r.Header.Get("X-API-Key")
-		if apiKey == "" {
-			apiKey = r.URL.Query().Get("api_key")
-		}
-
+		apiKey := extractAPIKey(r)
 		if apiKey == "" {
 			utils.WriteError(w, http.StatusUnauthorized, "API Key required")
 			return
 		}
 
 		// 验证 API Key
-		valid, err := s.db.ValidateAPIKey(apiKey)
+		key, err := s.db.LookupAPIKey(apiKey)
 		if err != nil {
 			utils.WriteError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
 
-		if !valid {
+		if key == nil {
 			utils.WriteError(w, http.StatusUnauthorized, "Invalid or expired API Key")
 			return
 		}
+		if !key.Has(scope) {
+			utils.WriteError(w, http.StatusForbidden, "API Key does not have the "+scope+" scope")
+			return
+		}
 
-		next(w, r)
+		next(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
 	}
 }
 
-// requireAuth 中间件：验证管理后台认证
-func (s *Server) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+// requireRoleOrAPIKey 中间件：请求携带 API Key 时要求 Key 拥有权限范围 scope，
+// 否则要求登录会话的用户拥有 role 或更高的权限
+func (s *Server) requireRoleOrAPIKey(role, scope string, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// 检查 session cookie
-		sessionCookie, err := r.Cookie("l2h_session")
-		if err != nil {
-			utils.WriteError(w, http.StatusUnauthorized, "Authentication required")
+		if extractAPIKey(r) != "" {
+			s.requireAPIKey(scope, next)(w, r)
 			return
 		}
+		s.requireRole(role, next)(w, r)
+	}
+}
+
+type apiKeyContextKey struct{}
+
+// apiKeyFromContext 返回 requireAPIKey 验证通过的 API Key
+func apiKeyFromContext(r *http.Request) *APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey{}).(*APIKey)
+	return key
+}
+
+// apiKeyAllows 检查请求使用的 API Key 是否允许查看或管理节点 nodeID 上的路径，
+// 请求使用登录会话时总是允许
+func apiKeyAllows(r *http.Request, path string, nodeID int) bool {
+	key := apiKeyFromContext(r)
+	return key == nil || (key.AllowsPath(path) && key.AllowsNode(nodeID))
+}
 
-		// 验证 session（这里简化处理，实际应该使用 JWT 或 session store）
-		settings, err := s.db.GetSettings()
-		if err != nil || settings == nil {
-			utils.WriteError(w, http.StatusInternalServerError, "Settings not configured")
+// actorName 返回执行操作的用户名，使用 API Key 时为 "api-key:<名称>"
+func actorName(r *http.Request) string {
+	if key := apiKeyFromContext(r); key != nil {
+		return "api-key:" + key.Name
+	}
+	return session.FromContext(r).User
+}
+
+// requireAuth 中间件：验证管理后台登录会话，任何角色均可访问
+func (s *Server) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return s.requireRole(RoleViewer, next)
+}
+
+// requireRole 中间件：验证登录会话，并要求当前用户拥有 role 或更高的权限
+func (s *Server) requireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return s.sessions.Require(func(w http.ResponseWriter, r *http.Request) {
+		user, err := s.db.GetUserByName(session.FromContext(r).User)
+		if err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-
-		// 简单的 session 验证（实际应该使用更安全的方式）
-		if sessionCookie.Value == "" {
-			utils.WriteError(w, http.StatusUnauthorized, "Invalid session")
+		// 用户已被删除，会话随之失效
+		if user == nil {
+			utils.WriteError(w, http.StatusUnauthorized, "Invalid or expired session")
+			return
+		}
+		if !user.Can(role) {
+			utils.WriteError(w, http.StatusForbidden, "Permission denied")
 			return
 		}
+		next(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, user)))
+	})
+}
 
-		next(w, r)
-	}
+type userContextKey struct{}
+
+// userFromContext 返回 requireRole 验证通过的当前用户
+func userFromContext(r *http.Request) *User {
+	user, _ := r.Context().Value(userContextKey{}).(*User)
+	return user
 }
 
 // CORS 中间件
@@ -0,0 +1,234 @@
+package servera
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"l2h/internal/utils"
+)
+
+// pathNetworkAllowed 按路径的网络规则检查访客的来源 IP：匹配拒绝规则的地址被拒绝，
+// 设置了允许规则时只有匹配的地址可以访问。规则在密码等认证之前检查
+func (s *Server) pathNetworkAllowed(r *http.Request, dbPath *Path) bool {
+	if dbPath.IPRules == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(utils.ClientIP(r))
+	if ip == nil {
+		return false
+	}
+
+	allow, deny, err := s.db.GetPathCIDRs(dbPath.ID)
+	if err != nil {
+		log.Printf("读取路径 %s 的网络规则失败: %v", dbPath.Path, err)
+		return false
+	}
+	// 保存时已验证网段格式，这里忽略无法解析的项
+	if utils.ContainsIP(parseCIDRsLenient(deny), ip) {
+		return false
+	}
+	return allow == nil || utils.ContainsIP(parseCIDRsLenient(allow), ip)
+}
+
+func parseCIDRsLenient(list []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if n, err := utils.ParseCIDR(s); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+// serveNetworkDenied 返回来源 IP 不允许访问路径的提示
+func (s *Server) serveNetworkDenied(w http.ResponseWriter, r *http.Request, dbPath *Path) {
+	log.Printf("拒绝来自 %s 的访问: 路径 %s 的网络规则不允许该地址", utils.ClientIP(r), dbPath.Path)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(`<!DOCTYPE html>
+<html>
+<head>
+	<title>禁止访问</title>
+	<meta charset="utf-8">
+</head>
+<body>
+	<h1>禁止访问</h1>
+	<p>您所在的网络不允许访问此路径。</p>
+</body>
+</html>`))
+}
+
+// validateCIDRs 检查并规范化网段列表，单个 IP 地址保持原样
+func validateCIDRs(list []string) ([]string, error) {
+	cidrs := []string{}
+	for _, s := range list {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if _, err := utils.ParseCIDR(s); err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, s)
+	}
+	return cidrs, nil
+}
+
+func (s *Server) handleGetIPLists(w http.ResponseWriter, r *http.Request) {
+	lists, err := s.db.GetIPLists()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, lists)
+}
+
+type ipListRequest struct {
+	Name  string   `json:"name"`
+	CIDRs []string `json:"cidrs"`
+}
+
+func decodeIPList(w http.ResponseWriter, r *http.Request) (*ipListRequest, bool) {
+	var req ipListRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		utils.WriteError(w, http.StatusBadRequest, "Name is required")
+		return nil, false
+	}
+	cidrs, err := validateCIDRs(req.CIDRs)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	req.CIDRs = cidrs
+	return &req, true
+}
+
+func (s *Server) handleCreateIPList(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeIPList(w, r)
+	if !ok {
+		return
+	}
+	if err := s.db.CreateIPList(req.Name, req.CIDRs); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.audit(r, "ip_list.create", req.Name)
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleUpdateIPList 修改地址列表，引用该列表的路径立即按新的地址生效
+func (s *Server) handleUpdateIPList(w http.ResponseWriter, r *http.Request) {
+	id, ok := idFromURL(r, "/api/ip-lists/")
+	if !ok {
+		utils.WriteError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	req, ok := decodeIPList(w, r)
+	if !ok {
+		return
+	}
+
+	name, err := s.db.GetIPListName(id)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if name == "" {
+		utils.WriteError(w, http.StatusNotFound, "List not found")
+		return
+	}
+
+	if err := s.db.UpdateIPList(id, req.Name, req.CIDRs); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.audit(r, "ip_list.update", req.Name)
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *Server) handleDeleteIPList(w http.ResponseWriter, r *http.Request) {
+	id, ok := idFromURL(r, "/api/ip-lists/")
+	if !ok {
+		utils.WriteError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	name, err := s.db.GetIPListName(id)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if name == "" {
+		utils.WriteError(w, http.StatusNotFound, "List not found")
+		return
+	}
+
+	if err := s.db.DeleteIPList(id); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.audit(r, "ip_list.delete", name)
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *Server) handleGetPathNetwork(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.accessPath(w, r)
+	if !ok {
+		return
+	}
+	network, err := s.db.GetPathNetwork(p.ID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"allow": network.Allow,
+		"deny":  network.Deny,
+		// 当前管理员的来源地址，便于设置允许规则时避免把自己排除在外
+		"client_ip": utils.ClientIP(r),
+	})
+}
+
+// handleSetPathNetwork 替换路径的网络规则，立即对新请求生效
+func (s *Server) handleSetPathNetwork(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.accessPath(w, r)
+	if !ok {
+		return
+	}
+
+	var network PathNetwork
+	if err := json.NewDecoder(r.Body).Decode(&network); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var err error
+	if network.Allow.CIDRs, err = validateCIDRs(network.Allow.CIDRs); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if network.Deny.CIDRs, err = validateCIDRs(network.Deny.CIDRs); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := s.db.SetPathNetwork(p.ID, &network); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.audit(r, "path.network", fmt.Sprintf("%s: 允许 %d 项, 拒绝 %d 项",
+		p.Path, len(network.Allow.CIDRs)+len(network.Allow.Lists), len(network.Deny.CIDRs)+len(network.Deny.Lists)))
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
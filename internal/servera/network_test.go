@@ -0,0 +1,104 @@
+package servera
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"l2h/internal/utils"
+)
+
+func TestPathNetwork(t *testing.T) {
+	s := newTestServer(t)
+	for _, path := range []string{"office", "public"} {
+		if err := s.db.AddPath(path, "", 0, 8080); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.db.CreateIPList("vpn", []string{"198.51.100.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	lists, _ := s.db.GetIPLists()
+	office, _ := s.db.GetPathByPath("office")
+	public, _ := s.db.GetPathByPath("public")
+	if err := s.db.SetPathNetwork(office.ID, &PathNetwork{
+		Allow: IPRuleSet{CIDRs: []string{"192.0.2.0/24"}, Lists: []int{lists[0].ID}},
+		Deny:  IPRuleSet{CIDRs: []string{"192.0.2.66"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.SetPathNetwork(public.ID, &PathNetwork{Deny: IPRuleSet{CIDRs: []string{"203.0.113.0/24"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := utils.SetTrustedProxies([]string{"10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { utils.SetTrustedProxies(nil) })
+
+	tests := []struct {
+		name       string
+		url        string
+		remoteAddr string
+		forwarded  string
+		status     int
+	}{
+		{name: "允许的网段", url: "/office/", remoteAddr: "192.0.2.1:1234", status: http.StatusOK},
+		{name: "地址列表中的网段", url: "/office/", remoteAddr: "198.51.100.9:1234", status: http.StatusOK},
+		{name: "拒绝优先于允许", url: "/office/", remoteAddr: "192.0.2.66:1234", status: http.StatusForbidden},
+		{name: "不在允许规则中", url: "/office/", remoteAddr: "203.0.113.1:1234", status: http.StatusForbidden},
+		{name: "只有拒绝规则", url: "/public/", remoteAddr: "192.0.2.1:1234", status: http.StatusOK},
+		{name: "拒绝的网段", url: "/public/", remoteAddr: "203.0.113.1:1234", status: http.StatusForbidden},
+		{name: "经可信代理", url: "/office/", remoteAddr: "10.0.0.1:1234", forwarded: "192.0.2.1", status: http.StatusOK},
+		{name: "不可信来源伪造地址", url: "/office/", remoteAddr: "203.0.113.1:1234", forwarded: "192.0.2.1", status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			w := httptest.NewRecorder()
+			s.handleRoot(w, r)
+			if w.Code != tt.status {
+				t.Errorf("状态码 = %d，期望 %d", w.Code, tt.status)
+			}
+		})
+	}
+
+	// 修改地址列表后引用它的路径立即生效
+	if err := s.db.UpdateIPList(lists[0].ID, "vpn", nil); err != nil {
+		t.Fatal(err)
+	}
+	office, _ = s.db.GetPathByPath("office")
+	r := httptest.NewRequest(http.MethodGet, "/office/", nil)
+	r.RemoteAddr = "198.51.100.9:1234"
+	if s.pathNetworkAllowed(r, office) {
+		t.Error("从地址列表移除后仍允许访问")
+	}
+}
+
+func TestValidateCIDRs(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []string
+		want    int
+		wantErr bool
+	}{
+		{name: "网段和地址", in: []string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"}, want: 3},
+		{name: "忽略空项", in: []string{"", " ", "10.0.0.0/8"}, want: 1},
+		{name: "无效网段", in: []string{"10.0.0.0/8", "10.0.0.0/40"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateCIDRs(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateCIDRs() 错误 = %v", err)
+			}
+			if len(got) != tt.want {
+				t.Errorf("validateCIDRs() = %v，期望 %d 项", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,17 +1,30 @@
 package servera
 
 import (
+	"crypto/ed25519"
 	"embed"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"l2h/internal/certs"
 	"l2h/internal/crypto"
+	"l2h/internal/link"
+	"l2h/internal/ratelimit"
+	"l2h/internal/session"
+	"l2h/internal/stun"
 	"l2h/internal/utils"
 	"l2h/internal/webrtc"
 )
@@ -19,11 +32,43 @@ import (
 //go:embed all:static
 var adminFS embed.FS
 
+//go:embed client
+var clientFS embed.FS
+
+// relayTimeout 数据通道在该时间内未能打开时，浏览器改用经服务器A的中继
+const relayTimeout = 10 * time.Second
+
+// keyRotationGrace 轮换 API Key 时旧 Key 默认继续有效的时间
+const keyRotationGrace = 24 * time.Hour
+
+// pathTokenTTL 路径访问令牌的有效期
+const pathTokenTTL = 7 * 24 * time.Hour
+
+// clientPrefix 引导页脚本在路径下的子目录，如 /<path>/__l2h/sw.js
+const clientPrefix = "__l2h/"
+
 type Server struct {
 	port       int
 	db         *Database
+	sessions   *session.Store
+	tokenKey   []byte
+	identity   ed25519.PrivateKey
+	guard      *ratelimit.Guard
 	webrtc     *webrtc.Manager
+	link       *link.Hub
+	stunPort   int
 	configFile string
+
+	// certs 不为 nil 时以 HTTPS 监听 port，httpPort 上的 HTTP 请求重定向到 HTTPS
+	certs    *certs.Manager
+	httpPort int
+
+	// ssoProviders 路径单点登录使用的 OpenID Connect 提供方
+	ssoProviders ssoProviders
+
+	// conflicts 各节点最近一次路径同步中的冲突
+	conflictsMu sync.Mutex
+	conflicts   map[int][]string
 }
 
 func NewServer(port int, dbPath string, configFile string) *Server {
@@ -31,24 +76,103 @@ func NewServer(port int, dbPath string, configFile string) *Server {
 	if err != nil {
 		log.Fatalf("初始化数据库失败: %v", err)
 	}
+	sessions, err := session.NewStore(db.db, "l2h_session")
+	if err != nil {
+		log.Fatalf("初始化会话存储失败: %v", err)
+	}
+	tokenKey, err := db.Secret("path_token")
+	if err != nil {
+		log.Fatalf("读取令牌密钥失败: %v", err)
+	}
+	identity, err := db.IdentityKey()
+	if err != nil {
+		log.Fatalf("读取身份密钥失败: %v", err)
+	}
 
-	return &Server{
+	s := &Server{
 		port:       port,
 		db:         db,
+		sessions:   sessions,
+		tokenKey:   tokenKey,
+		identity:   identity,
+		guard:      ratelimit.NewGuard(),
 		webrtc:     webrtc.NewManager(),
+		link:       link.NewHub(),
 		configFile: configFile,
+		conflicts:  make(map[int][]string),
 	}
+	s.link.SetIdentity(identity)
+	s.link.OnMessage(s.handleLinkMessage)
+	return s
+}
+
+// Fingerprint 返回服务器A身份公钥的指纹，服务器B首次连接时记录它
+func (s *Server) Fingerprint() string {
+	return link.Fingerprint(s.identity.Public().(ed25519.PublicKey))
+}
+
+// SetSTUNPort 设置内置 STUN 服务的 UDP 端口，0 表示关闭，需在 Start 之前调用
+func (s *Server) SetSTUNPort(port int) {
+	s.stunPort = port
 }
 
 func (s *Server) Start() error {
+	if s.stunPort > 0 {
+		go func() {
+			if err := stun.NewServer(s.stunPort).Start(); err != nil {
+				log.Printf("STUN 服务已停止: %v", err)
+			}
+		}()
+	}
+
 	mux := http.NewServeMux()
 
 	// 静态文件服务
 	mux.HandleFunc("/", s.handleRoot)
 	mux.HandleFunc("/api/", s.handleAPI)
 
-	log.Printf("服务器A启动在端口 %d", s.port)
-	return http.ListenAndServe(":"+strconv.Itoa(s.port), mux)
+	addr := ":" + strconv.Itoa(s.port)
+	if s.certs == nil {
+		log.Printf("服务器A启动在端口 %d", s.port)
+		return http.ListenAndServe(addr, mux)
+	}
+
+	if s.httpPort > 0 {
+		go func() {
+			handler := s.certs.HTTPHandler(http.HandlerFunc(s.redirectHTTPS))
+			if err := http.ListenAndServe(":"+strconv.Itoa(s.httpPort), handler); err != nil {
+				log.Printf("HTTP 重定向服务已停止: %v", err)
+			}
+		}()
+	}
+	srv := &http.Server{Addr: addr, Handler: mux, TLSConfig: s.certs.TLSConfig()}
+	log.Printf("服务器A启动在端口 %d（HTTPS）", s.port)
+	return srv.ListenAndServeTLS("", "")
+}
+
+// SetTLS 以 HTTPS 监听，httpPort 大于 0 时在该端口把 HTTP 请求重定向到 HTTPS，需在 Start 之前调用
+func (s *Server) SetTLS(m *certs.Manager, httpPort int) {
+	s.certs = m
+	s.httpPort = httpPort
+}
+
+// redirectHTTPS 把 HTTP 请求重定向到 HTTPS 端口。其他方法的请求可能已经以明文发送了密码等内容，
+// 直接拒绝，让客户端改用 HTTPS
+func (s *Server) redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		utils.WriteError(w, http.StatusBadRequest, "请使用 HTTPS")
+		return
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = strings.Trim(r.Host, "[]")
+	}
+	if s.port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(s.port))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
 }
 
 func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
@@ -73,34 +197,42 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// 检查是否是配置的路径
-	dbPath, err := s.db.GetPathByPath(path)
+	// 检查是否是配置的路径，支持 /<path>/<子路径>
+	dbPath, rest, err := s.matchPath(path)
 	if err == nil && dbPath != nil {
-		// 检查是否需要密码
-		if dbPath.Password != "" {
-			// 检查是否已认证
-			cookie, err := r.Cookie("l2h_auth_" + path)
-			if err != nil || cookie.Value == "" {
-				// 显示密码输入页面
-				s.servePasswordPage(w, r, path)
-				return
+		// 网络规则在所有认证之前检查，不允许的地址看不到登录页面
+		if !s.pathNetworkAllowed(r, dbPath) {
+			s.serveNetworkDenied(w, r, dbPath)
+			return
+		}
+
+		// 引导页脚本不含敏感信息，无需认证
+		if strings.HasPrefix(rest, clientPrefix) {
+			s.serveClientAsset(w, r, dbPath.Path, strings.TrimPrefix(rest, clientPrefix))
+			return
+		}
+
+		// 补全末尾斜杠，保证 Service Worker 作用域和相对地址正确
+		if rest == "" && !strings.HasSuffix(r.URL.Path, "/") {
+			target := "/" + dbPath.Path + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
 			}
-			// 验证cookie中的密码（支持哈希和明文）
-			valid := false
-			if crypto.IsHashed(dbPath.Password) {
-				valid, _ = crypto.VerifyPassword(cookie.Value, dbPath.Password)
+			http.Redirect(w, r, target, http.StatusFound)
+			return
+		}
+
+		if !s.pathAuthorized(r, dbPath) {
+			if dbPath.SSO {
+				s.startSSO(w, r, dbPath)
 			} else {
-				// 向后兼容
-				valid = cookie.Value == dbPath.Password
-			}
-			if !valid {
-				s.servePasswordPage(w, r, path)
-				return
+				s.servePasswordPage(w, r, dbPath)
 			}
+			return
 		}
 
 		// 通过 WebRTC 连接到服务器B
-		s.handleWebRTCPath(w, r, path, dbPath.ServerBPort)
+		s.handleWebRTCPath(w, r, dbPath)
 		return
 	}
 
@@ -108,72 +240,434 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
 	s.serveIndexPage(w, r)
 }
 
+// matchPath 查找请求路径所属的路径配置，按最长前缀匹配，返回配置和剩余的子路径
+func (s *Server) matchPath(reqPath string) (*Path, string, error) {
+	candidate := strings.TrimSuffix(reqPath, "/")
+	for candidate != "" {
+		p, err := s.db.GetPathByPath(candidate)
+		if err != nil {
+			return nil, "", err
+		}
+		if p != nil {
+			rest := strings.TrimPrefix(strings.TrimPrefix(reqPath, candidate), "/")
+			return p, rest, nil
+		}
+
+		i := strings.LastIndex(candidate, "/")
+		if i < 0 {
+			break
+		}
+		candidate = candidate[:i]
+	}
+	return nil, "", nil
+}
+
+// pathProtected 路径设置了密码、授权了访客账号或启用了单点登录时需要认证
+func pathProtected(dbPath *Path) bool {
+	return dbPath.Password != "" || dbPath.Grants > 0 || dbPath.SSO
+}
+
+// pathAuthorized 检查访客是否已通过路径的密码、访客账号或单点登录认证。
+// 启用单点登录的路径只接受单点登录签发的令牌
+func (s *Server) pathAuthorized(r *http.Request, dbPath *Path) bool {
+	if !pathProtected(dbPath) {
+		return true
+	}
+
+	cookie, err := r.Cookie(pathCookieName(dbPath))
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+
+	payload, ok := crypto.VerifyToken(s.tokenKey, cookie.Value)
+	if !ok {
+		return false
+	}
+
+	var id, version, visitorID int
+	var expires int64
+	if dbPath.SSO {
+		if _, err := fmt.Sscanf(payload, "%d.s%d.%d", &id, &version, &expires); err != nil {
+			return false
+		}
+		return id == dbPath.ID && version == dbPath.SSOVersion && time.Now().Unix() < expires
+	}
+	if _, err := fmt.Sscanf(payload, "%d.v%d.%d.%d", &id, &visitorID, &version, &expires); err == nil {
+		if id != dbPath.ID || time.Now().Unix() >= expires {
+			return false
+		}
+		// 每次请求都检查授权，删除、停用访客或撤销授权后立即生效
+		ok, err := s.db.VisitorCanAccess(visitorID, version, dbPath.ID)
+		if err != nil {
+			log.Printf("检查访客授权失败: %v", err)
+		}
+		return ok
+	}
+
+	if _, err := fmt.Sscanf(payload, "%d.%d.%d", &id, &version, &expires); err != nil {
+		return false
+	}
+	return dbPath.Password != "" && id == dbPath.ID && version == dbPath.PasswordVersion && time.Now().Unix() < expires
+}
+
+// pathToken 为通过密码认证的访客签发路径访问令牌，令牌包含路径 ID、密码版本和过期时间，
+// 路径密码修改后旧令牌随之失效
+func (s *Server) pathToken(dbPath *Path, expires time.Time) string {
+	return crypto.SignToken(s.tokenKey, fmt.Sprintf("%d.%d.%d", dbPath.ID, dbPath.PasswordVersion, expires.Unix()))
+}
+
+// visitorToken 为通过访客账号认证的访客签发路径访问令牌，令牌包含访客 ID 和账号版本，
+// 访客修改密码或被停用后旧令牌随之失效
+func (s *Server) visitorToken(dbPath *Path, visitor *Visitor, expires time.Time) string {
+	return crypto.SignToken(s.tokenKey, fmt.Sprintf("%d.v%d.%d.%d", dbPath.ID, visitor.ID, visitor.Version, expires.Unix()))
+}
+
+// pathCookieName 返回路径访问令牌的 cookie 名称，路径可能包含 cookie 名称不允许的字符，因此使用路径 ID
+func pathCookieName(dbPath *Path) string {
+	return "l2h_auth_" + strconv.Itoa(dbPath.ID)
+}
+
 func (s *Server) handleAPI(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/api/")
 
 	switch {
+	case path == "login" && r.Method == "POST":
+		s.handleLogin(w, r)
+	case path == "logout" && r.Method == "POST":
+		s.handleLogout(w, r)
+	case path == "identity" && r.Method == "GET":
+		s.handleIdentity(w, r)
+	case path == "logout-all" && r.Method == "POST":
+		s.requireAuth(s.handleLogoutAll)(w, r)
+	case path == "session" && r.Method == "GET":
+		s.requireAuth(s.handleGetSession)(w, r)
+	case path == "account" && r.Method == "PUT":
+		s.requireAuth(s.handleUpdateAccount)(w, r)
+	case path == "users" && r.Method == "GET":
+		s.requireRole(RoleOwner, s.handleGetUsers)(w, r)
+	case path == "users" && r.Method == "POST":
+		s.requireRole(RoleOwner, s.handleCreateUser)(w, r)
+	case strings.HasPrefix(path, "users/") && r.Method == "PUT":
+		s.requireRole(RoleOwner, s.handleUpdateUser)(w, r)
+	case strings.HasPrefix(path, "users/") && r.Method == "DELETE":
+		s.requireRole(RoleOwner, s.handleDeleteUser)(w, r)
+	case path == "visitors" && r.Method == "GET":
+		s.requireAuth(s.handleGetVisitors)(w, r)
+	case path == "visitors" && r.Method == "POST":
+		s.requireRole(RoleAdmin, s.handleCreateVisitor)(w, r)
+	case strings.HasPrefix(path, "visitors/") && r.Method == "PUT":
+		s.requireRole(RoleAdmin, s.handleUpdateVisitor)(w, r)
+	case strings.HasPrefix(path, "visitors/") && r.Method == "DELETE":
+		s.requireRole(RoleAdmin, s.handleDeleteVisitor)(w, r)
+	case path == "visitor-groups" && r.Method == "GET":
+		s.requireAuth(s.handleGetVisitorGroups)(w, r)
+	case path == "visitor-groups" && r.Method == "POST":
+		s.requireRole(RoleAdmin, s.handleCreateVisitorGroup)(w, r)
+	case strings.HasPrefix(path, "visitor-groups/") && r.Method == "PUT":
+		s.requireRole(RoleAdmin, s.handleUpdateVisitorGroup)(w, r)
+	case strings.HasPrefix(path, "visitor-groups/") && r.Method == "DELETE":
+		s.requireRole(RoleAdmin, s.handleDeleteVisitorGroup)(w, r)
+	case path == "ip-lists" && r.Method == "GET":
+		s.requireAuth(s.handleGetIPLists)(w, r)
+	case path == "ip-lists" && r.Method == "POST":
+		s.requireRole(RoleAdmin, s.handleCreateIPList)(w, r)
+	case strings.HasPrefix(path, "ip-lists/") && r.Method == "PUT":
+		s.requireRole(RoleAdmin, s.handleUpdateIPList)(w, r)
+	case strings.HasPrefix(path, "ip-lists/") && r.Method == "DELETE":
+		s.requireRole(RoleAdmin, s.handleDeleteIPList)(w, r)
+	case path == "audit" && r.Method == "GET":
+		s.requireRole(RoleAdmin, s.handleGetAudit)(w, r)
+	case path == "totp" && r.Method == "GET":
+		s.requireAuth(s.handleGetTOTP)(w, r)
+	case path == "totp/setup" && r.Method == "POST":
+		s.requireAuth(s.handleSetupTOTP)(w, r)
+	case path == "totp/enable" && r.Method == "POST":
+		s.requireAuth(s.handleEnableTOTP)(w, r)
+	case path == "totp/disable" && r.Method == "POST":
+		s.requireAuth(s.handleDisableTOTP)(w, r)
+	case path == "totp/recovery-codes" && r.Method == "POST":
+		s.requireAuth(s.handleRegenerateRecoveryCodes)(w, r)
+	case path == "lockouts" && r.Method == "GET":
+		s.requireAuth(s.handleGetLockouts)(w, r)
+	case path == "sessions" && r.Method == "GET":
+		s.requireAuth(s.handleGetSessions)(w, r)
+	case strings.HasPrefix(path, "sessions/") && r.Method == "DELETE":
+		s.requireAuth(s.handleRevokeSession)(w, r)
 	case path == "settings" && r.Method == "GET":
-		s.handleGetSettings(w, r)
+		s.requireAuth(s.handleGetSettings)(w, r)
 	case path == "settings" && r.Method == "POST":
-		s.handleSetSettings(w, r)
+		s.requireRole(RoleOwner, s.handleSetSettings)(w, r)
 	case path == "paths" && r.Method == "GET":
-		s.handleGetPaths(w, r)
+		s.requireRoleOrAPIKey(RoleViewer, ScopeStats, s.handleGetPaths)(w, r)
 	case path == "paths" && r.Method == "POST":
-		s.handleAddPath(w, r)
+		s.requireRoleOrAPIKey(RoleAdmin, ScopeAdmin, s.handleAddPath)(w, r)
+	case strings.HasPrefix(path, "paths/") && strings.HasSuffix(path, "/access") && r.Method == "GET":
+		s.requireAuth(s.handleGetPathAccess)(w, r)
+	case strings.HasPrefix(path, "paths/") && strings.HasSuffix(path, "/access") && r.Method == "PUT":
+		s.requireRole(RoleAdmin, s.handleSetPathAccess)(w, r)
+	case strings.HasPrefix(path, "paths/") && strings.HasSuffix(path, "/sso") && r.Method == "GET":
+		s.requireAuth(s.handleGetPathSSO)(w, r)
+	case strings.HasPrefix(path, "paths/") && strings.HasSuffix(path, "/sso") && r.Method == "PUT":
+		s.requireRole(RoleAdmin, s.handleSetPathSSO)(w, r)
+	case strings.HasPrefix(path, "paths/") && strings.HasSuffix(path, "/sso") && r.Method == "DELETE":
+		s.requireRole(RoleAdmin, s.handleDeletePathSSO)(w, r)
+	case strings.HasPrefix(path, "paths/") && strings.HasSuffix(path, "/network") && r.Method == "GET":
+		s.requireAuth(s.handleGetPathNetwork)(w, r)
+	case strings.HasPrefix(path, "paths/") && strings.HasSuffix(path, "/network") && r.Method == "PUT":
+		s.requireRole(RoleAdmin, s.handleSetPathNetwork)(w, r)
 	case strings.HasPrefix(path, "paths/") && r.Method == "DELETE":
-		s.handleDeletePath(w, r)
+		s.requireRoleOrAPIKey(RoleAdmin, ScopeAdmin, s.handleDeletePath)(w, r)
 	case path == "api-keys" && r.Method == "GET":
-		s.handleGetAPIKeys(w, r)
+		s.requireRole(RoleAdmin, s.handleGetAPIKeys)(w, r)
 	case path == "api-keys" && r.Method == "POST":
-		s.handleGenerateAPIKey(w, r)
+		s.requireRole(RoleAdmin, s.handleGenerateAPIKey)(w, r)
+	case strings.HasPrefix(path, "api-keys/") && strings.HasSuffix(path, "/rotate") && r.Method == "POST":
+		s.requireRole(RoleAdmin, s.handleRotateAPIKey)(w, r)
 	case strings.HasPrefix(path, "api-keys/") && r.Method == "DELETE":
-		s.handleDeleteAPIKey(w, r)
+		s.requireRole(RoleAdmin, s.handleDeleteAPIKey)(w, r)
+	case path == "connections" && r.Method == "GET":
+		s.requireRoleOrAPIKey(RoleViewer, ScopeStats, s.handleGetConnections)(w, r)
+	case strings.HasPrefix(path, "connections/") && r.Method == "GET":
+		s.requireRoleOrAPIKey(RoleViewer, ScopeStats, s.handleGetConnection)(w, r)
+	case strings.HasPrefix(path, "connections/") && r.Method == "DELETE":
+		s.requireRoleOrAPIKey(RoleAdmin, ScopeAdmin, s.handleCloseConnection)(w, r)
 	case path == "webrtc/offer" && r.Method == "POST":
 		s.handleWebRTCOffer(w, r)
+	case path == "webrtc/candidate" && r.Method == "POST":
+		s.handleWebRTCCandidate(w, r)
+	case path == "relay" && r.Method == "GET":
+		s.handleRelay(w, r)
+	case path == "nodes" && r.Method == "GET":
+		s.requireRoleOrAPIKey(RoleViewer, ScopeStats, s.handleGetNodes)(w, r)
+	case path == "link" && r.Method == "GET":
+		s.handleLink(w, r)
 	case path == "auth" && r.Method == "POST":
 		s.handleAuth(w, r)
+	case path == "oidc/callback" && r.Method == "GET":
+		s.handleSSOCallback(w, r)
 	default:
 		utils.WriteError(w, http.StatusNotFound, "Not found")
 	}
 }
 
+// handleLogin 验证管理员用户名和密码，成功后签发会话 cookie
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		// Code 两步验证码或恢复码，启用两步验证时必填
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ip := utils.ClientIP(r)
+	if wait := s.guard.Check(ip, "admin"); wait > 0 {
+		ratelimit.WriteTooMany(w, wait)
+		return
+	}
+
+	user, err := s.db.GetUserByName(req.Username)
+	if err != nil {
+		s.guard.Release(ip, "admin")
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// 用户名不存在时同样校验密码，避免通过响应时间判断用户名是否存在
+	hash := dummyPasswordHash()
+	if user != nil {
+		hash = user.Password
+	}
+	valid, _ := crypto.VerifyPassword(req.Password, hash)
+	if !valid || user == nil {
+		s.guard.Fail(ip, "admin")
+		log.Printf("管理员登录失败: 用户名 %q, 来自 %s", req.Username, ip)
+		utils.WriteError(w, http.StatusUnauthorized, "Invalid username or password")
+		return
+	}
+
+	ok, err := s.checkSecondFactor(user.Username, req.Code)
+	if err != nil {
+		s.guard.Release(ip, "admin")
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		message := "Verification code required"
+		if req.Code != "" {
+			s.guard.Fail(ip, "admin")
+			log.Printf("管理员 %s 两步验证失败, 来自 %s", user.Username, ip)
+			message = "Invalid verification code"
+		} else {
+			s.guard.Release(ip, "admin")
+		}
+		utils.WriteJSON(w, http.StatusUnauthorized, map[string]interface{}{"error": message, "totp_required": true})
+		return
+	}
+	s.guard.Succeed(ip, "admin")
+
+	if err := s.sessions.Login(w, r, user.Username); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := s.db.TouchUserLogin(user.ID); err != nil {
+		log.Printf("记录登录时间失败: %v", err)
+	}
+
+	log.Printf("管理员 %s 从 %s 登录", user.Username, ip)
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"username": user.Username, "role": user.Role})
+}
+
+// handleLogout 删除当前会话并清除 cookie
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if err := s.sessions.Logout(w, r); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleLogoutAll 吊销当前管理员在所有设备上的会话
+func (s *Server) handleLogoutAll(w http.ResponseWriter, r *http.Request) {
+	sess := session.FromContext(r)
+	if err := s.sessions.RevokeUser(sess.User, ""); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.sessions.Logout(w, r)
+	log.Printf("管理员 %s 退出了所有会话", sess.User)
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleGetSession 返回当前登录的用户和角色，供管理页面判断登录状态和可用的功能
+func (s *Server) handleGetSession(w http.ResponseWriter, r *http.Request) {
+	user := userFromContext(r)
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"username": user.Username, "role": user.Role, "email": user.Email})
+}
+
+// handleGetLockouts 返回最近因登录失败过多而触发的锁定
+func (s *Server) handleGetLockouts(w http.ResponseWriter, r *http.Request) {
+	utils.WriteJSON(w, http.StatusOK, s.guard.Events())
+}
+
+// handleGetSessions 列出登录会话，所有者可以看到所有用户的会话，其他用户只能看到自己的
+func (s *Server) handleGetSessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := s.visibleSessions(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, sessions)
+}
+
+func (s *Server) visibleSessions(r *http.Request) ([]*session.Session, error) {
+	sessions, err := s.sessions.List(session.FromContext(r).ID)
+	if err != nil {
+		return nil, err
+	}
+	user := userFromContext(r)
+	if user.Can(RoleOwner) {
+		return sessions, nil
+	}
+	own := sessions[:0]
+	for _, sess := range sessions {
+		if sess.User == user.Username {
+			own = append(own, sess)
+		}
+	}
+	return own, nil
+}
+
+func (s *Server) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/sessions/")
+	sessions, err := s.visibleSessions(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var target *session.Session
+	for _, sess := range sessions {
+		if sess.ID == id {
+			target = sess
+			break
+		}
+	}
+	if target == nil {
+		utils.WriteError(w, http.StatusNotFound, "Session not found")
+		return
+	}
+
+	if err := s.sessions.Revoke(id); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("管理员 %s 吊销了会话 %.8s", session.FromContext(r).User, id)
+	if target.User != session.FromContext(r).User {
+		s.audit(r, "session.revoke", target.User)
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleGetSettings 返回系统设置，账号信息由 /api/session 和 /api/users 提供
 func (s *Server) handleGetSettings(w http.ResponseWriter, r *http.Request) {
 	settings, err := s.db.GetSettings()
 	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	utils.WriteJSON(w, http.StatusOK, settings)
+	if settings == nil {
+		utils.WriteError(w, http.StatusServiceUnavailable, "Settings not configured")
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"admin_path": settings.AdminPath})
 }
 
 func (s *Server) handleSetSettings(w http.ResponseWriter, r *http.Request) {
-	var settings Settings
-	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+	var req struct {
+		AdminPath string `json:"admin_path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		utils.WriteError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if !utils.ValidatePath(req.AdminPath) {
+		utils.WriteError(w, http.StatusBadRequest, "Invalid admin path")
+		return
+	}
 
-	if err := s.db.SetSettings(&settings); err != nil {
+	if err := s.db.SetAdminPath(req.AdminPath); err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	s.audit(r, "settings.admin_path", req.AdminPath)
 	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 }
 
+// handleGetPaths 列出路径，使用 API Key 时只列出 Key 允许的路径
 func (s *Server) handleGetPaths(w http.ResponseWriter, r *http.Request) {
 	paths, err := s.db.GetPaths()
 	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	utils.WriteJSON(w, http.StatusOK, paths)
+	visible := make([]*Path, 0, len(paths))
+	for _, p := range paths {
+		if apiKeyAllows(r, p.Path, p.NodeID) {
+			visible = append(visible, p)
+		}
+	}
+	utils.WriteJSON(w, http.StatusOK, visible)
 }
 
 func (s *Server) handleAddPath(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Path        string `json:"path"`
 		Password    string `json:"password"`
+		NodeID      int    `json:"node_id"`
 		ServerBPort int    `json:"server_b_port"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -181,11 +675,29 @@ func (s *Server) handleAddPath(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.db.AddPath(req.Path, req.Password, req.ServerBPort); err != nil {
+	if req.NodeID != 0 {
+		node, err := s.db.GetNode(req.NodeID)
+		if err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if node == nil {
+			utils.WriteError(w, http.StatusBadRequest, "Node not found")
+			return
+		}
+	}
+	if !apiKeyAllows(r, req.Path, req.NodeID) {
+		utils.WriteError(w, http.StatusForbidden, "API Key is not allowed to manage this path")
+		return
+	}
+
+	if err := s.db.AddPath(req.Path, req.Password, req.NodeID, req.ServerBPort); err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	s.audit(r, "path.create", req.Path)
+
 	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 }
 
@@ -198,11 +710,23 @@ func (s *Server) handleDeletePath(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	p, err := s.db.GetPath(id)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if p == nil || !apiKeyAllows(r, p.Path, p.NodeID) {
+		utils.WriteError(w, http.StatusNotFound, "Path not found")
+		return
+	}
+
 	if err := s.db.DeletePath(id); err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	s.audit(r, "path.delete", p.Path)
+
 	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 }
 
@@ -219,19 +743,141 @@ func (s *Server) handleGenerateAPIKey(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Name          string `json:"name"`
 		ExpiresInDays int    `json:"expires_in_days"` // 0 表示永不过期
+		APIKeyAccess
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		utils.WriteError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	access, err := s.validateAPIKeyAccess(&req.APIKeyAccess)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	key, err := s.db.GenerateAPIKey(req.Name, req.ExpiresInDays)
+	key, err := s.db.GenerateAPIKey(req.Name, req.ExpiresInDays, access)
 	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusOK, map[string]string{"key": key})
+	s.audit(r, "api_key.create", req.Name)
+
+	// 完整的 Key 只在这里返回一次，之后只能看到前缀
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"key": key, "prefix": apiKeyPrefix(key)})
+}
+
+// handleRotateAPIKey 为 API Key 生成接替它的新 Key，旧 Key 在宽限期内继续有效。
+// 使用该 Key 的节点在线时新 Key 立即通过控制连接下发；不在线的节点需要管理员用返回的新 Key 重新设置，
+// 之后用旧 Key 连接的节点不会收到新 Key，避免持有旧 Key 的人借此换取新 Key
+func (s *Server) handleRotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var id int
+	if _, err := fmt.Sscanf(strings.TrimPrefix(r.URL.Path, "/api/api-keys/"), "%d/rotate", &id); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	var req struct {
+		// GraceHours 旧 Key 继续有效的小时数，0 表示立即失效，未指定时使用默认的 24 小时
+		GraceHours *int `json:"grace_hours"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			utils.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	grace := keyRotationGrace
+	if req.GraceHours != nil {
+		if *req.GraceHours < 0 {
+			utils.WriteError(w, http.StatusBadRequest, "Invalid grace period")
+			return
+		}
+		grace = time.Duration(*req.GraceHours) * time.Hour
+	}
+
+	old, err := s.db.GetAPIKey(id)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if old == nil {
+		utils.WriteError(w, http.StatusNotFound, "API Key not found")
+		return
+	}
+	if old.ReplacedBy != 0 {
+		utils.WriteError(w, http.StatusConflict, "API Key has already been rotated")
+		return
+	}
+
+	key, newID, err := s.db.RotateAPIKey(id, grace)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.audit(r, "api_key.rotate", old.Name)
+
+	delivered := false
+	if node, err := s.nodeForAPIKey(newID); err == nil && node != nil {
+		if err := s.link.Send(node.ID, &link.Message{Type: link.TypeKeyRotate, APIKey: key}); err == nil {
+			delivered = true
+			log.Printf("已向节点 %s 下发轮换后的 API Key", node.Name)
+		}
+	}
+
+	// 完整的 Key 只在这里返回一次，之后只能看到前缀
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"key":       key,
+		"prefix":    apiKeyPrefix(key),
+		"delivered": delivered,
+	})
+}
+
+// nodeForAPIKey 返回绑定了 API Key 的节点，没有时返回 nil
+func (s *Server) nodeForAPIKey(keyID int) (*Node, error) {
+	nodes, err := s.db.GetNodes()
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
+		if n.APIKeyID == keyID {
+			return n, nil
+		}
+	}
+	return nil, nil
+}
+
+// validateAPIKeyAccess 检查新 API Key 的权限范围、路径和节点，未指定权限范围时生成节点使用的 Key
+func (s *Server) validateAPIKeyAccess(a *APIKeyAccess) (*APIKeyAccess, error) {
+	access := DefaultAPIKeyAccess()
+	if len(a.Scopes) > 0 {
+		access.Scopes = []string{}
+		for _, scope := range a.Scopes {
+			if !ValidScope(scope) {
+				return nil, fmt.Errorf("Invalid scope: %s", scope)
+			}
+			access.Scopes = append(access.Scopes, scope)
+		}
+	}
+	for _, p := range a.Paths {
+		if p = strings.Trim(strings.TrimSpace(p), "/"); p == "" {
+			continue
+		}
+		if !validPathPattern(p) {
+			return nil, fmt.Errorf("Invalid path pattern: %s", p)
+		}
+		access.Paths = append(access.Paths, p)
+	}
+	for _, id := range a.Nodes {
+		node, err := s.db.GetNode(id)
+		if err != nil {
+			return nil, err
+		}
+		if node == nil {
+			return nil, fmt.Errorf("Node not found: %d", id)
+		}
+		access.Nodes = append(access.Nodes, id)
+	}
+	return access, nil
 }
 
 func (s *Server) handleDeleteAPIKey(w http.ResponseWriter, r *http.Request) {
@@ -242,11 +888,98 @@ func (s *Server) handleDeleteAPIKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	keys, err := s.db.GetAPIKeys()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	name := fmt.Sprintf("#%d", id)
+	for _, k := range keys {
+		if k.ID == id {
+			name = k.Name
+		}
+	}
+
 	if err := s.db.DeleteAPIKey(id); err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	s.audit(r, "api_key.delete", name)
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// connectionInfo 管理页面展示的连接信息
+type connectionInfo struct {
+	ID         string `json:"id"`
+	Path       string `json:"path"`
+	RemoteAddr string `json:"remote_addr"`
+	Transport  string `json:"transport"`
+	webrtc.Stats
+	// Duration 连接已持续的秒数
+	Duration int64 `json:"duration"`
+}
+
+func newConnectionInfo(conn *webrtc.Connection) connectionInfo {
+	st := conn.Stats()
+	return connectionInfo{
+		ID:         conn.ID,
+		Path:       conn.Path,
+		RemoteAddr: conn.RemoteAddr,
+		Transport:  conn.Transport,
+		Stats:      st,
+		Duration:   int64(time.Since(st.CreatedAt).Seconds()),
+	}
+}
+
+// connectionVisible 检查请求使用的 API Key 是否允许查看连接所访问的路径
+func (s *Server) connectionVisible(r *http.Request, conn *webrtc.Connection) bool {
+	if apiKeyFromContext(r) == nil {
+		return true
+	}
+	dbPath, err := s.db.GetPathByPath(conn.Path)
+	if err != nil || dbPath == nil {
+		return false
+	}
+	return apiKeyAllows(r, dbPath.Path, dbPath.NodeID)
+}
+
+func (s *Server) handleGetConnections(w http.ResponseWriter, r *http.Request) {
+	conns := s.webrtc.Connections()
+	infos := make([]connectionInfo, 0, len(conns))
+	for _, conn := range conns {
+		if s.connectionVisible(r, conn) {
+			infos = append(infos, newConnectionInfo(conn))
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].CreatedAt.After(infos[j].CreatedAt)
+	})
+	utils.WriteJSON(w, http.StatusOK, infos)
+}
+
+func (s *Server) handleGetConnection(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/connections/")
+	conn, ok := s.webrtc.GetConnection(id)
+	if !ok || !s.connectionVisible(r, conn) {
+		utils.WriteError(w, http.StatusNotFound, "Connection not found")
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, newConnectionInfo(conn))
+}
+
+// handleCloseConnection 强制关闭连接，服务器B和访客浏览器随之断开
+func (s *Server) handleCloseConnection(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/connections/")
+	if conn, ok := s.webrtc.GetConnection(id); !ok || !s.connectionVisible(r, conn) {
+		utils.WriteError(w, http.StatusNotFound, "Connection not found")
+		return
+	}
+
+	s.webrtc.Close(id)
+	log.Printf("管理员 %s 关闭了连接 %s", actorName(r), id)
+	s.audit(r, "connection.close", id)
 	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 }
 
@@ -260,19 +993,304 @@ func (s *Server) handleWebRTCOffer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 处理 WebRTC offer
-	answer, err := s.webrtc.HandleOffer(req.Offer, req.Path)
+	dbPath, err := s.db.GetPathByPath(req.Path)
+	if err != nil || dbPath == nil {
+		utils.WriteError(w, http.StatusNotFound, "Path not found")
+		return
+	}
+	if !s.pathNetworkAllowed(r, dbPath) {
+		utils.WriteError(w, http.StatusForbidden, "Access from your network is not allowed")
+		return
+	}
+	if !s.pathAuthorized(r, dbPath) {
+		utils.WriteError(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+
+	// 通过控制连接将 offer 转发给服务器B
+	// 连接由服务器B终结，本地关闭（如被清理）时通知服务器B
+	connID := webrtc.NewConnectionID()
+	s.webrtc.Track(connID, req.Path, webrtc.TransportP2P, utils.ClientIP(r), func() { s.link.Close(connID) })
+	answer, signature, err := s.link.Offer(dbPath.NodeID, connID, req.Path, req.Offer, s.iceServers(r))
+	if err != nil {
+		s.webrtc.Close(connID)
+		if err == link.ErrNoPeer {
+			utils.WriteError(w, http.StatusServiceUnavailable, nodeOfflineMessage(dbPath))
+			return
+		}
+		utils.WriteError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	s.webrtc.SetState(connID, webrtc.StateChecking)
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"id": connID, "answer": answer, "signature": signature})
+}
+
+// handleRelay 在 ICE 无法直连时，通过 WebSocket 和控制连接为访客中继流量
+func (s *Server) handleRelay(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	dbPath, err := s.db.GetPathByPath(query.Get("path"))
+	if err != nil || dbPath == nil {
+		utils.WriteError(w, http.StatusNotFound, "Path not found")
+		return
+	}
+	if !s.pathNetworkAllowed(r, dbPath) {
+		utils.WriteError(w, http.StatusForbidden, "Access from your network is not allowed")
+		return
+	}
+	if !s.pathAuthorized(r, dbPath) {
+		utils.WriteError(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+
+	// 放弃未能直连的对等连接
+	if prev := query.Get("id"); prev != "" {
+		if conn, ok := s.webrtc.GetConnection(prev); ok && conn.Path == dbPath.Path {
+			s.webrtc.Close(prev)
+		}
+	}
+
+	connID := webrtc.NewConnectionID()
+	relay, err := s.link.OpenRelay(dbPath.NodeID, connID, dbPath.Path, query.Get("secure") == "1")
+	if err != nil {
+		if err == link.ErrNoPeer {
+			utils.WriteError(w, http.StatusServiceUnavailable, nodeOfflineMessage(dbPath))
+			return
+		}
+		utils.WriteError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	conn := s.webrtc.Track(connID, dbPath.Path, webrtc.TransportRelay, utils.ClientIP(r), func() { relay.Close() })
+	s.webrtc.SetState(connID, webrtc.StateConnected)
+	defer s.webrtc.Close(connID)
+
+	link.ServeRelay(w, r, relay, conn)
+}
+
+// nodeOfflineMessage 返回路径所属节点不在线时的提示
+func nodeOfflineMessage(p *Path) string {
+	if p.NodeName != "" {
+		return fmt.Sprintf("服务器B节点 %s 不在线", p.NodeName)
+	}
+	return link.ErrNoPeer.Error()
+}
+
+// handleIdentity 用身份密钥签名服务器B发送的 challenge，服务器B据此确认服务器A的身份
+func (s *Server) handleIdentity(w http.ResponseWriter, r *http.Request) {
+	link.SignIdentity(w.Header(), s.identity, r)
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"fingerprint": s.Fingerprint()})
+}
+
+// handleLink 接受服务器B的控制连接，连接以 API Key 对应的节点身份登记
+func (s *Server) handleLink(w http.ResponseWriter, r *http.Request) {
+	addr := utils.ClientIP(r)
+	var nodeID int
+	s.link.Serve(w, r, func(apiKey string) (*link.Node, error) {
+		node, err := s.authenticateNode(apiKey)
+		if err != nil {
+			return nil, err
+		}
+		nodeID = node.ID
+		s.db.TouchNode(nodeID, addr)
+		return node, nil
+	})
+	if nodeID != 0 {
+		s.db.TouchNode(nodeID, addr)
+	}
+}
+
+// authenticateNode 校验服务器B的 API Key 并登记节点，
+// 未指定节点的路径只转发给 Key 允许使用该路径的节点
+func (s *Server) authenticateNode(apiKey string) (*link.Node, error) {
+	key, err := s.db.LookupAPIKey(apiKey)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, errors.New("API Key 无效或已过期")
+	}
+	if !key.Has(ScopeNode) {
+		return nil, fmt.Errorf("API Key 没有 %s 权限", ScopeNode)
+	}
+	node, err := s.db.RegisterNode(key)
+	if err != nil {
+		return nil, err
+	}
+	return &link.Node{ID: node.ID, Name: node.Name, Allow: key.AllowsPath}, nil
+}
+
+// syncPaths 根据节点上报的绑定更新路径，并把冲突返回给节点
+// 节点的 API Key 需要拥有 ScopeSync 权限，且只能同步 Key 允许的路径
+func (s *Server) syncPaths(peer *link.Peer, bindings []link.Binding) {
+	key, err := s.db.GetNodeAPIKey(peer.NodeID)
+	if err != nil {
+		log.Printf("读取节点 %s 的 API Key 失败: %v", peer.NodeName, err)
+		peer.Send(&link.Message{Type: link.TypeSyncResult, Error: err.Error()})
+		return
+	}
+	if key == nil || !key.Has(ScopeSync) {
+		log.Printf("节点 %s 的 API Key 没有同步路径的权限", peer.NodeName)
+		peer.Send(&link.Message{Type: link.TypeSyncResult, Error: "API Key 没有同步路径的权限"})
+		return
+	}
+
+	var conflicts []string
+	var paths []*Path
+	settings, _ := s.db.GetSettings()
+	for _, b := range bindings {
+		switch {
+		case !utils.ValidatePath(b.Path) || utils.ContainsSensitiveWord(b.Path):
+			conflicts = append(conflicts, fmt.Sprintf("路径 %s 格式无效或包含敏感词", b.Path))
+		case !key.AllowsPath(b.Path):
+			conflicts = append(conflicts, fmt.Sprintf("路径 %s 不在 API Key 允许的范围内", b.Path))
+		case settings != nil && b.Path == settings.AdminPath:
+			conflicts = append(conflicts, fmt.Sprintf("路径 %s 与管理路径冲突", b.Path))
+		default:
+			paths = append(paths, &Path{Path: b.Path, Password: b.Password, ServerBPort: b.Port})
+		}
+	}
+
+	dbConflicts, err := s.db.SyncNodePaths(peer.NodeID, paths)
+	if err != nil {
+		log.Printf("同步节点 %s 的路径失败: %v", peer.NodeName, err)
+		peer.Send(&link.Message{Type: link.TypeSyncResult, Error: err.Error()})
+		return
+	}
+	conflicts = append(conflicts, dbConflicts...)
+
+	s.conflictsMu.Lock()
+	if len(conflicts) > 0 {
+		s.conflicts[peer.NodeID] = conflicts
+	} else {
+		delete(s.conflicts, peer.NodeID)
+	}
+	s.conflictsMu.Unlock()
+
+	for _, c := range conflicts {
+		log.Printf("节点 %s 路径同步冲突: %s", peer.NodeName, c)
+	}
+	log.Printf("节点 %s 同步了 %d 个路径", peer.NodeName, len(bindings)-len(conflicts))
+	peer.Send(&link.Message{Type: link.TypeSyncResult, Conflicts: conflicts})
+}
+
+// nodeStatus 节点及其在线状态
+type nodeStatus struct {
+	*Node
+	Online      bool       `json:"online"`
+	RemoteAddr  string     `json:"remote_addr,omitempty"`
+	ConnectedAt *time.Time `json:"connected_at,omitempty"`
+	PathCount   int        `json:"path_count"`
+	Conflicts   []string   `json:"conflicts,omitempty"`
+}
+
+// handleGetNodes 列出所有节点，并标出当前离线的节点。使用 API Key 时只列出 Key 允许的节点
+func (s *Server) handleGetNodes(w http.ResponseWriter, r *http.Request) {
+	nodes, err := s.db.GetNodes()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	paths, err := s.db.GetPaths()
 	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusOK, map[string]string{"answer": answer})
+	online := make(map[int]link.Peer)
+	for _, peer := range s.link.Peers() {
+		online[peer.NodeID] = peer
+	}
+
+	result := make([]nodeStatus, 0, len(nodes))
+	for _, node := range nodes {
+		if key := apiKeyFromContext(r); key != nil && !key.AllowsNode(node.ID) {
+			continue
+		}
+		st := nodeStatus{Node: node}
+		if peer, ok := online[node.ID]; ok {
+			st.Online = true
+			st.RemoteAddr = peer.RemoteAddr
+			st.ConnectedAt = &peer.ConnectedAt
+		}
+		for _, p := range paths {
+			if p.NodeID == node.ID {
+				st.PathCount++
+			}
+		}
+		s.conflictsMu.Lock()
+		st.Conflicts = s.conflicts[node.ID]
+		s.conflictsMu.Unlock()
+		result = append(result, st)
+	}
+	utils.WriteJSON(w, http.StatusOK, result)
+}
+
+// handleLinkMessage 处理服务器B通过控制连接上报的消息。
+// 连接关闭和状态消息已由 Hub 确认属于该节点负责的连接
+func (s *Server) handleLinkMessage(peer *link.Peer, msg *link.Message) {
+	switch msg.Type {
+	case link.TypeSync:
+		s.syncPaths(peer, msg.Bindings)
+	case link.TypeClose:
+		s.webrtc.Close(msg.ID)
+	case link.TypeNodeKey:
+		s.saveNodeKey(peer, msg.NodeKey)
+	case link.TypeKeyRotated:
+		// 节点已保存新 Key
+		if key, err := s.db.GetNodeAPIKey(peer.NodeID); err == nil && key != nil {
+			s.db.TouchAPIKey(key.ID)
+			log.Printf("节点 %s 已保存轮换后的 API Key %s", peer.NodeName, key.Prefix)
+		}
+	case link.TypeState:
+		s.webrtc.UpdateStats(msg.ID, msg.BytesIn, msg.BytesOut)
+		s.webrtc.SetState(msg.ID, webrtc.State(msg.State))
+	}
+}
+
+// saveNodeKey 保存节点上报的公钥，访问该节点路径的访客用它验证 answer 和中继握手的签名
+func (s *Server) saveNodeKey(peer *link.Peer, key string) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err == nil {
+		_, err = crypto.ParseNodeKey(raw)
+	}
+	if err != nil {
+		log.Printf("节点 %s 上报的公钥无效: %v", peer.NodeName, err)
+		return
+	}
+	changed, err := s.db.SetNodeKey(peer.NodeID, key)
+	if err != nil {
+		log.Printf("保存节点 %s 的公钥失败: %v", peer.NodeName, err)
+		return
+	}
+	if changed {
+		log.Printf("节点 %s 的公钥指纹为 %s", peer.NodeName, crypto.KeyFingerprint(raw))
+	}
+}
+
+func (s *Server) handleWebRTCCandidate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID        string `json:"id"`
+		Candidate string `json:"candidate"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := s.link.Candidate(req.ID, req.Candidate); err != nil {
+		utils.WriteError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 }
 
 func (s *Server) handleAuth(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		Path     string `json:"path"`
+		Path string `json:"path"`
+		// Username 访客账号，为空时验证路径的共享密码
+		Username string `json:"username"`
 		Password string `json:"password"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -285,40 +1303,84 @@ func (s *Server) handleAuth(w http.ResponseWriter, r *http.Request) {
 		utils.WriteError(w, http.StatusNotFound, "Path not found")
 		return
 	}
+	if !s.pathNetworkAllowed(r, dbPath) {
+		utils.WriteError(w, http.StatusForbidden, "Access from your network is not allowed")
+		return
+	}
+	if dbPath.SSO {
+		utils.WriteError(w, http.StatusForbidden, "Path requires single sign-on")
+		return
+	}
+
+	ip := utils.ClientIP(r)
+	target := "path:" + dbPath.Path
+	if wait := s.guard.Check(ip, target); wait > 0 {
+		ratelimit.WriteTooMany(w, wait)
+		return
+	}
+
+	var token string
+	if req.Username != "" {
+		visitor, ok := s.checkVisitor(dbPath, req.Username, req.Password)
+		if !ok {
+			s.guard.Fail(ip, target)
+			log.Printf("访客 %q 登录路径 %s 失败, 来自 %s", req.Username, dbPath.Path, ip)
+			utils.WriteError(w, http.StatusUnauthorized, "Invalid username or password")
+			return
+		}
+		if err := s.db.TouchVisitorLogin(visitor.ID); err != nil {
+			log.Printf("记录访客登录时间失败: %v", err)
+		}
+		log.Printf("访客 %s 登录路径 %s, 来自 %s", visitor.Username, dbPath.Path, ip)
+		token = s.visitorToken(dbPath, visitor, time.Now().Add(pathTokenTTL))
+	} else {
+		if !s.checkPathPassword(dbPath, req.Password) {
+			s.guard.Fail(ip, target)
+			utils.WriteError(w, http.StatusUnauthorized, "Invalid password")
+			return
+		}
+		token = s.pathToken(dbPath, time.Now().Add(pathTokenTTL))
+	}
+	s.guard.Succeed(ip, target)
+
+	// 设置认证cookie，cookie 中只保存签名令牌，不保存密码
+	http.SetCookie(w, &http.Cookie{
+		Name:     pathCookieName(dbPath),
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(pathTokenTTL),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// checkPathPassword 验证路径的共享密码，未设置密码（只允许访客账号）的路径总是失败
+func (s *Server) checkPathPassword(dbPath *Path, password string) bool {
+	if dbPath.Password == "" {
+		return false
+	}
 
 	// 验证密码（支持哈希和明文，用于向后兼容）
 	valid := false
 	if crypto.IsHashed(dbPath.Password) {
 		// 使用哈希验证
-		valid, _ = crypto.VerifyPassword(req.Password, dbPath.Password)
+		valid, _ = crypto.VerifyPassword(password, dbPath.Password)
 	} else {
 		// 向后兼容：如果是明文，直接比较
-		valid = dbPath.Password == req.Password
+		valid = dbPath.Password == password
 		// 如果匹配，更新为哈希格式
 		if valid {
-			hashed, err := crypto.HashPassword(req.Password)
+			hashed, err := crypto.HashPassword(password)
 			if err == nil {
 				// 更新数据库中的密码为哈希格式
 				s.db.UpdatePathPassword(dbPath.ID, hashed)
 			}
 		}
 	}
-
-	if !valid {
-		utils.WriteError(w, http.StatusUnauthorized, "Invalid password")
-		return
-	}
-
-	// 设置认证cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "l2h_auth_" + req.Path,
-		Value:    req.Password,
-		Path:     "/",
-		MaxAge:   86400 * 7, // 7天
-		HttpOnly: true,
-	})
-
-	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	return valid
 }
 
 func (s *Server) serveIndexPage(w http.ResponseWriter, r *http.Request) {
@@ -434,7 +1496,18 @@ func (s *Server) serveAdminPage(w http.ResponseWriter, r *http.Request) {
 	http.ServeContent(w, r, fpath, stat.ModTime(), f.(io.ReadSeeker))
 }
 
-func (s *Server) servePasswordPage(w http.ResponseWriter, r *http.Request, path string) {
+func (s *Server) servePasswordPage(w http.ResponseWriter, r *http.Request, dbPath *Path) {
+	// 授权了访客账号的路径显示用户名输入框，同时设置了共享密码时用户名可以留空
+	usernameField := ""
+	if dbPath.Grants > 0 {
+		attrs := `placeholder="用户名" required`
+		if dbPath.Password != "" {
+			attrs = `placeholder="用户名（使用路径密码时留空）"`
+		}
+		usernameField = `<input type="text" id="username" autocomplete="username" ` + attrs + `>
+		`
+	}
+
 	html := `<!DOCTYPE html>
 <html>
 <head>
@@ -444,22 +1517,25 @@ func (s *Server) servePasswordPage(w http.ResponseWriter, r *http.Request, path
 <body>
 	<h1>此路径需要密码</h1>
 	<form id="authForm">
-		<input type="password" id="password" placeholder="请输入密码" required>
+		` + usernameField + `<input type="password" id="password" placeholder="请输入密码" required>
 		<button type="submit">提交</button>
 	</form>
 	<script>
 		document.getElementById('authForm').addEventListener('submit', async (e) => {
 			e.preventDefault();
+			const username = document.getElementById('username');
 			const password = document.getElementById('password').value;
 			const response = await fetch('/api/auth', {
 				method: 'POST',
 				headers: {'Content-Type': 'application/json'},
-				body: JSON.stringify({path: '` + path + `', password: password})
+				body: JSON.stringify({path: '` + dbPath.Path + `', username: username ? username.value : '', password: password})
 			});
 			if (response.ok) {
 				window.location.reload();
+			} else if (response.status === 429) {
+				alert((await response.json()).error);
 			} else {
-				alert('密码错误');
+				alert(username && username.value ? '用户名或密码错误' : '密码错误');
 			}
 		});
 	</script>
@@ -469,23 +1545,83 @@ func (s *Server) servePasswordPage(w http.ResponseWriter, r *http.Request, path
 	w.Write([]byte(html))
 }
 
-func (s *Server) handleWebRTCPath(w http.ResponseWriter, r *http.Request, path string, port int) {
-	// 这里应该实现 WebRTC 连接逻辑
-	// 暂时返回一个简单的页面
+// iceServers 返回访客和服务器B使用的 ICE 服务器
+// 启用内置 STUN 服务时使用访客访问本服务器的主机名，否则使用公共 STUN 服务器
+func (s *Server) iceServers(r *http.Request) []string {
+	if s.stunPort <= 0 {
+		return webrtc.DefaultICEServers
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	return []string{"stun:" + net.JoinHostPort(host, strconv.Itoa(s.stunPort))}
+}
+
+// handleWebRTCPath 返回引导页：注册 Service Worker 并建立到服务器B的数据通道，
+// 随后在 iframe 中加载应用，应用的所有请求都经由数据通道转发。
+// 路径指定了节点且节点上报过公钥时公布该公钥，引导页据此验证数据通道的另一端是该节点
+func (s *Server) handleWebRTCPath(w http.ResponseWriter, r *http.Request, dbPath *Path) {
+	path := dbPath.Path
+	config := map[string]interface{}{
+		"path":         path,
+		"base":         "/" + path + "/",
+		"iceServers":   s.iceServers(r),
+		"relayTimeout": relayTimeout.Milliseconds(),
+	}
+	if dbPath.NodeID != 0 {
+		if node, err := s.db.GetNode(dbPath.NodeID); err == nil && node != nil && node.NodeKey != "" {
+			config["nodeKey"] = node.NodeKey
+			config["nodeFingerprint"] = node.KeyFingerprint
+		}
+	}
+	configJSON, _ := json.Marshal(config)
+
 	html := `<!DOCTYPE html>
 <html>
 <head>
-	<title>WebRTC 连接</title>
+	<title>` + template.HTMLEscapeString(path) + `</title>
 	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<style>
+		html, body { margin: 0; height: 100%; overflow: hidden; }
+		#l2h-frame { border: 0; width: 100%; height: 100%; display: block; }
+		#l2h-status { position: fixed; top: 12px; left: 50%; transform: translateX(-50%);
+			padding: 6px 14px; border-radius: 4px; background: #333; color: #fff;
+			font: 14px sans-serif; }
+		#l2h-status.error { background: #c0392b; }
+	</style>
 </head>
 <body>
-	<h1>正在连接到服务器B的端口 ` + strconv.Itoa(port) + `</h1>
-	<div id="status">初始化中...</div>
-	<script>
-		// WebRTC 连接逻辑
-	</script>
+	<div id="l2h-status">初始化中...</div>
+	<iframe id="l2h-frame"></iframe>
+	<script>window.L2H = ` + string(configJSON) + `;</script>
+	<script src="/` + template.HTMLEscapeString(path) + `/` + clientPrefix + `l2h.js"></script>
 </body>
 </html>`
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
 	w.Write([]byte(html))
 }
+
+// serveClientAsset 提供引导页脚本和 Service Worker
+func (s *Server) serveClientAsset(w http.ResponseWriter, r *http.Request, path, name string) {
+	if name != "l2h.js" && name != "sw.js" {
+		http.NotFound(w, r)
+		return
+	}
+
+	content, err := clientFS.ReadFile("client/" + name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Service Worker 位于 __l2h/ 下，需要显式允许其作用域扩大到整个路径
+	if name == "sw.js" {
+		w.Header().Set("Service-Worker-Allowed", "/"+path+"/")
+	}
+	w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(content)
+}
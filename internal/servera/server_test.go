@@ -0,0 +1,599 @@
+package servera
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"l2h/internal/crypto"
+	"l2h/internal/link"
+	"l2h/internal/ratelimit"
+	"l2h/internal/webrtc"
+)
+
+// newTestServer 使用临时数据库创建服务器A
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	s := NewServer(0, filepath.Join(t.TempDir(), "l2h-s.db"), "")
+	t.Cleanup(func() { s.db.Close() })
+	return s
+}
+
+// login 设置管理员账号并登录，返回会话 cookie
+func login(t *testing.T, s *Server) *http.Cookie {
+	t.Helper()
+	if err := s.db.SetSettings(&Settings{Username: "admin", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	return loginWith(t, s, "admin", "secret")
+}
+
+// loginWith 以 username 和 password 登录，返回会话 cookie
+func loginWith(t *testing.T, s *Server, username, password string) *http.Cookie {
+	t.Helper()
+	w := apiRequest(s, http.MethodPost, "/api/login", `{"username":"`+username+`","password":"`+password+`"}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("登录失败: %d %s", w.Code, w.Body.String())
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "l2h_session" {
+			return c
+		}
+	}
+	t.Fatal("登录没有返回会话 cookie")
+	return nil
+}
+
+// apiRequest 携带会话 cookie 调用管理 API
+func apiRequest(s *Server, method, url, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	s.handleAPI(w, r)
+	return w
+}
+
+func TestPathBootstrap(t *testing.T) {
+	s := newTestServer(t)
+	for _, p := range []struct{ path, password string }{
+		{"app", ""},
+		{"team", ""},
+		{"team/x", "secret"},
+	} {
+		if err := s.db.AddPath(p.path, p.password, 0, 8080); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		url      string
+		status   int
+		location string
+		header   [2]string
+		contains string
+	}{
+		{name: "补全末尾斜杠", url: "/app?a=1", status: http.StatusFound, location: "/app/?a=1"},
+		{name: "引导页", url: "/app/", status: http.StatusOK, contains: `<script src="/app/__l2h/l2h.js">`},
+		{name: "子路径返回引导页", url: "/app/static/main.css", status: http.StatusOK, contains: `"base":"/app/"`},
+		{name: "Service Worker 作用域", url: "/app/__l2h/sw.js", status: http.StatusOK, header: [2]string{"Service-Worker-Allowed", "/app/"}},
+		{name: "未知的脚本", url: "/app/__l2h/other.js", status: http.StatusNotFound},
+		{name: "最长前缀匹配需要密码", url: "/team/x/", status: http.StatusOK, contains: "<form"},
+		{name: "受保护路径的脚本无需认证", url: "/team/x/__l2h/l2h.js", status: http.StatusOK, header: [2]string{"Content-Type", "application/javascript; charset=utf-8"}},
+		{name: "前缀路径不受子路径密码影响", url: "/team/y", status: http.StatusOK, contains: `"base":"/team/"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.handleRoot(w, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if w.Code != tt.status {
+				t.Fatalf("状态码 = %d，期望 %d", w.Code, tt.status)
+			}
+			if tt.location != "" && w.Header().Get("Location") != tt.location {
+				t.Errorf("Location = %q，期望 %q", w.Header().Get("Location"), tt.location)
+			}
+			if tt.header[0] != "" && w.Header().Get(tt.header[0]) != tt.header[1] {
+				t.Errorf("%s = %q，期望 %q", tt.header[0], w.Header().Get(tt.header[0]), tt.header[1])
+			}
+			if tt.contains != "" && !strings.Contains(w.Body.String(), tt.contains) {
+				t.Errorf("响应中没有 %q", tt.contains)
+			}
+		})
+	}
+}
+
+func TestConnections(t *testing.T) {
+	s := newTestServer(t)
+	cookie := login(t, s)
+	closed := make(map[string]bool)
+	for _, id := range []string{"c1", "c2"} {
+		s.webrtc.Track(id, "app", webrtc.TransportRelay, "203.0.113.1", func() { closed[id] = true })
+		time.Sleep(time.Millisecond)
+	}
+	s.webrtc.SetState("c2", webrtc.StateConnected)
+	s.webrtc.UpdateStats("c2", 10, 20)
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		status int
+		want   string
+	}{
+		{name: "列表按创建时间倒序", method: "GET", url: "/api/connections", status: http.StatusOK, want: `[{"id":"c2","path":"app","remote_addr":"203.0.113.1","transport":"relay","state":"connected"`},
+		{name: "单个连接", method: "GET", url: "/api/connections/c1", status: http.StatusOK, want: `{"id":"c1","path":"app","remote_addr":"203.0.113.1","transport":"relay","state":"new"`},
+		{name: "未知连接", method: "GET", url: "/api/connections/c3", status: http.StatusNotFound},
+		{name: "关闭连接", method: "DELETE", url: "/api/connections/c1", status: http.StatusOK},
+		{name: "已关闭的连接", method: "GET", url: "/api/connections/c1", status: http.StatusNotFound},
+		{name: "关闭未知连接", method: "DELETE", url: "/api/connections/c3", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := apiRequest(s, tt.method, tt.url, "", cookie)
+			if w.Code != tt.status {
+				t.Fatalf("状态码 = %d，期望 %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if !strings.HasPrefix(w.Body.String(), tt.want) {
+				t.Errorf("响应 = %s，期望以 %s 开头", w.Body.String(), tt.want)
+			}
+		})
+	}
+	if !closed["c1"] || closed["c2"] {
+		t.Errorf("关闭的连接 = %v，期望只有 c1", closed)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	s := newTestServer(t)
+	cookie := login(t, s)
+	expired, err := s.sessions.Create("expired", "127.0.0.1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.db.Exec("UPDATE sessions SET expires_at = '2000-01-01 00:00:00' WHERE username = 'expired'"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		body   string
+		cookie *http.Cookie
+		status int
+	}{
+		{name: "密码错误", method: "POST", url: "/api/login", body: `{"username":"admin","password":"wrong"}`, status: http.StatusUnauthorized},
+		{name: "用户名错误", method: "POST", url: "/api/login", body: `{"username":"root","password":"secret"}`, status: http.StatusUnauthorized},
+		{name: "请求格式错误", method: "POST", url: "/api/login", body: `{`, status: http.StatusBadRequest},
+		{name: "未登录", method: "GET", url: "/api/paths", status: http.StatusUnauthorized},
+		{name: "伪造的会话", method: "GET", url: "/api/paths", cookie: &http.Cookie{Name: "l2h_session", Value: "forged"}, status: http.StatusUnauthorized},
+		{name: "已过期的会话", method: "GET", url: "/api/paths", cookie: &http.Cookie{Name: "l2h_session", Value: expired}, status: http.StatusUnauthorized},
+		{name: "已登录", method: "GET", url: "/api/session", cookie: cookie, status: http.StatusOK},
+		{name: "设置不返回密码", method: "GET", url: "/api/settings", cookie: cookie, status: http.StatusOK},
+		{name: "退出登录", method: "POST", url: "/api/logout", cookie: cookie, status: http.StatusOK},
+		{name: "退出后会话失效", method: "GET", url: "/api/session", cookie: cookie, status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := apiRequest(s, tt.method, tt.url, tt.body, tt.cookie)
+			if w.Code != tt.status {
+				t.Fatalf("状态码 = %d，期望 %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if strings.Contains(w.Body.String(), "$argon2") {
+				t.Errorf("响应包含密码哈希: %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestPathAuthorized(t *testing.T) {
+	s := newTestServer(t)
+	if err := s.db.AddPath("app", "secret", 0, 8080); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.AddPath("other", "secret", 0, 8081); err != nil {
+		t.Fatal(err)
+	}
+	app, _ := s.db.GetPathByPath("app")
+	other, _ := s.db.GetPathByPath("other")
+	future := time.Now().Add(time.Hour)
+
+	// 密码修改后的同一路径
+	changed := *app
+	changed.PasswordVersion++
+
+	tests := []struct {
+		name  string
+		path  *Path
+		token string
+		want  bool
+	}{
+		{name: "有效令牌", path: app, token: s.pathToken(app, future), want: true},
+		{name: "没有令牌", path: app},
+		{name: "伪造的令牌", path: app, token: "forged"},
+		{name: "已过期", path: app, token: s.pathToken(app, time.Now().Add(-time.Minute))},
+		{name: "其他路径的令牌", path: app, token: s.pathToken(other, future)},
+		{name: "密码修改后旧令牌失效", path: &changed, token: s.pathToken(app, future)},
+		{name: "其他密钥签发", path: app, token: (&Server{tokenKey: []byte("other")}).pathToken(app, future)},
+		{name: "无密码路径", path: &Path{ID: 9, Path: "open"}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/"+tt.path.Path+"/", nil)
+			if tt.token != "" {
+				r.AddCookie(&http.Cookie{Name: pathCookieName(tt.path), Value: tt.token})
+			}
+			if got := s.pathAuthorized(r, tt.path); got != tt.want {
+				t.Errorf("pathAuthorized() = %v，期望 %v", got, tt.want)
+			}
+		})
+	}
+
+	// 令牌密钥保存在数据库中，重启后仍然有效
+	key, err := s.db.Secret("path_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key) != string(s.tokenKey) {
+		t.Error("Secret() 再次读取得到不同的密钥")
+	}
+}
+
+// TestLoginRateLimit 超过免费次数后登录被拒绝，不再验证密码
+func TestLoginRateLimit(t *testing.T) {
+	s := newTestServer(t)
+	login(t, s)
+	wrong := `{"username":"admin","password":"wrong"}`
+	for i := 0; i < ratelimit.IPPolicy.Free+1; i++ {
+		if w := apiRequest(s, http.MethodPost, "/api/login", wrong, nil); w.Code != http.StatusUnauthorized {
+			t.Fatalf("第 %d 次失败的状态码 = %d，期望 %d", i+1, w.Code, http.StatusUnauthorized)
+		}
+	}
+
+	// 正确的密码同样需要等待
+	w := apiRequest(s, http.MethodPost, "/api/login", `{"username":"admin","password":"secret"}`, nil)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("状态码 = %d, Retry-After = %q，期望 429", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+// keyRequest 携带 API Key 调用 API
+func keyRequest(s *Server, method, url, body, key string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	r.Header.Set("X-API-Key", key)
+	w := httptest.NewRecorder()
+	s.handleAPI(w, r)
+	return w
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	s := newTestServer(t)
+	login(t, s)
+	generate := func(name string, access *APIKeyAccess) string {
+		t.Helper()
+		key, err := s.db.GenerateAPIKey(name, 0, access)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	nodeKey := generate("office", nil)
+	k, _ := s.db.LookupAPIKey(nodeKey)
+	office, err := s.db.RegisterNode(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []struct {
+		path     string
+		password string
+		nodeID   int
+	}{{"team/app", "pw", office.ID}, {"other", "", 0}} {
+		if err := s.db.AddPath(p.path, p.password, p.nodeID, 8080); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := generate("stats", &APIKeyAccess{Scopes: []string{ScopeStats}, Paths: []string{"team/*"}})
+	admin := generate("admin", &APIKeyAccess{Scopes: []string{ScopeAdmin}, Nodes: []int{office.ID}})
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		body   string
+		key    string
+		status int
+		want   string
+	}{
+		{name: "节点 Key 不能读取状态", method: "GET", url: "/api/nodes", key: nodeKey, status: http.StatusForbidden},
+		{name: "节点 Key 不能添加路径", method: "POST", url: "/api/paths", body: `{"path":"x","server_b_port":1}`, key: nodeKey, status: http.StatusForbidden},
+		{name: "无效的 Key", method: "GET", url: "/api/nodes", key: "l2h_unknown", status: http.StatusUnauthorized},
+		{name: "读取节点", method: "GET", url: "/api/nodes", key: stats, status: http.StatusOK, want: `"name":"office"`},
+		{name: "只列出允许的路径", method: "GET", url: "/api/paths", key: stats, status: http.StatusOK, want: `"path":"team/app"`},
+		{name: "状态 Key 不能添加路径", method: "POST", url: "/api/paths", body: `{"path":"team/x","server_b_port":1}`, key: stats, status: http.StatusForbidden},
+		{name: "状态 Key 不能建立控制连接", method: "GET", url: "/api/link", key: stats, status: http.StatusUnauthorized},
+		{name: "管理 Key 不能查看 API Key", method: "GET", url: "/api/api-keys", key: admin, status: http.StatusUnauthorized},
+		{name: "管理 Key 不能修改系统设置", method: "POST", url: "/api/settings", body: `{"admin_path":"x"}`, key: admin, status: http.StatusUnauthorized},
+		{name: "管理 Key 在允许的节点上添加路径", method: "POST", url: "/api/paths", body: fmt.Sprintf(`{"path":"new","node_id":%d,"server_b_port":1}`, office.ID), key: admin, status: http.StatusOK},
+		{name: "管理 Key 不能添加未指定节点的路径", method: "POST", url: "/api/paths", body: `{"path":"any","server_b_port":1}`, key: admin, status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := keyRequest(s, tt.method, tt.url, tt.body, tt.key)
+			if w.Code != tt.status {
+				t.Fatalf("状态码 = %d，期望 %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tt.want) {
+				t.Errorf("响应 = %s，期望包含 %s", w.Body.String(), tt.want)
+			}
+		})
+	}
+
+	w := keyRequest(s, "GET", "/api/paths", "", stats)
+	if strings.Contains(w.Body.String(), `"path":"other"`) {
+		t.Errorf("状态 Key 看到了不允许的路径: %s", w.Body.String())
+	}
+	// 只告知是否设置了密码，不返回密码的哈希
+	if strings.Contains(w.Body.String(), `"password"`) || !strings.Contains(w.Body.String(), `"has_password":true`) {
+		t.Errorf("状态 Key 读取的路径 = %s，期望只有 has_password", w.Body.String())
+	}
+	entries, _ := s.db.GetAuditLog(1)
+	if len(entries) != 1 || entries[0].Username != "api-key:admin" || entries[0].Target != "new" {
+		t.Errorf("操作记录 = %+v，期望 api-key:admin 添加了 new", entries)
+	}
+}
+
+// TestSyncPathsScope 节点只能同步 API Key 允许的路径
+func TestSyncPathsScope(t *testing.T) {
+	s := newTestServer(t)
+	register := func(name string, access *APIKeyAccess) *Node {
+		t.Helper()
+		raw, err := s.db.GenerateAPIKey(name, 0, access)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, _ := s.db.LookupAPIKey(raw)
+		node, err := s.db.RegisterNode(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return node
+	}
+	limited := register("limited", &APIKeyAccess{Scopes: []string{ScopeNode, ScopeSync}, Paths: []string{"team/*"}})
+	noSync := register("nosync", &APIKeyAccess{Scopes: []string{ScopeNode}})
+
+	bindings := []link.Binding{{Path: "team/app", Port: 80}, {Path: "other", Port: 81}}
+	s.syncPaths(&link.Peer{NodeID: limited.ID, NodeName: limited.Name}, bindings)
+	s.syncPaths(&link.Peer{NodeID: noSync.ID, NodeName: noSync.Name}, []link.Binding{{Path: "nosync", Port: 82}})
+
+	paths, err := s.db.GetPaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range paths {
+		got = append(got, p.Path)
+	}
+	if len(got) != 1 || got[0] != "team/app" {
+		t.Errorf("同步后的路径 = %v，期望只有 team/app", got)
+	}
+	if c := s.conflicts[limited.ID]; len(c) != 1 || !strings.Contains(c[0], "other") {
+		t.Errorf("冲突 = %v，期望 other 不在允许的范围内", c)
+	}
+}
+
+// TestRotateAPIKeyDelivery 轮换后的新 Key 只下发给轮换时在线的节点，之后用旧 Key 连接的节点不会收到
+func TestRotateAPIKeyDelivery(t *testing.T) {
+	s := newTestServer(t)
+	cookie := login(t, s)
+	srv := httptest.NewServer(http.HandlerFunc(s.handleAPI))
+	t.Cleanup(srv.Close)
+
+	// connect 用 key 建立控制连接，返回收到的轮换后的 Key
+	connect := func(key string) <-chan string {
+		received := make(chan string, 1)
+		c := link.NewClient(srv.URL, key, func(c *link.Client, msg *link.Message) {
+			if msg.Type == link.TypeKeyRotate {
+				received <- msg.APIKey
+			}
+		})
+		connected := make(chan struct{})
+		c.OnConnect(func(*link.Client) { close(connected) })
+		go c.Run()
+		select {
+		case <-connected:
+		case <-time.After(5 * time.Second):
+			t.Fatal("节点没有连接到服务器A")
+		}
+		return received
+	}
+	rotate := func(id int, body string) (string, bool) {
+		t.Helper()
+		w := apiRequest(s, "POST", fmt.Sprintf("/api/api-keys/%d/rotate", id), body, cookie)
+		if w.Code != http.StatusOK {
+			t.Fatalf("轮换失败: %d %s", w.Code, w.Body.String())
+		}
+		var resp struct {
+			Key       string `json:"key"`
+			Delivered bool   `json:"delivered"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp.Key, resp.Delivered
+	}
+	keyID := func(raw string) int {
+		t.Helper()
+		k, _ := s.db.LookupAPIKey(raw)
+		if k == nil {
+			t.Fatalf("Key %.8s 无效", raw)
+		}
+		return k.ID
+	}
+
+	online, _ := s.db.GenerateAPIKey("online", 0, nil)
+	received := connect(online)
+	key, delivered := rotate(keyID(online), `{"grace_hours":1}`)
+	if !delivered {
+		t.Error("在线节点的新 Key 没有被下发")
+	}
+	select {
+	case got := <-received:
+		if got != key {
+			t.Errorf("节点收到 %.8s，期望 %.8s", got, key)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("在线节点没有收到新 Key")
+	}
+
+	offline, _ := s.db.GenerateAPIKey("offline", 0, nil)
+	offlineID := keyID(offline)
+	if _, err := s.db.RegisterNode(&APIKey{ID: offlineID, Name: "offline"}); err != nil {
+		t.Fatal(err)
+	}
+	key, delivered = rotate(offlineID, `{"grace_hours":1}`)
+	if delivered {
+		t.Error("离线节点的新 Key 被标记为已下发")
+	}
+	// 宽限期内旧 Key 仍可连接，但不会换到新 Key，轮换时返回的 Key 保持有效
+	select {
+	case got := <-connect(offline):
+		t.Errorf("用旧 Key 连接的节点收到了新 Key %.8s", got)
+	case <-time.After(300 * time.Millisecond):
+	}
+	keyID(key)
+
+	// grace_hours 为 0 时旧 Key 立即失效，未指定时使用默认的宽限期
+	immediate, _ := s.db.GenerateAPIKey("immediate", 0, nil)
+	rotate(keyID(immediate), `{"grace_hours":0}`)
+	if k, _ := s.db.LookupAPIKey(immediate); k != nil {
+		t.Error("grace_hours 为 0 时旧 Key 仍然有效")
+	}
+	fallback, _ := s.db.GenerateAPIKey("default", 0, nil)
+	rotate(keyID(fallback), "")
+	if k, _ := s.db.LookupAPIKey(fallback); k == nil || k.ExpiresAt == nil || time.Until(*k.ExpiresAt) < 23*time.Hour {
+		t.Errorf("未指定宽限期时旧 Key = %+v，期望 24 小时后过期", k)
+	}
+
+	for _, tt := range []struct {
+		id     int
+		status int
+	}{{offlineID, http.StatusConflict}, {999, http.StatusNotFound}} {
+		if w := apiRequest(s, "POST", fmt.Sprintf("/api/api-keys/%d/rotate", tt.id), "", cookie); w.Code != tt.status {
+			t.Errorf("轮换 Key %d 的状态码 = %d，期望 %d", tt.id, w.Code, tt.status)
+		}
+	}
+}
+
+// TestIdentity 身份密钥在重启后保持不变，服务器B可以通过 /api/identity 验证服务器A的身份
+func TestIdentity(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "l2h-s.db")
+	s := NewServer(0, dbPath, "")
+	srv := httptest.NewServer(http.HandlerFunc(s.handleAPI))
+	t.Cleanup(srv.Close)
+
+	fp, err := link.FetchIdentity(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp != s.Fingerprint() {
+		t.Errorf("FetchIdentity() = %q，期望 %q", fp, s.Fingerprint())
+	}
+	s.db.Close()
+
+	restarted := NewServer(0, dbPath, "")
+	t.Cleanup(func() { restarted.db.Close() })
+	if restarted.Fingerprint() != fp {
+		t.Errorf("重启后身份指纹 = %q，期望 %q", restarted.Fingerprint(), fp)
+	}
+}
+
+// TestNodeKey 节点上报的公钥会公布在其负责路径的引导页中，供访客浏览器验证服务器B
+func TestNodeKey(t *testing.T) {
+	s := newTestServer(t)
+	raw, _ := s.db.GenerateAPIKey("node", 0, nil)
+	apiKey, _ := s.db.LookupAPIKey(raw)
+	node, err := s.db.RegisterNode(apiKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.AddPath("app", "", node.ID, 8080); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.AddPath("any", "", 0, 8080); err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := crypto.GenerateNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := crypto.ParseNodePrivateKey(der)
+	pub := crypto.MarshalNodeKey(&key.PublicKey)
+	peer := &link.Peer{NodeID: node.ID, NodeName: node.Name}
+	s.saveNodeKey(peer, "bm90IGEga2V5")
+	if n, _ := s.db.GetNode(node.ID); n.NodeKey != "" {
+		t.Fatalf("保存了无效的公钥 %q", n.NodeKey)
+	}
+	// verified 返回路径能否被访客浏览器验证
+	verified := func(path string) bool {
+		p, err := s.db.GetPathByPath(path)
+		if err != nil || p == nil {
+			t.Fatalf("GetPathByPath(%q) = %v, %v", path, p, err)
+		}
+		return p.Verified
+	}
+	if verified("app") {
+		t.Error("节点上报公钥之前路径不应显示为已验证")
+	}
+	s.saveNodeKey(peer, base64.StdEncoding.EncodeToString(pub))
+	if !verified("app") || verified("any") {
+		t.Errorf("已验证: app = %v，any = %v，期望只有指定节点的路径已验证", verified("app"), verified("any"))
+	}
+
+	page := func(url string) string {
+		w := httptest.NewRecorder()
+		s.handleRoot(w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w.Body.String()
+	}
+	if body, want := page("/app/"), `"nodeFingerprint":"`+crypto.KeyFingerprint(pub)+`"`; !strings.Contains(body, want) {
+		t.Errorf("引导页中没有 %s", want)
+	}
+	if body := page("/any/"); strings.Contains(body, "nodeKey") {
+		t.Error("未指定节点的路径不应公布节点公钥")
+	}
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	tests := []struct {
+		name     string
+		port     int
+		method   string
+		host     string
+		url      string
+		status   int
+		location string
+	}{
+		{"保留路径和查询", 55080, http.MethodGet, "example.com:80", "/app/x?a=1", http.StatusMovedPermanently, "https://example.com:55080/app/x?a=1"},
+		{"默认端口", 443, http.MethodGet, "example.com", "/", http.StatusMovedPermanently, "https://example.com/"},
+		{"IPv6", 443, http.MethodHead, "[::1]:80", "/", http.StatusMovedPermanently, "https://[::1]/"},
+		{"拒绝明文提交", 443, http.MethodPost, "example.com", "/api/login", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{port: tt.port}
+			r := httptest.NewRequest(tt.method, tt.url, nil)
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+			s.redirectHTTPS(w, r)
+			if w.Code != tt.status || w.Header().Get("Location") != tt.location {
+				t.Errorf("状态码 = %d，Location = %q，期望 %d %q", w.Code, w.Header().Get("Location"), tt.status, tt.location)
+			}
+		})
+	}
+}
@@ -0,0 +1,403 @@
+package servera
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"l2h/internal/crypto"
+	"l2h/internal/oidc"
+	"l2h/internal/utils"
+)
+
+const (
+	// ssoTokenTTL 单点登录后路径访问令牌的有效期，过期后重新向提供方登录
+	ssoTokenTTL = 8 * time.Hour
+	// ssoStateTTL 从跳转到提供方到回调完成的最长时间
+	ssoStateTTL = 10 * time.Minute
+	// ssoProviderTTL 提供方配置的缓存时间
+	ssoProviderTTL = time.Hour
+	// ssoCallbackPath 提供方登录完成后的回调地址，需要在提供方注册
+	ssoCallbackPath = "/api/oidc/callback"
+)
+
+// ssoProviders 按 issuer 缓存的提供方配置和公钥
+type ssoProviders struct {
+	mu    sync.Mutex
+	cache map[string]*cachedProvider
+}
+
+type cachedProvider struct {
+	provider *oidc.Provider
+	fetched  time.Time
+}
+
+// get 返回提供方，缓存过期或不存在时重新读取配置文档
+func (c *ssoProviders) get(ctx context.Context, issuer string) (*oidc.Provider, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cached, ok := c.cache[issuer]; ok && time.Since(cached.fetched) < ssoProviderTTL {
+		return cached.provider, nil
+	}
+	provider, err := oidc.Discover(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if c.cache == nil {
+		c.cache = make(map[string]*cachedProvider)
+	}
+	c.cache[issuer] = &cachedProvider{provider: provider, fetched: time.Now()}
+	return provider, nil
+}
+
+// forget 删除缓存的提供方配置
+func (c *ssoProviders) forget(issuer string) {
+	c.mu.Lock()
+	delete(c.cache, issuer)
+	c.mu.Unlock()
+}
+
+// ssoState 跳转到提供方前保存在 cookie 中的登录状态
+type ssoState struct {
+	PathID   int    `json:"p"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"`
+	ReturnTo string `json:"r"`
+	Expires  int64  `json:"e"`
+}
+
+// ssoStateCookie 返回登录状态 cookie 的名称，名称包含 state 参数，同时在多个标签页中登录互不影响
+func ssoStateCookie(state string) string {
+	return "l2h_oidc_" + state
+}
+
+// ssoRedirectURI 返回本服务器的回调地址
+func ssoRedirectURI(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + ssoCallbackPath
+}
+
+// ssoToken 为通过单点登录的访客签发路径访问令牌，令牌包含单点登录配置的版本，
+// 修改或关闭单点登录后旧令牌随之失效
+func (s *Server) ssoToken(dbPath *Path, expires time.Time) string {
+	return crypto.SignToken(s.tokenKey, fmt.Sprintf("%d.s%d.%d", dbPath.ID, dbPath.SSOVersion, expires.Unix()))
+}
+
+// startSSO 将未登录的访客重定向到路径配置的 OpenID Connect 提供方
+func (s *Server) startSSO(w http.ResponseWriter, r *http.Request, dbPath *Path) {
+	config, err := s.db.GetPathSSO(dbPath.ID)
+	if err != nil || config == nil {
+		log.Printf("读取路径 %s 的单点登录配置失败: %v", dbPath.Path, err)
+		s.serveSSOError(w, http.StatusInternalServerError, "单点登录配置不可用")
+		return
+	}
+	provider, err := s.ssoProviders.get(r.Context(), config.Issuer)
+	if err != nil {
+		log.Printf("路径 %s 的单点登录提供方不可用: %v", dbPath.Path, err)
+		s.serveSSOError(w, http.StatusBadGateway, "无法连接单点登录提供方，请稍后再试")
+		return
+	}
+
+	state, err := oidc.RandomString(24)
+	if err != nil {
+		s.serveSSOError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	nonce, err := oidc.RandomString(24)
+	if err != nil {
+		s.serveSSOError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	verifier, challenge, err := oidc.NewPKCE()
+	if err != nil {
+		s.serveSSOError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	payload, _ := json.Marshal(ssoState{
+		PathID:   dbPath.ID,
+		Nonce:    nonce,
+		Verifier: verifier,
+		ReturnTo: r.URL.RequestURI(),
+		Expires:  time.Now().Add(ssoStateTTL).Unix(),
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoStateCookie(state),
+		Value:    crypto.SignToken(s.tokenKey, string(payload)),
+		Path:     ssoCallbackPath,
+		MaxAge:   int(ssoStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		// 提供方通过顶层导航跳转回来，Lax 模式下 cookie 会被发送
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, provider.AuthCodeURL(config.ClientID, ssoRedirectURI(r), state, nonce, challenge), http.StatusFound)
+}
+
+// handleSSOCallback 处理提供方登录完成后的回调：验证 ID Token 和允许的邮箱或组，
+// 通过后签发路径访问令牌并返回原来访问的地址
+func (s *Server) handleSSOCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	stateParam := query.Get("state")
+	if stateParam == "" {
+		s.serveSSOError(w, http.StatusBadRequest, "缺少 state 参数")
+		return
+	}
+
+	cookie, err := r.Cookie(ssoStateCookie(stateParam))
+	if err != nil {
+		s.serveSSOError(w, http.StatusBadRequest, "登录已过期，请重新访问")
+		return
+	}
+	// 登录状态只能使用一次
+	http.SetCookie(w, &http.Cookie{Name: cookie.Name, Path: ssoCallbackPath, MaxAge: -1})
+
+	var state ssoState
+	payload, ok := crypto.VerifyToken(s.tokenKey, cookie.Value)
+	if !ok || json.Unmarshal([]byte(payload), &state) != nil || time.Now().Unix() >= state.Expires {
+		s.serveSSOError(w, http.StatusBadRequest, "登录已过期，请重新访问")
+		return
+	}
+
+	if e := query.Get("error"); e != "" {
+		log.Printf("单点登录提供方返回错误: %s %s", e, query.Get("error_description"))
+		s.serveSSOError(w, http.StatusForbidden, "单点登录失败: "+e)
+		return
+	}
+
+	dbPath, err := s.db.GetPath(state.PathID)
+	if err != nil || dbPath == nil || !dbPath.SSO {
+		s.serveSSOError(w, http.StatusNotFound, "路径不存在或已关闭单点登录")
+		return
+	}
+	if !s.pathNetworkAllowed(r, dbPath) {
+		s.serveNetworkDenied(w, r, dbPath)
+		return
+	}
+	config, err := s.db.GetPathSSO(dbPath.ID)
+	if err != nil || config == nil {
+		s.serveSSOError(w, http.StatusInternalServerError, "单点登录配置不可用")
+		return
+	}
+	provider, err := s.ssoProviders.get(r.Context(), config.Issuer)
+	if err != nil {
+		log.Printf("路径 %s 的单点登录提供方不可用: %v", dbPath.Path, err)
+		s.serveSSOError(w, http.StatusBadGateway, "无法连接单点登录提供方，请稍后再试")
+		return
+	}
+
+	ip := utils.ClientIP(r)
+	rawToken, err := provider.Exchange(r.Context(), config.ClientID, config.ClientSecret, ssoRedirectURI(r), query.Get("code"), state.Verifier)
+	if err != nil {
+		log.Printf("路径 %s 单点登录换取令牌失败: %v", dbPath.Path, err)
+		s.serveSSOError(w, http.StatusBadGateway, "单点登录失败，请重新访问")
+		return
+	}
+	idToken, err := provider.Verify(r.Context(), rawToken, config.ClientID, state.Nonce)
+	if err != nil {
+		log.Printf("路径 %s 单点登录验证 ID Token 失败: %v", dbPath.Path, err)
+		s.serveSSOError(w, http.StatusForbidden, "单点登录失败，请重新访问")
+		return
+	}
+
+	if !ssoAllowed(config, idToken) {
+		log.Printf("单点登录用户 %s 无权访问路径 %s, 来自 %s", idToken.Name(), dbPath.Path, ip)
+		s.serveSSOError(w, http.StatusForbidden, "账号 "+idToken.Name()+" 无权访问此路径")
+		return
+	}
+	log.Printf("单点登录用户 %s 登录路径 %s, 来自 %s", idToken.Name(), dbPath.Path, ip)
+
+	expires := time.Now().Add(ssoTokenTTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     pathCookieName(dbPath),
+		Value:    s.ssoToken(dbPath, expires),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	// 只允许返回该路径下的地址，防止被用作开放重定向
+	returnTo := "/" + dbPath.Path + "/"
+	if strings.HasPrefix(state.ReturnTo, returnTo) {
+		returnTo = state.ReturnTo
+	}
+	http.Redirect(w, r, returnTo, http.StatusFound)
+}
+
+// ssoAllowed 检查用户是否在允许的邮箱或组中，两者都未配置时允许提供方的所有用户
+func ssoAllowed(config *PathSSO, token *oidc.IDToken) bool {
+	if len(config.AllowedEmails) == 0 && len(config.AllowedGroups) == 0 {
+		return true
+	}
+
+	// 未经提供方验证的邮箱可能由用户随意填写
+	if token.Email != "" && token.EmailVerified {
+		email := strings.ToLower(token.Email)
+		for _, allowed := range config.AllowedEmails {
+			allowed = strings.ToLower(allowed)
+			if email == allowed || (strings.HasPrefix(allowed, "@") && strings.HasSuffix(email, allowed)) {
+				return true
+			}
+		}
+	}
+
+	claim := config.GroupsClaim
+	if claim == "" {
+		claim = "groups"
+	}
+	for _, group := range token.Strings(claim) {
+		if slices.Contains(config.AllowedGroups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+var ssoErrorPage = template.Must(template.New("sso").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<title>单点登录失败</title>
+	<meta charset="utf-8">
+</head>
+<body>
+	<h1>单点登录失败</h1>
+	<p>{{.}}</p>
+</body>
+</html>`))
+
+func (s *Server) serveSSOError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	ssoErrorPage.Execute(w, message)
+}
+
+// handleGetPathSSO 返回路径的单点登录配置，不返回客户端密钥
+func (s *Server) handleGetPathSSO(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.accessPath(w, r)
+	if !ok {
+		return
+	}
+	config, err := s.db.GetPathSSO(p.ID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if config == nil {
+		utils.WriteJSON(w, http.StatusOK, map[string]interface{}{"enabled": false, "redirect_uri": ssoRedirectURI(r)})
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"enabled":        true,
+		"issuer":         config.Issuer,
+		"client_id":      config.ClientID,
+		"has_secret":     config.ClientSecret != "",
+		"allowed_emails": config.AllowedEmails,
+		"allowed_groups": config.AllowedGroups,
+		"groups_claim":   config.GroupsClaim,
+		"redirect_uri":   ssoRedirectURI(r),
+	})
+}
+
+// handleSetPathSSO 启用或修改路径的单点登录，保存前读取提供方配置以验证 issuer。
+// 客户端密钥留空时保持原密钥
+func (s *Server) handleSetPathSSO(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.accessPath(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Issuer        string   `json:"issuer"`
+		ClientID      string   `json:"client_id"`
+		ClientSecret  string   `json:"client_secret"`
+		AllowedEmails []string `json:"allowed_emails"`
+		AllowedGroups []string `json:"allowed_groups"`
+		GroupsClaim   string   `json:"groups_claim"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	config := &PathSSO{
+		PathID:        p.ID,
+		Issuer:        strings.TrimSpace(req.Issuer),
+		ClientID:      strings.TrimSpace(req.ClientID),
+		ClientSecret:  req.ClientSecret,
+		AllowedEmails: trimList(req.AllowedEmails),
+		AllowedGroups: trimList(req.AllowedGroups),
+		GroupsClaim:   strings.TrimSpace(req.GroupsClaim),
+	}
+	if config.Issuer == "" || config.ClientID == "" {
+		utils.WriteError(w, http.StatusBadRequest, "Issuer and client ID are required")
+		return
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	if config.ClientSecret == "" {
+		existing, err := s.db.GetPathSSO(p.ID)
+		if err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if existing != nil {
+			config.ClientSecret = existing.ClientSecret
+		}
+	}
+
+	// 重新读取提供方配置，同时验证 issuer 可用
+	s.ssoProviders.forget(config.Issuer)
+	if _, err := s.ssoProviders.get(r.Context(), config.Issuer); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := s.db.SetPathSSO(config); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.audit(r, "path.sso", p.Path+": "+config.Issuer)
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleDeletePathSSO 关闭路径的单点登录，通过单点登录获得的令牌立即失效
+func (s *Server) handleDeletePathSSO(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.accessPath(w, r)
+	if !ok {
+		return
+	}
+	if err := s.db.DeletePathSSO(p.ID); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.audit(r, "path.sso.disable", p.Path)
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// trimList 去掉列表项两端的空白并忽略空项
+func trimList(list []string) []string {
+	trimmed := []string{}
+	for _, item := range list {
+		if item = strings.TrimSpace(item); item != "" {
+			trimmed = append(trimmed, item)
+		}
+	}
+	return trimmed
+}
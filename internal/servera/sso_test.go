@@ -0,0 +1,205 @@
+package servera
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIdP 模拟的 OpenID Connect 提供方。令牌端点检查 PKCE，
+// 按授权请求中的 nonce 和 claims 签发 ES256 的 ID Token
+type mockIdP struct {
+	*httptest.Server
+	key *ecdsa.PrivateKey
+
+	mu        sync.Mutex
+	challenge string
+	nonce     string
+	claims    map[string]any
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIdP{key: key}
+	m.Server = httptest.NewServer(http.HandlerFunc(m.serve))
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockIdP) serve(w http.ResponseWriter, r *http.Request) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	case "/jwks":
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "EC", "kid": "k1", "alg": "ES256", "crv": "P-256",
+			"x": b64(m.key.X.FillBytes(make([]byte, 32))), "y": b64(m.key.Y.FillBytes(make([]byte, 32))),
+		}}})
+	case "/token":
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if r.PostFormValue("code") != "good-code" || b64(sum[:]) != m.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claims := map[string]any{
+			"iss":   m.URL,
+			"sub":   "user-1",
+			"aud":   "l2h",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": m.nonce,
+		}
+		for k, v := range m.claims {
+			if v == nil {
+				delete(claims, k)
+			} else {
+				claims[k] = v
+			}
+		}
+		header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": "k1"})
+		payload, _ := json.Marshal(claims)
+		signed := b64(header) + "." + b64(payload)
+		digest := sha256.Sum256([]byte(signed))
+		sr, ss, _ := ecdsa.Sign(rand.Reader, m.key, digest[:])
+		sig := append(sr.FillBytes(make([]byte, 32)), ss.FillBytes(make([]byte, 32))...)
+		json.NewEncoder(w).Encode(map[string]string{"id_token": signed + "." + b64(sig)})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestSSOLogin(t *testing.T) {
+	idp := newMockIdP(t)
+	s := newTestServer(t)
+	if err := s.db.AddPath("app", "", 0, 8080); err != nil {
+		t.Fatal(err)
+	}
+	app, _ := s.db.GetPathByPath("app")
+	if err := s.db.SetPathSSO(&PathSSO{
+		PathID:        app.ID,
+		Issuer:        idp.URL,
+		ClientID:      "l2h",
+		ClientSecret:  "secret",
+		AllowedEmails: []string{"alice@example.com", "@corp.example"},
+		AllowedGroups: []string{"ops"},
+		GroupsClaim:   "groups",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// claims 覆盖 ID Token 的声明，值为 nil 时删除该声明
+		claims map[string]any
+		// nonce 不为空时令牌端点使用该 nonce 而不是授权请求中的
+		nonce string
+		// challenge 不为空时令牌端点以它检查 code_verifier，模拟 PKCE 不匹配
+		challenge string
+		code      string
+		state     string
+		status    int
+	}{
+		{name: "允许的邮箱", claims: map[string]any{"email": "Alice@example.com", "email_verified": true}, status: http.StatusFound},
+		{name: "允许的域名", claims: map[string]any{"email": "bob@corp.example", "email_verified": true}, status: http.StatusFound},
+		{name: "允许的组", claims: map[string]any{"groups": []string{"dev", "ops"}}, status: http.StatusFound},
+		{name: "未验证的邮箱", claims: map[string]any{"email": "alice@example.com", "email_verified": false}, status: http.StatusForbidden},
+		{name: "未声明邮箱是否验证", claims: map[string]any{"email": "alice@example.com"}, status: http.StatusForbidden},
+		{name: "不允许的邮箱", claims: map[string]any{"email": "eve@example.com", "email_verified": true}, status: http.StatusForbidden},
+		{name: "相似的域名", claims: map[string]any{"email": "eve@evilcorp.example", "email_verified": true}, status: http.StatusForbidden},
+		{name: "ID Token 已过期", claims: map[string]any{"email": "alice@example.com", "email_verified": true, "exp": time.Now().Add(-time.Hour).Unix()}, status: http.StatusForbidden},
+		{name: "受众不匹配", claims: map[string]any{"email": "alice@example.com", "email_verified": true, "aud": "other"}, status: http.StatusForbidden},
+		{name: "nonce 不匹配", claims: map[string]any{"email": "alice@example.com", "email_verified": true}, nonce: "other", status: http.StatusForbidden},
+		{name: "PKCE 验证失败", claims: map[string]any{"email": "alice@example.com", "email_verified": true}, challenge: "wrong", status: http.StatusBadGateway},
+		{name: "授权码无效", code: "bad-code", status: http.StatusBadGateway},
+		{name: "state 不匹配", state: "forged", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 未登录的访客被重定向到提供方
+			w := httptest.NewRecorder()
+			s.handleRoot(w, httptest.NewRequest(http.MethodGet, "/app/docs?x=1", nil))
+			if w.Code != http.StatusFound {
+				t.Fatalf("访问路径的状态码 = %d，期望 302", w.Code)
+			}
+			auth, err := url.Parse(w.Header().Get("Location"))
+			if err != nil || !strings.HasPrefix(auth.String(), idp.URL+"/authorize?") {
+				t.Fatalf("重定向到 %q", w.Header().Get("Location"))
+			}
+			q := auth.Query()
+			if q.Get("code_challenge_method") != "S256" || q.Get("redirect_uri") != "http://example.com/api/oidc/callback" {
+				t.Fatalf("授权请求参数 = %v", q)
+			}
+			stateCookie := w.Result().Cookies()[0]
+
+			idp.mu.Lock()
+			idp.challenge = q.Get("code_challenge")
+			idp.nonce = q.Get("nonce")
+			if tt.nonce != "" {
+				idp.nonce = tt.nonce
+			}
+			if tt.challenge != "" {
+				idp.challenge = tt.challenge
+			}
+			idp.claims = tt.claims
+			idp.mu.Unlock()
+
+			// 提供方登录完成后回调
+			state := q.Get("state")
+			if tt.state != "" {
+				state = tt.state
+			}
+			code := "good-code"
+			if tt.code != "" {
+				code = tt.code
+			}
+			req := httptest.NewRequest(http.MethodGet, "/api/oidc/callback?"+url.Values{"state": {state}, "code": {code}}.Encode(), nil)
+			req.AddCookie(stateCookie)
+			w = httptest.NewRecorder()
+			s.handleAPI(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("回调的状态码 = %d，期望 %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if tt.status != http.StatusFound {
+				return
+			}
+			if loc := w.Header().Get("Location"); loc != "/app/docs?x=1" {
+				t.Errorf("登录后返回 %q，期望 /app/docs?x=1", loc)
+			}
+
+			// 携带签发的令牌可以访问路径
+			req = httptest.NewRequest(http.MethodGet, "/app/", nil)
+			for _, c := range w.Result().Cookies() {
+				if c.Name == pathCookieName(app) {
+					req.AddCookie(c)
+				}
+			}
+			w = httptest.NewRecorder()
+			s.handleRoot(w, req)
+			if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "__l2h/l2h.js") {
+				t.Errorf("登录后访问路径的状态码 = %d", w.Code)
+			}
+		})
+	}
+}
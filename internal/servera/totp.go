@@ -0,0 +1,246 @@
+package servera
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"l2h/internal/crypto"
+	"l2h/internal/session"
+	"l2h/internal/utils"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// recoveryCodeCount 每次生成的恢复码数量
+const recoveryCodeCount = 10
+
+// totpIssuer 身份验证器中显示的发行方名称
+const totpIssuer = "L2H"
+
+// checkSecondFactor 验证管理员登录时的两步验证码或恢复码，未启用两步验证时直接通过
+func (s *Server) checkSecondFactor(username, code string) (bool, error) {
+	totp, err := s.db.GetTOTP(username)
+	if err != nil {
+		return false, err
+	}
+	if totp == nil || !totp.Enabled {
+		return true, nil
+	}
+	if code == "" {
+		return false, nil
+	}
+
+	if step, ok := crypto.VerifyTOTP(totp.Secret, code, time.Now()); ok {
+		// 同一个验证码只能使用一次
+		return s.db.UseTOTPStep(username, step)
+	}
+
+	ok, err := s.db.UseRecoveryCode(username, code)
+	if ok {
+		left, _ := s.db.CountRecoveryCodes(username)
+		log.Printf("管理员 %s 使用恢复码登录，剩余 %d 个恢复码", username, left)
+	}
+	return ok, err
+}
+
+// generateRecoveryCodes 生成一组形如 xxxxx-xxxxx 的恢复码
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		secret, err := crypto.GenerateTOTPSecret()
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(secret[:10])
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+// checkAdminPassword 关闭两步验证、修改密码等敏感操作前再次确认当前用户的密码
+func (s *Server) checkAdminPassword(w http.ResponseWriter, r *http.Request, password string) bool {
+	if valid, _ := crypto.VerifyPassword(password, userFromContext(r).Password); !valid {
+		utils.WriteError(w, http.StatusForbidden, "Invalid password")
+		return false
+	}
+	return true
+}
+
+// handleGetTOTP 返回当前管理员的两步验证状态
+func (s *Server) handleGetTOTP(w http.ResponseWriter, r *http.Request) {
+	username := session.FromContext(r).User
+	totp, err := s.db.GetTOTP(username)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	status := map[string]interface{}{"enabled": totp != nil && totp.Enabled}
+	if totp != nil && totp.Enabled {
+		left, err := s.db.CountRecoveryCodes(username)
+		if err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		status["recovery_codes"] = left
+	}
+	utils.WriteJSON(w, http.StatusOK, status)
+}
+
+// handleSetupTOTP 生成新的 TOTP 密钥，返回配置地址和二维码，验证一次验证码后才会启用
+func (s *Server) handleSetupTOTP(w http.ResponseWriter, r *http.Request) {
+	username := session.FromContext(r).User
+	totp, err := s.db.GetTOTP(username)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if totp != nil && totp.Enabled {
+		utils.WriteError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+
+	secret, err := crypto.GenerateTOTPSecret()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := s.db.SetTOTPSecret(username, secret); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// 账户名带上服务器地址，便于在身份验证器中区分多个 l2h-s
+	account := username
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		account += "@" + host
+	} else if r.Host != "" {
+		account += "@" + r.Host
+	}
+	uri := crypto.TOTPURI(totpIssuer, account, secret)
+
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{
+		"secret": secret,
+		"uri":    uri,
+		"qr":     "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	})
+}
+
+// handleEnableTOTP 验证身份验证器生成的验证码，成功后启用两步验证并返回恢复码
+func (s *Server) handleEnableTOTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	username := session.FromContext(r).User
+	totp, err := s.db.GetTOTP(username)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if totp == nil {
+		utils.WriteError(w, http.StatusBadRequest, "Two-factor authentication has not been set up")
+		return
+	}
+	if totp.Enabled {
+		utils.WriteError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+
+	step, ok := crypto.VerifyTOTP(totp.Secret, req.Code, time.Now())
+	if !ok {
+		utils.WriteError(w, http.StatusBadRequest, "Invalid verification code")
+		return
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := s.db.EnableTOTP(username, step, codes); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Printf("管理员 %s 启用了两步验证", username)
+	s.audit(r, "totp.enable", username)
+	utils.WriteJSON(w, http.StatusOK, map[string][]string{"recovery_codes": codes})
+}
+
+// handleDisableTOTP 确认密码后关闭两步验证
+func (s *Server) handleDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !s.checkAdminPassword(w, r, req.Password) {
+		return
+	}
+
+	username := session.FromContext(r).User
+	if err := s.db.ResetTOTP(username); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Printf("管理员 %s 关闭了两步验证", username)
+	s.audit(r, "totp.disable", username)
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleRegenerateRecoveryCodes 确认密码后生成新的恢复码，旧的恢复码全部失效
+func (s *Server) handleRegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !s.checkAdminPassword(w, r, req.Password) {
+		return
+	}
+
+	username := session.FromContext(r).User
+	totp, err := s.db.GetTOTP(username)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if totp == nil || !totp.Enabled {
+		utils.WriteError(w, http.StatusBadRequest, "Two-factor authentication is not enabled")
+		return
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := s.db.SetRecoveryCodes(username, codes); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Printf("管理员 %s 重新生成了恢复码", username)
+	utils.WriteJSON(w, http.StatusOK, map[string][]string{"recovery_codes": codes})
+}
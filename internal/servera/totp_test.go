@@ -0,0 +1,126 @@
+package servera
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"l2h/internal/crypto"
+)
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("生成 %d 个恢复码，期望 %d 个", len(codes), recoveryCodeCount)
+	}
+	format := regexp.MustCompile(`^[a-z2-7]{5}-[a-z2-7]{5}$`)
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		if !format.MatchString(code) {
+			t.Errorf("恢复码 %q 格式不对", code)
+		}
+		if seen[code] {
+			t.Errorf("恢复码 %q 重复", code)
+		}
+		seen[code] = true
+	}
+}
+
+func TestCheckSecondFactor(t *testing.T) {
+	s := newTestServer(t)
+	secret, err := crypto.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.SetTOTPSecret("admin", secret); err != nil {
+		t.Fatal(err)
+	}
+	// 启用时使用的是上上个时间步，当前时间步的验证码仍可使用一次
+	now := crypto.TOTPStep(time.Now())
+	if err := s.db.EnableTOTP("admin", now-2, codes); err != nil {
+		t.Fatal(err)
+	}
+	current, _ := crypto.TOTPCode(secret, now)
+	previous, _ := crypto.TOTPCode(secret, now-1)
+
+	// 按顺序执行，后面的步骤依赖前面的结果
+	steps := []struct {
+		name string
+		user string
+		code string
+		want bool
+	}{
+		{name: "未启用两步验证", user: "other", code: "", want: true},
+		{name: "缺少验证码", user: "admin", code: ""},
+		{name: "错误的验证码", user: "admin", code: "000000"},
+		{name: "当前验证码", user: "admin", code: current, want: true},
+		{name: "重放当前验证码", user: "admin", code: current},
+		{name: "更早的验证码", user: "admin", code: previous},
+		{name: "恢复码", user: "admin", code: codes[0], want: true},
+		{name: "重复使用恢复码", user: "admin", code: codes[0]},
+		{name: "恢复码忽略大小写和分隔符", user: "admin", code: strings.ToUpper(strings.ReplaceAll(codes[1], "-", " ")), want: true},
+	}
+	for _, st := range steps {
+		got, err := s.checkSecondFactor(st.user, st.code)
+		if err != nil {
+			t.Fatalf("%s: %v", st.name, err)
+		}
+		if got != st.want {
+			t.Errorf("%s: checkSecondFactor() = %v，期望 %v", st.name, got, st.want)
+		}
+	}
+
+	if left, _ := s.db.CountRecoveryCodes("admin"); left != recoveryCodeCount-2 {
+		t.Errorf("剩余恢复码 %d 个，期望 %d 个", left, recoveryCodeCount-2)
+	}
+}
+
+func TestLoginSecondFactor(t *testing.T) {
+	s := newTestServer(t)
+	login(t, s)
+	secret, err := crypto.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.SetTOTPSecret("admin", secret); err != nil {
+		t.Fatal(err)
+	}
+	now := crypto.TOTPStep(time.Now())
+	if err := s.db.EnableTOTP("admin", now-2, []string{"aaaaa-bbbbb"}); err != nil {
+		t.Fatal(err)
+	}
+	code, _ := crypto.TOTPCode(secret, now)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		want   string
+	}{
+		{name: "缺少验证码", body: `{"username":"admin","password":"secret"}`, status: http.StatusUnauthorized, want: `"totp_required":true`},
+		{name: "错误的验证码", body: `{"username":"admin","password":"secret","code":"000000"}`, status: http.StatusUnauthorized, want: "Invalid verification code"},
+		{name: "密码错误时不提示两步验证", body: `{"username":"admin","password":"wrong","code":"` + code + `"}`, status: http.StatusUnauthorized, want: "Invalid username or password"},
+		{name: "正确的验证码", body: `{"username":"admin","password":"secret","code":"` + code + `"}`, status: http.StatusOK},
+		{name: "恢复码", body: `{"username":"admin","password":"secret","code":"aaaaa-bbbbb"}`, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := apiRequest(s, http.MethodPost, "/api/login", tt.body, nil)
+			if w.Code != tt.status {
+				t.Fatalf("状态码 = %d，期望 %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tt.want) {
+				t.Errorf("响应 = %s，期望包含 %s", w.Body.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package servera
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"l2h/internal/crypto"
+	"l2h/internal/session"
+	"l2h/internal/utils"
+)
+
+// minPasswordLength 管理后台用户密码的最小长度，与初始化向导一致
+const minPasswordLength = 6
+
+// auditLogLimit 操作记录接口返回的最大条数
+const auditLogLimit = 500
+
+// dummyPasswordHash 用户名不存在时用于校验的哈希，使登录耗时与用户名是否存在无关
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, err := crypto.HashPassword(utils.GenerateRandomString(16))
+	if err != nil {
+		log.Printf("生成占位密码哈希失败: %v", err)
+	}
+	return hash
+})
+
+// audit 记录当前用户或 API Key 的一次修改操作
+func (s *Server) audit(r *http.Request, action, target string) {
+	if err := s.db.AddAudit(actorName(r), action, target, utils.ClientIP(r)); err != nil {
+		log.Printf("写入操作记录失败: %v", err)
+	}
+}
+
+// idFromURL 从 prefix 之后的 URL 路径中解析 ID，如 /api/users/<id>
+func idFromURL(r *http.Request, prefix string) (int, bool) {
+	var id int
+	_, err := fmt.Sscanf(strings.TrimPrefix(r.URL.Path, prefix), "%d", &id)
+	return id, err == nil
+}
+
+func (s *Server) handleGetUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := s.db.GetUsers()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, users)
+}
+
+func (s *Server) handleCreateUser(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Role     string `json:"role"`
+		Email    string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	req.Username = strings.TrimSpace(req.Username)
+	if req.Username == "" {
+		utils.WriteError(w, http.StatusBadRequest, "Username is required")
+		return
+	}
+	if len(req.Password) < minPasswordLength {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Sprintf("Password must be at least %d characters", minPasswordLength))
+		return
+	}
+	if !ValidRole(req.Role) {
+		utils.WriteError(w, http.StatusBadRequest, "Invalid role")
+		return
+	}
+
+	existing, err := s.db.GetUserByName(req.Username)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if existing != nil {
+		utils.WriteError(w, http.StatusConflict, "Username already exists")
+		return
+	}
+
+	if err := s.db.CreateUser(req.Username, req.Password, req.Role, req.Email); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.audit(r, "user.create", req.Username+" ("+req.Role+")")
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleUpdateUser 修改用户的角色、邮箱，或重置其密码。
+// 所有者不能修改自己的角色，保证系统中始终至少有一个所有者
+func (s *Server) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := idFromURL(r, "/api/users/")
+	if !ok {
+		utils.WriteError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	var req struct {
+		Role     string `json:"role"`
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user, err := s.db.GetUser(id)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if user == nil {
+		utils.WriteError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if !ValidRole(req.Role) {
+		utils.WriteError(w, http.StatusBadRequest, "Invalid role")
+		return
+	}
+	if user.ID == userFromContext(r).ID && req.Role != user.Role {
+		utils.WriteError(w, http.StatusBadRequest, "Cannot change your own role")
+		return
+	}
+	if req.Password != "" && len(req.Password) < minPasswordLength {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Sprintf("Password must be at least %d characters", minPasswordLength))
+		return
+	}
+
+	if err := s.db.UpdateUser(id, req.Role, req.Email); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if req.Role != user.Role {
+		s.audit(r, "user.role", user.Username+": "+user.Role+" → "+req.Role)
+	}
+
+	// 重置密码后该用户需要重新登录
+	if req.Password != "" {
+		if err := s.db.SetUserPassword(id, req.Password); err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		except := ""
+		if user.ID == userFromContext(r).ID {
+			except = session.FromContext(r).ID
+		}
+		if err := s.sessions.RevokeUser(user.Username, except); err != nil {
+			log.Printf("吊销旧会话失败: %v", err)
+		}
+		s.audit(r, "user.password", user.Username)
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleDeleteUser 删除用户并吊销其所有会话，不能删除自己
+func (s *Server) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := idFromURL(r, "/api/users/")
+	if !ok {
+		utils.WriteError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	if id == userFromContext(r).ID {
+		utils.WriteError(w, http.StatusBadRequest, "Cannot delete yourself")
+		return
+	}
+
+	user, err := s.db.GetUser(id)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if user == nil {
+		utils.WriteError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	if err := s.db.DeleteUser(id); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := s.sessions.RevokeUser(user.Username, ""); err != nil {
+		log.Printf("吊销用户 %s 的会话失败: %v", user.Username, err)
+	}
+
+	s.audit(r, "user.delete", user.Username)
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleUpdateAccount 修改当前用户自己的邮箱和密码，修改密码需要确认当前密码
+func (s *Server) handleUpdateAccount(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email           string `json:"email"`
+		Password        string `json:"password"`
+		CurrentPassword string `json:"current_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user := userFromContext(r)
+	if req.Password != "" {
+		if len(req.Password) < minPasswordLength {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Sprintf("Password must be at least %d characters", minPasswordLength))
+			return
+		}
+		if !s.checkAdminPassword(w, r, req.CurrentPassword) {
+			return
+		}
+	}
+
+	if err := s.db.UpdateUser(user.ID, user.Role, req.Email); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// 修改密码后其他设备上的会话失效
+	if req.Password != "" {
+		if err := s.db.SetUserPassword(user.ID, req.Password); err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := s.sessions.RevokeUser(user.Username, session.FromContext(r).ID); err != nil {
+			log.Printf("吊销旧会话失败: %v", err)
+		}
+		s.audit(r, "account.password", user.Username)
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleGetAudit 返回最近的操作记录
+func (s *Server) handleGetAudit(w http.ResponseWriter, r *http.Request) {
+	entries, err := s.db.GetAuditLog(auditLogLimit)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, entries)
+}
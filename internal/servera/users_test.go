@@ -0,0 +1,93 @@
+package servera
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// loginAs 创建角色为 role 的用户并登录，密码为 secret123
+func loginAs(t *testing.T, s *Server, username, role string) *http.Cookie {
+	t.Helper()
+	if err := s.db.CreateUser(username, "secret123", role, ""); err != nil {
+		t.Fatal(err)
+	}
+	return loginWith(t, s, username, "secret123")
+}
+
+func TestRoles(t *testing.T) {
+	s := newTestServer(t)
+	owner := login(t, s)
+	admin := loginAs(t, s, "ops", RoleAdmin)
+	viewer := loginAs(t, s, "guest", RoleViewer)
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		body   string
+		cookie *http.Cookie
+		status int
+	}{
+		{name: "只读用户查看路径", method: "GET", url: "/api/paths", cookie: viewer, status: http.StatusOK},
+		{name: "只读用户不能添加路径", method: "POST", url: "/api/paths", body: `{"path":"app","server_b_port":8080}`, cookie: viewer, status: http.StatusForbidden},
+		{name: "只读用户不能查看 API Key", method: "GET", url: "/api/api-keys", cookie: viewer, status: http.StatusForbidden},
+		{name: "只读用户不能查看操作记录", method: "GET", url: "/api/audit", cookie: viewer, status: http.StatusForbidden},
+		{name: "管理员添加路径", method: "POST", url: "/api/paths", body: `{"path":"app","server_b_port":8080}`, cookie: admin, status: http.StatusOK},
+		{name: "管理员不能管理用户", method: "GET", url: "/api/users", cookie: admin, status: http.StatusForbidden},
+		{name: "管理员不能修改系统设置", method: "POST", url: "/api/settings", body: `{"admin_path":"/x"}`, cookie: admin, status: http.StatusForbidden},
+		{name: "所有者管理用户", method: "GET", url: "/api/users", cookie: owner, status: http.StatusOK},
+		{name: "用户名重复", method: "POST", url: "/api/users", body: `{"username":"ops","password":"secret123","role":"viewer"}`, cookie: owner, status: http.StatusConflict},
+		{name: "无效角色", method: "POST", url: "/api/users", body: `{"username":"new","password":"secret123","role":"root"}`, cookie: owner, status: http.StatusBadRequest},
+		{name: "密码太短", method: "POST", url: "/api/users", body: `{"username":"new","password":"123","role":"viewer"}`, cookie: owner, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := apiRequest(s, tt.method, tt.url, tt.body, tt.cookie)
+			if w.Code != tt.status {
+				t.Fatalf("状态码 = %d，期望 %d: %s", w.Code, tt.status, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestUserManagement(t *testing.T) {
+	s := newTestServer(t)
+	owner := login(t, s)
+	viewer := loginAs(t, s, "guest", RoleViewer)
+	self, _ := s.db.GetUserByName("admin")
+	guest, _ := s.db.GetUserByName("guest")
+
+	// 按顺序执行，后面的步骤依赖前面的结果
+	steps := []struct {
+		name   string
+		method string
+		url    string
+		body   string
+		cookie *http.Cookie
+		status int
+	}{
+		{name: "不能修改自己的角色", method: "PUT", url: fmt.Sprintf("/api/users/%d", self.ID), body: `{"role":"viewer"}`, cookie: owner, status: http.StatusBadRequest},
+		{name: "不能删除自己", method: "DELETE", url: fmt.Sprintf("/api/users/%d", self.ID), cookie: owner, status: http.StatusBadRequest},
+		{name: "提升角色", method: "PUT", url: fmt.Sprintf("/api/users/%d", guest.ID), body: `{"role":"admin"}`, cookie: owner, status: http.StatusOK},
+		{name: "提升后立即生效", method: "GET", url: "/api/api-keys", cookie: viewer, status: http.StatusOK},
+		{name: "删除用户", method: "DELETE", url: fmt.Sprintf("/api/users/%d", guest.ID), cookie: owner, status: http.StatusOK},
+		{name: "被删除用户的会话失效", method: "GET", url: "/api/paths", cookie: viewer, status: http.StatusUnauthorized},
+		{name: "删除不存在的用户", method: "DELETE", url: fmt.Sprintf("/api/users/%d", guest.ID), cookie: owner, status: http.StatusNotFound},
+	}
+	for _, st := range steps {
+		w := apiRequest(s, st.method, st.url, st.body, st.cookie)
+		if w.Code != st.status {
+			t.Fatalf("%s: 状态码 = %d，期望 %d: %s", st.name, w.Code, st.status, w.Body.String())
+		}
+	}
+
+	// 修改操作写入操作记录
+	w := apiRequest(s, http.MethodGet, "/api/audit", "", owner)
+	for _, action := range []string{"user.role", "user.delete"} {
+		if !strings.Contains(w.Body.String(), `"`+action+`"`) {
+			t.Errorf("操作记录缺少 %s: %s", action, w.Body.String())
+		}
+	}
+}
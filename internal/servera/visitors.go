@@ -0,0 +1,319 @@
+package servera
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"l2h/internal/crypto"
+	"l2h/internal/utils"
+)
+
+// checkVisitor 验证访客账号的密码，并检查该访客是否被授权访问路径
+func (s *Server) checkVisitor(dbPath *Path, username, password string) (*Visitor, bool) {
+	visitor, err := s.db.GetVisitorByName(username)
+	if err != nil {
+		log.Printf("查询访客失败: %v", err)
+		return nil, false
+	}
+
+	// 访客不存在时同样校验密码，避免通过响应时间判断用户名是否存在
+	hash := dummyPasswordHash()
+	if visitor != nil {
+		hash = visitor.Password
+	}
+	if valid, _ := crypto.VerifyPassword(password, hash); !valid || visitor == nil {
+		return nil, false
+	}
+
+	ok, err := s.db.VisitorCanAccess(visitor.ID, visitor.Version, dbPath.ID)
+	if err != nil {
+		log.Printf("检查访客授权失败: %v", err)
+	}
+	return visitor, ok
+}
+
+func (s *Server) handleGetVisitors(w http.ResponseWriter, r *http.Request) {
+	visitors, err := s.db.GetVisitors()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, visitors)
+}
+
+func (s *Server) handleCreateVisitor(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Note     string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	req.Username = strings.TrimSpace(req.Username)
+	if req.Username == "" {
+		utils.WriteError(w, http.StatusBadRequest, "Username is required")
+		return
+	}
+	if len(req.Password) < minPasswordLength {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Sprintf("Password must be at least %d characters", minPasswordLength))
+		return
+	}
+
+	existing, err := s.db.GetVisitorByName(req.Username)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if existing != nil {
+		utils.WriteError(w, http.StatusConflict, "Username already exists")
+		return
+	}
+
+	if err := s.db.CreateVisitor(req.Username, req.Password, req.Note); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.audit(r, "visitor.create", req.Username)
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleUpdateVisitor 修改访客的备注、停用状态，或重置其密码
+func (s *Server) handleUpdateVisitor(w http.ResponseWriter, r *http.Request) {
+	id, ok := idFromURL(r, "/api/visitors/")
+	if !ok {
+		utils.WriteError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	var req struct {
+		Note     string `json:"note"`
+		Disabled bool   `json:"disabled"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Password != "" && len(req.Password) < minPasswordLength {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Sprintf("Password must be at least %d characters", minPasswordLength))
+		return
+	}
+
+	visitor, err := s.db.GetVisitor(id)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if visitor == nil {
+		utils.WriteError(w, http.StatusNotFound, "Visitor not found")
+		return
+	}
+
+	if err := s.db.UpdateVisitor(id, req.Note, req.Disabled); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if req.Disabled != visitor.Disabled {
+		action := "visitor.enable"
+		if req.Disabled {
+			action = "visitor.disable"
+		}
+		s.audit(r, action, visitor.Username)
+	}
+
+	if req.Password != "" {
+		if err := s.db.SetVisitorPassword(id, req.Password); err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		s.audit(r, "visitor.password", visitor.Username)
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleDeleteVisitor 删除访客，其访问令牌立即失效
+func (s *Server) handleDeleteVisitor(w http.ResponseWriter, r *http.Request) {
+	id, ok := idFromURL(r, "/api/visitors/")
+	if !ok {
+		utils.WriteError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	visitor, err := s.db.GetVisitor(id)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if visitor == nil {
+		utils.WriteError(w, http.StatusNotFound, "Visitor not found")
+		return
+	}
+
+	if err := s.db.DeleteVisitor(id); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.audit(r, "visitor.delete", visitor.Username)
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *Server) handleGetVisitorGroups(w http.ResponseWriter, r *http.Request) {
+	groups, err := s.db.GetVisitorGroups()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, groups)
+}
+
+type visitorGroupRequest struct {
+	Name    string `json:"name"`
+	Members []int  `json:"members"`
+}
+
+func decodeVisitorGroup(w http.ResponseWriter, r *http.Request) (*visitorGroupRequest, bool) {
+	var req visitorGroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		utils.WriteError(w, http.StatusBadRequest, "Name is required")
+		return nil, false
+	}
+	return &req, true
+}
+
+func (s *Server) handleCreateVisitorGroup(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeVisitorGroup(w, r)
+	if !ok {
+		return
+	}
+	if err := s.db.CreateVisitorGroup(req.Name, req.Members); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.audit(r, "visitor_group.create", req.Name)
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleUpdateVisitorGroup 修改组名称并替换组成员，移出组的访客立即失去通过该组获得的授权
+func (s *Server) handleUpdateVisitorGroup(w http.ResponseWriter, r *http.Request) {
+	id, ok := idFromURL(r, "/api/visitor-groups/")
+	if !ok {
+		utils.WriteError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	req, ok := decodeVisitorGroup(w, r)
+	if !ok {
+		return
+	}
+
+	name, err := s.db.GetVisitorGroupName(id)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if name == "" {
+		utils.WriteError(w, http.StatusNotFound, "Group not found")
+		return
+	}
+
+	if err := s.db.UpdateVisitorGroup(id, req.Name, req.Members); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.audit(r, "visitor_group.update", req.Name)
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *Server) handleDeleteVisitorGroup(w http.ResponseWriter, r *http.Request) {
+	id, ok := idFromURL(r, "/api/visitor-groups/")
+	if !ok {
+		utils.WriteError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	name, err := s.db.GetVisitorGroupName(id)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if name == "" {
+		utils.WriteError(w, http.StatusNotFound, "Group not found")
+		return
+	}
+
+	if err := s.db.DeleteVisitorGroup(id); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.audit(r, "visitor_group.delete", name)
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// accessPath 解析 /api/paths/<id>/access 中的路径
+func (s *Server) accessPath(w http.ResponseWriter, r *http.Request) (*Path, bool) {
+	id, ok := idFromURL(r, "/api/paths/")
+	if !ok {
+		utils.WriteError(w, http.StatusBadRequest, "Invalid ID")
+		return nil, false
+	}
+	p, err := s.db.GetPath(id)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return nil, false
+	}
+	if p == nil {
+		utils.WriteError(w, http.StatusNotFound, "Path not found")
+		return nil, false
+	}
+	return p, true
+}
+
+func (s *Server) handleGetPathAccess(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.accessPath(w, r)
+	if !ok {
+		return
+	}
+	access, err := s.db.GetPathAccess(p.ID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, access)
+}
+
+// handleSetPathAccess 替换路径授权的访客和访客组，被撤销授权的访客立即无法访问
+func (s *Server) handleSetPathAccess(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.accessPath(w, r)
+	if !ok {
+		return
+	}
+
+	var access PathAccess
+	if err := json.NewDecoder(r.Body).Decode(&access); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := s.db.SetPathAccess(p.ID, &access); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.audit(r, "path.access", fmt.Sprintf("%s: %d 个访客, %d 个组", p.Path, len(access.Visitors), len(access.Groups)))
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,96 @@
+package servera
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// visitorLogin 以访客账号登录路径，返回状态码和访问令牌 cookie
+func visitorLogin(s *Server, path, username, password string) (int, *http.Cookie) {
+	body := fmt.Sprintf(`{"path":%q,"username":%q,"password":%q}`, path, username, password)
+	w := apiRequest(s, http.MethodPost, "/api/auth", body, nil)
+	for _, c := range w.Result().Cookies() {
+		return w.Code, c
+	}
+	return w.Code, nil
+}
+
+func TestVisitorAccess(t *testing.T) {
+	s := newTestServer(t)
+	if err := s.db.AddPath("team", "", 0, 8080); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := s.db.GetPathByPath("team")
+	ids := make(map[string]int)
+	for _, name := range []string{"alice", "bob", "carol"} {
+		if err := s.db.CreateVisitor(name, "secret123", ""); err != nil {
+			t.Fatal(err)
+		}
+		v, _ := s.db.GetVisitorByName(name)
+		ids[name] = v.ID
+	}
+	if err := s.db.CreateVisitorGroup("dev", []int{ids["bob"]}); err != nil {
+		t.Fatal(err)
+	}
+	groups, _ := s.db.GetVisitorGroups()
+	if err := s.db.SetPathAccess(p.ID, &PathAccess{Visitors: []int{ids["alice"]}, Groups: []int{groups[0].ID}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 授权访客后路径需要认证
+	p, _ = s.db.GetPathByPath("team")
+	if !pathProtected(p) {
+		t.Fatal("授权了访客的路径不需要认证")
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		status   int
+	}{
+		{name: "直接授权", username: "alice", password: "secret123", status: http.StatusOK},
+		{name: "通过访客组授权", username: "bob", password: "secret123", status: http.StatusOK},
+		{name: "未授权", username: "carol", password: "secret123", status: http.StatusUnauthorized},
+		{name: "密码错误", username: "alice", password: "wrong", status: http.StatusUnauthorized},
+		{name: "访客不存在", username: "dave", password: "secret123", status: http.StatusUnauthorized},
+		{name: "没有共享密码的路径", password: "secret123", status: http.StatusUnauthorized},
+	}
+	cookies := make(map[string]*http.Cookie)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, cookie := visitorLogin(s, "team", tt.username, tt.password)
+			if status != tt.status {
+				t.Fatalf("状态码 = %d，期望 %d", status, tt.status)
+			}
+			if status == http.StatusOK {
+				cookies[tt.username] = cookie
+			}
+		})
+	}
+
+	authorized := func(name string) bool {
+		r := httptest.NewRequest(http.MethodGet, "/team/", nil)
+		r.AddCookie(cookies[name])
+		return s.pathAuthorized(r, p)
+	}
+	if !authorized("alice") || !authorized("bob") {
+		t.Fatal("登录后的访问令牌无效")
+	}
+
+	// 停用访客、移出访客组后已签发的令牌立即失效
+	if err := s.db.UpdateVisitor(ids["alice"], "", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.UpdateVisitorGroup(groups[0].ID, "dev", nil); err != nil {
+		t.Fatal(err)
+	}
+	if authorized("alice") {
+		t.Error("停用的访客仍可访问")
+	}
+	if authorized("bob") {
+		t.Error("移出访客组后仍可访问")
+	}
+}
@@ -1,6 +1,7 @@
 package serverb
 
 import (
+	"crypto/ecdsa"
 	"database/sql"
 	"time"
 
@@ -53,6 +54,17 @@ func (d *Database) initTables() error {
 			api_key TEXT NOT NULL,
 			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		)`,
+		`CREATE TABLE IF NOT EXISTS server_identity (
+			id INTEGER PRIMARY KEY,
+			server_url TEXT NOT NULL,
+			fingerprint TEXT NOT NULL,
+			pinned_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS node_key (
+			id INTEGER PRIMARY KEY,
+			private_key BLOB NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
 	}
 
 	for _, query := range queries {
@@ -110,11 +122,11 @@ func (d *Database) SetAdminInfo(username, password string) error {
 }
 
 type Binding struct {
-	ID        int
-	Path      string
-	Port      int
-	Password  string
-	CreatedAt time.Time
+	ID        int       `json:"id"`
+	Path      string    `json:"path"`
+	Port      int       `json:"port"`
+	Password  string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 func (d *Database) GetBindings() ([]*Binding, error) {
@@ -221,3 +233,37 @@ func (d *Database) SetServerInfo(serverURL, apiKey string) error {
 		serverURL, apiKey)
 	return err
 }
+
+// GetServerFingerprint 返回记录的服务器A身份指纹，没有记录或记录的是其他地址的服务器时返回空
+func (d *Database) GetServerFingerprint(serverURL string) (string, error) {
+	var fp string
+	err := d.db.QueryRow("SELECT fingerprint FROM server_identity WHERE id = 1 AND server_url = ?", serverURL).Scan(&fp)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return fp, err
+}
+
+// PinServerFingerprint 记录服务器A的身份指纹，之后只连接身份与之一致的服务器
+func (d *Database) PinServerFingerprint(serverURL, fingerprint string) error {
+	_, err := d.db.Exec(
+		"INSERT OR REPLACE INTO server_identity (id, server_url, fingerprint) VALUES (1, ?, ?)",
+		serverURL, fingerprint)
+	return err
+}
+
+// NodeKey 返回本节点的密钥，首次调用时生成。访客浏览器用服务器A公布的节点公钥
+// 验证数据通道的另一端是本节点
+func (d *Database) NodeKey() (*ecdsa.PrivateKey, error) {
+	der, err := crypto.GenerateNodeKey()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := d.db.Exec("INSERT OR IGNORE INTO node_key (id, private_key) VALUES (1, ?)", der); err != nil {
+		return nil, err
+	}
+	if err := d.db.QueryRow("SELECT private_key FROM node_key WHERE id = 1").Scan(&der); err != nil {
+		return nil, err
+	}
+	return crypto.ParseNodePrivateKey(der)
+}
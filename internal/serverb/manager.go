@@ -1,5 +1,12 @@
 package serverb
 
+import (
+	"fmt"
+
+	"l2h/internal/crypto"
+	"l2h/internal/link"
+)
+
 type Manager struct {
 	db *Database
 }
@@ -31,3 +38,39 @@ func (m *Manager) DeleteBinding(id int) error {
 func (m *Manager) SetServerInfo(serverURL, apiKey string) error {
 	return m.db.SetServerInfo(serverURL, apiKey)
 }
+
+// PinServer 获取服务器A当前的身份指纹并记录，返回之前记录的指纹和新的指纹。
+// expected 不为空时服务器A的指纹必须与之一致；此时服务器A暂时无法访问也直接记录 expected
+func (m *Manager) PinServer(expected string) (old, fingerprint string, err error) {
+	info, err := m.db.GetServerInfo()
+	if err != nil {
+		return "", "", err
+	}
+	if info == nil {
+		return "", "", fmt.Errorf("尚未设置服务器A，请先使用 -s 设置地址和 API Key")
+	}
+	if old, err = m.db.GetServerFingerprint(info.ServerURL); err != nil {
+		return "", "", err
+	}
+
+	expected = link.NormalizeFingerprint(expected)
+	fingerprint, err = link.FetchIdentity(info.ServerURL)
+	switch {
+	case err != nil && expected == "":
+		return old, "", fmt.Errorf("获取服务器A的身份指纹失败: %w", err)
+	case err != nil:
+		fingerprint = expected
+	case expected != "" && fingerprint != expected:
+		return old, fingerprint, fmt.Errorf("服务器A的身份指纹为 %s，与指定的 %s 不一致", fingerprint, expected)
+	}
+	return old, fingerprint, m.db.PinServerFingerprint(info.ServerURL, fingerprint)
+}
+
+// NodeKeyFingerprint 返回本节点公钥的指纹，访客可以用它核对连接的是本节点
+func (m *Manager) NodeKeyFingerprint() (string, error) {
+	key, err := m.db.NodeKey()
+	if err != nil {
+		return "", err
+	}
+	return crypto.KeyFingerprint(crypto.MarshalNodeKey(&key.PublicKey)), nil
+}
@@ -1,21 +1,46 @@
 package serverb
 
 import (
+	"crypto/ecdsa"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"l2h/internal/crypto"
+	"l2h/internal/link"
+	"l2h/internal/ratelimit"
+	"l2h/internal/session"
+	"l2h/internal/tunnel"
 	"l2h/internal/utils"
 	"l2h/internal/webrtc"
 )
 
+// statsInterval 向服务器A上报连接流量的周期
+const statsInterval = 15 * time.Second
+
+// syncInterval 检查路径绑定是否变化的周期，命令行修改绑定后由此同步到服务器A
+const syncInterval = 30 * time.Second
+
 type Server struct {
-	port   int
-	db     *Database
-	webrtc *webrtc.Manager
+	port     int
+	db       *Database
+	sessions *session.Store
+	guard    *ratelimit.Guard
+	webrtc   *webrtc.Manager
+	link     *link.Client
+	nodeKey  *ecdsa.PrivateKey
+	// skipIdentity 为 true 时不验证服务器A的身份，用于连接旧版本的服务器A
+	skipIdentity bool
+
+	syncMu   sync.Mutex
+	lastSync string
 }
 
 func NewServer(port int, dbPath string) *Server {
@@ -23,12 +48,32 @@ func NewServer(port int, dbPath string) *Server {
 	if err != nil {
 		log.Fatalf("初始化数据库失败: %v", err)
 	}
+	// 与服务器A部署在同一主机时 cookie 不区分端口，因此使用不同的名称
+	sessions, err := session.NewStore(db.db, "l2h_c_session")
+	if err != nil {
+		log.Fatalf("初始化会话存储失败: %v", err)
+	}
+	nodeKey, err := db.NodeKey()
+	if err != nil {
+		log.Fatalf("读取节点密钥失败: %v", err)
+	}
 
-	return &Server{
-		port:   port,
-		db:     db,
-		webrtc: webrtc.NewManager(),
+	s := &Server{
+		port:     port,
+		db:       db,
+		sessions: sessions,
+		guard:    ratelimit.NewGuard(),
+		webrtc:   webrtc.NewManager(),
+		nodeKey:  nodeKey,
 	}
+	s.webrtc.OnChannel(s.handleWebRTCRequest)
+	s.webrtc.OnStateChange(s.handleStateChange)
+	return s
+}
+
+// SkipIdentity 不验证服务器A的身份，在连接请求头中直接发送 API Key，需在 Start 之前调用
+func (s *Server) SkipIdentity() {
+	s.skipIdentity = true
 }
 
 func (s *Server) Start() error {
@@ -37,6 +82,35 @@ func (s *Server) Start() error {
 	mux.HandleFunc("/", s.handleRoot)
 	mux.HandleFunc("/api/", s.handleAPI)
 
+	// 主动连接服务器A，建立控制连接
+	info, err := s.db.GetServerInfo()
+	if err != nil {
+		return err
+	}
+	if info != nil {
+		s.link = link.NewClient(info.ServerURL, info.APIKey, s.handleLinkMessage)
+		pinned, err := s.db.GetServerFingerprint(info.ServerURL)
+		if err != nil {
+			return err
+		}
+		s.link.PinIdentity(pinned, func(fp string) error {
+			return s.db.PinServerFingerprint(info.ServerURL, fp)
+		})
+		if s.skipIdentity {
+			log.Printf("警告: 已跳过服务器A的身份验证，伪造的服务器A可以获得 API Key")
+			s.link.SkipIdentity()
+		}
+		s.link.OnConnect(func(c *link.Client) {
+			s.reportNodeKey(c)
+			s.syncBindings(true)
+		})
+		go s.link.Run()
+		go s.reportStats()
+		go s.watchBindings()
+	} else {
+		log.Printf("未配置服务器A，请使用 -s 参数设置地址和 API Key")
+	}
+
 	log.Printf("服务器B启动在端口 %d", s.port)
 	return http.ListenAndServe(":"+strconv.Itoa(s.port), mux)
 }
@@ -53,27 +127,116 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 处理 WebRTC 连接请求
-	s.handleWebRTCRequest(w, r, path)
+	// 访客的请求通过数据通道到达，不经过此 HTTP 服务
+	http.NotFound(w, r)
 }
 
 func (s *Server) handleAPI(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/api/")
 
 	switch {
+	case path == "login" && r.Method == "POST":
+		s.handleLogin(w, r)
+	case path == "logout" && r.Method == "POST":
+		s.handleLogout(w, r)
+	case path == "logout-all" && r.Method == "POST":
+		s.sessions.Require(s.handleLogoutAll)(w, r)
+	case path == "sessions" && r.Method == "GET":
+		s.sessions.Require(s.handleGetSessions)(w, r)
+	case strings.HasPrefix(path, "sessions/") && r.Method == "DELETE":
+		s.sessions.Require(s.handleRevokeSession)(w, r)
 	case path == "bindings" && r.Method == "GET":
-		s.handleGetBindings(w, r)
+		s.sessions.Require(s.handleGetBindings)(w, r)
 	case path == "bindings" && r.Method == "POST":
-		s.handleAddBinding(w, r)
+		s.sessions.Require(s.handleAddBinding)(w, r)
 	case strings.HasPrefix(path, "bindings/") && r.Method == "DELETE":
-		s.handleDeleteBinding(w, r)
-	case path == "webrtc/answer" && r.Method == "POST":
-		s.handleWebRTCAnswer(w, r)
+		s.sessions.Require(s.handleDeleteBinding)(w, r)
 	default:
 		utils.WriteError(w, http.StatusNotFound, "Not found")
 	}
 }
 
+// handleLogin 验证管理员用户名和密码，成功后签发会话 cookie
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ip := utils.ClientIP(r)
+	if wait := s.guard.Check(ip, "admin"); wait > 0 {
+		ratelimit.WriteTooMany(w, wait)
+		return
+	}
+
+	admin, err := s.db.GetAdminInfo()
+	if err != nil {
+		s.guard.Release(ip, "admin")
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	valid, _ := crypto.VerifyPassword(req.Password, admin.Password)
+	if !valid || req.Username != admin.Username {
+		s.guard.Fail(ip, "admin")
+		log.Printf("管理员登录失败: 用户名 %q, 来自 %s", req.Username, ip)
+		utils.WriteError(w, http.StatusUnauthorized, "Invalid username or password")
+		return
+	}
+	s.guard.Succeed(ip, "admin")
+
+	if err := s.sessions.Login(w, r, admin.Username); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Printf("管理员 %s 从 %s 登录", admin.Username, ip)
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"username": admin.Username})
+}
+
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if err := s.sessions.Logout(w, r); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleLogoutAll 吊销管理员在所有设备上的会话
+func (s *Server) handleLogoutAll(w http.ResponseWriter, r *http.Request) {
+	sess := session.FromContext(r)
+	if err := s.sessions.RevokeUser(sess.User, ""); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.sessions.Logout(w, r)
+	log.Printf("管理员 %s 退出了所有会话", sess.User)
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *Server) handleGetSessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := s.sessions.List(session.FromContext(r).ID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, sessions)
+}
+
+func (s *Server) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/sessions/")
+	if err := s.sessions.Revoke(id); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("管理员 %s 吊销了会话 %.8s", session.FromContext(r).User, id)
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
 func (s *Server) handleGetBindings(w http.ResponseWriter, r *http.Request) {
 	bindings, err := s.db.GetBindings()
 	if err != nil {
@@ -98,6 +261,7 @@ func (s *Server) handleAddBinding(w http.ResponseWriter, r *http.Request) {
 		utils.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	go s.syncBindings(false)
 
 	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 }
@@ -114,22 +278,205 @@ func (s *Server) handleDeleteBinding(w http.ResponseWriter, r *http.Request) {
 		utils.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	go s.syncBindings(false)
 
 	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 }
 
-func (s *Server) handleWebRTCAnswer(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Answer string `json:"answer"`
-		Path   string `json:"path"`
+// handleLinkMessage 处理服务器A通过控制连接下发的信令
+func (s *Server) handleLinkMessage(c *link.Client, msg *link.Message) {
+	switch msg.Type {
+	case link.TypeOffer:
+		binding, err := s.db.GetBindingByPath(msg.Path)
+		if err != nil || binding == nil {
+			c.Send(&link.Message{Type: link.TypeError, ID: msg.ID, Error: "Path not found"})
+			return
+		}
+		// 使用服务器A下发的 ICE 服务器（默认为其内置 STUN 服务）
+		answer, err := s.webrtc.HandleOffer(msg.ID, msg.Path, msg.SDP, msg.ICEServers)
+		if err != nil {
+			c.Send(&link.Message{Type: link.TypeError, ID: msg.ID, Error: err.Error()})
+			return
+		}
+		signature, err := s.signAnswer(msg.Path, msg.SDP, answer)
+		if err != nil {
+			s.webrtc.Close(msg.ID)
+			c.Send(&link.Message{Type: link.TypeError, ID: msg.ID, Error: err.Error()})
+			return
+		}
+		c.Send(&link.Message{Type: link.TypeAnswer, ID: msg.ID, SDP: answer, Signature: signature})
+	case link.TypeCandidate:
+		if err := s.webrtc.AddICECandidate(msg.ID, msg.Candidate); err != nil {
+			log.Printf("添加 ICE 候选失败: %v", err)
+		}
+	case link.TypeClose:
+		s.webrtc.Close(msg.ID)
+	case link.TypeSyncResult:
+		if msg.Error != "" {
+			log.Printf("路径同步失败: %s", msg.Error)
+		}
+		for _, c := range msg.Conflicts {
+			log.Printf("路径同步冲突: %s", c)
+		}
+	case link.TypeKeyRotate:
+		s.saveRotatedKey(c, msg.APIKey)
+	case link.TypeRelayOpen:
+		relay, ok := c.Relay(msg.ID)
+		if !ok {
+			return
+		}
+		defer relay.Close()
+		var conn tunnel.Conn = relay
+		if msg.Secure {
+			secure, err := tunnel.AcceptSecure(relay, s.nodeKey, msg.Path)
+			if err != nil {
+				log.Printf("中继 %s 加密握手失败: %v", msg.ID, err)
+				return
+			}
+			conn = secure
+		}
+		s.serveTunnel(msg.ID, msg.Path, conn)
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		utils.WriteError(w, http.StatusBadRequest, err.Error())
+}
+
+// saveRotatedKey 保存服务器A轮换后下发的 API Key，之后的重连使用新 Key，
+// 保存成功后回复服务器A，旧 Key 在宽限期结束后失效
+func (s *Server) saveRotatedKey(c *link.Client, apiKey string) {
+	if apiKey == "" {
 		return
 	}
+	info, err := s.db.GetServerInfo()
+	if err != nil || info == nil {
+		log.Printf("保存轮换后的 API Key 失败: %v", err)
+		return
+	}
+	if err := s.db.SetServerInfo(info.ServerURL, apiKey); err != nil {
+		log.Printf("保存轮换后的 API Key 失败: %v", err)
+		return
+	}
+	c.SetAPIKey(apiKey)
+	c.Send(&link.Message{Type: link.TypeKeyRotated})
+	log.Printf("服务器A轮换了 API Key，已保存新 Key")
+}
 
-	// 处理 WebRTC answer
-	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+// reportNodeKey 向服务器A上报本节点的公钥，服务器A把它公布给访问本节点路径的访客
+func (s *Server) reportNodeKey(c *link.Client) {
+	key := base64.StdEncoding.EncodeToString(crypto.MarshalNodeKey(&s.nodeKey.PublicKey))
+	if err := c.Send(&link.Message{Type: link.TypeNodeKey, NodeKey: key}); err != nil {
+		log.Printf("上报节点公钥失败: %v", err)
+	}
+}
+
+// signAnswer 用节点密钥对 offer 和 answer 中的 DTLS 证书指纹签名，访客浏览器验证后才使用 answer，
+// 服务器A无法替换任一方的证书来解密数据通道
+func (s *Server) signAnswer(path, offer, answer string) (string, error) {
+	msg, err := crypto.DTLSMessage(path, offer, answer)
+	if err != nil {
+		return "", err
+	}
+	sig, err := crypto.SignNode(s.nodeKey, msg)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// syncBindings 将全部路径绑定同步到服务器A，force 为 false 时绑定没有变化则跳过
+func (s *Server) syncBindings(force bool) {
+	if s.link == nil {
+		return
+	}
+
+	bindings, err := s.db.GetBindings()
+	if err != nil {
+		log.Printf("读取路径绑定失败: %v", err)
+		return
+	}
+	msg := &link.Message{Type: link.TypeSync, Bindings: make([]link.Binding, 0, len(bindings))}
+	for _, b := range bindings {
+		msg.Bindings = append(msg.Bindings, link.Binding{Path: b.Path, Port: b.Port, Password: b.Password})
+	}
+	sort.Slice(msg.Bindings, func(i, j int) bool {
+		return msg.Bindings[i].Path < msg.Bindings[j].Path
+	})
+	data, _ := json.Marshal(msg.Bindings)
+
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	if !force && string(data) == s.lastSync {
+		return
+	}
+	if err := s.link.Send(msg); err != nil {
+		return
+	}
+	s.lastSync = string(data)
+}
+
+// watchBindings 定期检查路径绑定是否被命令行等其他进程修改
+func (s *Server) watchBindings() {
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.syncBindings(false)
+	}
+}
+
+// handleStateChange 将连接状态变化上报给服务器A
+func (s *Server) handleStateChange(conn *webrtc.Connection) {
+	if s.link == nil {
+		return
+	}
+	if conn.State() == webrtc.StateClosed {
+		s.link.Send(&link.Message{Type: link.TypeClose, ID: conn.ID})
+		return
+	}
+	s.reportState(conn)
+}
+
+// reportStats 定期向服务器A上报各连接的累计流量，服务器A据此判断连接是否空闲
+func (s *Server) reportStats() {
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, conn := range s.webrtc.Connections() {
+			if conn.State() == webrtc.StateConnected {
+				s.reportState(conn)
+			}
+		}
+	}
+}
+
+func (s *Server) reportState(conn *webrtc.Connection) {
+	st := conn.Stats()
+	s.link.Send(&link.Message{
+		Type:     link.TypeState,
+		ID:       conn.ID,
+		State:    string(st.State),
+		BytesIn:  st.BytesIn,
+		BytesOut: st.BytesOut,
+	})
+}
+
+// handleWebRTCRequest 在数据通道上处理访客的 HTTP 请求
+func (s *Server) handleWebRTCRequest(conn *webrtc.Connection, ch *webrtc.Channel) {
+	defer ch.Close()
+	s.serveTunnel(conn.ID, conn.Path, ch)
+}
+
+// serveTunnel 在数据通道或中继上处理访客请求，并在绑定的本地端口上重放
+func (s *Server) serveTunnel(id, path string, conn tunnel.Conn) {
+	binding, err := s.db.GetBindingByPath(path)
+	if err != nil || binding == nil {
+		log.Printf("连接 %s 的路径 %s 没有绑定", id, path)
+		return
+	}
+
+	target := "127.0.0.1:" + strconv.Itoa(binding.Port)
+	if err := tunnel.Serve(conn, target); err != nil {
+		log.Printf("连接 %s 异常结束: %v", id, err)
+	}
 }
 
 func (s *Server) serveAdminPage(w http.ResponseWriter, r *http.Request) {
@@ -142,24 +489,86 @@ func (s *Server) serveAdminPage(w http.ResponseWriter, r *http.Request) {
 </head>
 <body>
 	<h1>L2H 服务端管理</h1>
-	<div id="app">
+	<div id="login" style="display:none">
+		<h2>登录</h2>
+		<p><input id="username" placeholder="用户名"></p>
+		<p><input id="password" type="password" placeholder="密码" onkeyup="if (event.key === 'Enter') login()"></p>
+		<button onclick="login()">登录</button>
+		<p id="login-error" style="color:red"></p>
+	</div>
+	<div id="app" style="display:none">
+		<p>
+			<button onclick="logout()">退出登录</button>
+			<button onclick="logoutAll()">退出所有设备</button>
+		</p>
 		<h2>路径绑定管理</h2>
 		<div id="bindings"></div>
 		<button onclick="loadBindings()">刷新</button>
 		<button onclick="showAddForm()">添加绑定</button>
+		<h2>登录会话</h2>
+		<div id="sessions"></div>
 	</div>
 	<script>
+		function esc(s) {
+			return String(s).replace(/[&<>"']/g, c => '&#' + c.charCodeAt(0) + ';');
+		}
+		async function api(url, options) {
+			const response = await fetch(url, options);
+			if (response.status === 401) {
+				showLogin();
+				throw new Error('未登录');
+			}
+			return response;
+		}
+		function showLogin() {
+			document.getElementById('app').style.display = 'none';
+			document.getElementById('login').style.display = '';
+		}
+		function showApp() {
+			document.getElementById('login').style.display = 'none';
+			document.getElementById('app').style.display = '';
+			loadBindings();
+			loadSessions();
+		}
+		async function login() {
+			const response = await fetch('/api/login', {
+				method: 'POST',
+				headers: {'Content-Type': 'application/json'},
+				body: JSON.stringify({
+					username: document.getElementById('username').value,
+					password: document.getElementById('password').value
+				})
+			});
+			if (!response.ok) {
+				document.getElementById('login-error').textContent =
+					response.status === 429 ? (await response.json()).error : '用户名或密码错误';
+				return;
+			}
+			document.getElementById('password').value = '';
+			document.getElementById('login-error').textContent = '';
+			showApp();
+		}
+		async function logout() {
+			await fetch('/api/logout', {method: 'POST'});
+			showLogin();
+		}
+		async function logoutAll() {
+			if (confirm('确定要退出所有设备上的登录吗？')) {
+				await api('/api/logout-all', {method: 'POST'});
+				showLogin();
+			}
+		}
 		async function loadBindings() {
-			const response = await fetch('/api/bindings');
-			const bindings = await response.json();
+			const response = await api('/api/bindings');
+			const bindings = await response.json() || [];
 			const div = document.getElementById('bindings');
 			div.innerHTML = '<table border="1"><tr><th>ID</th><th>路径</th><th>端口</th><th>操作</th></tr>' +
-				bindings.map(b => '<tr><td>' + b.id + '</td><td>' + b.path + '</td><td>' + b.port + '</td><td><button onclick="deleteBinding(' + b.id + ')">删除</button></td></tr>').join('') +
+				bindings.map(b => '<tr><td>' + b.id + '</td><td>' + esc(b.path) + '</td><td>' + b.port + '</td><td><button onclick="deleteBinding(' + b.id + ')">删除</button></td></tr>').join('') +
 				'</table>';
 		}
 		async function deleteBinding(id) {
 			if (confirm('确定要删除吗？')) {
-				await fetch('/api/bindings/' + id, {method: 'DELETE'});
+				await api('/api/bindings/' + id, {method: 'DELETE'});
 				loadBindings();
 			}
 		}
@@ -168,44 +577,31 @@ func (s *Server) serveAdminPage(w http.ResponseWriter, r *http.Request) {
 			const port = prompt('请输入端口:');
 			const password = prompt('请输入密码（可选，直接回车跳过）:');
 			if (path && port) {
-				fetch('/api/bindings', {
+				api('/api/bindings', {
 					method: 'POST',
 					headers: {'Content-Type': 'application/json'},
 					body: JSON.stringify({path: path, port: parseInt(port), password: password || ''})
 				}).then(() => loadBindings());
 			}
 		}
-		loadBindings();
+		async function loadSessions() {
+			const response = await api('/api/sessions');
+			const sessions = await response.json() || [];
+			const div = document.getElementById('sessions');
+			div.innerHTML = '<table border="1"><tr><th>IP</th><th>浏览器</th><th>登录时间</th><th>最近活动</th><th>操作</th></tr>' +
+				sessions.map(s => '<tr><td>' + esc(s.ip) + '</td><td>' + esc(s.user_agent) + '</td><td>' +
+					new Date(s.created_at).toLocaleString() + '</td><td>' + new Date(s.last_seen_at).toLocaleString() + '</td><td>' +
+					(s.current ? '当前会话' : '<button onclick="revokeSession(\'' + s.id + '\')">吊销</button>') + '</td></tr>').join('') +
+				'</table>';
+		}
+		async function revokeSession(id) {
+			await api('/api/sessions/' + id, {method: 'DELETE'});
+			loadSessions();
+		}
+		api('/api/sessions').then(showApp, () => {});
 	</script>
 </body>
 </html>`
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.Write([]byte(html))
 }
-
-func (s *Server) handleWebRTCRequest(w http.ResponseWriter, r *http.Request, path string) {
-	// 查找对应的绑定
-	binding, err := s.db.GetBindingByPath(path)
-	if err != nil || binding == nil {
-		http.NotFound(w, r)
-		return
-	}
-
-	// 这里应该实现 WebRTC 连接逻辑，将请求转发到本地端口
-	html := fmt.Sprintf(`<!DOCTYPE html>
-<html>
-<head>
-	<title>WebRTC 代理</title>
-	<meta charset="utf-8">
-</head>
-<body>
-	<h1>WebRTC 代理到端口 %d</h1>
-	<div id="status">连接中...</div>
-	<script>
-		// WebRTC 连接逻辑，连接到本地端口 %d
-	</script>
-</body>
-</html>`, binding.Port, binding.Port)
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.Write([]byte(html))
-}
@@ -0,0 +1,224 @@
+package serverb
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"l2h/internal/crypto"
+	"l2h/internal/link"
+)
+
+// newTestServer 使用临时数据库创建服务器B，管理员为 admin/secret
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	s := NewServer(0, filepath.Join(t.TempDir(), "l2h-c.db"))
+	t.Cleanup(func() { s.db.db.Close() })
+	if err := s.db.SetAdminInfo("admin", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// apiRequest 携带 cookie 调用管理 API
+func apiRequest(s *Server, method, url, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	s.handleAPI(w, r)
+	return w
+}
+
+// login 登录并返回会话 cookie
+func login(t *testing.T, s *Server) *http.Cookie {
+	t.Helper()
+	w := apiRequest(s, http.MethodPost, "/api/login", `{"username":"admin","password":"secret"}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("登录失败: %d %s", w.Code, w.Body.String())
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "l2h_c_session" {
+			return c
+		}
+	}
+	t.Fatal("登录没有返回会话 cookie")
+	return nil
+}
+
+func TestLogin(t *testing.T) {
+	s := newTestServer(t)
+	cookie := login(t, s)
+	other := login(t, s)
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		body   string
+		cookie *http.Cookie
+		status int
+		want   string
+	}{
+		{name: "密码错误", method: "POST", url: "/api/login", body: `{"username":"admin","password":"wrong"}`, status: http.StatusUnauthorized},
+		{name: "用户名错误", method: "POST", url: "/api/login", body: `{"username":"root","password":"secret"}`, status: http.StatusUnauthorized},
+		{name: "未登录", method: "GET", url: "/api/bindings", status: http.StatusUnauthorized},
+		{name: "未登录不能添加绑定", method: "POST", url: "/api/bindings", body: `{"path":"app","port":8080}`, status: http.StatusUnauthorized},
+		{name: "添加绑定", method: "POST", url: "/api/bindings", body: `{"path":"app","port":8080,"password":"pw"}`, cookie: cookie, status: http.StatusOK},
+		{name: "绑定列表不返回密码", method: "GET", url: "/api/bindings", cookie: cookie, status: http.StatusOK, want: `"path":"app","port":8080,"created_at"`},
+		{name: "管理端口不接受 offer", method: "POST", url: "/api/webrtc/offer", body: `{"path":"app","offer":"v=0"}`, cookie: cookie, status: http.StatusNotFound},
+		{name: "会话列表", method: "GET", url: "/api/sessions", cookie: cookie, status: http.StatusOK, want: `"current":true`},
+		{name: "退出所有设备", method: "POST", url: "/api/logout-all", cookie: other, status: http.StatusOK},
+		{name: "其他设备的会话失效", method: "GET", url: "/api/bindings", cookie: cookie, status: http.StatusUnauthorized},
+		{name: "当前设备的会话失效", method: "GET", url: "/api/bindings", cookie: other, status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := apiRequest(s, tt.method, tt.url, tt.body, tt.cookie)
+			if w.Code != tt.status {
+				t.Fatalf("状态码 = %d，期望 %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tt.want) {
+				t.Errorf("响应 = %s，期望包含 %s", w.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	s := newTestServer(t)
+	cookie := login(t, s)
+	other := login(t, s)
+
+	w := apiRequest(s, http.MethodGet, "/api/sessions", "", cookie)
+	var sessions []struct {
+		ID      string `json:"id"`
+		Current bool   `json:"current"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &sessions); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("会话数量 = %d，期望 2", len(sessions))
+	}
+	for _, sess := range sessions {
+		if !sess.Current {
+			if w := apiRequest(s, http.MethodDelete, "/api/sessions/"+sess.ID, "", cookie); w.Code != http.StatusOK {
+				t.Fatalf("吊销会话失败: %d %s", w.Code, w.Body.String())
+			}
+		}
+	}
+
+	if w := apiRequest(s, http.MethodGet, "/api/bindings", "", other); w.Code != http.StatusUnauthorized {
+		t.Errorf("被吊销的会话状态码 = %d，期望 %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := apiRequest(s, http.MethodGet, "/api/bindings", "", cookie); w.Code != http.StatusOK {
+		t.Errorf("当前会话状态码 = %d，期望 %d", w.Code, http.StatusOK)
+	}
+}
+
+// TestSaveRotatedKey 收到服务器A轮换的 API Key 后保存，下次重连使用新 Key
+func TestSaveRotatedKey(t *testing.T) {
+	s := newTestServer(t)
+	if err := s.db.SetServerInfo("https://a.example.com", "old-key"); err != nil {
+		t.Fatal(err)
+	}
+	c := link.NewClient("https://a.example.com", "old-key", nil)
+	s.handleLinkMessage(c, &link.Message{Type: link.TypeKeyRotate, APIKey: "new-key"})
+
+	info, err := s.db.GetServerInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ServerURL != "https://a.example.com" || info.APIKey != "new-key" {
+		t.Errorf("服务器信息 = %+v，期望保存新 Key", info)
+	}
+}
+
+// TestPinServer 记录的身份指纹只对记录时的服务器A地址有效
+func TestPinServer(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := link.Fingerprint(key.Public().(ed25519.PublicKey))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		link.SignIdentity(w.Header(), key, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	m := NewManager(filepath.Join(t.TempDir(), "l2h-c.db"))
+	if _, _, err := m.PinServer(""); err == nil {
+		t.Error("未设置服务器A时 PinServer() 没有返回错误")
+	}
+	if err := m.SetServerInfo(srv.URL, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := m.PinServer("SHA256:other"); err == nil {
+		t.Error("指定的指纹与服务器A不一致时 PinServer() 没有返回错误")
+	}
+	old, got, err := m.PinServer(strings.TrimPrefix(fp, "SHA256:"))
+	if err != nil || old != "" || got != fp {
+		t.Fatalf("PinServer() = %q, %q, %v，期望记录 %q", old, got, err, fp)
+	}
+
+	if pinned, _ := m.db.GetServerFingerprint(srv.URL); pinned != fp {
+		t.Errorf("记录的指纹 = %q，期望 %q", pinned, fp)
+	}
+	// 更换 API Key 不影响记录的指纹，更换服务器地址后需要重新记录
+	if err := m.SetServerInfo(srv.URL, "rotated"); err != nil {
+		t.Fatal(err)
+	}
+	if pinned, _ := m.db.GetServerFingerprint(srv.URL); pinned != fp {
+		t.Errorf("更换 API Key 后记录的指纹 = %q，期望 %q", pinned, fp)
+	}
+	if pinned, _ := m.db.GetServerFingerprint("https://other.example.com"); pinned != "" {
+		t.Errorf("其他地址的记录指纹 = %q，期望为空", pinned)
+	}
+}
+
+// TestSignAnswer 节点密钥在重启后保持不变，签名覆盖双方的 DTLS 证书指纹
+func TestSignAnswer(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "l2h-c.db")
+	s := NewServer(0, dbPath)
+	t.Cleanup(func() { s.db.db.Close() })
+	restarted, err := s.db.NodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.Equal(s.nodeKey) {
+		t.Fatal("重新读取的节点密钥与启动时不同")
+	}
+
+	offer := "v=0\r\na=fingerprint:sha-256 AA:BB\r\n"
+	answer := "v=0\r\na=fingerprint:sha-256 CC:DD\r\n"
+	sig, err := s.signAnswer("app", offer, answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := base64.StdEncoding.DecodeString(sig)
+	for _, tt := range []struct {
+		name          string
+		offer, answer string
+		valid         bool
+	}{
+		{"原始内容", offer, answer, true},
+		{"替换访客证书", "a=fingerprint:sha-256 EE:FF\r\n", answer, false},
+		{"替换服务器B证书", offer, "a=fingerprint:sha-256 EE:FF\r\n", false},
+	} {
+		msg, _ := crypto.DTLSMessage("app", tt.offer, tt.answer)
+		if got := crypto.VerifyNode(&s.nodeKey.PublicKey, msg, raw); got != tt.valid {
+			t.Errorf("%s: VerifyNode() = %v，期望 %v", tt.name, got, tt.valid)
+		}
+	}
+
+	if _, err := s.signAnswer("app", "v=0\r\n", answer); err == nil {
+		t.Error("offer 没有证书指纹时 signAnswer() 没有返回错误")
+	}
+}
@@ -0,0 +1,265 @@
+// Package session 提供服务器A和服务器B管理后台共用的登录会话
+//
+// 会话保存在各自的 SQLite 数据库中，浏览器 cookie 只保存随机令牌，数据库
+// 保存令牌的 SHA-256 作为会话 ID。会话在有效期内被使用时会自动续期。
+package session
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"l2h/internal/utils"
+)
+
+const (
+	// DefaultTTL 会话闲置多久后过期
+	DefaultTTL = 24 * time.Hour
+	// MaxLifetime 无论是否续期，会话自创建起的最长有效期
+	MaxLifetime = 30 * 24 * time.Hour
+	// renewInterval 续期的最小间隔，避免每个请求都写数据库
+	renewInterval = time.Minute
+)
+
+// timeFormat 时间统一以 UTC 写入，与 SQLite 的 CURRENT_TIMESTAMP 一致
+const timeFormat = "2006-01-02 15:04:05"
+
+// Session 一个管理后台登录会话
+type Session struct {
+	ID         string    `json:"id"`
+	User       string    `json:"user"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// Current 是否为发起查询的会话
+	Current bool `json:"current"`
+}
+
+// Store 会话存储
+type Store struct {
+	db         *sql.DB
+	cookieName string
+	ttl        time.Duration
+}
+
+// NewStore 在 db 中创建 sessions 表并返回会话存储，cookieName 为会话 cookie 的名称
+func NewStore(db *sql.DB, cookieName string) (*Store, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS sessions (
+		id TEXT PRIMARY KEY,
+		username TEXT NOT NULL,
+		ip TEXT,
+		user_agent TEXT,
+		expires_at DATETIME NOT NULL,
+		last_seen_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("创建会话表失败: %w", err)
+	}
+
+	// 旧版本的 sessions 表没有 last_seen_at 列
+	if _, err := db.Exec("ALTER TABLE sessions ADD COLUMN last_seen_at DATETIME"); err != nil && !isDuplicateColumn(err) {
+		return nil, fmt.Errorf("升级会话表失败: %w", err)
+	}
+
+	return &Store{db: db, cookieName: cookieName, ttl: DefaultTTL}, nil
+}
+
+func isDuplicateColumn(err error) bool {
+	return strings.Contains(err.Error(), "duplicate column name")
+}
+
+// hashToken 返回令牌对应的会话 ID
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create 为 user 创建会话并返回随机令牌
+func (s *Store) Create(user, ip, userAgent string) (string, error) {
+	token := utils.GenerateRandomString(43)
+	if token == "" {
+		return "", fmt.Errorf("生成会话令牌失败")
+	}
+
+	now := time.Now().UTC()
+	_, err := s.db.Exec(
+		"INSERT INTO sessions (id, username, ip, user_agent, expires_at, last_seen_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		hashToken(token), user, ip, userAgent,
+		now.Add(s.ttl).Format(timeFormat), now.Format(timeFormat), now.Format(timeFormat))
+	if err != nil {
+		return "", fmt.Errorf("创建会话失败: %w", err)
+	}
+
+	// 顺便清理过期会话，失败不影响登录
+	s.db.Exec("DELETE FROM sessions WHERE expires_at <= ?", now.Format(timeFormat))
+	return token, nil
+}
+
+const sessionColumns = "id, username, COALESCE(ip, ''), COALESCE(user_agent, ''), created_at, last_seen_at, expires_at FROM sessions"
+
+func scanSession(row interface{ Scan(...any) error }) (*Session, error) {
+	var sess Session
+	var createdAt, lastSeenAt, expiresAt sql.NullTime
+	if err := row.Scan(&sess.ID, &sess.User, &sess.IP, &sess.UserAgent, &createdAt, &lastSeenAt, &expiresAt); err != nil {
+		return nil, err
+	}
+	sess.CreatedAt = createdAt.Time
+	sess.LastSeenAt = lastSeenAt.Time
+	if !lastSeenAt.Valid {
+		sess.LastSeenAt = sess.CreatedAt
+	}
+	sess.ExpiresAt = expiresAt.Time
+	return &sess, nil
+}
+
+// Validate 查找令牌对应的有效会话并为其续期，不存在或已过期时返回 nil
+func (s *Store) Validate(token string) (*Session, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	now := time.Now().UTC()
+	sess, err := scanSession(s.db.QueryRow("SELECT "+sessionColumns+" WHERE id = ? AND expires_at > ?",
+		hashToken(token), now.Format(timeFormat)))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if now.Sub(sess.LastSeenAt) >= renewInterval {
+		expiresAt := now.Add(s.ttl)
+		if limit := sess.CreatedAt.Add(MaxLifetime); expiresAt.After(limit) {
+			expiresAt = limit
+		}
+		_, err := s.db.Exec("UPDATE sessions SET last_seen_at = ?, expires_at = ? WHERE id = ?",
+			now.Format(timeFormat), expiresAt.Format(timeFormat), sess.ID)
+		if err != nil {
+			return nil, fmt.Errorf("续期会话失败: %w", err)
+		}
+		sess.LastSeenAt = now
+		sess.ExpiresAt = expiresAt
+	}
+	return sess, nil
+}
+
+// List 返回所有未过期的会话，最近活动的在前，ID 为 current 的会话会被标记
+func (s *Store) List(current string) ([]*Session, error) {
+	now := time.Now().UTC().Format(timeFormat)
+	rows, err := s.db.Query("SELECT "+sessionColumns+" WHERE expires_at > ? ORDER BY last_seen_at DESC", now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*Session
+	for rows.Next() {
+		sess, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sess.Current = sess.ID == current
+		sessions = append(sessions, sess)
+	}
+	return sessions, rows.Err()
+}
+
+// Delete 删除令牌对应的会话，用于退出登录
+func (s *Store) Delete(token string) error {
+	return s.Revoke(hashToken(token))
+}
+
+// Revoke 按会话 ID 吊销会话
+func (s *Store) Revoke(id string) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE id = ?", id)
+	return err
+}
+
+// RevokeUser 吊销 user 的所有会话，except 不为空时保留该会话
+func (s *Store) RevokeUser(user, except string) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE username = ? AND id != ?", user, except)
+	return err
+}
+
+// Login 创建会话并通过 cookie 下发令牌
+func (s *Store) Login(w http.ResponseWriter, r *http.Request, user string) error {
+	token, err := s.Create(user, utils.ClientIP(r), r.UserAgent())
+	if err != nil {
+		return err
+	}
+	s.setCookie(w, r, token, int(MaxLifetime.Seconds()))
+	return nil
+}
+
+// Logout 删除当前请求的会话并清除 cookie
+func (s *Store) Logout(w http.ResponseWriter, r *http.Request) error {
+	if token := s.token(r); token != "" {
+		if err := s.Delete(token); err != nil {
+			return err
+		}
+	}
+	s.setCookie(w, r, "", -1)
+	return nil
+}
+
+// token 返回请求携带的会话令牌
+func (s *Store) token(r *http.Request) string {
+	cookie, err := r.Cookie(s.cookieName)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// setCookie 下发会话 cookie。服务端会话会续期，因此 cookie 使用最长有效期
+func (s *Store) setCookie(w http.ResponseWriter, r *http.Request, token string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.cookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+type contextKey struct{}
+
+// Require 中间件：要求请求携带有效会话，会话可通过 FromContext 取得
+func (s *Store) Require(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := s.token(r)
+		if token == "" {
+			utils.WriteError(w, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+
+		sess, err := s.Validate(token)
+		if err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if sess == nil {
+			utils.WriteError(w, http.StatusUnauthorized, "Invalid or expired session")
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, sess)))
+	}
+}
+
+// FromContext 返回 Require 验证通过的会话
+func FromContext(r *http.Request) *Session {
+	sess, _ := r.Context().Value(contextKey{}).(*Session)
+	return sess
+}
@@ -0,0 +1,189 @@
+package session
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "sessions.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	s, err := NewStore(db, "test_session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// setTimes 修改会话的时间，模拟经过了一段时间
+func setTimes(t *testing.T, s *Store, token string, created, lastSeen, expires time.Time) {
+	t.Helper()
+	_, err := s.db.Exec("UPDATE sessions SET created_at = ?, last_seen_at = ?, expires_at = ? WHERE id = ?",
+		created.UTC().Format(timeFormat), lastSeen.UTC().Format(timeFormat), expires.UTC().Format(timeFormat), hashToken(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		created     time.Time
+		lastSeen    time.Time
+		expires     time.Time
+		valid       bool
+		wantExpires time.Time
+	}{
+		{name: "刚刚使用过不续期", created: now.Add(-time.Hour), lastSeen: now, expires: now.Add(time.Hour), valid: true, wantExpires: now.Add(time.Hour)},
+		{name: "使用时续期", created: now.Add(-time.Hour), lastSeen: now.Add(-time.Hour), expires: now.Add(time.Hour), valid: true, wantExpires: now.Add(DefaultTTL)},
+		{name: "续期不超过最长有效期", created: now.Add(-MaxLifetime + time.Hour), lastSeen: now.Add(-time.Hour), expires: now.Add(time.Minute), valid: true, wantExpires: now.Add(time.Hour)},
+		{name: "已过期", created: now.Add(-48 * time.Hour), lastSeen: now.Add(-25 * time.Hour), expires: now.Add(-time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t)
+			token, err := s.Create("admin", "127.0.0.1", "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			setTimes(t, s, token, tt.created, tt.lastSeen, tt.expires)
+
+			sess, err := s.Validate(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (sess != nil) != tt.valid {
+				t.Fatalf("Validate() = %v，期望有效 = %v", sess, tt.valid)
+			}
+			if sess == nil {
+				return
+			}
+			if sess.User != "admin" || sess.IP != "127.0.0.1" || sess.UserAgent != "test" {
+				t.Errorf("Validate() = %+v", sess)
+			}
+			if d := sess.ExpiresAt.Sub(tt.wantExpires); d < -2*time.Second || d > 2*time.Second {
+				t.Errorf("过期时间 = %s，期望 %s", sess.ExpiresAt, tt.wantExpires.UTC())
+			}
+		})
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	s := newTestStore(t)
+	tokens := make(map[string]string)
+	for _, name := range []string{"a1", "a2", "a3", "b1"} {
+		token, err := s.Create(name[:1], "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[name] = token
+	}
+
+	if err := s.Delete(tokens["a1"]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RevokeUser("a", hashToken(tokens["a2"])); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{name: "a1", valid: false},
+		{name: "a2", valid: true},
+		{name: "a3", valid: false},
+		{name: "b1", valid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sess, err := s.Validate(tokens[tt.name])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (sess != nil) != tt.valid {
+				t.Errorf("Validate() = %v，期望有效 = %v", sess, tt.valid)
+			}
+		})
+	}
+
+	sessions, err := s.List(hashToken(tokens["b1"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := 0
+	for _, sess := range sessions {
+		if sess.Current {
+			current++
+			if sess.User != "b" {
+				t.Errorf("当前会话 = %+v，期望用户 b", sess)
+			}
+		}
+	}
+	if len(sessions) != 2 || current != 1 {
+		t.Errorf("List() 返回 %d 个会话，%d 个当前会话，期望 2 个和 1 个", len(sessions), current)
+	}
+}
+
+func TestRequire(t *testing.T) {
+	s := newTestStore(t)
+	login := httptest.NewRecorder()
+	if err := s.Login(login, httptest.NewRequest(http.MethodPost, "/api/login", nil), "admin"); err != nil {
+		t.Fatal(err)
+	}
+	cookies := login.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "test_session" || !cookies[0].HttpOnly {
+		t.Fatalf("登录下发的 cookie = %v", cookies)
+	}
+
+	handler := s.Require(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(FromContext(r).User))
+	})
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		status int
+	}{
+		{name: "没有 cookie", status: http.StatusUnauthorized},
+		{name: "无效令牌", cookie: &http.Cookie{Name: "test_session", Value: "forged"}, status: http.StatusUnauthorized},
+		{name: "其他名称的 cookie", cookie: &http.Cookie{Name: "other", Value: cookies[0].Value}, status: http.StatusUnauthorized},
+		{name: "有效会话", cookie: cookies[0], status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/bindings", nil)
+			if tt.cookie != nil {
+				r.AddCookie(tt.cookie)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("状态码 = %d，期望 %d", w.Code, tt.status)
+			}
+			if tt.status == http.StatusOK && w.Body.String() != "admin" {
+				t.Errorf("FromContext() 用户 = %q，期望 admin", w.Body.String())
+			}
+		})
+	}
+
+	// 退出后令牌失效
+	r := httptest.NewRequest(http.MethodPost, "/api/logout", nil)
+	r.AddCookie(cookies[0])
+	if err := s.Logout(httptest.NewRecorder(), r); err != nil {
+		t.Fatal(err)
+	}
+	if sess, _ := s.Validate(cookies[0].Value); sess != nil {
+		t.Error("退出后会话仍然有效")
+	}
+}
@@ -0,0 +1,77 @@
+// Package stun 实现一个最小的 STUN 服务（RFC 5389 Binding），
+// 使 l2h-s 无需依赖公共 STUN 服务器即可完成 ICE 候选收集
+package stun
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/pion/stun/v3"
+)
+
+// Server 只响应 Binding 请求的 UDP STUN 服务
+type Server struct {
+	port int
+	conn net.PacketConn
+}
+
+func NewServer(port int) *Server {
+	return &Server{port: port}
+}
+
+// Start 监听 UDP 端口并处理请求，直到连接关闭
+func (s *Server) Start() error {
+	conn, err := net.ListenPacket("udp", ":"+strconv.Itoa(s.port))
+	if err != nil {
+		return fmt.Errorf("监听 STUN 端口失败: %w", err)
+	}
+	s.conn = conn
+	log.Printf("STUN 服务启动在 UDP 端口 %d", s.port)
+
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if err := s.handle(buf[:n], addr); err != nil {
+			log.Printf("处理 STUN 请求失败 (%s): %v", addr, err)
+		}
+	}
+}
+
+// handle 对 Binding 请求返回请求方的公网地址，其余报文忽略
+func (s *Server) handle(data []byte, addr net.Addr) error {
+	if !stun.IsMessage(data) {
+		return nil
+	}
+
+	req := &stun.Message{Raw: append([]byte(nil), data...)}
+	if err := req.Decode(); err != nil {
+		return err
+	}
+	if req.Type != stun.BindingRequest {
+		return nil
+	}
+
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+
+	resp, err := stun.Build(
+		stun.NewTransactionIDSetter(req.TransactionID),
+		stun.BindingSuccess,
+		&stun.XORMappedAddress{IP: udpAddr.IP, Port: udpAddr.Port},
+		stun.NewSoftware("l2h"),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.conn.WriteTo(resp.Raw, addr)
+	return err
+}
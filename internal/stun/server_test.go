@@ -0,0 +1,80 @@
+package stun
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/stun/v3"
+)
+
+func TestHandle(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	s := &Server{conn: conn}
+
+	binding := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	// 有效的 STUN 头，但属性长度超出报文
+	truncated := append([]byte(nil), binding.Raw...)
+	truncated[3] = 8
+
+	tests := []struct {
+		name      string
+		data      []byte
+		wantReply bool
+		wantErr   bool
+	}{
+		{name: "Binding 请求", data: binding.Raw, wantReply: true},
+		{name: "Binding 指示", data: stun.MustBuild(stun.TransactionID, stun.NewType(stun.MethodBinding, stun.ClassIndication)).Raw},
+		{name: "其他方法", data: stun.MustBuild(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest)).Raw},
+		{name: "不是 STUN 报文", data: []byte("GET / HTTP/1.1\r\n\r\n")},
+		{name: "格式错误", data: truncated, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.handle(tt.data, client.LocalAddr())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("handle() 错误 = %v", err)
+			}
+
+			buf := make([]byte, 1500)
+			client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			n, _, err := client.ReadFrom(buf)
+			if !tt.wantReply {
+				if err == nil {
+					t.Errorf("不应回复，收到 %d 字节", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp := &stun.Message{Raw: buf[:n]}
+			if err := resp.Decode(); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Type != stun.BindingSuccess || resp.TransactionID != binding.TransactionID {
+				t.Errorf("回复 %s，事务ID 相同 = %v", resp.Type, resp.TransactionID == binding.TransactionID)
+			}
+			if err := stun.Fingerprint.Check(resp); err != nil {
+				t.Errorf("指纹无效: %v", err)
+			}
+			var mapped stun.XORMappedAddress
+			if err := mapped.GetFrom(resp); err != nil {
+				t.Fatal(err)
+			}
+			if mapped.String() != client.LocalAddr().String() {
+				t.Errorf("映射地址 = %s，期望 %s", mapped.String(), client.LocalAddr())
+			}
+		})
+	}
+}
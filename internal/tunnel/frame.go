@@ -0,0 +1,84 @@
+// Package tunnel 定义在数据通道上复用 HTTP 请求的帧协议
+//
+// 每条数据通道消息就是一个帧，格式如下：
+//
+//	+---------+------------------+----------+
+//	| 类型 1B | 流ID 4B（大端序） | 负载     |
+//	+---------+------------------+----------+
+//
+// 访客为每个 HTTP 请求分配一个新的流ID，依次发送 REQUEST（JSON 请求头）、
+// 若干 DATA（请求体分块）和 END；l2h-c 在同一流ID上依次返回 RESPONSE
+// （JSON 响应头）、若干 DATA 和 END。任一方可随时发送 ABORT 终止该流。
+// 多个流可以在同一数据通道上交错传输，互不阻塞。
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// 帧类型
+const (
+	FrameRequest  byte = 1
+	FrameResponse byte = 2
+	FrameData     byte = 3
+	FrameEnd      byte = 4
+	FrameAbort    byte = 5
+)
+
+// headerSize 帧头长度
+const headerSize = 5
+
+// MaxChunkSize 单个 DATA 帧负载的最大长度
+const MaxChunkSize = 16<<10 - headerSize
+
+// ErrShortFrame 帧长度不足
+var ErrShortFrame = errors.New("帧长度不足")
+
+// Frame 协议帧
+type Frame struct {
+	Type    byte
+	Stream  uint32
+	Payload []byte
+}
+
+// Marshal 将帧编码为一条消息
+func (f *Frame) Marshal() []byte {
+	buf := make([]byte, headerSize+len(f.Payload))
+	buf[0] = f.Type
+	binary.BigEndian.PutUint32(buf[1:headerSize], f.Stream)
+	copy(buf[headerSize:], f.Payload)
+	return buf
+}
+
+// ParseFrame 从一条消息中解析帧
+func ParseFrame(msg []byte) (*Frame, error) {
+	if len(msg) < headerSize {
+		return nil, ErrShortFrame
+	}
+	return &Frame{
+		Type:    msg[0],
+		Stream:  binary.BigEndian.Uint32(msg[1:headerSize]),
+		Payload: msg[headerSize:],
+	}, nil
+}
+
+// RequestHead REQUEST 帧的负载
+type RequestHead struct {
+	Method string              `json:"method"`
+	URL    string              `json:"url"`
+	Header map[string][]string `json:"headers"`
+}
+
+// ResponseHead RESPONSE 帧的负载
+type ResponseHead struct {
+	Status int                 `json:"status"`
+	Header map[string][]string `json:"headers"`
+}
+
+// Conn 面向消息的双向连接，每次读写对应一个完整的帧
+type Conn interface {
+	ReadMessage() ([]byte, error)
+	WriteMessage([]byte) error
+	Close() error
+}
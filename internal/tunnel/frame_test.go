@@ -0,0 +1,48 @@
+package tunnel
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame Frame
+		want  []byte
+	}{
+		{"空负载", Frame{Type: FrameEnd, Stream: 1}, []byte{FrameEnd, 0, 0, 0, 1}},
+		{"大端序流ID", Frame{Type: FrameData, Stream: 0x01020304, Payload: []byte("ab")}, []byte{FrameData, 1, 2, 3, 4, 'a', 'b'}},
+		{"最大流ID", Frame{Type: FrameAbort, Stream: 0xffffffff, Payload: []byte("x")}, []byte{FrameAbort, 0xff, 0xff, 0xff, 0xff, 'x'}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.frame.Marshal()
+			if !bytes.Equal(got, tt.want) {
+				t.Fatalf("Marshal() = %v，期望 %v", got, tt.want)
+			}
+			f, err := ParseFrame(got)
+			if err != nil {
+				t.Fatalf("ParseFrame() 失败: %v", err)
+			}
+			if f.Type != tt.frame.Type || f.Stream != tt.frame.Stream || !bytes.Equal(f.Payload, tt.frame.Payload) {
+				t.Errorf("ParseFrame() = %+v，期望 %+v", f, tt.frame)
+			}
+		})
+	}
+}
+
+func TestParseFrameShort(t *testing.T) {
+	for _, msg := range [][]byte{nil, {}, {FrameData}, {FrameData, 0, 0, 0}} {
+		if _, err := ParseFrame(msg); err != ErrShortFrame {
+			t.Errorf("ParseFrame(%v) 错误 = %v，期望 ErrShortFrame", msg, err)
+		}
+	}
+}
+
+func TestMaxChunkSize(t *testing.T) {
+	f := Frame{Type: FrameData, Payload: make([]byte, MaxChunkSize)}
+	if n := len(f.Marshal()); n != 16<<10 {
+		t.Errorf("最大 DATA 帧长度 = %d，期望 %d", n, 16<<10)
+	}
+}
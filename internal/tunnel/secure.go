@@ -0,0 +1,145 @@
+package tunnel
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"l2h/internal/crypto"
+)
+
+// 中继经过服务器A转发，为了不让服务器A看到访客的流量，访客和 l2h-c 在中继上先完成一次握手：
+//
+//  1. 访客发送临时的 P-256 ECDH 公钥（65 字节）
+//  2. l2h-c 回复自己的临时公钥（65 字节）和用节点密钥对握手内容的签名（64 字节）
+//
+// 访客用路径公布的节点公钥验证签名，双方用 ECDH 共享密钥经 HKDF-SHA256 派生出两个方向的
+// AES-256-GCM 密钥。之后每条消息都单独加密，nonce 为各方向从 0 开始的消息序号，
+// 服务器A无法解密、篡改、重放或调换消息的顺序
+
+// secureInfo HKDF 的 info，也是签名内容的前缀
+const secureInfo = "l2h-relay-v1"
+
+var (
+	ErrHandshake = errors.New("中继加密握手失败")
+	ErrDecrypt   = errors.New("中继消息解密失败")
+)
+
+// secureConn 加密的中继连接
+type secureConn struct {
+	conn Conn
+
+	writeMu  sync.Mutex
+	send     cipher.AEAD
+	sendSeq  uint64
+	recv     cipher.AEAD
+	recvSeq  uint64
+	overhead int
+}
+
+// HandshakeMessage 返回 l2h-c 用节点密钥签名的握手内容
+func HandshakeMessage(path string, visitorKey, nodeKey []byte) []byte {
+	msg := []byte(secureInfo + "\n" + path + "\n")
+	msg = append(msg, visitorKey...)
+	return append(msg, nodeKey...)
+}
+
+// AcceptSecure 作为 l2h-c 在中继上完成加密握手，返回加密后的连接
+func AcceptSecure(conn Conn, key *ecdsa.PrivateKey, path string) (Conn, error) {
+	hello, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	visitorKey, err := ecdh.P256().NewPublicKey(hello)
+	if err != nil {
+		return nil, ErrHandshake
+	}
+
+	eph, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	nodeKey := eph.PublicKey().Bytes()
+	sig, err := crypto.SignNode(key, HandshakeMessage(path, hello, nodeKey))
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.WriteMessage(append(append([]byte{}, nodeKey...), sig...)); err != nil {
+		return nil, err
+	}
+
+	shared, err := eph.ECDH(visitorKey)
+	if err != nil {
+		return nil, ErrHandshake
+	}
+	// 前 32 字节用于访客到 l2h-c 的方向，后 32 字节用于 l2h-c 到访客的方向
+	recv, send, err := secureKeys(shared, hello, nodeKey)
+	if err != nil {
+		return nil, err
+	}
+	return &secureConn{conn: conn, send: send, recv: recv, overhead: send.Overhead()}, nil
+}
+
+// secureKeys 派生两个方向的 AES-GCM 密钥，salt 为双方的临时公钥
+func secureKeys(shared, visitorKey, nodeKey []byte) (visitorToNode, nodeToVisitor cipher.AEAD, err error) {
+	salt := append(append([]byte{}, visitorKey...), nodeKey...)
+	okm, err := hkdf.Key(sha256.New, shared, salt, secureInfo, 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	if visitorToNode, err = newGCM(okm[:32]); err != nil {
+		return nil, nil, err
+	}
+	if nodeToVisitor, err = newGCM(okm[32:]); err != nil {
+		return nil, nil, err
+	}
+	return visitorToNode, nodeToVisitor, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seqNonce(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+// ReadMessage 读取并解密下一条消息，ReadMessage 不能并发调用
+func (c *secureConn) ReadMessage() ([]byte, error) {
+	msg, err := c.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	plain, err := c.recv.Open(nil, seqNonce(c.recvSeq), msg, nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	c.recvSeq++
+	return plain, nil
+}
+
+// WriteMessage 加密并发送一条消息
+func (c *secureConn) WriteMessage(data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	sealed := c.send.Seal(make([]byte, 0, len(data)+c.overhead), seqNonce(c.sendSeq), data, nil)
+	c.sendSeq++
+	return c.conn.WriteMessage(sealed)
+}
+
+func (c *secureConn) Close() error {
+	return c.conn.Close()
+}
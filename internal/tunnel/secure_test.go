@@ -0,0 +1,165 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"l2h/internal/crypto"
+)
+
+func newNodeKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	der, err := crypto.GenerateNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := crypto.ParseNodePrivateKey(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// visitorHandshake 模拟访客浏览器完成握手，返回访客发送和接收方向的密钥
+func visitorHandshake(t *testing.T, c *pipeConn, pub *ecdsa.PublicKey, path string) (send, recv cipher.AEAD, err error) {
+	t.Helper()
+	eph, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	visitorKey := eph.PublicKey().Bytes()
+	c.in <- visitorKey
+
+	var reply []byte
+	select {
+	case reply = <-c.out:
+	case <-time.After(time.Second):
+		t.Fatal("等待握手回复超时")
+	}
+	if len(reply) != 65+64 {
+		t.Fatalf("握手回复长度 = %d，期望 129", len(reply))
+	}
+	nodeKey, sig := reply[:65], reply[65:]
+	if !crypto.VerifyNode(pub, HandshakeMessage(path, visitorKey, nodeKey), sig) {
+		return nil, nil, ErrHandshake
+	}
+	peer, err := ecdh.P256().NewPublicKey(nodeKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := eph.ECDH(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secureKeys(shared, visitorKey, nodeKey)
+}
+
+func acceptSecure(t *testing.T, key *ecdsa.PrivateKey, path string) (*pipeConn, chan Conn) {
+	t.Helper()
+	c := newPipeConn()
+	t.Cleanup(func() { c.Close() })
+	accepted := make(chan Conn, 1)
+	go func() {
+		conn, err := AcceptSecure(c, key, path)
+		if err != nil {
+			t.Errorf("AcceptSecure() 失败: %v", err)
+		}
+		accepted <- conn
+	}()
+	return c, accepted
+}
+
+func TestSecureConn(t *testing.T) {
+	key := newNodeKey(t)
+	c, accepted := acceptSecure(t, key, "/app")
+	send, recv, err := visitorHandshake(t, c, &key.PublicKey, "/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := <-accepted
+
+	// 访客到 l2h-c
+	for i, msg := range []string{"first", "second"} {
+		c.in <- send.Seal(nil, seqNonce(uint64(i)), []byte(msg), nil)
+		got, err := conn.ReadMessage()
+		if err != nil || string(got) != msg {
+			t.Fatalf("ReadMessage() = %q, %v，期望 %q", got, err, msg)
+		}
+	}
+
+	// l2h-c 到访客，服务器A只能看到密文
+	if err := conn.WriteMessage([]byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	sealed := <-c.out
+	if bytes.Contains(sealed, []byte("reply")) {
+		t.Error("中继转发的消息包含明文")
+	}
+	got, err := recv.Open(nil, seqNonce(0), sealed, nil)
+	if err != nil || string(got) != "reply" {
+		t.Errorf("访客解密 = %q, %v，期望 %q", got, err, "reply")
+	}
+}
+
+func TestSecureConnTampered(t *testing.T) {
+	tests := []struct {
+		name string
+		msgs func(send cipher.AEAD) [][]byte
+	}{
+		{"篡改密文", func(send cipher.AEAD) [][]byte {
+			msg := send.Seal(nil, seqNonce(0), []byte("data"), nil)
+			msg[0] ^= 1
+			return [][]byte{msg}
+		}},
+		{"调换顺序", func(send cipher.AEAD) [][]byte {
+			return [][]byte{send.Seal(nil, seqNonce(1), []byte("b"), nil)}
+		}},
+		{"重放", func(send cipher.AEAD) [][]byte {
+			msg := send.Seal(nil, seqNonce(0), []byte("a"), nil)
+			return [][]byte{msg, msg}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := newNodeKey(t)
+			c, accepted := acceptSecure(t, key, "/app")
+			send, _, err := visitorHandshake(t, c, &key.PublicKey, "/app")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn := <-accepted
+
+			msgs := tt.msgs(send)
+			for _, msg := range msgs {
+				c.in <- msg
+			}
+			for range len(msgs) - 1 {
+				if _, err := conn.ReadMessage(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := conn.ReadMessage(); err != ErrDecrypt {
+				t.Errorf("ReadMessage() 错误 = %v，期望 ErrDecrypt", err)
+			}
+		})
+	}
+}
+
+func TestSecureHandshakeSignature(t *testing.T) {
+	key := newNodeKey(t)
+
+	// 访客期望的是另一个节点的公钥，或者路径被服务器A替换，签名都无法通过验证
+	c, _ := acceptSecure(t, key, "/app")
+	if _, _, err := visitorHandshake(t, c, &newNodeKey(t).PublicKey, "/app"); err != ErrHandshake {
+		t.Errorf("其他节点公钥: 错误 = %v，期望 ErrHandshake", err)
+	}
+	c, _ = acceptSecure(t, key, "/other")
+	if _, _, err := visitorHandshake(t, c, &key.PublicKey, "/app"); err != ErrHandshake {
+		t.Errorf("路径不同: 错误 = %v，期望 ErrHandshake", err)
+	}
+}
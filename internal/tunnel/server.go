@@ -0,0 +1,385 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxStreams 单个连接上同时进行的最大请求数
+const maxStreams = 256
+
+// maxBodyBuffer 单个请求暂存的、尚未被本地服务读取的请求体上限，超过时重置该请求
+const maxBodyBuffer = 1 << 20
+
+// hopHeaders 逐跳头部，不在代理两端之间转发
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+var errAborted = errors.New("请求已被访客取消")
+
+// client 转发到本地服务时使用的 HTTP 客户端
+// 不跟随重定向、不自动解压，响应原样交给访客浏览器处理
+var client = &http.Client{
+	Transport: &http.Transport{
+		DisableCompression:  true,
+		MaxIdleConnsPerHost: 32,
+		IdleConnTimeout:     90 * time.Second,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// Server 在一个连接上处理访客发起的 HTTP 请求，并在本地服务上重放
+type Server struct {
+	conn   Conn
+	target string
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	streams map[uint32]*stream
+}
+
+type stream struct {
+	// body 请求体缓冲，没有请求体时为 nil
+	body   *bodyBuffer
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// bodyBuffer 暂存尚未写入本地服务的请求体。读循环追加数据时不会阻塞，
+// 某个请求的本地服务读得慢不会拖住同一连接上的其他请求
+type bodyBuffer struct {
+	mu     sync.Mutex
+	chunks [][]byte
+	size   int
+	ended  bool
+	ready  chan struct{}
+}
+
+func newBodyBuffer() *bodyBuffer {
+	return &bodyBuffer{ready: make(chan struct{}, 1)}
+}
+
+// push 追加一块数据，暂存的数据超过 maxBodyBuffer 时返回 false
+func (b *bodyBuffer) push(chunk []byte) bool {
+	b.mu.Lock()
+	if b.ended {
+		b.mu.Unlock()
+		return true
+	}
+	if b.size+len(chunk) > maxBodyBuffer {
+		b.mu.Unlock()
+		return false
+	}
+	b.chunks = append(b.chunks, chunk)
+	b.size += len(chunk)
+	b.mu.Unlock()
+	b.notify()
+	return true
+}
+
+// end 标记请求体已结束
+func (b *bodyBuffer) end() {
+	b.mu.Lock()
+	b.ended = true
+	b.mu.Unlock()
+	b.notify()
+}
+
+func (b *bodyBuffer) notify() {
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+}
+
+// next 等待下一块数据，请求体结束时返回 io.EOF
+func (b *bodyBuffer) next(ctx context.Context) ([]byte, error) {
+	for {
+		b.mu.Lock()
+		if len(b.chunks) > 0 {
+			chunk := b.chunks[0]
+			b.chunks[0] = nil
+			b.chunks = b.chunks[1:]
+			b.size -= len(chunk)
+			b.mu.Unlock()
+			return chunk, nil
+		}
+		ended := b.ended
+		b.mu.Unlock()
+		if ended {
+			return nil, io.EOF
+		}
+
+		select {
+		case <-b.ready:
+		case <-ctx.Done():
+			return nil, errAborted
+		}
+	}
+}
+
+// Serve 在 conn 上处理请求直到连接关闭，target 为本地服务地址，如 127.0.0.1:8080
+func Serve(conn Conn, target string) error {
+	s := &Server{
+		conn:    conn,
+		target:  target,
+		streams: make(map[uint32]*stream),
+	}
+	defer s.abortAll()
+
+	for {
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		frame, err := ParseFrame(msg)
+		if err != nil {
+			return err
+		}
+		s.handleFrame(frame)
+	}
+}
+
+func (s *Server) handleFrame(f *Frame) {
+	switch f.Type {
+	case FrameRequest:
+		s.handleRequest(f)
+	case FrameData:
+		st := s.stream(f.Stream)
+		if st == nil || st.body == nil || st.ctx.Err() != nil {
+			return
+		}
+		if !st.body.push(f.Payload) {
+			st.cancel()
+			s.abort(f.Stream, "请求体缓冲区已满，本地服务读取过慢")
+		}
+	case FrameEnd:
+		st := s.stream(f.Stream)
+		if st == nil || st.body == nil {
+			return
+		}
+		st.body.end()
+	case FrameAbort:
+		if st := s.stream(f.Stream); st != nil {
+			st.cancel()
+		}
+	}
+}
+
+func (s *Server) handleRequest(f *Frame) {
+	var head RequestHead
+	if err := json.Unmarshal(f.Payload, &head); err != nil {
+		s.abort(f.Stream, "无效的请求头")
+		return
+	}
+
+	s.mu.Lock()
+	if _, exists := s.streams[f.Stream]; exists || len(s.streams) >= maxStreams {
+		s.mu.Unlock()
+		s.abort(f.Stream, "流ID重复或并发请求过多")
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	st := &stream{ctx: ctx, cancel: cancel}
+	s.streams[f.Stream] = st
+	s.mu.Unlock()
+
+	req, err := s.newRequest(ctx, &head, st)
+	if err != nil {
+		s.finish(f.Stream, st)
+		s.abort(f.Stream, err.Error())
+		return
+	}
+
+	go s.roundTrip(f.Stream, st, req)
+}
+
+// newRequest 根据请求头构造发往本地服务的请求，请求体通过 DATA 帧流式写入
+func (s *Server) newRequest(ctx context.Context, head *RequestHead, st *stream) (*http.Request, error) {
+	// 只接受以 / 开头的路径，访客不能通过 @host 或绝对 URL 让请求发往绑定端口以外的地址
+	if !strings.HasPrefix(head.URL, "/") {
+		return nil, errors.New("无效的请求地址")
+	}
+	reqURL, err := url.ParseRequestURI(head.URL)
+	if err != nil {
+		return nil, errors.New("无效的请求地址")
+	}
+	target := &url.URL{
+		Scheme:   "http",
+		Host:     s.target,
+		Path:     reqURL.Path,
+		RawPath:  reqURL.RawPath,
+		RawQuery: reqURL.RawQuery,
+	}
+
+	header := http.Header(head.Header)
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Del("Host")
+	removeHopHeaders(header)
+
+	var contentLength int64 = -1
+	if v := header.Get("Content-Length"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return nil, errors.New("无效的 Content-Length")
+		}
+		contentLength = n
+	}
+
+	// 没有请求体时不读取后续 DATA 帧
+	var body io.Reader = http.NoBody
+	hasBody := contentLength > 0 ||
+		(contentLength < 0 && head.Method != http.MethodGet && head.Method != http.MethodHead)
+	if hasBody {
+		pr, pw := io.Pipe()
+		st.body = newBodyBuffer()
+		go pipeBody(st, pw)
+		body = pr
+	}
+
+	req, err := http.NewRequestWithContext(ctx, head.Method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	if hasBody {
+		req.ContentLength = contentLength
+	} else {
+		req.ContentLength = 0
+	}
+	return req, nil
+}
+
+// pipeBody 将收到的 DATA 帧写入请求体
+func pipeBody(st *stream, pw *io.PipeWriter) {
+	for {
+		chunk, err := st.body.next(st.ctx)
+		if err == io.EOF {
+			pw.Close()
+			return
+		}
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := pw.Write(chunk); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) roundTrip(id uint32, st *stream, req *http.Request) {
+	defer s.finish(id, st)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		if st.ctx.Err() != nil {
+			return
+		}
+		log.Printf("转发请求 %s %s 失败: %v", req.Method, req.URL.Path, err)
+		s.writeHead(id, http.StatusBadGateway, http.Header{"Content-Type": {"text/plain; charset=utf-8"}})
+		s.write(&Frame{Type: FrameData, Stream: id, Payload: []byte("无法连接到本地服务: " + err.Error())})
+		s.write(&Frame{Type: FrameEnd, Stream: id})
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	if err := s.writeHead(id, resp.StatusCode, resp.Header); err != nil {
+		return
+	}
+
+	buf := make([]byte, MaxChunkSize)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			chunk := append([]byte(nil), buf[:n]...)
+			if werr := s.write(&Frame{Type: FrameData, Stream: id, Payload: chunk}); werr != nil {
+				return
+			}
+		}
+		if err == io.EOF {
+			s.write(&Frame{Type: FrameEnd, Stream: id})
+			return
+		}
+		if err != nil {
+			if st.ctx.Err() == nil {
+				s.abort(id, err.Error())
+			}
+			return
+		}
+	}
+}
+
+func (s *Server) writeHead(id uint32, status int, header http.Header) error {
+	payload, err := json.Marshal(&ResponseHead{Status: status, Header: header})
+	if err != nil {
+		return err
+	}
+	return s.write(&Frame{Type: FrameResponse, Stream: id, Payload: payload})
+}
+
+func (s *Server) write(f *Frame) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.conn.WriteMessage(f.Marshal())
+}
+
+func (s *Server) abort(id uint32, reason string) {
+	s.write(&Frame{Type: FrameAbort, Stream: id, Payload: []byte(reason)})
+}
+
+func (s *Server) stream(id uint32) *stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+// finish 结束一个流并释放其资源
+func (s *Server) finish(id uint32, st *stream) {
+	st.cancel()
+	s.mu.Lock()
+	if s.streams[id] == st {
+		delete(s.streams, id)
+	}
+	s.mu.Unlock()
+}
+
+func (s *Server) abortAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, st := range s.streams {
+		st.cancel()
+	}
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
@@ -0,0 +1,207 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeConn 以通道模拟数据通道，测试一侧通过 in 发送帧，从 out 读取回复
+type pipeConn struct {
+	in   chan []byte
+	out  chan []byte
+	once sync.Once
+	done chan struct{}
+}
+
+func newPipeConn() *pipeConn {
+	return &pipeConn{in: make(chan []byte, 16), out: make(chan []byte, 64), done: make(chan struct{})}
+}
+
+func (c *pipeConn) ReadMessage() ([]byte, error) {
+	select {
+	case msg := <-c.in:
+		return msg, nil
+	case <-c.done:
+		return nil, io.EOF
+	}
+}
+
+func (c *pipeConn) WriteMessage(data []byte) error {
+	select {
+	case c.out <- append([]byte(nil), data...):
+		return nil
+	case <-c.done:
+		return io.ErrClosedPipe
+	}
+}
+
+func (c *pipeConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+func (c *pipeConn) send(t *testing.T, f Frame) {
+	t.Helper()
+	c.in <- f.Marshal()
+}
+
+func (c *pipeConn) next(t *testing.T) *Frame {
+	t.Helper()
+	select {
+	case msg := <-c.out:
+		f, err := ParseFrame(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	case <-time.After(5 * time.Second):
+		t.Fatal("等待回复超时")
+		return nil
+	}
+}
+
+func requestFrame(t *testing.T, stream uint32, head RequestHead) Frame {
+	t.Helper()
+	payload, err := json.Marshal(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Frame{Type: FrameRequest, Stream: stream, Payload: payload}
+}
+
+func TestServe(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Host", r.Host)
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, r.Method+" "+r.URL.RequestURI()+" "+string(body))
+	}))
+	defer backend.Close()
+	target := strings.TrimPrefix(backend.URL, "http://")
+
+	tests := []struct {
+		name   string
+		head   RequestHead
+		body   []string
+		status int
+		want   string
+		abort  bool
+	}{
+		{name: "GET", head: RequestHead{Method: "GET", URL: "/a?b=c"}, status: http.StatusCreated, want: "GET /a?b=c "},
+		{name: "分块请求体", head: RequestHead{Method: "POST", URL: "/upload"}, body: []string{"he", "llo"}, status: http.StatusCreated, want: "POST /upload hello"},
+		{name: "忽略访客的 Host", head: RequestHead{Method: "GET", URL: "/", Header: map[string][]string{"Host": {"evil.example"}}}, status: http.StatusCreated, want: "GET / "},
+		{name: "保留路径编码", head: RequestHead{Method: "GET", URL: "/a%2Fb?q=%20"}, status: http.StatusCreated, want: "GET /a%2Fb?q=%20 "},
+		{name: "双斜杠开头的路径", head: RequestHead{Method: "GET", URL: "//evil.example/x"}, status: http.StatusCreated, want: "GET //evil.example/x "},
+		{name: "@host 形式的地址", head: RequestHead{Method: "GET", URL: "@evil.example:22/x"}, abort: true},
+		{name: "绝对 URL", head: RequestHead{Method: "GET", URL: "http://evil.example/x"}, abort: true},
+		{name: "无效的 Content-Length", head: RequestHead{Method: "POST", URL: "/", Header: map[string][]string{"Content-Length": {"-1"}}}, abort: true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := newPipeConn()
+			defer conn.Close()
+			go Serve(conn, target)
+
+			stream := uint32(i + 1)
+			conn.send(t, requestFrame(t, stream, tt.head))
+			for _, chunk := range tt.body {
+				conn.send(t, Frame{Type: FrameData, Stream: stream, Payload: []byte(chunk)})
+			}
+			if tt.body != nil {
+				conn.send(t, Frame{Type: FrameEnd, Stream: stream})
+			}
+
+			f := conn.next(t)
+			if tt.abort {
+				if f.Type != FrameAbort || f.Stream != stream {
+					t.Fatalf("回复 = %+v，期望 ABORT", f)
+				}
+				return
+			}
+			if f.Type != FrameResponse || f.Stream != stream {
+				t.Fatalf("回复 = %+v，期望 RESPONSE", f)
+			}
+			var head ResponseHead
+			if err := json.Unmarshal(f.Payload, &head); err != nil {
+				t.Fatal(err)
+			}
+			if head.Status != tt.status {
+				t.Errorf("状态码 = %d，期望 %d", head.Status, tt.status)
+			}
+			if got := http.Header(head.Header).Get("X-Host"); got != target {
+				t.Errorf("本地服务收到的 Host = %q，期望 %q", got, target)
+			}
+
+			var body strings.Builder
+			for {
+				f := conn.next(t)
+				if f.Type == FrameEnd {
+					break
+				}
+				if f.Type != FrameData {
+					t.Fatalf("回复 = %+v，期望 DATA 或 END", f)
+				}
+				body.Write(f.Payload)
+			}
+			if body.String() != tt.want {
+				t.Errorf("响应体 = %q，期望 %q", body.String(), tt.want)
+			}
+		})
+	}
+}
+
+// TestSlowUpload 本地服务读取请求体很慢时，同一连接上的其他请求不受影响，
+// 暂存的请求体超过上限后只重置这个请求
+func TestSlowUpload(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			// 不读取请求体。没有读完请求体时服务端察觉不到连接关闭，由测试结束时放行
+			<-release
+			return
+		}
+		io.WriteString(w, "fast")
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	conn := newPipeConn()
+	defer conn.Close()
+	go Serve(conn, strings.TrimPrefix(backend.URL, "http://"))
+
+	conn.send(t, requestFrame(t, 1, RequestHead{Method: "POST", URL: "/slow"}))
+	// 远超本地连接的内核缓冲区和 maxBodyBuffer，读循环阻塞时这里会卡住
+	chunk := make([]byte, MaxChunkSize)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range (32 << 20) / MaxChunkSize {
+			select {
+			case conn.in <- (&Frame{Type: FrameData, Stream: 1, Payload: chunk}).Marshal():
+			case <-conn.done:
+				return
+			}
+		}
+		conn.send(t, requestFrame(t, 2, RequestHead{Method: "GET", URL: "/fast"}))
+	}()
+
+	var aborted, answered bool
+	for !aborted || !answered {
+		f := conn.next(t)
+		switch {
+		case f.Stream == 1 && f.Type == FrameAbort:
+			aborted = true
+		case f.Stream == 2 && f.Type == FrameResponse:
+			answered = true
+		case f.Stream == 1:
+			t.Fatalf("慢请求收到 %+v，期望 ABORT", f)
+		}
+	}
+	<-done
+}
@@ -5,8 +5,11 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
 	"strings"
+	"sync/atomic"
 )
 
 // generateRandomString 生成指定长度的随机字符串
@@ -45,6 +48,98 @@ func WriteError(w http.ResponseWriter, status int, message string) {
 	WriteJSON(w, status, map[string]string{"error": message})
 }
 
+// trustedProxies 可信反向代理的网段，来自这些地址的请求使用 X-Forwarded-For 中的客户端地址
+var trustedProxies atomic.Pointer[[]*net.IPNet]
+
+// SetTrustedProxies 设置可信反向代理的网段，支持 CIDR 和单个 IP 地址
+func SetTrustedProxies(list []string) error {
+	nets, err := ParseCIDRs(list)
+	if err != nil {
+		return err
+	}
+	trustedProxies.Store(&nets)
+	return nil
+}
+
+// ParseCIDR 解析 CIDR 网段，单个 IP 地址视为只包含该地址的网段
+func ParseCIDR(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("无效的 IP 地址 %q", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("无效的网段 %q", s)
+	}
+	return n, nil
+}
+
+// ParseCIDRs 解析一组网段，忽略空项
+func ParseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		n, err := ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// ContainsIP 检查 IP 地址是否属于任一网段
+func ContainsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP 返回请求方的 IP 地址。请求来自可信反向代理时，从右向左跳过 X-Forwarded-For
+// 中的可信代理，取第一个不可信的地址，客户端无法通过伪造该请求头冒充其他地址
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	proxies := trustedProxies.Load()
+	if proxies == nil || len(*proxies) == 0 {
+		return host
+	}
+	if ip := net.ParseIP(host); ip == nil || !ContainsIP(*proxies, ip) {
+		return host
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		host = ip.String()
+		if !ContainsIP(*proxies, ip) {
+			break
+		}
+	}
+	return host
+}
+
 // ContainsSensitiveWord 检查路径是否包含敏感词
 func ContainsSensitiveWord(path string) bool {
 	sensitiveWords := []string{
@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{name: "IPv4", remoteAddr: "203.0.113.1:1234", want: "203.0.113.1"},
+		{name: "IPv6", remoteAddr: "[2001:db8::1]:1234", want: "2001:db8::1"},
+		{name: "没有端口", remoteAddr: "203.0.113.1", want: "203.0.113.1"},
+		{name: "不可信来源的 X-Forwarded-For", remoteAddr: "203.0.113.1:1234", forwarded: []string{"198.51.100.7"}, want: "203.0.113.1"},
+		{name: "可信代理", remoteAddr: "10.0.0.2:1234", forwarded: []string{"198.51.100.7"}, want: "198.51.100.7"},
+		{name: "跳过多级可信代理", remoteAddr: "10.0.0.2:1234", forwarded: []string{"198.51.100.7, 10.0.0.3"}, want: "198.51.100.7"},
+		{name: "客户端伪造的地址被忽略", remoteAddr: "10.0.0.2:1234", forwarded: []string{"192.0.2.99, 198.51.100.7"}, want: "198.51.100.7"},
+		{name: "多个请求头", remoteAddr: "10.0.0.2:1234", forwarded: []string{"192.0.2.99", "198.51.100.7"}, want: "198.51.100.7"},
+		{name: "无效地址", remoteAddr: "10.0.0.2:1234", forwarded: []string{"garbage"}, want: "10.0.0.2"},
+		{name: "没有 X-Forwarded-For", remoteAddr: "10.0.0.2:1234", want: "10.0.0.2"},
+	}
+	if err := SetTrustedProxies([]string{"10.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetTrustedProxies(nil) })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, f := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", f)
+			}
+			if got := ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP() = %q，期望 %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCIDR(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "10.0.0.0/8", want: "10.0.0.0/8"},
+		{in: "10.1.2.3/8", want: "10.0.0.0/8"},
+		{in: " 192.0.2.1 ", want: "192.0.2.1/32"},
+		{in: "2001:db8::/32", want: "2001:db8::/32"},
+		{in: "2001:db8::1", want: "2001:db8::1/128"},
+		{in: "10.0.0.0/33", wantErr: true},
+		{in: "example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseCIDR(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseCIDR() 错误 = %v", err)
+			}
+			if err == nil && got.String() != tt.want {
+				t.Errorf("ParseCIDR() = %s，期望 %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package webrtc
+
+import (
+	"io"
+	"sync"
+
+	pion "github.com/pion/webrtc/v4"
+)
+
+const (
+	// maxBufferedAmount 发送缓冲超过该值时 WriteMessage 会阻塞等待
+	maxBufferedAmount = 1 << 20
+	// lowBufferedAmount 发送缓冲降到该值以下时恢复写入
+	lowBufferedAmount = 256 << 10
+	// MaxMessageSize 单条消息的最大长度，浏览器之间可安全互通
+	MaxMessageSize = 16 << 10
+)
+
+// Channel 数据通道的消息式封装，每次读写对应一条完整消息
+type Channel struct {
+	dc        *pion.DataChannel
+	conn      *Connection
+	messages  chan []byte
+	lowWater  chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newChannel(dc *pion.DataChannel, conn *Connection) *Channel {
+	c := &Channel{
+		dc:       dc,
+		conn:     conn,
+		messages: make(chan []byte, 64),
+		lowWater: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	dc.SetBufferedAmountLowThreshold(lowBufferedAmount)
+	dc.OnBufferedAmountLow(func() {
+		select {
+		case c.lowWater <- struct{}{}:
+		default:
+		}
+	})
+	// 队列满时阻塞 pion 的读循环，由 SCTP 向对端施加背压
+	dc.OnMessage(func(msg pion.DataChannelMessage) {
+		select {
+		case c.messages <- msg.Data:
+		case <-c.done:
+		}
+	})
+	dc.OnClose(func() {
+		c.closeOnce.Do(func() { close(c.done) })
+	})
+
+	return c
+}
+
+// Label 返回数据通道标签
+func (c *Channel) Label() string {
+	return c.dc.Label()
+}
+
+// ReadMessage 读取下一条消息，通道关闭后返回 io.EOF
+func (c *Channel) ReadMessage() ([]byte, error) {
+	select {
+	case msg := <-c.messages:
+		c.conn.AddBytesIn(len(msg))
+		return msg, nil
+	case <-c.done:
+		return nil, io.EOF
+	}
+}
+
+// WriteMessage 发送一条消息，发送缓冲过大时阻塞直到对端消费
+func (c *Channel) WriteMessage(data []byte) error {
+	for c.dc.BufferedAmount() > maxBufferedAmount {
+		select {
+		case <-c.lowWater:
+		case <-c.done:
+			return io.ErrClosedPipe
+		}
+	}
+	if err := c.dc.Send(data); err != nil {
+		return err
+	}
+	c.conn.AddBytesOut(len(data))
+	return nil
+}
+
+// Close 关闭数据通道
+func (c *Channel) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return c.dc.Close()
+}
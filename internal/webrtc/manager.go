@@ -1,47 +1,300 @@
+// Package webrtc 提供基于 WebRTC 数据通道的对等连接管理
 package webrtc
 
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
 	"sync"
+	"time"
+
+	pion "github.com/pion/webrtc/v4"
+)
+
+// DefaultICEServers 默认使用的 STUN 服务器
+var DefaultICEServers = []string{"stun:stun.l.google.com:19302"}
+
+// 连接使用的传输方式
+const (
+	// TransportP2P 浏览器与服务器B之间的 WebRTC 数据通道
+	TransportP2P = "p2p"
+	// TransportRelay ICE 无法直连时经服务器A中继
+	TransportRelay = "relay"
+)
+
+// gatherTimeout 等待 ICE 候选收集完成的最长时间
+const gatherTimeout = 10 * time.Second
+
+const (
+	// DefaultIdleTimeout 连接在该时间内没有任何流量时被清理
+	DefaultIdleTimeout = 30 * time.Minute
+	// handshakeTimeout 连接在该时间内仍未建立时被清理
+	handshakeTimeout = time.Minute
+	// disconnectTimeout 连接断开后在该时间内未恢复时被清理
+	disconnectTimeout = 30 * time.Second
+	// reapInterval 清理过期连接的周期
+	reapInterval = 15 * time.Second
+)
+
+// State 连接状态
+type State string
+
+const (
+	StateNew          State = "new"
+	StateChecking     State = "checking"
+	StateConnected    State = "connected"
+	StateDisconnected State = "disconnected"
+	StateFailed       State = "failed"
+	StateClosed       State = "closed"
 )
 
 type Manager struct {
+	api         *pion.API
+	iceServers  []string
+	idleTimeout time.Duration
 	connections map[string]*Connection
+	onChannel   func(*Connection, *Channel)
+	onState     func(*Connection)
 	mu          sync.RWMutex
 }
 
+// Connection 一个访客连接，导出字段创建后不再改变
 type Connection struct {
-	ID     string
-	Path   string
-	Status string
+	ID         string
+	Path       string
+	Transport  string
+	RemoteAddr string
+	CreatedAt  time.Time
+
+	mu          sync.Mutex
+	state       State
+	changedAt   time.Time
+	connectedAt time.Time
+	lastActive  time.Time
+	bytesIn     int64
+	bytesOut    int64
+
+	pc     *pion.PeerConnection
+	closer func()
+}
+
+// Stats 连接状态与流量的快照，流量方向以访客为准：In 为访客发出，Out 为访客收到
+type Stats struct {
+	State       State     `json:"state"`
+	CreatedAt   time.Time `json:"created_at"`
+	ChangedAt   time.Time `json:"changed_at"`
+	ConnectedAt time.Time `json:"connected_at"`
+	LastActive  time.Time `json:"last_active"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+}
+
+func newConnection(id, path, transport string) *Connection {
+	now := time.Now()
+	return &Connection{
+		ID:         id,
+		Path:       path,
+		Transport:  transport,
+		CreatedAt:  now,
+		state:      StateNew,
+		changedAt:  now,
+		lastActive: now,
+	}
+}
+
+// State 返回连接当前状态
+func (c *Connection) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// Stats 返回连接状态与流量的快照
+func (c *Connection) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{
+		State:       c.state,
+		CreatedAt:   c.CreatedAt,
+		ChangedAt:   c.changedAt,
+		ConnectedAt: c.connectedAt,
+		LastActive:  c.lastActive,
+		BytesIn:     c.bytesIn,
+		BytesOut:    c.bytesOut,
+	}
+}
+
+// AddBytesIn 记录访客发出的流量
+func (c *Connection) AddBytesIn(n int) {
+	c.mu.Lock()
+	c.bytesIn += int64(n)
+	c.lastActive = time.Now()
+	c.mu.Unlock()
+}
+
+// AddBytesOut 记录访客收到的流量
+func (c *Connection) AddBytesOut(n int) {
+	c.mu.Lock()
+	c.bytesOut += int64(n)
+	c.lastActive = time.Now()
+	c.mu.Unlock()
+}
+
+// setState 更新状态，返回状态是否发生变化
+func (c *Connection) setState(state State) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == state || c.state == StateClosed {
+		return false
+	}
+	now := time.Now()
+	c.state = state
+	c.changedAt = now
+	if state == StateConnected && c.connectedAt.IsZero() {
+		c.connectedAt = now
+		c.lastActive = now
+	}
+	return true
 }
 
 func NewManager() *Manager {
-	return &Manager{
+	m := &Manager{
+		api:         pion.NewAPI(),
+		iceServers:  DefaultICEServers,
+		idleTimeout: DefaultIdleTimeout,
 		connections: make(map[string]*Connection),
 	}
+	go m.reap()
+	return m
+}
+
+// SetIdleTimeout 设置空闲超时，0 表示不因空闲清理连接
+func (m *Manager) SetIdleTimeout(d time.Duration) {
+	m.mu.Lock()
+	m.idleTimeout = d
+	m.mu.Unlock()
+}
+
+// OnChannel 设置远端打开数据通道后的处理函数
+func (m *Manager) OnChannel(f func(conn *Connection, ch *Channel)) {
+	m.mu.Lock()
+	m.onChannel = f
+	m.mu.Unlock()
+}
+
+// OnStateChange 设置连接状态变化（包括关闭）时的回调
+func (m *Manager) OnStateChange(f func(conn *Connection)) {
+	m.mu.Lock()
+	m.onState = f
+	m.mu.Unlock()
 }
 
-func (m *Manager) HandleOffer(offer string, path string) (string, error) {
-	// 生成连接ID
-	connID := generateConnectionID()
+// Track 登记一个由其他节点终结的连接，仅在本地跟踪其状态
+// remoteAddr 为访客地址，closer 在连接被关闭（包括被清理）时调用，用于释放对应的资源
+func (m *Manager) Track(id, path, transport, remoteAddr string, closer func()) *Connection {
+	conn := newConnection(id, path, transport)
+	conn.RemoteAddr = remoteAddr
+	conn.closer = closer
 
 	m.mu.Lock()
-	m.connections[connID] = &Connection{
-		ID:     connID,
-		Path:   path,
-		Status: "connecting",
+	m.connections[id] = conn
+	m.mu.Unlock()
+	return conn
+}
+
+// HandleOffer 处理远端的 SDP offer，建立对等连接并返回 SDP answer
+// 返回的 answer 已包含收集到的全部 ICE 候选，对端无需再交换候选
+// iceServers 为空时使用默认的 ICE 服务器
+func (m *Manager) HandleOffer(id, path, offer string, iceServers []string) (string, error) {
+	if len(iceServers) == 0 {
+		iceServers = m.iceServers
+	}
+	pc, err := m.api.NewPeerConnection(pion.Configuration{
+		ICEServers: []pion.ICEServer{{URLs: iceServers}},
+	})
+	if err != nil {
+		return "", fmt.Errorf("创建对等连接失败: %w", err)
 	}
+
+	conn := newConnection(id, path, TransportP2P)
+	conn.pc = pc
+
+	m.mu.Lock()
+	m.connections[id] = conn
 	m.mu.Unlock()
 
-	// 这里应该实现真正的 WebRTC offer/answer 交换
-	// 为了简化，我们返回一个模拟的 answer
-	answer := generateAnswer(offer)
+	pc.OnConnectionStateChange(func(state pion.PeerConnectionState) {
+		m.SetState(id, peerState(state))
+	})
 
+	pc.OnDataChannel(func(dc *pion.DataChannel) {
+		ch := newChannel(dc, conn)
+		dc.OnOpen(func() {
+			m.mu.RLock()
+			handler := m.onChannel
+			m.mu.RUnlock()
+
+			if handler == nil {
+				log.Printf("连接 %s 的数据通道 %s 没有处理程序，已关闭", id, dc.Label())
+				ch.Close()
+				return
+			}
+			go handler(conn, ch)
+		})
+	})
+
+	answer, err := m.answer(pc, offer)
+	if err != nil {
+		m.Close(id)
+		return "", err
+	}
 	return answer, nil
 }
 
+// answer 设置远端描述并生成包含全部候选的本地 answer
+func (m *Manager) answer(pc *pion.PeerConnection, offer string) (string, error) {
+	if err := pc.SetRemoteDescription(pion.SessionDescription{
+		Type: pion.SDPTypeOffer,
+		SDP:  offer,
+	}); err != nil {
+		return "", fmt.Errorf("无效的 offer: %w", err)
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", fmt.Errorf("生成 answer 失败: %w", err)
+	}
+
+	gatherComplete := pion.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return "", fmt.Errorf("设置本地描述失败: %w", err)
+	}
+
+	select {
+	case <-gatherComplete:
+	case <-time.After(gatherTimeout):
+		// 超时后使用已收集到的候选
+	}
+
+	return pc.LocalDescription().SDP, nil
+}
+
+// AddICECandidate 为指定连接添加远端 ICE 候选，candidate 为 RTCIceCandidateInit 的 JSON
+func (m *Manager) AddICECandidate(id, candidate string) error {
+	conn, ok := m.GetConnection(id)
+	if !ok || conn.pc == nil {
+		return fmt.Errorf("连接 %s 不存在", id)
+	}
+
+	var init pion.ICECandidateInit
+	if err := json.Unmarshal([]byte(candidate), &init); err != nil {
+		return fmt.Errorf("无效的 ICE 候选: %w", err)
+	}
+	return conn.pc.AddICECandidate(init)
+}
+
 func (m *Manager) GetConnection(id string) (*Connection, bool) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -49,16 +302,143 @@ func (m *Manager) GetConnection(id string) (*Connection, bool) {
 	return conn, ok
 }
 
-func generateConnectionID() string {
-	bytes := make([]byte, 16)
-	rand.Read(bytes)
-	return base64.URLEncoding.EncodeToString(bytes)
+// Connections 返回当前所有连接
+func (m *Manager) Connections() []*Connection {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	conns := make([]*Connection, 0, len(m.connections))
+	for _, conn := range m.connections {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// Close 关闭并移除指定连接
+func (m *Manager) Close(id string) {
+	m.mu.Lock()
+	conn, ok := m.connections[id]
+	delete(m.connections, id)
+	m.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	if conn.pc != nil {
+		conn.pc.Close()
+	}
+	if conn.closer != nil {
+		conn.closer()
+	}
+	m.changed(conn, StateClosed)
 }
 
-func generateAnswer(offer string) string {
-	// 这里应该实现真正的 WebRTC answer 生成
-	// 为了简化，返回一个模拟的 answer
-	bytes := make([]byte, 32)
+// SetState 更新连接状态，进入 failed 或 closed 状态的连接会被关闭并移除
+func (m *Manager) SetState(id string, state State) {
+	conn, ok := m.GetConnection(id)
+	if !ok {
+		return
+	}
+	switch state {
+	case StateClosed:
+		m.Close(id)
+	case StateFailed:
+		m.changed(conn, state)
+		m.Close(id)
+	default:
+		m.changed(conn, state)
+	}
+}
+
+// UpdateStats 用其他节点上报的累计流量更新连接，流量增加时视为活跃
+func (m *Manager) UpdateStats(id string, bytesIn, bytesOut int64) {
+	conn, ok := m.GetConnection(id)
+	if !ok {
+		return
+	}
+	conn.mu.Lock()
+	if bytesIn > conn.bytesIn || bytesOut > conn.bytesOut {
+		conn.lastActive = time.Now()
+	}
+	conn.bytesIn = max(conn.bytesIn, bytesIn)
+	conn.bytesOut = max(conn.bytesOut, bytesOut)
+	conn.mu.Unlock()
+}
+
+// changed 更新状态并在状态变化时调用回调
+func (m *Manager) changed(conn *Connection, state State) {
+	if !conn.setState(state) {
+		return
+	}
+
+	m.mu.RLock()
+	handler := m.onState
+	m.mu.RUnlock()
+
+	if handler != nil {
+		handler(conn)
+	}
+}
+
+// reap 定期关闭并移除过期的连接
+func (m *Manager) reap() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		m.mu.RLock()
+		idleTimeout := m.idleTimeout
+		m.mu.RUnlock()
+
+		for _, conn := range m.Connections() {
+			if reason := expired(conn.Stats(), now, idleTimeout); reason != "" {
+				log.Printf("连接 %s (%s) %s，已清理", conn.ID, conn.Path, reason)
+				m.Close(conn.ID)
+			}
+		}
+	}
+}
+
+// expired 判断连接是否过期，返回过期原因
+func expired(st Stats, now time.Time, idleTimeout time.Duration) string {
+	switch st.State {
+	case StateNew, StateChecking:
+		if now.Sub(st.CreatedAt) > handshakeTimeout {
+			return "建立超时"
+		}
+	case StateDisconnected:
+		if now.Sub(st.ChangedAt) > disconnectTimeout {
+			return "断开后未恢复"
+		}
+	case StateFailed, StateClosed:
+		return "已失效"
+	}
+	if idleTimeout > 0 && now.Sub(st.LastActive) > idleTimeout {
+		return "空闲超时"
+	}
+	return ""
+}
+
+// peerState 将 pion 的连接状态映射为连接状态
+func peerState(state pion.PeerConnectionState) State {
+	switch state {
+	case pion.PeerConnectionStateConnecting:
+		return StateChecking
+	case pion.PeerConnectionStateConnected:
+		return StateConnected
+	case pion.PeerConnectionStateDisconnected:
+		return StateDisconnected
+	case pion.PeerConnectionStateFailed:
+		return StateFailed
+	case pion.PeerConnectionStateClosed:
+		return StateClosed
+	default:
+		return StateNew
+	}
+}
+
+// NewConnectionID 生成新的连接ID
+func NewConnectionID() string {
+	bytes := make([]byte, 16)
 	rand.Read(bytes)
 	return base64.URLEncoding.EncodeToString(bytes)
 }
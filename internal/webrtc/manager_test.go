@@ -0,0 +1,177 @@
+package webrtc
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	pion "github.com/pion/webrtc/v4"
+)
+
+// newTestManager 不使用外部 STUN 服务器，只收集本机候选
+func newTestManager() *Manager {
+	m := NewManager()
+	m.iceServers = nil
+	return m
+}
+
+// dialManager 模拟浏览器：创建数据通道和 offer，交给 m 处理后设置返回的 answer
+func dialManager(t *testing.T, m *Manager, id string) (*pion.PeerConnection, *pion.DataChannel) {
+	t.Helper()
+	pc, err := pion.NewPeerConnection(pion.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	dc, err := pc.CreateDataChannel("http", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := pion.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+
+	answer, err := m.HandleOffer(id, "app", pc.LocalDescription().SDP, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.SetRemoteDescription(pion.SessionDescription{Type: pion.SDPTypeAnswer, SDP: answer}); err != nil {
+		t.Fatal(err)
+	}
+	return pc, dc
+}
+
+func TestHandleOffer(t *testing.T) {
+	m := newTestManager()
+	// 回显收到的消息
+	m.OnChannel(func(conn *Connection, ch *Channel) {
+		for {
+			msg, err := ch.ReadMessage()
+			if err != nil {
+				return
+			}
+			ch.WriteMessage(append([]byte(conn.Path+":"), msg...))
+		}
+	})
+
+	_, dc := dialManager(t, m, "c1")
+	replies := make(chan []byte, 1)
+	dc.OnMessage(func(msg pion.DataChannelMessage) { replies <- msg.Data })
+	opened := make(chan struct{})
+	dc.OnOpen(func() { close(opened) })
+
+	select {
+	case <-opened:
+	case <-time.After(10 * time.Second):
+		t.Fatal("数据通道没有打开")
+	}
+	if err := dc.Send([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-replies:
+		if !bytes.Equal(got, []byte("app:ping")) {
+			t.Errorf("收到 %q，期望 %q", got, "app:ping")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("没有收到回复")
+	}
+
+	conn, ok := m.GetConnection("c1")
+	if !ok || conn.Path != "app" || conn.Transport != TransportP2P {
+		t.Fatalf("GetConnection() = %v, %v", conn, ok)
+	}
+	if st := conn.Stats(); st.State != StateConnected || st.BytesIn != 4 || st.BytesOut != 8 {
+		t.Errorf("Stats() = %+v", st)
+	}
+	m.Close("c1")
+	if _, ok := m.GetConnection("c1"); ok {
+		t.Error("关闭后连接仍然存在")
+	}
+}
+
+func TestHandleOfferInvalid(t *testing.T) {
+	m := newTestManager()
+	tests := []struct {
+		name  string
+		offer string
+	}{
+		{name: "空", offer: ""},
+		{name: "不是 SDP", offer: "32 random bytes"},
+		{name: "没有媒体", offer: "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := m.HandleOffer("bad", "app", tt.offer, nil); err == nil {
+				t.Error("HandleOffer() 期望失败")
+			}
+			if _, ok := m.GetConnection("bad"); ok {
+				t.Error("失败的连接没有被移除")
+			}
+		})
+	}
+}
+
+func TestExpired(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name  string
+		stats Stats
+		idle  time.Duration
+		want  bool
+	}{
+		{name: "新建", stats: Stats{State: StateNew, CreatedAt: now.Add(-time.Second), LastActive: now}},
+		{name: "建立超时", stats: Stats{State: StateChecking, CreatedAt: now.Add(-2 * handshakeTimeout), LastActive: now}, want: true},
+		{name: "已连接", stats: Stats{State: StateConnected, CreatedAt: now.Add(-time.Hour), LastActive: now.Add(-time.Minute)}, idle: DefaultIdleTimeout},
+		{name: "空闲超时", stats: Stats{State: StateConnected, LastActive: now.Add(-2 * DefaultIdleTimeout)}, idle: DefaultIdleTimeout, want: true},
+		{name: "不限制空闲时间", stats: Stats{State: StateConnected, LastActive: now.Add(-24 * time.Hour)}},
+		{name: "短暂断开", stats: Stats{State: StateDisconnected, ChangedAt: now.Add(-time.Second), LastActive: now}},
+		{name: "断开后未恢复", stats: Stats{State: StateDisconnected, ChangedAt: now.Add(-2 * disconnectTimeout), LastActive: now}, want: true},
+		{name: "已失败", stats: Stats{State: StateFailed, LastActive: now}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := expired(tt.stats, now, tt.idle); (got != "") != tt.want {
+				t.Errorf("expired() = %q，期望过期 = %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrack(t *testing.T) {
+	m := newTestManager()
+	var states []State
+	m.OnStateChange(func(conn *Connection) { states = append(states, conn.State()) })
+
+	closed := 0
+	conn := m.Track("r1", "app", TransportRelay, "203.0.113.1", func() { closed++ })
+	m.SetState("r1", StateConnected)
+	m.SetState("r1", StateConnected)
+	m.UpdateStats("r1", 100, 200)
+	// 上报的累计流量不会减少
+	m.UpdateStats("r1", 50, 300)
+	if st := conn.Stats(); st.BytesIn != 100 || st.BytesOut != 300 || st.ConnectedAt.IsZero() {
+		t.Errorf("Stats() = %+v", st)
+	}
+
+	m.SetState("r1", StateFailed)
+	if _, ok := m.GetConnection("r1"); ok {
+		t.Error("失败的连接没有被移除")
+	}
+	if closed != 1 {
+		t.Errorf("closer 调用了 %d 次，期望 1 次", closed)
+	}
+	// 关闭后不再变化
+	m.SetState("r1", StateConnected)
+	if got := fmt.Sprint(states); got != "[connected failed closed]" {
+		t.Errorf("状态变化 = %s，期望 [connected failed closed]", got)
+	}
+}
@@ -1,6 +1,8 @@
 import { createApp } from 'vue'
 import App from './App.vue'
 import router from './router'
+import axios from 'axios'
+import { clearSession } from './session'
 
 import PrimeVue from 'primevue/config'
 import Aura from '@primevue/themes/aura'
@@ -10,6 +12,18 @@ import ConfirmationService from 'primevue/confirmationservice';
 import './assets/main.css'
 import 'primeicons/primeicons.css'
 
+// 会话失效时回到登录页
+axios.interceptors.response.use(
+    (response) => response,
+    (error) => {
+        if (error.response && error.response.status === 401 && router.currentRoute.value.name !== 'login') {
+            clearSession()
+            router.push('/login')
+        }
+        return Promise.reject(error)
+    }
+)
+
 const app = createApp(App)
 
 app.use(router)
@@ -18,11 +18,36 @@ const router = createRouter({
                     name: 'paths',
                     component: () => import('@/views/Paths.vue')
                 },
+                {
+                    path: '/nodes',
+                    name: 'nodes',
+                    component: () => import('@/views/Nodes.vue')
+                },
+                {
+                    path: '/visitors',
+                    name: 'visitors',
+                    component: () => import('@/views/Visitors.vue')
+                },
+                {
+                    path: '/ip-lists',
+                    name: 'ip-lists',
+                    component: () => import('@/views/IPLists.vue')
+                },
                 {
                     path: '/api-keys',
                     name: 'api-keys',
                     component: () => import('@/views/APIKeys.vue')
                 },
+                {
+                    path: '/security',
+                    name: 'security',
+                    component: () => import('@/views/Security.vue')
+                },
+                {
+                    path: '/users',
+                    name: 'users',
+                    component: () => import('@/views/Users.vue')
+                },
                 {
                     path: '/settings',
                     name: 'settings',
@@ -0,0 +1,22 @@
+import { reactive } from 'vue';
+import axios from 'axios';
+
+// 当前登录的用户，由 loadSession 从 /api/session 加载
+export const currentUser = reactive({ username: '', role: '', email: '' });
+
+const roleLevels = { viewer: 1, admin: 2, owner: 3 };
+
+// 角色的显示名称
+export const roleLabels = { owner: '所有者', admin: '管理员', viewer: '只读' };
+
+// can 检查当前用户是否拥有 role 或更高的权限
+export const can = (role) => (roleLevels[currentUser.role] || 0) >= roleLevels[role];
+
+export const loadSession = async () => {
+    const res = await axios.get('/api/session');
+    Object.assign(currentUser, res.data);
+};
+
+export const clearSession = () => {
+    Object.assign(currentUser, { username: '', role: '', email: '' });
+};